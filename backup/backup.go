@@ -0,0 +1,184 @@
+// Package backup writes all buckets of a storage to a portable archive and restores them.
+//
+// An archive is a gzip compressed tar file with a directory per bucket and a file per key.
+// Bucket names and keys are path escaped, the modification time, content type and attributes
+// of a value are kept in the tar header.
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+const (
+	contentTypeRecord = "STORAGE.content-type"
+	attributePrefix   = "STORAGE.attribute."
+)
+
+// Write streams all buckets of store to w
+// If store supports snapshots the archive is taken from a snapshot, so it is consistent
+// even if store is written meanwhile. Otherwise each bucket is read as it is when it is reached.
+func Write(store storage.Storage, w io.Writer) error {
+	store, release, err := storage.Snapshot(store)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return write(store, w)
+}
+
+// WriteSnapshot streams all buckets of a snapshot of store to w
+// If store can not take snapshots it fails with an Unsupported error before anything is written.
+func WriteSnapshot(store storage.Storage, w io.Writer) error {
+	s, ok := store.(storage.Snapshotter)
+	if !ok {
+		return common.Error(common.Unsupported, errors.New("the storage can not take snapshots"))
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	return write(snap, w)
+}
+
+func write(store storage.Storage, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	buckets, err := store.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err = writeBucket(store, tw, bucket); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeBucket(store storage.Storage, tw *tar.Writer, bucket string) error {
+	dir := url.PathEscape(bucket) + "/"
+	err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755})
+	if err != nil {
+		return err
+	}
+	iter, err := store.Iterate(bucket, &common.ListOpts{WithMeta: true})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.Next() {
+		doc := iter.Doc()
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     dir + url.PathEscape(doc.Key),
+			Mode:     0644,
+			Size:     int64(len(doc.Value)),
+		}
+		if doc.Meta != nil {
+			hdr.ModTime = doc.Meta.Modified
+			hdr.PAXRecords = make(map[string]string)
+			if doc.Meta.ContentType != "" {
+				hdr.PAXRecords[contentTypeRecord] = doc.Meta.ContentType
+			}
+			for name, value := range doc.Meta.Attributes {
+				hdr.PAXRecords[attributePrefix+name] = value
+			}
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err = tw.Write(doc.Value); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// Restore loads an archive written by Write into store
+// Missing buckets are created and existing keys are overwritten, other keys are left alone.
+func Restore(store storage.Storage, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(strings.TrimSuffix(hdr.Name, "/"), "/", 2)
+		bucket, err := url.PathUnescape(parts[0])
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			if err = store.CreateBucket(bucket); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(parts) != 2 {
+			return errors.New("malformed archive entry " + hdr.Name)
+		}
+		key, err := url.PathUnescape(parts[1])
+		if err != nil {
+			return err
+		}
+		value, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err = restore(store, bucket, key, value, readMeta(hdr)); err != nil {
+			return err
+		}
+	}
+}
+
+// restore saves a value along with its metadata if store keeps metadata
+func restore(store storage.Storage, bucket, key string, value []byte, meta *common.Metadata) error {
+	if s, ok := store.(storage.MetaStorage); ok && meta != nil {
+		err := s.PutWithMeta(bucket, key, value, meta)
+		if !common.IsError(err, common.Unsupported) {
+			return err
+		}
+	}
+	return store.Put(bucket, key, value)
+}
+
+// readMeta returns the content type and attributes of an entry or nil if it has none
+func readMeta(hdr *tar.Header) *common.Metadata {
+	meta := &common.Metadata{}
+	for name, value := range hdr.PAXRecords {
+		switch {
+		case name == contentTypeRecord:
+			meta.ContentType = value
+		case strings.HasPrefix(name, attributePrefix):
+			if meta.Attributes == nil {
+				meta.Attributes = make(map[string]string)
+			}
+			meta.Attributes[strings.TrimPrefix(name, attributePrefix)] = value
+		}
+	}
+	if meta.ContentType == "" && meta.Attributes == nil {
+		return nil
+	}
+	return meta
+}
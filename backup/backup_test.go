@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trusch/storage/common"
+	"github.com/trusch/storage/engines/file"
+	"github.com/trusch/storage/engines/memory"
+)
+
+func TestWriteRestore(t *testing.T) {
+	store, err := memory.NewStorage()
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("p1:bucket/with slash"))
+	assert.NoError(t, store.CreateBucket("p1:empty"))
+	assert.NoError(t, store.Put("p1:bucket/with slash", "a/b?c", []byte("hello")))
+	assert.NoError(t, store.Put("p1:bucket/with slash", "empty", []byte{}))
+	assert.NoError(t, store.PutWithMeta("p1:bucket/with slash", "doc", []byte("world"), &common.Metadata{
+		ContentType: "text/plain",
+		Attributes:  map[string]string{"author": "alice"},
+	}))
+	buf := &bytes.Buffer{}
+	assert.NoError(t, Write(store, buf))
+
+	restored, err := memory.NewStorage()
+	assert.NoError(t, err)
+	defer restored.Close()
+	assert.NoError(t, Restore(restored, buf))
+	buckets, err := restored.ListBuckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"p1:bucket/with slash", "p1:empty"}, buckets)
+	val, err := restored.Get("p1:bucket/with slash", "a/b?c")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(val))
+	val, err = restored.Get("p1:bucket/with slash", "empty")
+	assert.NoError(t, err)
+	assert.Empty(t, val)
+	meta, err := restored.Stat("p1:bucket/with slash", "doc")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, map[string]string{"author": "alice"}, meta.Attributes)
+	assert.Equal(t, int64(5), meta.Size)
+}
+
+func TestRestoreGarbage(t *testing.T) {
+	store, err := memory.NewStorage()
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.Error(t, Restore(store, bytes.NewReader([]byte("no archive"))))
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// the file storage can not take snapshots
+	store, err := file.NewStorage(dir)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket"))
+	buf := &bytes.Buffer{}
+	err = WriteSnapshot(store, buf)
+	assert.True(t, common.IsError(err, common.Unsupported))
+	assert.Zero(t, buf.Len())
+	assert.NoError(t, Write(store, buf))
+	assert.NotZero(t, buf.Len())
+}
@@ -0,0 +1,33 @@
+package storage
+
+import "github.com/trusch/storage/common"
+
+// NewBatch returns a batch for the given storage.
+// If the storage is not a Batcher, the returned batch applies its operations one by one
+// and is therefore not atomic.
+func NewBatch(store Storage) Batch {
+	if s, ok := store.(Batcher); ok {
+		return s.NewBatch()
+	}
+	return &sequentialBatch{store: store}
+}
+
+type sequentialBatch struct {
+	common.BatchOps
+	store Storage
+}
+
+func (batch *sequentialBatch) Commit() error {
+	for _, op := range batch.Ops {
+		var err error
+		if op.Delete {
+			err = batch.store.Delete(op.Bucket, op.Key)
+		} else {
+			err = batch.store.Put(op.Bucket, op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+func runGet(args []string) error {
+	fs := flags("get")
+	openBackend := backend(fs)
+	format := formatFlag(fs)
+	args = parse(fs, args, 2, 2)
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	value, err := store.Get(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	doc := &common.DocInfo{Key: args[1], Value: value}
+	if *format != raw {
+		if doc.Meta, err = storage.Stat(store, args[0], args[1]); err != nil {
+			return err
+		}
+	}
+	out := newPrinter(os.Stdout, *format, false)
+	if err = out.doc(doc); err != nil {
+		return err
+	}
+	return out.close()
+}
+
+func runCat(args []string) error {
+	fs := flags("cat")
+	openBackend := backend(fs)
+	args = parse(fs, args, 2, 2)
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	r, err := storage.GetReader(store, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
+
+func runPut(args []string) error {
+	fs := flags("put")
+	openBackend := backend(fs)
+	contentType := fs.String("content-type", "", "content type saved along with the value")
+	ttl := fs.Duration("ttl", 0, "time after which the key expires")
+	args = parse(fs, args, 2, 3)
+	if *contentType != "" && *ttl != 0 {
+		return errors.New("-content-type and -ttl can not be combined")
+	}
+	var in io.ReadCloser = os.Stdin
+	if len(args) == 3 && args[2] != "-" {
+		f, err := os.Open(args[2])
+		if err != nil {
+			return err
+		}
+		in = f
+	}
+	defer in.Close()
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	bucket, key := args[0], args[1]
+	switch {
+	case *contentType != "":
+		s, ok := store.(storage.MetaStorage)
+		if !ok {
+			return common.Error(common.Unsupported)
+		}
+		value, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		return s.PutWithMeta(bucket, key, value, &common.Metadata{ContentType: *contentType})
+	case *ttl != 0:
+		s, ok := store.(storage.TTLStorage)
+		if !ok {
+			return common.Error(common.Unsupported)
+		}
+		value, err := ioutil.ReadAll(in)
+		if err != nil {
+			return err
+		}
+		return s.PutWithTTL(bucket, key, value, *ttl)
+	}
+	return storage.PutReader(store, bucket, key, in)
+}
+
+func runDelete(args []string) error {
+	fs := flags("delete")
+	openBackend := backend(fs)
+	args = parse(fs, args, 2, 2)
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return store.Delete(args[0], args[1])
+}
+
+func runList(args []string) error {
+	fs := flags("ls")
+	openBackend := backend(fs)
+	format := formatFlag(fs)
+	opts := &common.ListOpts{}
+	fs.StringVar(&opts.Prefix, "prefix", "", "only list keys starting with prefix")
+	fs.StringVar(&opts.Start, "start", "", "only list keys from start on, needs -end")
+	fs.StringVar(&opts.End, "end", "", "only list keys before end, needs -start")
+	fs.IntVar(&opts.Limit, "limit", 0, "list at most limit keys")
+	fs.BoolVar(&opts.Reverse, "reverse", false, "list in reverse key order")
+	fs.BoolVar(&opts.KeysOnly, "keys", false, "do not load the values")
+	args = parse(fs, args, 0, 1)
+	if (opts.Start == "") != (opts.End == "") {
+		return errors.New("-start and -end must be given together")
+	}
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if len(args) == 0 {
+		out := newPrinter(os.Stdout, *format, false)
+		buckets, err := store.ListBuckets()
+		if err != nil {
+			return err
+		}
+		if err = out.buckets(buckets); err != nil {
+			return err
+		}
+		return out.close()
+	}
+	out := newPrinter(os.Stdout, *format, true)
+	if *format == raw {
+		opts.KeysOnly = true
+	} else {
+		opts.WithMeta = true
+	}
+	iter, err := store.Iterate(args[0], opts)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.Next() {
+		if err = out.doc(iter.Doc()); err != nil {
+			return err
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return err
+	}
+	return out.close()
+}
+
+func runCreateBucket(args []string) error {
+	fs := flags("mkbucket")
+	openBackend := backend(fs)
+	args = parse(fs, args, 1, 1)
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return store.CreateBucket(args[0])
+}
+
+func runDeleteBucket(args []string) error {
+	fs := flags("rmbucket")
+	openBackend := backend(fs)
+	args = parse(fs, args, 1, 1)
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return store.DeleteBucket(args[0])
+}
+
+// modified formats the modification time of a value for the table output
+func modified(meta *common.Metadata) string {
+	if meta == nil || meta.Modified.IsZero() {
+		return "-"
+	}
+	return meta.Modified.Local().Format(time.RFC3339)
+}
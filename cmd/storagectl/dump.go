@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/trusch/storage/dump"
+)
+
+func runDump(args []string) error {
+	fs := flags("dump")
+	openBackend := backend(fs)
+	out := fs.String("o", "-", "dump file, - for stdout")
+	parse(fs, args, 0, 0)
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	var w io.WriteCloser = os.Stdout
+	if *out != "-" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+	}
+	if err = dump.Export(store, w); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func runRestore(args []string) error {
+	fs := flags("restore")
+	openBackend := backend(fs)
+	in := fs.String("i", "-", "dump file, - for stdin")
+	parse(fs, args, 0, 0)
+	store, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	var r io.ReadCloser = os.Stdin
+	if *in != "-" {
+		if r, err = os.Open(*in); err != nil {
+			return err
+		}
+	}
+	defer r.Close()
+	return dump.Import(store, r)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/trusch/storage/common"
+)
+
+const (
+	raw   = "raw"
+	jsn   = "json"
+	table = "table"
+)
+
+// maxCell is the number of bytes of a value shown in the table output
+const maxCell = 40
+
+func formatFlag(fs *flag.FlagSet) *string {
+	return fs.String("format", raw, "output format: raw, json or table")
+}
+
+// printer writes docs and bucket names in one of the output formats
+// raw prints values as they are, or one key or bucket name per line when listing.
+// json prints a single object for get and an array when listing, values are base64 encoded.
+// table prints aligned columns with the metadata and the beginning of the values.
+type printer struct {
+	format  string
+	w       *bufio.Writer
+	tw      *tabwriter.Writer
+	listing bool
+	count   int
+}
+
+// newPrinter returns a printer for a single doc or a list of bucket names, or for a listing of docs
+func newPrinter(w io.Writer, format string, listing bool) *printer {
+	return &printer{format: format, w: bufio.NewWriter(w), listing: listing}
+}
+
+// doc prints a doc
+func (p *printer) doc(doc *common.DocInfo) error {
+	p.count++
+	switch p.format {
+	case raw:
+		if !p.listing {
+			_, err := p.w.Write(doc.Value)
+			return err
+		}
+		_, err := fmt.Fprintln(p.w, doc.Key)
+		return err
+	case jsn:
+		return p.json(doc)
+	case table:
+		if p.tw == nil {
+			p.tw = tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(p.tw, "KEY\tSIZE\tMODIFIED\tCONTENT-TYPE\tVALUE")
+		}
+		size := int64(len(doc.Value))
+		contentType := ""
+		if doc.Meta != nil {
+			size = doc.Meta.Size
+			contentType = doc.Meta.ContentType
+		}
+		_, err := fmt.Fprintf(p.tw, "%v\t%v\t%v\t%v\t%v\n", doc.Key, size, modified(doc.Meta), contentType, cell(doc.Value))
+		return err
+	}
+	return fmt.Errorf("unknown format %q", p.format)
+}
+
+// buckets prints a list of bucket names
+func (p *printer) buckets(buckets []string) error {
+	switch p.format {
+	case raw, table:
+		for _, bucket := range buckets {
+			if _, err := fmt.Fprintln(p.w, bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	case jsn:
+		data, err := json.Marshal(buckets)
+		if err != nil {
+			return err
+		}
+		_, err = p.w.Write(data)
+		return err
+	}
+	return fmt.Errorf("unknown format %q", p.format)
+}
+
+// json streams docs as elements of an array, so large buckets are not held in memory
+func (p *printer) json(doc *common.DocInfo) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if p.listing {
+		sep := ",\n"
+		if p.count == 1 {
+			sep = "[\n"
+		}
+		p.w.WriteString(sep)
+	}
+	_, err = p.w.Write(data)
+	return err
+}
+
+// close finishes the output, it has to be called even if nothing was printed
+func (p *printer) close() error {
+	switch {
+	case p.format == jsn && p.listing && p.count == 0:
+		p.w.WriteString("[]")
+	case p.format == jsn && p.listing:
+		p.w.WriteString("\n]")
+	}
+	if p.format == jsn {
+		p.w.WriteString("\n")
+	}
+	if p.tw != nil {
+		if err := p.tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return p.w.Flush()
+}
+
+// cell returns the beginning of a value for the table output, quoted if it is not printable
+func cell(value []byte) string {
+	s := string(value)
+	if len(s) > maxCell {
+		s = s[:maxCell] + "..."
+	}
+	if q := strconv.Quote(s); q[1:len(q)-1] != s {
+		return q
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+// storagectl manages the data of a storage backend from the command line.
+//
+// Every backend meta.NewStorage understands can be used, including storaged:// and sstoraged://.
+// The backend is given with -uri, it defaults to $STORAGE_URI.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/trusch/storage"
+	_ "github.com/trusch/storage/engines/all"
+	"github.com/trusch/storage/engines/meta"
+)
+
+const defaultURI = "leveldb:///usr/share/storaged"
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"get":      {"get [-uri uri] [-format raw|json|table] bucket key", runGet},
+	"cat":      {"cat [-uri uri] bucket key", runCat},
+	"put":      {"put [-uri uri] [-content-type type] [-ttl duration] bucket key [file]", runPut},
+	"delete":   {"delete [-uri uri] bucket key", runDelete},
+	"ls":       {"ls [-uri uri] [-format raw|json|table] [-prefix p | -start s -end e] [-limit n] [-reverse] [-keys] [bucket]", runList},
+	"mkbucket": {"mkbucket [-uri uri] bucket", runCreateBucket},
+	"rmbucket": {"rmbucket [-uri uri] bucket", runDeleteBucket},
+	"dump":     {"dump [-uri uri] [-o file]", runDump},
+	"restore":  {"restore [-uri uri] [-i file]", runRestore},
+	"migrate":  {"migrate -from uri -to uri [-workers n] [-checkpoint file] [-dual-write] [-verify=false] [-verify-only]", runMigrate},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: storagectl <command> [flags] [args]")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  storagectl", commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr, "all commands take -token for sstoraged:// backends")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "storagectl:", err)
+		os.Exit(1)
+	}
+}
+
+// flags returns a flag set for a command, it exits on -h or bad flags
+func flags(name string) *flag.FlagSet {
+	return flag.NewFlagSet("storagectl "+name, flag.ExitOnError)
+}
+
+// backend adds the -uri and -token flags to fs and returns a function opening the backend
+func backend(fs *flag.FlagSet) func() (storage.Storage, error) {
+	def := os.Getenv("STORAGE_URI")
+	if def == "" {
+		def = defaultURI
+	}
+	uri := fs.String("uri", def, "backend uri")
+	token := tokenFlag(fs)
+	return func() (storage.Storage, error) {
+		return open(*uri, *token)
+	}
+}
+
+func tokenFlag(fs *flag.FlagSet) *string {
+	return fs.String("token", os.Getenv("STORAGE_TOKEN"), "token for sstoraged:// backends")
+}
+
+// open connects to the backend at uri
+func open(uri, token string) (storage.Storage, error) {
+	if token != "" {
+		return meta.NewStorage(uri, token)
+	}
+	return meta.NewStorage(uri)
+}
+
+// parse parses the flags of a command and checks the number of remaining arguments
+func parse(fs *flag.FlagSet, args []string, min, max int) []string {
+	fs.Parse(args)
+	if fs.NArg() < min || fs.NArg() > max {
+		fmt.Fprintln(os.Stderr, "wrong number of arguments, usage:")
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
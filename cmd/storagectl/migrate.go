@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/trusch/storage/migrate"
+)
+
+func runMigrate(args []string) error {
+	fs := flags("migrate")
+	from := fs.String("from", "", "source backend uri")
+	to := fs.String("to", "", "target backend uri")
+	workers := fs.Int("workers", 4, "number of buckets copied in parallel")
+	checkpoint := fs.String("checkpoint", "", "progress file, an interrupted migration resumes from it")
+	dualWrite := fs.Bool("dual-write", false, "clients write to both backends through mirror://<from>,<to>, keys existing in the target are kept")
+	verify := fs.Bool("verify", true, "compare the key count and a hash of every bucket afterwards")
+	verifyOnly := fs.Bool("verify-only", false, "only compare the backends")
+	token := tokenFlag(fs)
+	parse(fs, args, 0, 0)
+	if *from == "" || *to == "" {
+		return errors.New("migrate needs -from and -to")
+	}
+	source, err := open(*from, *token)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := open(*to, *token)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	opts := &migrate.Options{
+		Workers:      *workers,
+		Checkpoint:   *checkpoint,
+		KeepExisting: *dualWrite,
+		Progress: func(bucket string, copied int) {
+			fmt.Fprintf(os.Stderr, "copied %v keys of %v\n", copied, bucket)
+		},
+	}
+	if !*verifyOnly {
+		if err = migrate.Copy(source, target, opts); err != nil {
+			return err
+		}
+	}
+	if !*verify && !*verifyOnly {
+		return nil
+	}
+	results, err := migrate.Verify(source, target, opts)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, res := range results {
+		if !res.OK() {
+			fmt.Fprintf(os.Stderr, "mismatch in %v: %v keys (%v) in source, %v keys (%v) in target\n",
+				res.Bucket, res.Count, res.Sum, res.TargetCount, res.TargetSum)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v buckets differ", failed, len(results))
+	}
+	fmt.Fprintf(os.Stderr, "verified %v buckets\n", len(results))
+	return nil
+}
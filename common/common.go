@@ -1,26 +1,225 @@
 package common
 
-import "fmt"
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
 // DocInfo describes a document
-// It is used for directory listing
+// It is used for directory listing, Meta is only set if requested by ListOpts.WithMeta.
 type DocInfo struct {
 	Key   string
 	Value []byte
+	Meta  *Metadata `json:",omitempty"`
+}
+
+// Metadata describes a value
+// Created, Modified and Size are maintained by the storage, ContentType and Attributes are set by the writer.
+type Metadata struct {
+	Created     time.Time         `json:"created"`
+	Modified    time.Time         `json:"modified"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// Touch returns the metadata of a value of size bytes written at now
+// Created is kept from old, the metadata of the replaced value, ContentType and Attributes are taken
+// from meta. Both may be nil.
+func Touch(old, meta *Metadata, size int64, now time.Time) *Metadata {
+	res := &Metadata{Created: now, Modified: now, Size: size}
+	if old != nil && !old.Created.IsZero() {
+		res.Created = old.Created
+	}
+	if meta != nil {
+		res.ContentType = meta.ContentType
+		res.Attributes = meta.Attributes
+	}
+	return res
+}
+
+// Version describes an entry of the history of a key
+// Versions are numbered from 1 in the order they were written, deletes are kept as Deleted versions.
+type Version struct {
+	Version  uint64    `json:"version"`
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+	Deleted  bool      `json:"deleted,omitempty"`
+}
+
+// MetaHeaderPrefix prefixes the HTTP headers carrying the attributes of a value
+// Header names are case insensitive, so attribute names are sent and read in lower case.
+const MetaHeaderPrefix = "X-Meta-"
+
+// WriteMetaHeader sets the HTTP headers describing meta
+// The timestamps are sent as X-Created and X-Modified in RFC 3339 format and as Last-Modified.
+func WriteMetaHeader(h http.Header, meta *Metadata) {
+	if meta.ContentType != "" {
+		h.Set("Content-Type", meta.ContentType)
+	}
+	for name, value := range meta.Attributes {
+		h.Set(MetaHeaderPrefix+name, value)
+	}
+	if !meta.Created.IsZero() {
+		h.Set("X-Created", meta.Created.Format(time.RFC3339Nano))
+	}
+	if !meta.Modified.IsZero() {
+		h.Set("X-Modified", meta.Modified.Format(time.RFC3339Nano))
+		h.Set("Last-Modified", meta.Modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// ReadMetaHeader returns the metadata described by HTTP headers written by WriteMetaHeader
+// Size is not part of the headers.
+func ReadMetaHeader(h http.Header) *Metadata {
+	meta := &Metadata{ContentType: h.Get("Content-Type")}
+	for name, values := range h {
+		if strings.HasPrefix(name, MetaHeaderPrefix) && len(values) > 0 {
+			if meta.Attributes == nil {
+				meta.Attributes = make(map[string]string)
+			}
+			meta.Attributes[strings.ToLower(name[len(MetaHeaderPrefix):])] = values[0]
+		}
+	}
+	meta.Created, _ = time.Parse(time.RFC3339Nano, h.Get("X-Created"))
+	meta.Modified, _ = time.Parse(time.RFC3339Nano, h.Get("X-Modified"))
+	return meta
 }
 
 // ListOpts are options given to the List command of storage implementations
 // If Prefix != "" only docs with a key starting with the prefix are returned
 // If Prefix == "" && Start != "" && End != "" only keys between Start and End are returned.
 // Start and End are inclusive
+// Docs are returned in key order, or in reverse key order if Reverse is set.
+// If Limit > 0 at most Limit docs are returned.
+// If Cursor != "" the listing continues behind the doc the cursor was created from, see NewCursor.
+// If KeysOnly is set the values are not loaded and returned docs only carry their key.
+// If WithMeta is set the returned docs carry the metadata of their value.
 type ListOpts struct {
-	Prefix string
-	Start  string
-	End    string
+	Prefix   string
+	Start    string
+	End      string
+	Limit    int
+	Reverse  bool
+	Cursor   string
+	KeysOnly bool
+	WithMeta bool
+}
+
+// KeysOnly returns a copy of opts which only lists keys
+func KeysOnly(opts *ListOpts) *ListOpts {
+	res := ListOpts{}
+	if opts != nil {
+		res = *opts
+	}
+	res.KeysOnly = true
+	return &res
+}
+
+// Match checks if a key lies within the prefix or range specified by the options
+func (opts *ListOpts) Match(key string) bool {
+	switch {
+	case opts.Prefix != "":
+		return strings.HasPrefix(key, opts.Prefix)
+	case opts.Start != "":
+		return strings.Compare(opts.Start, key) <= 0 && strings.Compare(key, opts.End) < 0
+	}
+	return true
+}
+
+// NewCursor returns an opaque cursor pointing behind the doc with the given key
+// Pass the key of the last doc of a page to get the cursor for the next one.
+func NewCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// CursorKey returns the key the cursor of the options was created from
+// ok is false if no cursor is set.
+func (opts *ListOpts) CursorKey() (key string, ok bool, err error) {
+	if opts.Cursor == "" {
+		return "", false, nil
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return "", false, Error(ReadFailed, errors.New("malformed cursor"), err)
+	}
+	return string(bs), true, nil
+}
+
+// Paginate applies cursor, order and limit of the options to docs
+// The docs must be sorted by key and match the options.
+func Paginate(docs []*DocInfo, opts *ListOpts) ([]*DocInfo, error) {
+	cursor, ok, err := opts.CursorKey()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if opts.Reverse {
+			docs = docs[:sort.Search(len(docs), func(i int) bool { return docs[i].Key >= cursor })]
+		} else {
+			docs = docs[sort.Search(len(docs), func(i int) bool { return docs[i].Key > cursor }):]
+		}
+	}
+	if opts.Reverse {
+		reversed := make([]*DocInfo, len(docs))
+		for i, doc := range docs {
+			reversed[len(docs)-1-i] = doc
+		}
+		docs = reversed
+	}
+	if opts.Limit > 0 && len(docs) > opts.Limit {
+		docs = docs[:opts.Limit]
+	}
+	return docs, nil
+}
+
+// DocChannel returns a closed channel buffering all given docs
+func DocChannel(docs []*DocInfo) chan *DocInfo {
+	ch := make(chan *DocInfo, len(docs))
+	for _, doc := range docs {
+		ch <- doc
+	}
+	close(ch)
+	return ch
+}
+
+// Equal compares two values, nil stands for a missing value and only equals nil
+func Equal(a, b []byte) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return bytes.Equal(a, b)
+}
+
+// ETag returns a quoted entity tag identifying a value
+func ETag(value []byte) string {
+	sum := sha1.Sum(value)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// NewETagHash returns the hash ETag is based on, for values which are not held in memory
+func NewETagHash() hash.Hash {
+	return sha1.New()
+}
+
+// HashETag returns the entity tag of the value written to a hash returned by NewETagHash
+func HashETag(h hash.Hash) string {
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
 }
 
 // StorageError is the type of all possible storage errors
 type StorageError struct {
+	Type   StorageErrorType
 	Msg    string
 	Errors []error
 }
@@ -44,21 +243,147 @@ const (
 	CloseFailed
 	// InitFailed is thrown if opening of the underlying db is not possible
 	InitFailed
+	// Unsupported is thrown if the storage engine does not support the requested operation
+	Unsupported
+	// Conflict is thrown if a transaction can not be committed because of a concurrent write
+	Conflict
+	// ReadOnly is thrown on writes to a read-only storage like a snapshot
+	ReadOnly
 )
 
 // Error returns a StorageError with the specified type and info
 func Error(typ StorageErrorType, errors ...error) error {
 	switch typ {
 	case BucketNotFound:
-		return &StorageError{"bucket not found", errors}
+		return &StorageError{typ, "bucket not found", errors}
 	case ReadFailed:
-		return &StorageError{"key not found", errors}
+		return &StorageError{typ, "key not found", errors}
 	case WriteFailed:
-		return &StorageError{"write failed", errors}
+		return &StorageError{typ, "write failed", errors}
 	case CloseFailed:
-		return &StorageError{"close failed", errors}
+		return &StorageError{typ, "close failed", errors}
 	case InitFailed:
-		return &StorageError{"init failed", errors}
+		return &StorageError{typ, "init failed", errors}
+	case Unsupported:
+		return &StorageError{typ, "operation not supported", errors}
+	case Conflict:
+		return &StorageError{typ, "transaction conflict", errors}
+	case ReadOnly:
+		return &StorageError{typ, "storage is read-only", errors}
+	}
+	return &StorageError{typ, "unknown storage error type", errors}
+}
+
+// IsError checks if err is a StorageError of the specified type
+func IsError(err error, typ StorageErrorType) bool {
+	e, ok := err.(*StorageError)
+	return ok && e.Type == typ
+}
+
+// EventType is the kind of change an Event reports
+type EventType string
+
+const (
+	// PutEvent reports a saved value
+	PutEvent EventType = "put"
+	// DeleteEvent reports a deleted key
+	DeleteEvent EventType = "delete"
+	// DeleteBucketEvent reports a deleted bucket, Key is empty
+	DeleteBucketEvent EventType = "delete-bucket"
+)
+
+// Event describes a change of a key, Value is only set for PutEvents of values which were not streamed
+type Event struct {
+	Type   EventType `json:"type"`
+	Bucket string    `json:"bucket"`
+	Key    string    `json:"key,omitempty"`
+	Value  []byte    `json:"value,omitempty"`
+}
+
+// BatchOp is a single write operation of a batch
+// If Delete is true the key is removed, otherwise Value is written.
+type BatchOp struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// BatchOps collects the operations of a batch
+// Storage implementations embed it into their batch types and only implement Commit.
+type BatchOps struct {
+	Ops []*BatchOp
+}
+
+// Put adds a put operation to the batch
+func (batch *BatchOps) Put(bucket, key string, value []byte) {
+	batch.Ops = append(batch.Ops, &BatchOp{Bucket: bucket, Key: key, Value: value})
+}
+
+// Delete adds a delete operation to the batch
+func (batch *BatchOps) Delete(bucket, key string) {
+	batch.Ops = append(batch.Ops, &BatchOp{Bucket: bucket, Key: key, Delete: true})
+}
+
+// Buckets returns the distinct buckets touched by the batch
+func (batch *BatchOps) Buckets() []string {
+	seen := make(map[string]bool)
+	buckets := make([]string, 0)
+	for _, op := range batch.Ops {
+		if !seen[op.Bucket] {
+			seen[op.Bucket] = true
+			buckets = append(buckets, op.Bucket)
+		}
+	}
+	return buckets
+}
+
+// ReadOnlyStorage implements the write methods of a storage by returning ReadOnly errors
+// Read-only views like snapshots embed it and only implement the read methods.
+type ReadOnlyStorage struct{}
+
+// Put fails with a ReadOnly error
+func (ReadOnlyStorage) Put(bucket, key string, value []byte) error {
+	return Error(ReadOnly)
+}
+
+// Delete fails with a ReadOnly error
+func (ReadOnlyStorage) Delete(bucket, key string) error {
+	return Error(ReadOnly)
+}
+
+// CreateBucket fails with a ReadOnly error
+func (ReadOnlyStorage) CreateBucket(bucket string) error {
+	return Error(ReadOnly)
+}
+
+// DeleteBucket fails with a ReadOnly error
+func (ReadOnlyStorage) DeleteBucket(bucket string) error {
+	return Error(ReadOnly)
+}
+
+// ReapInterval is the interval in which storages remove expired entries in the background
+var ReapInterval = 10 * time.Second
+
+// StartReaper calls reap every ReapInterval until the returned stop function is called
+// The interval is read when the reaper starts, so changing ReapInterval only affects later storages.
+// The stop function may be called multiple times.
+func StartReaper(reap func()) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(ReapInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				reap()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
 	}
-	return &StorageError{"unknown storage error type", errors}
 }
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"context"
+	"log"
+)
+
+// Iterator walks over the documents of a bucket in key order.
+// Next must be called before the first call to Doc. Once Next returns false,
+// Err tells apart the end of the bucket from a failure.
+type Iterator interface {
+	// Next advances to the next document and reports whether there is one
+	Next() bool
+	// Doc returns the current document
+	Doc() *DocInfo
+	// Err returns the error which stopped the iteration, if any
+	Err() error
+	// Close releases the resources held by the iterator
+	Close() error
+}
+
+// SliceIterator returns an Iterator over already loaded docs
+func SliceIterator(docs []*DocInfo) Iterator {
+	return &sliceIterator{docs: docs, pos: -1}
+}
+
+type sliceIterator struct {
+	docs []*DocInfo
+	pos  int
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.pos+1 >= len(it.docs) {
+		it.pos = len(it.docs)
+		return false
+	}
+	it.pos++
+	return true
+}
+
+func (it *sliceIterator) Doc() *DocInfo {
+	if it.pos < 0 || it.pos >= len(it.docs) {
+		return nil
+	}
+	return it.docs[it.pos]
+}
+
+func (it *sliceIterator) Err() error   { return nil }
+func (it *sliceIterator) Close() error { return nil }
+
+// ChannelIterator returns an Iterator reading from a List channel
+// Since the channel can not carry errors, Err is always nil.
+func ChannelIterator(ch chan *DocInfo) Iterator {
+	return &channelIterator{ch: ch}
+}
+
+type channelIterator struct {
+	ch  chan *DocInfo
+	doc *DocInfo
+}
+
+func (it *channelIterator) Next() bool {
+	doc, ok := <-it.ch
+	it.doc = doc
+	return ok
+}
+
+func (it *channelIterator) Doc() *DocInfo { return it.doc }
+func (it *channelIterator) Err() error    { return nil }
+
+// Close drains the channel so the producing goroutine can finish
+func (it *channelIterator) Close() error {
+	go func() {
+		for range it.ch {
+		}
+	}()
+	return nil
+}
+
+// ContextIterator stops iter as soon as ctx is done, Err returns the context error then
+func ContextIterator(ctx context.Context, iter Iterator) Iterator {
+	return &contextIterator{Iterator: iter, ctx: ctx}
+}
+
+type contextIterator struct {
+	Iterator
+	ctx context.Context
+	err error
+}
+
+func (it *contextIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		return false
+	}
+	return it.Iterator.Next()
+}
+
+func (it *contextIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.Iterator.Err()
+}
+
+// IteratorChannel streams the documents of iter into a channel as returned by List.
+// The iterator is closed once it is exhausted or ctx is done. The channel can not carry
+// errors, so they are only logged; use the iterator directly to handle them.
+func IteratorChannel(ctx context.Context, iter Iterator) chan *DocInfo {
+	ch := make(chan *DocInfo, 64)
+	go func() {
+		defer close(ch)
+		defer iter.Close()
+		for iter.Next() {
+			select {
+			case ch <- iter.Doc():
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := iter.Err(); err != nil {
+			log.Print(err)
+		}
+	}()
+	return ch
+}
+
+// Count consumes and closes iter and returns the number of docs it yielded
+func Count(iter Iterator) (int, error) {
+	defer iter.Close()
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
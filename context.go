@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/trusch/storage/common"
+)
+
+// WithContext returns a ContextStorage for the given storage.
+// If the storage is not context aware itself, the context is only checked before each operation
+// and List results are forwarded until the context is done.
+func WithContext(store Storage) ContextStorage {
+	if s, ok := store.(ContextStorage); ok {
+		return s
+	}
+	return &contextAdapter{store}
+}
+
+type contextAdapter struct {
+	Storage
+}
+
+func (store *contextAdapter) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Put(bucket, key, value)
+}
+
+func (store *contextAdapter) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.Get(bucket, key)
+}
+
+func (store *contextAdapter) DeleteContext(ctx context.Context, bucket, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Delete(bucket, key)
+}
+
+func (store *contextAdapter) CreateBucketContext(ctx context.Context, bucket string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.CreateBucket(bucket)
+}
+
+func (store *contextAdapter) DeleteBucketContext(ctx context.Context, bucket string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.DeleteBucket(bucket)
+}
+
+func (store *contextAdapter) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	input, err := store.List(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	output := make(chan *common.DocInfo, 64)
+	go func() {
+		defer close(output)
+		for doc := range input {
+			select {
+			case output <- doc:
+			case <-ctx.Done():
+				// drain the input so the producer can finish
+				for range input {
+				}
+				return
+			}
+		}
+	}()
+	return output, nil
+}
+
+func (store *contextAdapter) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	iter, err := store.Iterate(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.ContextIterator(ctx, iter), nil
+}
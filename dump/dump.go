@@ -0,0 +1,199 @@
+// Package dump exports all buckets of a storage to an engine independent dump and imports it again.
+//
+// A dump is a stream of JSON records, one per line. It starts with a header naming the format
+// version, every bucket starts with a bucket record followed by its entries and ends with a
+// record holding the number of entries and a SHA-256 checksum over them. A trailer closes the
+// dump, so a truncated dump is detected. Values are base64 encoded.
+package dump
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// Version is the format version written by Export
+const Version = 1
+
+const (
+	headerRecord  = "header"
+	bucketRecord  = "bucket"
+	entryRecord   = "entry"
+	endRecord     = "end"
+	trailerRecord = "trailer"
+)
+
+// maxLine is the size of the longest record Import accepts
+const maxLine = 1 << 30
+
+type record struct {
+	Type     string           `json:"type"`
+	Version  int              `json:"version,omitempty"`
+	Bucket   string           `json:"bucket,omitempty"`
+	Key      string           `json:"key,omitempty"`
+	Value    []byte           `json:"value,omitempty"`
+	Meta     *common.Metadata `json:"meta,omitempty"`
+	Count    int              `json:"count,omitempty"`
+	Checksum string           `json:"checksum,omitempty"`
+}
+
+// Export writes all buckets of store to w
+// If store supports snapshots the dump is taken from a snapshot, so it is consistent
+// even if store is written meanwhile.
+func Export(store storage.Storage, w io.Writer) error {
+	store, release, err := storage.Snapshot(store)
+	if err != nil {
+		return err
+	}
+	defer release()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err = enc.Encode(&record{Type: headerRecord, Version: Version}); err != nil {
+		return err
+	}
+	buckets, err := store.ListBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		if err = exportBucket(store, enc, bucket); err != nil {
+			return err
+		}
+	}
+	if err = enc.Encode(&record{Type: trailerRecord, Count: len(buckets)}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func exportBucket(store storage.Storage, enc *json.Encoder, bucket string) error {
+	if err := enc.Encode(&record{Type: bucketRecord, Bucket: bucket}); err != nil {
+		return err
+	}
+	iter, err := store.Iterate(bucket, &common.ListOpts{WithMeta: true})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	sum := sha256.New()
+	count := 0
+	for iter.Next() {
+		doc := iter.Doc()
+		if err = enc.Encode(&record{Type: entryRecord, Key: doc.Key, Value: doc.Value, Meta: doc.Meta}); err != nil {
+			return err
+		}
+		checksum(sum, doc.Key, doc.Value)
+		count++
+	}
+	if err = iter.Err(); err != nil {
+		return err
+	}
+	return enc.Encode(&record{Type: endRecord, Bucket: bucket, Count: count, Checksum: hex.EncodeToString(sum.Sum(nil))})
+}
+
+// checksum adds an entry to the checksum of its bucket
+func checksum(sum hash.Hash, key string, value []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(key)))
+	sum.Write(size[:])
+	sum.Write([]byte(key))
+	binary.BigEndian.PutUint64(size[:], uint64(len(value)))
+	sum.Write(size[:])
+	sum.Write(value)
+}
+
+// Import loads a dump written by Export into store
+// Missing buckets are created and existing keys are overwritten, other keys are left alone.
+// Entries are written as they are read, so if the dump turns out to be corrupt or truncated
+// the entries before are already in store.
+func Import(store storage.Storage, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLine)
+	var (
+		bucket   string
+		inBucket bool
+		buckets  int
+		count    int
+		sum      hash.Hash
+		started  bool
+	)
+	for scanner.Scan() {
+		rec := &record{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return err
+		}
+		if !started && rec.Type != headerRecord {
+			return errors.New("dump: missing header")
+		}
+		switch rec.Type {
+		case headerRecord:
+			if started {
+				return errors.New("dump: duplicate header")
+			}
+			if rec.Version != Version {
+				return fmt.Errorf("dump: unsupported format version %v", rec.Version)
+			}
+			started = true
+		case bucketRecord:
+			if inBucket {
+				return fmt.Errorf("dump: bucket %v is not closed", bucket)
+			}
+			if err := store.CreateBucket(rec.Bucket); err != nil {
+				return err
+			}
+			bucket, inBucket, count, sum = rec.Bucket, true, 0, sha256.New()
+		case entryRecord:
+			if !inBucket {
+				return errors.New("dump: entry outside of a bucket")
+			}
+			if err := put(store, bucket, rec.Key, rec.Value, rec.Meta); err != nil {
+				return err
+			}
+			checksum(sum, rec.Key, rec.Value)
+			count++
+		case endRecord:
+			if !inBucket || rec.Bucket != bucket {
+				return fmt.Errorf("dump: unexpected end of bucket %v", rec.Bucket)
+			}
+			if rec.Count != count || rec.Checksum != hex.EncodeToString(sum.Sum(nil)) {
+				return fmt.Errorf("dump: checksum mismatch in bucket %v", bucket)
+			}
+			inBucket = false
+			buckets++
+		case trailerRecord:
+			if inBucket {
+				return fmt.Errorf("dump: bucket %v is not closed", bucket)
+			}
+			if rec.Count != buckets {
+				return fmt.Errorf("dump: expected %v buckets, got %v", rec.Count, buckets)
+			}
+			return nil
+		default:
+			return fmt.Errorf("dump: unknown record type %q", rec.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("dump: truncated")
+}
+
+// put saves a value along with its metadata if store keeps metadata
+func put(store storage.Storage, bucket, key string, value []byte, meta *common.Metadata) error {
+	if s, ok := store.(storage.MetaStorage); ok && meta != nil {
+		err := s.PutWithMeta(bucket, key, value, meta)
+		if !common.IsError(err, common.Unsupported) {
+			return err
+		}
+	}
+	return store.Put(bucket, key, value)
+}
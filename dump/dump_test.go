@@ -0,0 +1,76 @@
+package dump
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trusch/storage/common"
+	"github.com/trusch/storage/engines/memory"
+)
+
+func fill(t *testing.T) *memory.Storage {
+	store, err := memory.NewStorage()
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateBucket("p1:bucket"))
+	assert.NoError(t, store.CreateBucket("p1:empty"))
+	assert.NoError(t, store.Put("p1:bucket", "a", []byte("hello")))
+	assert.NoError(t, store.Put("p1:bucket", "empty", []byte{}))
+	assert.NoError(t, store.Put("p1:bucket", "binary", []byte{0, 1, 2, 255}))
+	assert.NoError(t, store.PutWithMeta("p1:bucket", "doc", []byte("world"), &common.Metadata{
+		ContentType: "text/plain",
+		Attributes:  map[string]string{"author": "alice"},
+	}))
+	return store
+}
+
+func TestExportImport(t *testing.T) {
+	store := fill(t)
+	defer store.Close()
+	buf := &bytes.Buffer{}
+	assert.NoError(t, Export(store, buf))
+
+	restored, err := memory.NewStorage()
+	assert.NoError(t, err)
+	defer restored.Close()
+	assert.NoError(t, Import(restored, buf))
+	buckets, err := restored.ListBuckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"p1:bucket", "p1:empty"}, buckets)
+	val, err := restored.Get("p1:bucket", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(val))
+	val, err = restored.Get("p1:bucket", "binary")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2, 255}, val)
+	val, err = restored.Get("p1:bucket", "empty")
+	assert.NoError(t, err)
+	assert.Empty(t, val)
+	meta, err := restored.Stat("p1:bucket", "doc")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, map[string]string{"author": "alice"}, meta.Attributes)
+}
+
+func TestImportCorrupt(t *testing.T) {
+	store := fill(t)
+	defer store.Close()
+	buf := &bytes.Buffer{}
+	assert.NoError(t, Export(store, buf))
+	lines := strings.SplitAfter(buf.String(), "\n")
+
+	for name, dump := range map[string]string{
+		"garbage":   "no dump",
+		"empty":     "",
+		"truncated": strings.Join(lines[:len(lines)-2], ""),
+		"tampered":  strings.Replace(buf.String(), `"key":"a"`, `"key":"b"`, 1),
+		"version":   strings.Replace(buf.String(), `"version":1`, `"version":99`, 1),
+		"no header": strings.Join(lines[1:], ""),
+	} {
+		restored, err := memory.NewStorage()
+		assert.NoError(t, err)
+		assert.Error(t, Import(restored, strings.NewReader(dump)), name)
+		restored.Close()
+	}
+}
@@ -0,0 +1,10 @@
+// Package all registers all engines of this repository with meta.NewStorage, importing it is enough.
+// The LevelDB, BoltDB and MongoDB engines are left out with the build tags noleveldb, noboltdb and nomongodb.
+package all
+
+import (
+	// the engines without dependencies beyond this repository are always registered
+	_ "github.com/trusch/storage/engines/file/register"
+	_ "github.com/trusch/storage/engines/memory/register"
+	_ "github.com/trusch/storage/engines/storaged/register"
+)
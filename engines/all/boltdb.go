@@ -0,0 +1,8 @@
+//go:build !noboltdb
+// +build !noboltdb
+
+package all
+
+import (
+	_ "github.com/trusch/storage/engines/boltdb/register"
+)
@@ -0,0 +1,8 @@
+//go:build !noleveldb
+// +build !noleveldb
+
+package all
+
+import (
+	_ "github.com/trusch/storage/engines/leveldb/register"
+)
@@ -0,0 +1,8 @@
+//go:build !nomongodb
+// +build !nomongodb
+
+package all
+
+import (
+	_ "github.com/trusch/storage/engines/mongodb/register"
+)
@@ -2,71 +2,186 @@ package boltdb
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/trusch/storage"
 	"github.com/trusch/storage/common"
 )
 
-//Storage is an implementation for storage.Storage
+// Storage is an implementation for storage.Storage
 type Storage struct {
-	db *bolt.DB
+	// uploads is the id of the last stream upload, it is accessed atomically
+	uploads    uint64
+	db         *bolt.DB
+	stopReaper func()
+}
+
+// ttlBucket holds one nested bucket per data bucket mapping keys to their deadline in unix nanoseconds
+var ttlBucket = []byte("\x00ttl")
+
+// streamBucket holds one nested bucket per data bucket mapping keys of streamed values to their manifest
+var streamBucket = []byte("\x00stream")
+
+// chunkBucket holds one nested bucket per data bucket with the chunks of streamed values
+var chunkBucket = []byte("\x00chunk")
+
+// metaBucket holds one nested bucket per data bucket mapping keys to their JSON encoded metadata
+var metaBucket = []byte("\x00meta")
+
+// versionBucket holds one nested bucket per versioned data bucket mapping the key, a zero byte and the
+// big endian version number to the modification time, a tombstone flag and the value
+var versionBucket = []byte("\x00version")
+
+// ChunkSize is the size of the chunks streamed values are split into
+var ChunkSize = 1 << 20
+
+// InitialMmapSize is the size of the memory map a database is opened with
+// Writes only block on open snapshots once the database outgrows the memory map.
+var InitialMmapSize = 1 << 30
+
+// Options tune a bolt database
+type Options struct {
+	// Timeout is the time to wait for the file lock held by another process, 0 waits forever
+	Timeout time.Duration
+	// NoSync skips the fsync after each commit, a crash may lose or corrupt the last writes
+	NoSync bool
+	// InitialMmapSize is the size of the memory map, 0 uses the InitialMmapSize variable
+	InitialMmapSize int
 }
 
 // NewStorage creates a new storage instance
 func NewStorage(path string) (*Storage, error) {
-	db, err := bolt.Open(path, 0600, nil)
+	return NewStorageWithOptions(path, Options{})
+}
+
+// NewStorageWithOptions creates a new storage instance with the given options
+func NewStorageWithOptions(path string, options Options) (*Storage, error) {
+	if options.InitialMmapSize == 0 {
+		options.InitialMmapSize = InitialMmapSize
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: options.Timeout, InitialMmapSize: options.InitialMmapSize})
 	if err != nil {
 		return nil, common.Error(common.InitFailed, err)
 	}
-	store := &Storage{db}
+	db.NoSync = options.NoSync
+	store := &Storage{db: db, uploads: uint64(time.Now().UnixNano())}
+	store.stopReaper = common.StartReaper(store.reap)
 	return store, nil
 }
 
 // Put saves a byteslice to the db.
 // Example: Save("/foo/bar", []byte{1,2,3})
 func (store *Storage) Put(bucketID, key string, value []byte) error {
+	return store.PutContext(context.Background(), bucketID, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucketID, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.put(bucketID, key, value, nil)
+}
+
+// put saves a value along with its metadata
+func (store *Storage) put(bucketID, key string, value []byte, meta *common.Metadata) error {
 	return store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketID))
 		if bucket == nil {
 			return common.Error(common.BucketNotFound)
 		}
-		return bucket.Put([]byte(key), value)
+		if err := bucket.Put([]byte(key), value); err != nil {
+			return err
+		}
+		if err := clearIndexes(tx, bucketID, key); err != nil {
+			return err
+		}
+		if err := record(tx, bucketID, key, value, false); err != nil {
+			return err
+		}
+		return touch(tx, bucketID, key, int64(len(value)), meta)
 	})
 }
 
 // Get loads data from a path
 func (store *Storage) Get(bucketID, key string) ([]byte, error) {
+	return store.GetContext(context.Background(), bucketID, key)
+}
+
+// GetContext loads data from a path
+func (store *Storage) GetContext(ctx context.Context, bucketID, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	var result []byte
 	err := store.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketID))
-		if bucket == nil {
-			return common.Error(common.BucketNotFound)
-		}
-		key := []byte(key)
-		value := bucket.Get(key)
-		if value == nil {
-			return common.Error(common.ReadFailed)
-		}
-		result = make([]byte, len(value))
-		copy(result, value)
-		return nil
+		var err error
+		result, err = get(tx, bucketID, key, time.Now())
+		return err
 	})
 	return result, err
 }
 
+// get loads the value of a key which has not expired at now
+func get(tx *bolt.Tx, bucketID, key string, now time.Time) ([]byte, error) {
+	bucket := tx.Bucket([]byte(bucketID))
+	if bucket == nil {
+		return nil, common.Error(common.BucketNotFound)
+	}
+	value := bucket.Get([]byte(key))
+	if value == nil || expired(tx, bucketID, []byte(key), now) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	return load(tx, bucketID, key, value)
+}
+
 // Delete deletes a value from the db
 func (store *Storage) Delete(bucketID, key string) error {
+	return store.DeleteContext(context.Background(), bucketID, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucketID, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(bucketID))
 		if bucket == nil {
 			return common.Error(common.BucketNotFound)
 		}
-		return bucket.Delete([]byte(key))
+		if err := record(tx, bucketID, key, nil, true); err != nil {
+			return err
+		}
+		if err := bucket.Delete([]byte(key)); err != nil {
+			return err
+		}
+		if err := clearIndexes(tx, bucketID, key); err != nil {
+			return err
+		}
+		return dropMeta(tx, bucketID, key)
 	})
 }
 
 // CreateBucket creates a bucket
 func (store *Storage) CreateBucket(bucketID string) error {
+	return store.CreateBucketContext(context.Background(), bucketID)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucketID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return store.db.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists([]byte(bucketID))
 		if err != nil {
@@ -78,62 +193,1231 @@ func (store *Storage) CreateBucket(bucketID string) error {
 
 // DeleteBucket deletes a bucket
 func (store *Storage) DeleteBucket(bucketID string) error {
+	return store.DeleteBucketContext(context.Background(), bucketID)
+}
+
+// DeleteBucketContext deletes a bucket
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucketID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return store.db.Update(func(tx *bolt.Tx) error {
 		err := tx.DeleteBucket([]byte(bucketID))
 		if err != nil {
 			return common.Error(common.WriteFailed, err)
 		}
+		for _, name := range [][]byte{ttlBucket, metaBucket, streamBucket, chunkBucket, versionBucket} {
+			if root := tx.Bucket(name); root != nil && root.Bucket([]byte(bucketID)) != nil {
+				if err := root.DeleteBucket([]byte(bucketID)); err != nil {
+					return common.Error(common.WriteFailed, err)
+				}
+			}
+		}
 		return nil
 	})
 }
 
+// ListBuckets returns the names of all buckets in lexical order
+func (store *Storage) ListBuckets() ([]string, error) {
+	return listBuckets(store.db.View)
+}
+
+// listBuckets returns the names of all buckets seen by the transactions of view
+func listBuckets(view func(func(*bolt.Tx) error) error) ([]string, error) {
+	buckets := []string{}
+	err := view(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			// the names of internal buckets start with a zero byte
+			if len(name) > 0 && name[0] != 0 {
+				buckets = append(buckets, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return buckets, nil
+}
+
 // List returns all Entries of a bucket
 // optionally provide arguments to specifiy a key offset and a key limit
 // Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
 func (store *Storage) List(bucketID string, opts *common.ListOpts) (chan *common.DocInfo, error) {
-	res := make(chan *common.DocInfo, 64)
+	return store.ListContext(context.Background(), bucketID, opts)
+}
+
+// ListContext returns all Entries of a bucket
+// The channel is closed and the read transaction is released as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucketID string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.IterateContext(ctx, bucketID, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(ctx, iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucketID string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucketID, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+// The bucket is read in pages, each in its own read transaction, so a slow consumer
+// does not keep a transaction open.
+func (store *Storage) IterateContext(ctx context.Context, bucketID string, opts *common.ListOpts) (common.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	it, err := iterate(store.db.View, bucketID, opts, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return common.ContextIterator(ctx, it), nil
+}
+
+// iterate returns an iterator reading the pages of a bucket with the transactions of view
+// Keys are expired as of at, or as of the time each page is read if at is zero.
+func iterate(view func(func(*bolt.Tx) error) error, bucketID string, opts *common.ListOpts, at time.Time) (common.Iterator, error) {
+	err := view(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketID)) == nil {
+			return common.Error(common.BucketNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	if opts == nil {
 		opts = &common.ListOpts{}
 	}
-	earlyError := make(chan error, 2)
-	go store.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(bucketID))
+	it := &docIterator{view: view, bucketID: bucketID, opts: opts, at: at}
+	cursor, ok, err := opts.CursorKey()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		it.last = []byte(cursor)
+	}
+	return it, nil
+}
+
+// Count returns the number of entries of a bucket, values are not loaded
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	iter, err := store.Iterate(bucket, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	return common.Count(iter)
+}
+
+// pageSize is the number of entries a docIterator reads per transaction
+const pageSize = 128
+
+type docIterator struct {
+	view     func(func(*bolt.Tx) error) error
+	bucketID string
+	opts     *common.ListOpts
+	at       time.Time
+	page     []*common.DocInfo
+	// last is the key the next page starts behind, initially the cursor
+	last  []byte
+	count int
+	done  bool
+	doc   *common.DocInfo
+	err   error
+}
+
+func (it *docIterator) Next() bool {
+	if it.opts.Limit > 0 && it.count >= it.opts.Limit {
+		it.doc = nil
+		return false
+	}
+	if len(it.page) == 0 && !it.done && it.err == nil {
+		it.err = it.fill()
+	}
+	if len(it.page) == 0 {
+		it.doc = nil
+		return false
+	}
+	it.doc, it.page = it.page[0], it.page[1:]
+	it.count++
+	return true
+}
+
+// fill reads the next page, starting behind the last key of the previous one
+func (it *docIterator) fill() error {
+	return it.view(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(it.bucketID))
 		if bucket == nil {
-			err := common.Error(common.BucketNotFound)
-			earlyError <- err
-			return err
+			return common.Error(common.BucketNotFound)
 		}
-		earlyError <- nil
 		c := bucket.Cursor()
-		switch {
-		case opts.Prefix != "":
-			{
-				for k, v := c.Seek([]byte(opts.Prefix)); k != nil && bytes.HasPrefix(k, []byte(opts.Prefix)); k, v = c.Next() {
-					res <- &common.DocInfo{Key: string(k), Value: v}
+		k, v := it.seek(c)
+		step := c.Next
+		if it.opts.Reverse {
+			step = c.Prev
+		}
+		now := it.at
+		if now.IsZero() {
+			now = time.Now()
+		}
+		for ; k != nil; k, v = step() {
+			if !it.opts.Match(string(k)) {
+				break
+			}
+			if len(it.page) == pageSize {
+				return nil
+			}
+			if expired(tx, it.bucketID, k, now) {
+				continue
+			}
+			doc := &common.DocInfo{Key: string(k)}
+			if it.opts.WithMeta {
+				var err error
+				if doc.Meta, err = stat(tx, it.bucketID, doc.Key, v); err != nil {
+					return err
 				}
 			}
-		case opts.Start != "":
-			{
-				for k, v := c.Seek([]byte(opts.Start)); k != nil && bytes.Compare(k, []byte(opts.End)) < 0; k, v = c.Next() {
-					res <- &common.DocInfo{Key: string(k), Value: v}
+			if !it.opts.KeysOnly {
+				// values are only valid during the transaction, so they are copied by load
+				var err error
+				if doc.Value, err = load(tx, it.bucketID, doc.Key, v); err != nil {
+					return err
 				}
 			}
-		default:
-			{
-				for k, v := c.First(); k != nil; k, v = c.Next() {
-					res <- &common.DocInfo{Key: string(k), Value: v}
+			it.page = append(it.page, doc)
+			it.last = []byte(doc.Key)
+		}
+		it.done = true
+		return nil
+	})
+}
+
+// seek positions c on the first key to read, which is the first key of the range
+// or the first key behind last, whichever comes later in iteration order
+func (it *docIterator) seek(c *bolt.Cursor) ([]byte, []byte) {
+	if it.opts.Reverse {
+		upper, bounded := upperBound(it.opts)
+		if it.last != nil && (!bounded || bytes.Compare(it.last, upper) < 0) {
+			upper, bounded = it.last, true
+		}
+		if !bounded {
+			return c.Last()
+		}
+		// upper is exclusive, so step back from the first key not below it
+		if k, _ := c.Seek(upper); k == nil {
+			return c.Last()
+		}
+		return c.Prev()
+	}
+	var lower []byte
+	switch {
+	case it.opts.Prefix != "":
+		lower = []byte(it.opts.Prefix)
+	case it.opts.Start != "":
+		lower = []byte(it.opts.Start)
+	}
+	if it.last != nil && bytes.Compare(it.last, lower) >= 0 {
+		k, v := c.Seek(it.last)
+		if bytes.Equal(k, it.last) {
+			return c.Next()
+		}
+		return k, v
+	}
+	if lower == nil {
+		return c.First()
+	}
+	return c.Seek(lower)
+}
+
+// upperBound returns the exclusive upper bound of the range selected by opts
+func upperBound(opts *common.ListOpts) ([]byte, bool) {
+	switch {
+	case opts.Prefix != "":
+		// the prefix with its last byte below 0xff incremented is the first key behind it
+		prefix := []byte(opts.Prefix)
+		for i := len(prefix) - 1; i >= 0; i-- {
+			if prefix[i] < 0xff {
+				upper := append([]byte{}, prefix[:i+1]...)
+				upper[i]++
+				return upper, true
+			}
+		}
+		return nil, false
+	case opts.Start != "":
+		return []byte(opts.End), true
+	}
+	return nil, false
+}
+
+func (it *docIterator) Doc() *common.DocInfo {
+	return it.doc
+}
+
+func (it *docIterator) Err() error {
+	return it.err
+}
+
+func (it *docIterator) Close() error {
+	it.page = nil
+	it.done = true
+	return nil
+}
+
+// NewBatch creates an empty batch which is applied in a single bolt transaction
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+// Commit writes all operations of the batch atomically
+func (b *batch) Commit() error {
+	return b.store.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range b.Ops {
+			bucket := tx.Bucket([]byte(op.Bucket))
+			if bucket == nil {
+				return common.Error(common.BucketNotFound)
+			}
+			err := record(tx, op.Bucket, op.Key, op.Value, op.Delete)
+			if err == nil && op.Delete {
+				err = bucket.Delete([]byte(op.Key))
+			} else if err == nil {
+				err = bucket.Put([]byte(op.Key), op.Value)
+			}
+			if err == nil {
+				err = clearIndexes(tx, op.Bucket, op.Key)
+			}
+			if err == nil && op.Delete {
+				err = dropMeta(tx, op.Bucket, op.Key)
+			} else if err == nil {
+				err = touch(tx, op.Bucket, op.Key, int64(len(op.Value)), nil)
+			}
+			if err != nil {
+				return common.Error(common.WriteFailed, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Begin starts a writable bolt transaction
+// Bolt allows only one writable transaction at a time, so other writes block until it is closed.
+func (store *Storage) Begin() (storage.Tx, error) {
+	t, err := store.db.Begin(true)
+	if err != nil {
+		return nil, common.Error(common.WriteFailed, err)
+	}
+	return &tx{t}, nil
+}
+
+type tx struct {
+	tx *bolt.Tx
+}
+
+// Get loads data from a key
+func (t *tx) Get(bucketID, key string) ([]byte, error) {
+	bucket := t.tx.Bucket([]byte(bucketID))
+	if bucket == nil {
+		return nil, common.Error(common.BucketNotFound)
+	}
+	value := bucket.Get([]byte(key))
+	if value == nil || expired(t.tx, bucketID, []byte(key), time.Now()) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	result, err := load(t.tx, bucketID, key, value)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Put saves a byteslice to the db
+func (t *tx) Put(bucketID, key string, value []byte) error {
+	bucket := t.tx.Bucket([]byte(bucketID))
+	if bucket == nil {
+		return common.Error(common.BucketNotFound)
+	}
+	if err := bucket.Put([]byte(key), value); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err := clearIndexes(t.tx, bucketID, key); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err := record(t.tx, bucketID, key, value, false); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err := touch(t.tx, bucketID, key, int64(len(value)), nil); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// Delete deletes a value from the db
+func (t *tx) Delete(bucketID, key string) error {
+	bucket := t.tx.Bucket([]byte(bucketID))
+	if bucket == nil {
+		return common.Error(common.BucketNotFound)
+	}
+	if err := record(t.tx, bucketID, key, nil, true); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err := bucket.Delete([]byte(key)); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err := clearIndexes(t.tx, bucketID, key); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err := dropMeta(t.tx, bucketID, key); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// List returns all Entries of a bucket
+// bolt transactions are not safe for concurrent use, so the entries are collected before returning.
+func (t *tx) List(bucketID string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	bucket := t.tx.Bucket([]byte(bucketID))
+	if bucket == nil {
+		return nil, common.Error(common.BucketNotFound)
+	}
+	if opts == nil {
+		opts = &common.ListOpts{}
+	}
+	docs := make([]*common.DocInfo, 0)
+	c := bucket.Cursor()
+	var k, v []byte
+	switch {
+	case opts.Prefix != "":
+		k, v = c.Seek([]byte(opts.Prefix))
+	case opts.Start != "":
+		k, v = c.Seek([]byte(opts.Start))
+	default:
+		k, v = c.First()
+	}
+	now := time.Now()
+	for ; k != nil && opts.Match(string(k)); k, v = c.Next() {
+		if expired(t.tx, bucketID, k, now) {
+			continue
+		}
+		val, err := load(t.tx, bucketID, string(k), v)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, &common.DocInfo{Key: string(k), Value: val})
+	}
+	return common.DocChannel(docs), nil
+}
+
+// Commit commits the transaction
+func (t *tx) Commit() error {
+	if err := t.tx.Commit(); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// Rollback discards the transaction, it is a noop if the transaction is already closed
+func (t *tx) Rollback() error {
+	if err := t.tx.Rollback(); err != nil && err != bolt.ErrTxClosed {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// CompareAndSwap saves new if the current value of key equals old
+func (store *Storage) CompareAndSwap(bucketID, key string, old, new []byte) (bool, error) {
+	swapped := false
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketID))
+		if bucket == nil {
+			return common.Error(common.BucketNotFound)
+		}
+		val, err := current(tx, bucket, bucketID, key)
+		if err != nil || !common.Equal(val, old) {
+			return err
+		}
+		if err := bucket.Put([]byte(key), new); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := clearIndexes(tx, bucketID, key); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := record(tx, bucketID, key, new, false); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := touch(tx, bucketID, key, int64(len(new)), nil); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucketID, key string, value []byte) (bool, error) {
+	return store.CompareAndSwap(bucketID, key, nil, value)
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucketID, key string, old []byte) (bool, error) {
+	deleted := false
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketID))
+		if bucket == nil {
+			return common.Error(common.BucketNotFound)
+		}
+		val, err := current(tx, bucket, bucketID, key)
+		if err != nil || old == nil || !common.Equal(val, old) {
+			return err
+		}
+		if err := record(tx, bucketID, key, nil, true); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := bucket.Delete([]byte(key)); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := clearIndexes(tx, bucketID, key); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := dropMeta(tx, bucketID, key); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		deleted = true
+		return nil
+	})
+	return deleted, err
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+func (store *Storage) PutWithTTL(bucketID, key string, value []byte, ttl time.Duration) error {
+	deadline := make([]byte, 8)
+	binary.BigEndian.PutUint64(deadline, uint64(time.Now().Add(ttl).UnixNano()))
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketID))
+		if bucket == nil {
+			return common.Error(common.BucketNotFound)
+		}
+		if err := bucket.Put([]byte(key), value); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := dropStream(tx, bucketID, key); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := record(tx, bucketID, key, value, false); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := touch(tx, bucketID, key, int64(len(value)), nil); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		root, err := tx.CreateBucketIfNotExists(ttlBucket)
+		if err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		index, err := root.CreateBucketIfNotExists([]byte(bucketID))
+		if err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		return index.Put([]byte(key), deadline)
+	})
+}
+
+// reap removes all expired keys listed in the expiry index
+// The index is scanned in a read transaction first, so no write happens if nothing has expired.
+func (store *Storage) reap() {
+	now := time.Now()
+	candidates := make(map[string][][]byte)
+	store.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(ttlBucket)
+		if root == nil {
+			return nil
+		}
+		return root.ForEach(func(bucketID, _ []byte) error {
+			if index := root.Bucket(bucketID); index != nil {
+				index.ForEach(func(k, v []byte) error {
+					if !now.Before(deadline(v)) {
+						candidates[string(bucketID)] = append(candidates[string(bucketID)], append([]byte{}, k...))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if len(candidates) == 0 {
+		return
+	}
+	store.db.Update(func(tx *bolt.Tx) error {
+		for bucketID, keys := range candidates {
+			bucket := tx.Bucket([]byte(bucketID))
+			for _, k := range keys {
+				if bucket != nil && expired(tx, bucketID, k, now) {
+					// expired keys of versioned buckets leave a tombstone like deleted ones
+					record(tx, bucketID, string(k), nil, true)
+					bucket.Delete(k)
+					clearIndexes(tx, bucketID, string(k))
+					dropMeta(tx, bucketID, string(k))
 				}
 			}
 		}
-		close(res)
 		return nil
 	})
-	err := <-earlyError
-	return res, err
+}
+
+// PutWithMeta saves a byteslice along with the content type and attributes of meta
+func (store *Storage) PutWithMeta(bucketID, key string, value []byte, meta *common.Metadata) error {
+	return store.put(bucketID, key, value, meta)
+}
+
+// Stat returns the metadata of a key
+func (store *Storage) Stat(bucketID, key string) (*common.Metadata, error) {
+	var meta *common.Metadata
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = statKey(tx, bucketID, key, time.Now())
+		return err
+	})
+	return meta, err
+}
+
+// statKey returns the metadata of a key which has not expired at now
+func statKey(tx *bolt.Tx, bucketID, key string, now time.Time) (*common.Metadata, error) {
+	bucket := tx.Bucket([]byte(bucketID))
+	if bucket == nil {
+		return nil, common.Error(common.BucketNotFound)
+	}
+	val := bucket.Get([]byte(key))
+	if val == nil || expired(tx, bucketID, []byte(key), now) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	return stat(tx, bucketID, key, val)
+}
+
+// Snapshot returns a read-only view of the storage as it is now, backed by a read transaction
+// Keys are expired as of the time the snapshot was taken. Bolt can not grow its memory map while
+// a read transaction is open, so once the database outgrows InitialMmapSize writes block until
+// the snapshot is closed.
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	t, err := store.db.Begin(false)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return &snapshot{tx: t, at: time.Now()}, nil
+}
+
+// snapshot serializes the use of its transaction, since bolt transactions are not safe for concurrent use
+type snapshot struct {
+	common.ReadOnlyStorage
+	mutex sync.Mutex
+	tx    *bolt.Tx
+	at    time.Time
+}
+
+// view calls fn with the transaction of the snapshot
+func (s *snapshot) view(fn func(*bolt.Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx == nil {
+		return common.Error(common.ReadFailed, bolt.ErrTxClosed)
+	}
+	return fn(s.tx)
+}
+
+// Get loads data from a key
+func (s *snapshot) Get(bucketID, key string) ([]byte, error) {
+	var result []byte
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		result, err = get(tx, bucketID, key, s.at)
+		return err
+	})
+	return result, err
+}
+
+// Stat returns the metadata of a key
+func (s *snapshot) Stat(bucketID, key string) (*common.Metadata, error) {
+	var meta *common.Metadata
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = statKey(tx, bucketID, key, s.at)
+		return err
+	})
+	return meta, err
+}
+
+// ListBuckets returns the names of all buckets in lexical order
+func (s *snapshot) ListBuckets() ([]string, error) {
+	return listBuckets(s.view)
+}
+
+// List returns all Entries of a bucket
+func (s *snapshot) List(bucketID string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := s.Iterate(bucketID, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(context.Background(), iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (s *snapshot) Iterate(bucketID string, opts *common.ListOpts) (common.Iterator, error) {
+	return iterate(s.view, bucketID, opts, s.at)
+}
+
+// Count returns the number of entries of a bucket, values are not loaded
+func (s *snapshot) Count(bucketID string, opts *common.ListOpts) (int, error) {
+	iter, err := s.Iterate(bucketID, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	return common.Count(iter)
+}
+
+// Close ends the read transaction of the snapshot
+func (s *snapshot) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Rollback()
+	s.tx = nil
+	if err != nil {
+		return common.Error(common.CloseFailed, err)
+	}
+	return nil
+}
+
+// EnableVersioning starts keeping the history of all keys of a bucket
+// The current values become the first versions of their keys.
+func (store *Storage) EnableVersioning(bucketID string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketID))
+		if bucket == nil {
+			return common.Error(common.BucketNotFound)
+		}
+		if history(tx, bucketID) != nil {
+			return nil
+		}
+		if _, err := nestedBucket(tx, versionBucket, bucketID); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		now := time.Now()
+		return bucket.ForEach(func(k, v []byte) error {
+			if expired(tx, bucketID, k, now) {
+				return nil
+			}
+			val, err := load(tx, bucketID, string(k), v)
+			if err != nil {
+				return err
+			}
+			if err = record(tx, bucketID, string(k), val, false); err != nil {
+				return common.Error(common.WriteFailed, err)
+			}
+			return nil
+		})
+	})
+}
+
+// GetVersion loads a former value of a key
+func (store *Storage) GetVersion(bucketID, key string, version uint64) ([]byte, error) {
+	var result []byte
+	err := store.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketID)) == nil {
+			return common.Error(common.BucketNotFound)
+		}
+		versions := history(tx, bucketID)
+		if versions == nil {
+			return common.Error(common.ReadFailed)
+		}
+		val := versions.Get(versionKey(key, version))
+		if val == nil {
+			return common.Error(common.ReadFailed)
+		}
+		if len(val) < 9 || val[8] != 0 {
+			return common.Error(common.ReadFailed, errors.New("version is a tombstone"))
+		}
+		result = append([]byte{}, val[9:]...)
+		return nil
+	})
+	return result, err
+}
+
+// ListVersions returns the history of a key, oldest first
+func (store *Storage) ListVersions(bucketID, key string) ([]*common.Version, error) {
+	versions := []*common.Version{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketID)) == nil {
+			return common.Error(common.BucketNotFound)
+		}
+		index := history(tx, bucketID)
+		if index == nil {
+			return nil
+		}
+		prefix := []byte(key + "\x00")
+		c := index.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if len(k) != len(prefix)+8 || len(v) < 9 {
+				continue
+			}
+			versions = append(versions, &common.Version{
+				Version:  binary.BigEndian.Uint64(k[len(prefix):]),
+				Modified: time.Unix(0, int64(binary.BigEndian.Uint64(v))),
+				Size:     int64(len(v) - 9),
+				Deleted:  v[8] != 0,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// touch writes the metadata of a new value of size bytes, keeping the creation time of the old one
+func touch(tx *bolt.Tx, bucketID, key string, size int64, meta *common.Metadata) error {
+	old, err := readMeta(tx, bucketID, key)
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(common.Touch(old, meta, size, time.Now()))
+	if err != nil {
+		return err
+	}
+	index, err := nestedBucket(tx, metaBucket, bucketID)
+	if err != nil {
+		return err
+	}
+	return index.Put([]byte(key), val)
+}
+
+// dropMeta removes the metadata of a key
+func dropMeta(tx *bolt.Tx, bucketID, key string) error {
+	root := tx.Bucket(metaBucket)
+	if root == nil {
+		return nil
+	}
+	index := root.Bucket([]byte(bucketID))
+	if index == nil {
+		return nil
+	}
+	return index.Delete([]byte(key))
+}
+
+// readMeta returns the metadata of a key or nil if it has none
+func readMeta(tx *bolt.Tx, bucketID, key string) (*common.Metadata, error) {
+	root := tx.Bucket(metaBucket)
+	if root == nil {
+		return nil, nil
+	}
+	index := root.Bucket([]byte(bucketID))
+	if index == nil {
+		return nil, nil
+	}
+	val := index.Get([]byte(key))
+	if val == nil {
+		return nil, nil
+	}
+	meta := &common.Metadata{}
+	if err := json.Unmarshal(val, meta); err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return meta, nil
+}
+
+// stat returns the metadata of key, val is its raw value
+// Values written before metadata was kept only report their size.
+func stat(tx *bolt.Tx, bucketID, key string, val []byte) (*common.Metadata, error) {
+	meta, err := readMeta(tx, bucketID, key)
+	if err != nil || meta != nil {
+		return meta, err
+	}
+	if val, err = load(tx, bucketID, key, val); err != nil {
+		return nil, err
+	}
+	return &common.Metadata{Size: int64(len(val))}, nil
+}
+
+// clearIndexes removes the expiry and the chunks of a key
+func clearIndexes(tx *bolt.Tx, bucketID, key string) error {
+	if err := clearTTL(tx, bucketID, key); err != nil {
+		return err
+	}
+	return dropStream(tx, bucketID, key)
+}
+
+// clearTTL removes the expiry of a key
+func clearTTL(tx *bolt.Tx, bucketID, key string) error {
+	root := tx.Bucket(ttlBucket)
+	if root == nil {
+		return nil
+	}
+	index := root.Bucket([]byte(bucketID))
+	if index == nil {
+		return nil
+	}
+	return index.Delete([]byte(key))
+}
+
+// expired checks the expiry index of a key
+func expired(tx *bolt.Tx, bucketID string, key []byte, now time.Time) bool {
+	root := tx.Bucket(ttlBucket)
+	if root == nil {
+		return false
+	}
+	index := root.Bucket([]byte(bucketID))
+	if index == nil {
+		return false
+	}
+	val := index.Get(key)
+	return val != nil && !now.Before(deadline(val))
+}
+
+// current returns the value of key or nil if it does not exist or has expired
+func current(tx *bolt.Tx, bucket *bolt.Bucket, bucketID, key string) ([]byte, error) {
+	val := bucket.Get([]byte(key))
+	if val == nil || expired(tx, bucketID, []byte(key), time.Now()) {
+		return nil, nil
+	}
+	return load(tx, bucketID, key, val)
+}
+
+func deadline(val []byte) time.Time {
+	if len(val) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(val)))
+}
+
+// PutReader saves everything read from r
+// Values larger than ChunkSize are written chunk by chunk, each in its own transaction,
+// and replace the old value atomically once r is drained.
+// In versioned buckets the value is read into memory, since the history keeps a copy of it.
+func (store *Storage) PutReader(bucketID, key string, r io.Reader) error {
+	versioned := false
+	store.db.View(func(tx *bolt.Tx) error {
+		versioned = history(tx, bucketID) != nil
+		return nil
+	})
+	if versioned {
+		value, err := ioutil.ReadAll(r)
+		if err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		return store.Put(bucketID, key, value)
+	}
+	buf := make([]byte, ChunkSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return store.Put(bucketID, key, buf[:n])
+	}
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	m := &manifest{id: atomic.AddUint64(&store.uploads, 1)}
+	size := int64(0)
+	for n > 0 {
+		err = store.db.Update(func(tx *bolt.Tx) error {
+			if tx.Bucket([]byte(bucketID)) == nil {
+				return common.Error(common.BucketNotFound)
+			}
+			chunks, err := nestedBucket(tx, chunkBucket, bucketID)
+			if err != nil {
+				return err
+			}
+			return chunks.Put(m.chunkKey(key, m.chunks), buf[:n])
+		})
+		if err != nil {
+			break
+		}
+		m.chunks++
+		size += int64(n)
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = store.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte(bucketID))
+			if bucket == nil {
+				return common.Error(common.BucketNotFound)
+			}
+			if err := clearIndexes(tx, bucketID, key); err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), []byte{}); err != nil {
+				return err
+			}
+			if err := touch(tx, bucketID, key, size, nil); err != nil {
+				return err
+			}
+			index, err := nestedBucket(tx, streamBucket, bucketID)
+			if err != nil {
+				return err
+			}
+			return index.Put([]byte(key), m.bytes())
+		})
+	}
+	if err != nil {
+		// remove the chunks written so far
+		store.db.Update(func(tx *bolt.Tx) error {
+			m.drop(tx, bucketID, key)
+			return nil
+		})
+		if common.IsError(err, common.BucketNotFound) {
+			return err
+		}
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// GetReader opens a value for reading
+// Streamed values are read chunk by chunk, each in its own read transaction.
+// If the value is replaced meanwhile, reading fails.
+func (store *Storage) GetReader(bucketID, key string) (io.ReadCloser, error) {
+	var value []byte
+	var m *manifest
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketID))
+		if bucket == nil {
+			return common.Error(common.BucketNotFound)
+		}
+		val := bucket.Get([]byte(key))
+		if val == nil || expired(tx, bucketID, []byte(key), time.Now()) {
+			return common.Error(common.ReadFailed)
+		}
+		var err error
+		if m, err = readManifest(tx, bucketID, key); err != nil || m != nil {
+			return err
+		}
+		value = make([]byte, len(val))
+		copy(value, val)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return ioutil.NopCloser(bytes.NewReader(value)), nil
+	}
+	return &chunkReader{db: store.db, m: m, bucketID: bucketID, key: key}, nil
+}
+
+type chunkReader struct {
+	db       *bolt.DB
+	m        *manifest
+	bucketID string
+	key      string
+	next     uint64
+	buf      []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next >= r.m.chunks {
+			return 0, io.EOF
+		}
+		err := r.db.View(func(tx *bolt.Tx) error {
+			chunk := chunkAt(tx, r.bucketID, r.m.chunkKey(r.key, r.next))
+			if chunk == nil {
+				return common.Error(common.ReadFailed, errors.New("value was replaced while reading"))
+			}
+			r.buf = append([]byte{}, chunk...)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		r.next++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.buf = nil
+	r.next = r.m.chunks
+	return nil
+}
+
+// manifest describes a streamed value, its chunks are stored under the id of the upload
+// so a new upload never overwrites the chunks of the current value.
+type manifest struct {
+	id     uint64
+	chunks uint64
+}
+
+func (m *manifest) bytes() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, m.id)
+	binary.BigEndian.PutUint64(b[8:], m.chunks)
+	return b
+}
+
+func (m *manifest) chunkKey(key string, i uint64) []byte {
+	suffix := make([]byte, 16)
+	binary.BigEndian.PutUint64(suffix, m.id)
+	binary.BigEndian.PutUint64(suffix[8:], i)
+	return append([]byte(key+"\x00"), suffix...)
+}
+
+// drop deletes all chunks of the manifest
+func (m *manifest) drop(tx *bolt.Tx, bucketID, key string) error {
+	root := tx.Bucket(chunkBucket)
+	if root == nil {
+		return nil
+	}
+	chunks := root.Bucket([]byte(bucketID))
+	if chunks == nil {
+		return nil
+	}
+	for i := uint64(0); i < m.chunks; i++ {
+		if err := chunks.Delete(m.chunkKey(key, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// history returns the version index of a bucket or nil if the bucket is not versioned
+func history(tx *bolt.Tx, bucketID string) *bolt.Bucket {
+	root := tx.Bucket(versionBucket)
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(bucketID))
+}
+
+func versionKey(key string, version uint64) []byte {
+	suffix := make([]byte, 8)
+	binary.BigEndian.PutUint64(suffix, version)
+	return append([]byte(key+"\x00"), suffix...)
+}
+
+// record adds a version of key if its bucket is versioned, it must be called before the key is changed
+// Deleting a key which does not exist adds no tombstone.
+func record(tx *bolt.Tx, bucketID, key string, value []byte, deleted bool) error {
+	index := history(tx, bucketID)
+	if index == nil {
+		return nil
+	}
+	if deleted && tx.Bucket([]byte(bucketID)).Get([]byte(key)) == nil {
+		return nil
+	}
+	head := uint64(0)
+	c := index.Cursor()
+	// the versions of key are followed by the keys starting with key and a one byte
+	if k, _ := c.Seek([]byte(key + "\x01")); k != nil {
+		k, _ = c.Prev()
+		head = versionOf(k, key)
+	} else if k, _ = c.Last(); k != nil {
+		head = versionOf(k, key)
+	}
+	val := make([]byte, 9, 9+len(value))
+	binary.BigEndian.PutUint64(val, uint64(time.Now().UnixNano()))
+	if deleted {
+		val[8] = 1
+	}
+	return index.Put(versionKey(key, head+1), append(val, value...))
+}
+
+// versionOf returns the version number of a key of the version index or 0 if it is no version of key
+func versionOf(k []byte, key string) uint64 {
+	if len(k) != len(key)+9 || !bytes.HasPrefix(k, []byte(key+"\x00")) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(k[len(key)+1:])
+}
+
+// nestedBucket returns the nested bucket of bucketID in the internal bucket root, creating both if needed
+func nestedBucket(tx *bolt.Tx, root []byte, bucketID string) (*bolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists(root)
+	if err != nil {
+		return nil, err
+	}
+	return b.CreateBucketIfNotExists([]byte(bucketID))
+}
+
+func chunkAt(tx *bolt.Tx, bucketID string, chunkKey []byte) []byte {
+	root := tx.Bucket(chunkBucket)
+	if root == nil {
+		return nil
+	}
+	chunks := root.Bucket([]byte(bucketID))
+	if chunks == nil {
+		return nil
+	}
+	return chunks.Get(chunkKey)
+}
+
+// readManifest returns the manifest of a streamed value or nil for a plain value
+func readManifest(tx *bolt.Tx, bucketID, key string) (*manifest, error) {
+	root := tx.Bucket(streamBucket)
+	if root == nil {
+		return nil, nil
+	}
+	index := root.Bucket([]byte(bucketID))
+	if index == nil {
+		return nil, nil
+	}
+	val := index.Get([]byte(key))
+	if val == nil {
+		return nil, nil
+	}
+	if len(val) != 16 {
+		return nil, errors.New("malformed stream manifest")
+	}
+	return &manifest{id: binary.BigEndian.Uint64(val), chunks: binary.BigEndian.Uint64(val[8:])}, nil
+}
+
+// dropStream deletes the chunks and the manifest of a streamed value
+func dropStream(tx *bolt.Tx, bucketID, key string) error {
+	m, err := readManifest(tx, bucketID, key)
+	if err != nil || m == nil {
+		return err
+	}
+	if err = m.drop(tx, bucketID, key); err != nil {
+		return err
+	}
+	return tx.Bucket(streamBucket).Bucket([]byte(bucketID)).Delete([]byte(key))
+}
+
+// load returns a copy of val, or the reassembled chunks if key holds a streamed value
+func load(tx *bolt.Tx, bucketID, key string, val []byte) ([]byte, error) {
+	m, err := readManifest(tx, bucketID, key)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if m == nil {
+		result := make([]byte, len(val))
+		copy(result, val)
+		return result, nil
+	}
+	buf := &bytes.Buffer{}
+	for i := uint64(0); i < m.chunks; i++ {
+		chunk := chunkAt(tx, bucketID, m.chunkKey(key, i))
+		if chunk == nil {
+			return nil, common.Error(common.ReadFailed, errors.New("missing chunk"))
+		}
+		buf.Write(chunk)
+	}
+	return buf.Bytes(), nil
 }
 
 // Close closes the db
 func (store *Storage) Close() error {
+	store.stopReaper()
 	err := store.db.Close()
 	if err != nil {
 		return common.Error(common.CloseFailed, err)
@@ -0,0 +1,31 @@
+// Package register makes the boltdb engine available to meta.NewStorage under the boltdb scheme.
+package register
+
+import (
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/engines/boltdb"
+	"github.com/trusch/storage/engines/meta"
+)
+
+// boltdb:///data.db?timeout=1s&nosync=true&mmap=256MB
+func init() {
+	meta.Register("boltdb", func(uri string, options ...interface{}) (storage.Storage, error) {
+		p, err := meta.Path(uri)
+		if err != nil {
+			return nil, err
+		}
+		q, err := meta.ParseQuery("boltdb", uri)
+		if err != nil {
+			return nil, err
+		}
+		opts := boltdb.Options{
+			Timeout:         q.Duration("timeout", 0),
+			NoSync:          q.Boolean("nosync", false),
+			InitialMmapSize: q.Size("mmap", 0),
+		}
+		if err = q.Done(); err != nil {
+			return nil, err
+		}
+		return boltdb.NewStorageWithOptions(p, opts)
+	})
+}
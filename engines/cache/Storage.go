@@ -1,30 +1,154 @@
 package cache
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/trusch/storage"
 	"github.com/trusch/storage/common"
 )
 
+// Mode selects how writes reach the two levels
+type Mode string
+
+const (
+	// WriteThrough writes to the first and then to the second level
+	WriteThrough Mode = "write-through"
+	// WriteBack writes to the first level and queues the write for the second level, the queue is flushed in the background
+	WriteBack Mode = "write-back"
+	// WriteAround writes to the second level and drops the key from the first level, which is filled by reads
+	WriteAround Mode = "write-around"
+)
+
+// Options tune a cache storage
+type Options struct {
+	Mode Mode
+	// TTL expires the values read through into the first level, which must support TTLs.
+	// 0 keeps them until they are overwritten or evicted.
+	TTL time.Duration
+	// NegativeTTL remembers the keys missing in the second level for this long, 0 disables negative caching
+	NegativeTTL time.Duration
+	// Queue is the file write-back mode keeps the pending writes in, they are flushed again after a crash.
+	// Without a queue the pending writes are lost on a crash. Writes which keep failing are appended
+	// to the file Queue+".failed".
+	Queue string
+	// FlushInterval is the time between the flushes of write-back mode
+	FlushInterval time.Duration
+	// Warm puts the values listed from the second level into the first level
+	Warm bool
+}
+
+// DefaultOptions are the options NewStorage uses
+var DefaultOptions = Options{Mode: WriteThrough, FlushInterval: time.Second}
+
+// maxMisses bounds the number of remembered misses, they are forgotten all at once beyond it
+const maxMisses = 100000
+
 // Storage creates the apropriate store from an URI
 type Storage struct {
-	first  storage.Storage
-	second storage.Storage
+	first   storage.Storage
+	second  storage.Storage
+	options Options
+	// mutex guards the pending writes of write-back mode, their queue, the number of the last batch
+	// and the remembered misses
+	mutex   sync.Mutex
+	pending map[slot]*write
+	queue   *queue
+	batches uint64
+	misses  map[slot]time.Time
+	// flushMutex serializes the flushes
+	flushMutex  sync.Mutex
+	stopFlusher func()
+}
+
+// slot identifies a key of a bucket
+type slot struct {
+	bucket string
+	key    string
 }
 
 // NewStorage creates a new storage from a URI
 func NewStorage(first, second storage.Storage) (*Storage, error) {
-	return &Storage{first, second}, nil
+	return NewStorageWithOptions(first, second, DefaultOptions)
+}
+
+// NewStorageWithOptions creates a new storage with the given options
+// In write-back mode the writes left in the queue are flushed in the background.
+func NewStorageWithOptions(first, second storage.Storage, options Options) (*Storage, error) {
+	if options.Mode == "" {
+		options.Mode = DefaultOptions.Mode
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultOptions.FlushInterval
+	}
+	switch options.Mode {
+	case WriteThrough, WriteAround:
+		if options.Queue != "" {
+			return nil, common.Error(common.InitFailed, errors.New("a queue is only used in write-back mode"))
+		}
+	case WriteBack:
+	default:
+		return nil, common.Error(common.InitFailed, fmt.Errorf("unknown cache mode %q", options.Mode))
+	}
+	if _, ok := first.(storage.TTLStorage); options.TTL > 0 && !ok {
+		return nil, common.Error(common.InitFailed, errors.New("the first level does not support TTLs"))
+	}
+	store := &Storage{
+		first:   first,
+		second:  second,
+		options: options,
+		pending: make(map[slot]*write),
+		misses:  make(map[slot]time.Time),
+	}
+	if options.Mode == WriteBack {
+		if options.Queue != "" {
+			q, writes, err := openQueue(options.Queue)
+			if err != nil {
+				return nil, common.Error(common.InitFailed, err)
+			}
+			store.queue = q
+			for _, w := range writes {
+				store.pending[w.slot()] = w
+				if w.Batch > store.batches {
+					store.batches = w.Batch
+				}
+			}
+		}
+		store.stopFlusher = store.flushInBackground()
+	}
+	return store, nil
 }
 
 // Put saves a byteslice to the db.
 // Example: Save("/foo/bar", []byte{1,2,3})
 func (store *Storage) Put(bucket, key string, value []byte) error {
-	if err := store.first.Put(bucket, key, value); err != nil {
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	store.forget(bucket, key)
+	switch store.options.Mode {
+	case WriteBack:
+		return store.enqueue(func() error {
+			return store.fill(ctx, bucket, key, value)
+		}, &write{Bucket: bucket, Key: key, Value: value})
+	case WriteAround:
+		if err := storage.WithContext(store.second).PutContext(ctx, bucket, key, value); err != nil {
+			return common.Error(common.WriteFailed, errors.New("second level fail"), err)
+		}
+		return store.drop(ctx, bucket, key)
+	}
+	if err := store.fill(ctx, bucket, key, value); err != nil {
 		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
 	}
-	if err := store.second.Put(bucket, key, value); err != nil {
+	if err := storage.WithContext(store.second).PutContext(ctx, bucket, key, value); err != nil {
 		return common.Error(common.WriteFailed, errors.New("second level fail"), err)
 	}
 	return nil
@@ -32,22 +156,81 @@ func (store *Storage) Put(bucket, key string, value []byte) error {
 
 // Get loads data from a key
 func (store *Storage) Get(bucket, key string) ([]byte, error) {
-	val, err := store.first.Get(bucket, key)
-	if err != nil {
-		val, err = store.second.Get(bucket, key)
-		if err == nil {
-			store.first.Put(bucket, key, val)
+	return store.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext loads data from a key
+// Pending writes come first, then the first level. Values read from the second level are put into the first one,
+// keys missing there are remembered for NegativeTTL.
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	if w, ok := store.pendingWrite(bucket, key); ok {
+		if w.Delete || w.expired(time.Now()) {
+			return nil, common.Error(common.ReadFailed)
 		}
+		return w.Value, nil
+	}
+	val, err := storage.WithContext(store.first).GetContext(ctx, bucket, key)
+	if err == nil {
+		return val, nil
+	}
+	if store.missing(bucket, key) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	val, err = storage.WithContext(store.second).GetContext(ctx, bucket, key)
+	switch {
+	case err == nil:
+		store.fill(ctx, bucket, key, val)
+	case common.IsError(err, common.ReadFailed):
+		store.remember(bucket, key)
 	}
 	return val, err
 }
 
+// fill puts a value into the first level, it expires after TTL if one is set
+func (store *Storage) fill(ctx context.Context, bucket, key string, value []byte) error {
+	if store.options.TTL > 0 {
+		return store.first.(storage.TTLStorage).PutWithTTL(bucket, key, value, store.options.TTL)
+	}
+	return storage.WithContext(store.first).PutContext(ctx, bucket, key, value)
+}
+
+// drop removes a key from the first level after it has been written to the second one
+func (store *Storage) drop(ctx context.Context, bucket, key string) error {
+	if err := storage.WithContext(store.first).DeleteContext(ctx, bucket, key); err != nil {
+		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
+	}
+	return nil
+}
+
+// update brings the first level up to date after a write to the second level
+// Write-through mode puts the value into it, the other modes drop the key.
+func (store *Storage) update(ctx context.Context, bucket, key string, value []byte) error {
+	if store.options.Mode != WriteThrough {
+		return store.drop(ctx, bucket, key)
+	}
+	if err := store.fill(ctx, bucket, key, value); err != nil {
+		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
+	}
+	return nil
+}
+
 // Delete deletes a value from the db
 func (store *Storage) Delete(bucket, key string) error {
-	if err := store.first.Delete(bucket, key); err != nil {
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	store.forget(bucket, key)
+	if store.options.Mode == WriteBack {
+		return store.enqueue(func() error {
+			return storage.WithContext(store.first).DeleteContext(ctx, bucket, key)
+		}, &write{Bucket: bucket, Key: key, Delete: true})
+	}
+	if err := storage.WithContext(store.first).DeleteContext(ctx, bucket, key); err != nil {
 		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
 	}
-	if err := store.second.Delete(bucket, key); err != nil {
+	if err := storage.WithContext(store.second).DeleteContext(ctx, bucket, key); err != nil {
 		return common.Error(common.WriteFailed, errors.New("second level fail"), err)
 	}
 	return nil
@@ -55,10 +238,15 @@ func (store *Storage) Delete(bucket, key string) error {
 
 // CreateBucket creates a bucket
 func (store *Storage) CreateBucket(bucket string) error {
-	if err := store.first.CreateBucket(bucket); err != nil {
+	return store.CreateBucketContext(context.Background(), bucket)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	if err := storage.WithContext(store.first).CreateBucketContext(ctx, bucket); err != nil {
 		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
 	}
-	if err := store.second.CreateBucket(bucket); err != nil {
+	if err := storage.WithContext(store.second).CreateBucketContext(ctx, bucket); err != nil {
 		return common.Error(common.WriteFailed, errors.New("second level fail"), err)
 	}
 	return nil
@@ -66,33 +254,328 @@ func (store *Storage) CreateBucket(bucket string) error {
 
 // DeleteBucket deletes a bucket
 func (store *Storage) DeleteBucket(bucket string) error {
-	if err := store.first.DeleteBucket(bucket); err != nil {
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket, the pending writes to it are discarded
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	if err := store.discard(bucket); err != nil {
+		return common.Error(common.WriteFailed, errors.New("queue fail"), err)
+	}
+	if err := storage.WithContext(store.first).DeleteBucketContext(ctx, bucket); err != nil {
 		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
 	}
-	if err := store.second.DeleteBucket(bucket); err != nil {
+	if err := storage.WithContext(store.second).DeleteBucketContext(ctx, bucket); err != nil {
 		return common.Error(common.WriteFailed, errors.New("second level fail"), err)
 	}
 	return nil
 }
 
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+// The second level holds all keys, the first one only those which have been cached, so the second level
+// is listed. In write-back mode the writes which have not reached it yet are merged in.
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.iterate(ctx, bucket, opts)
+}
+
+// Count returns the number of entries of a bucket
+// Like List, it counts in the second level merged with the pending writes.
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	pending, err := store.pendingWrites(bucket, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		return store.second.Count(bucket, opts)
+	}
+	iter, err := store.iterate(context.Background(), bucket, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	return common.Count(iter)
+}
+
+// ListBuckets returns the buckets of the second level
+func (store *Storage) ListBuckets() ([]string, error) {
+	return store.second.ListBuckets()
+}
+
 // List returns all Entries of a directory
 // optionally provide arguments to specifiy a key offset and a key limit
 // Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
 func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
-	ch, err := store.first.List(bucket, opts)
+	return store.ListContext(context.Background(), bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.iterate(ctx, bucket, opts)
 	if err != nil {
-		ch, err = store.second.List(bucket, opts)
+		return nil, err
+	}
+	return common.IteratorChannel(ctx, iter), nil
+}
+
+// NewBatch creates an empty batch
+// On commit the batch is applied to the first level and then to the second level,
+// each level applies it atomically if it supports batches. In write-back mode the batch is queued as a whole.
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+// Commit applies the batch to both levels
+func (b *batch) Commit() error {
+	// the first level gets the values in write-through and write-back mode, unless they would outlive the TTL
+	keep := b.store.options.Mode == WriteBack || (b.store.options.Mode == WriteThrough && b.store.options.TTL == 0)
+	first := storage.NewBatch(b.store.first)
+	writes := make([]*write, 0, len(b.Ops))
+	for _, op := range b.Ops {
+		b.store.forget(op.Bucket, op.Key)
+		if op.Delete || !keep {
+			first.Delete(op.Bucket, op.Key)
+		} else {
+			first.Put(op.Bucket, op.Key, op.Value)
+		}
+		writes = append(writes, &write{Bucket: op.Bucket, Key: op.Key, Value: op.Value, Delete: op.Delete})
+	}
+	if b.store.options.Mode == WriteBack {
+		return b.store.enqueue(first.Commit, writes...)
+	}
+	second := storage.NewBatch(b.store.second)
+	for _, op := range b.Ops {
+		if op.Delete {
+			second.Delete(op.Bucket, op.Key)
+		} else {
+			second.Put(op.Bucket, op.Key, op.Value)
+		}
+	}
+	if b.store.options.Mode == WriteAround {
+		if err := second.Commit(); err != nil {
+			return common.Error(common.WriteFailed, errors.New("second level fail"), err)
+		}
+		if err := first.Commit(); err != nil {
+			return common.Error(common.WriteFailed, errors.New("first level fail"), err)
+		}
+		return nil
+	}
+	if err := first.Commit(); err != nil {
+		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
+	}
+	if err := second.Commit(); err != nil {
+		return common.Error(common.WriteFailed, errors.New("second level fail"), err)
+	}
+	return nil
+}
+
+// CompareAndSwap saves new if the current value of key in the second level equals old
+// On success the first level is updated as well. A pending write of the key is flushed first.
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	second, ok := store.second.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	if err := store.settle(bucket, key); err != nil {
+		return false, err
+	}
+	swapped, err := second.CompareAndSwap(bucket, key, old, new)
+	if err != nil || !swapped {
+		return swapped, err
+	}
+	store.forget(bucket, key)
+	return true, store.update(context.Background(), bucket, key, new)
+}
+
+// PutIfAbsent saves value if key does not exist yet in the second level
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return store.CompareAndSwap(bucket, key, nil, value)
+}
+
+// DeleteIfEquals deletes key if its current value in the second level equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	second, ok := store.second.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	if err := store.settle(bucket, key); err != nil {
+		return false, err
+	}
+	deleted, err := second.DeleteIfEquals(bucket, key, old)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	return true, store.drop(context.Background(), bucket, key)
+}
+
+// PutWithTTL saves a byteslice with a TTL to the second level
+// The first level gets the same TTL if it supports it, otherwise the key is dropped from it.
+// This holds in write-around mode as well, since a value read through would not expire with the key.
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	second, ok := store.second.(storage.TTLStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	store.forget(bucket, key)
+	updateFirst := func() error {
+		if first, ok := store.first.(storage.TTLStorage); ok {
+			return first.PutWithTTL(bucket, key, value, ttl)
+		}
+		return store.first.Delete(bucket, key)
+	}
+	if store.options.Mode == WriteBack {
+		deadline := time.Now().Add(ttl)
+		return store.enqueue(updateFirst, &write{Bucket: bucket, Key: key, Value: value, Expires: &deadline})
+	}
+	if err := second.PutWithTTL(bucket, key, value, ttl); err != nil {
+		return err
+	}
+	if err := updateFirst(); err != nil {
+		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
+	}
+	return nil
+}
+
+// PutReader streams r into the second level and drops the key from the first level
+// The value is not buffered, so the first level is filled by the next Get. A pending write of the key is flushed first.
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	if err := store.settle(bucket, key); err != nil {
+		return err
+	}
+	store.forget(bucket, key)
+	if err := storage.PutReader(store.second, bucket, key, r); err != nil {
+		return common.Error(common.WriteFailed, errors.New("second level fail"), err)
+	}
+	if err := store.first.Delete(bucket, key); err != nil {
+		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
+	}
+	return nil
+}
+
+// GetReader opens a value of the first level and falls back to the second
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	if _, ok := store.pendingWrite(bucket, key); ok {
+		val, err := store.Get(bucket, key)
 		if err != nil {
 			return nil, err
 		}
+		return ioutil.NopCloser(bytes.NewReader(val)), nil
+	}
+	r, err := storage.GetReader(store.first, bucket, key)
+	if err != nil {
+		return storage.GetReader(store.second, bucket, key)
+	}
+	return r, nil
+}
+
+// PutWithMeta saves a byteslice along with its metadata to the second level
+// The first level gets the metadata as well if it supports it, otherwise the key is dropped from it.
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	second, ok := store.second.(storage.MetaStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	store.forget(bucket, key)
+	updateFirst := func() error {
+		// values with metadata are not read through, so they would not expire from the first level
+		if first, ok := store.first.(storage.MetaStorage); ok && store.options.Mode != WriteAround && store.options.TTL == 0 {
+			return first.PutWithMeta(bucket, key, value, meta)
+		}
+		return store.first.Delete(bucket, key)
+	}
+	if store.options.Mode == WriteBack {
+		return store.enqueue(updateFirst, &write{Bucket: bucket, Key: key, Value: value, Meta: meta})
+	}
+	if err := second.PutWithMeta(bucket, key, value, meta); err != nil {
+		return common.Error(common.WriteFailed, errors.New("second level fail"), err)
+	}
+	if err := updateFirst(); err != nil {
+		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
+	}
+	return nil
+}
+
+// Stat returns the metadata of a key of the second level, which holds the original timestamps
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	if err := store.settle(bucket, key); err != nil {
+		return nil, err
+	}
+	return storage.Stat(store.second, bucket, key)
+}
+
+// EnableVersioning starts keeping the history of the keys of a bucket
+// The history is kept by the second level only, the first level caches the current values.
+func (store *Storage) EnableVersioning(bucket string) error {
+	if s, ok := store.second.(storage.VersionedStorage); ok {
+		return s.EnableVersioning(bucket)
+	}
+	return common.Error(common.Unsupported)
+}
+
+// GetVersion loads a former value of a key
+func (store *Storage) GetVersion(bucket, key string, version uint64) ([]byte, error) {
+	if s, ok := store.second.(storage.VersionedStorage); ok {
+		if err := store.settle(bucket, key); err != nil {
+			return nil, err
+		}
+		return s.GetVersion(bucket, key, version)
 	}
-	return ch, nil
+	return nil, common.Error(common.Unsupported)
+}
+
+// ListVersions returns the history of a key, oldest first
+func (store *Storage) ListVersions(bucket, key string) ([]*common.Version, error) {
+	if s, ok := store.second.(storage.VersionedStorage); ok {
+		if err := store.settle(bucket, key); err != nil {
+			return nil, err
+		}
+		return s.ListVersions(bucket, key)
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// Begin is not supported by the cache storage, since a transaction can not span both levels
+func (store *Storage) Begin() (storage.Tx, error) {
+	return nil, common.Error(common.Unsupported)
 }
 
-// Close closes the storage
+// Snapshot returns a read-only view of the second level as it is now
+// The first level only holds copies of the second level, so it is not part of the snapshot.
+// Pending writes are flushed first.
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	if s, ok := store.second.(storage.Snapshotter); ok {
+		if err := store.Flush(); err != nil {
+			return nil, err
+		}
+		return s.Snapshot()
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// Close flushes the pending writes and closes the storage
 func (store *Storage) Close() error {
+	if store.stopFlusher != nil {
+		store.stopFlusher()
+	}
+	// writes which fail to flush stay in the queue and are flushed again by the next storage
+	flushErr := store.Flush()
+	if err := store.closeQueue(); err != nil {
+		return common.Error(common.CloseFailed, errors.New("queue fail"), err)
+	}
 	err1 := store.first.Close()
 	err2 := store.second.Close()
+	if flushErr != nil {
+		return common.Error(common.CloseFailed, flushErr)
+	}
 	if err1 != nil && err2 == nil {
 		return common.Error(common.CloseFailed, errors.New("first level fail"), err1)
 	}
@@ -104,3 +587,49 @@ func (store *Storage) Close() error {
 	}
 	return nil
 }
+
+// missing checks if a key has been remembered as missing in the second level
+func (store *Storage) missing(bucket, key string) bool {
+	if store.options.NegativeTTL <= 0 {
+		return false
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	deadline, ok := store.misses[slot{bucket, key}]
+	if ok && !time.Now().Before(deadline) {
+		delete(store.misses, slot{bucket, key})
+		return false
+	}
+	return ok
+}
+
+// remember notes that a key is missing in the second level
+func (store *Storage) remember(bucket, key string) {
+	if store.options.NegativeTTL <= 0 {
+		return
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	if len(store.misses) >= maxMisses {
+		for s, deadline := range store.misses {
+			if !now.Before(deadline) {
+				delete(store.misses, s)
+			}
+		}
+		if len(store.misses) >= maxMisses {
+			store.misses = make(map[slot]time.Time)
+		}
+	}
+	store.misses[slot{bucket, key}] = now.Add(store.options.NegativeTTL)
+}
+
+// forget drops a remembered miss, it is called on every write of a key
+func (store *Storage) forget(bucket, key string) {
+	if store.options.NegativeTTL <= 0 {
+		return
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	delete(store.misses, slot{bucket, key})
+}
@@ -1,11 +1,15 @@
 package cache
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/common"
 	"github.com/trusch/storage/engines/leveldb"
 	"github.com/trusch/storage/engines/memory"
 	"github.com/trusch/storage/testsuite"
@@ -31,3 +35,251 @@ func TestBoltDBStorage(t *testing.T) {
 	err = store.Close()
 	assert.NoError(t, err)
 }
+
+func TestModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, opts := range map[string]Options{
+		"write-back":   {Mode: WriteBack, Queue: filepath.Join(dir, "queue"), FlushInterval: 10 * time.Millisecond},
+		"write-around": {Mode: WriteAround, TTL: time.Minute, NegativeTTL: time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			first, err := memory.NewStorage()
+			assert.NoError(t, err)
+			second, err := memory.NewStorage()
+			assert.NoError(t, err)
+			store, err := NewStorageWithOptions(first, second, opts)
+			assert.NoError(t, err)
+			s := &StorageSuite{}
+			s.Store = store
+			suite.Run(t, s)
+			assert.NoError(t, store.Close())
+		})
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := Options{Mode: WriteBack, Queue: filepath.Join(dir, "queue"), FlushInterval: time.Hour}
+	// the first level only holds one entry, so pending writes get evicted from it
+	first, err := memory.NewStorageWithOptions(memory.Options{MaxEntries: 1})
+	assert.NoError(t, err)
+	second, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorageWithOptions(first, second, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateBucket("bucket"))
+	assert.NoError(t, store.Put("bucket", "a", []byte("a")))
+	batch := store.NewBatch()
+	batch.Put("bucket", "b", []byte("b"))
+	batch.Put("bucket", "c", []byte("c"))
+	assert.NoError(t, batch.Commit())
+	_, err = second.Get("bucket", "a")
+	assert.True(t, common.IsError(err, common.ReadFailed), "the write is pending")
+	for _, key := range []string{"a", "b", "c"} {
+		val, err := store.Get("bucket", key)
+		assert.NoError(t, err)
+		assert.Equal(t, key, string(val))
+	}
+
+	// a crash loses the first level, the queue is flushed by the next storage
+	store.stopFlusher()
+	store.queue.file.Close()
+	first, err = memory.NewStorage()
+	assert.NoError(t, err)
+	assert.NoError(t, first.CreateBucket("bucket"))
+	store, err = NewStorageWithOptions(first, second, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Delete("bucket", "c"))
+	assert.NoError(t, store.Flush())
+	for key, expected := range map[string]string{"a": "a", "b": "b"} {
+		val, err := second.Get("bucket", key)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(val))
+	}
+	_, err = second.Get("bucket", "c")
+	assert.True(t, common.IsError(err, common.ReadFailed))
+	info, err := os.Stat(opts.Queue)
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	// conditional writes see the pending value
+	assert.NoError(t, store.Put("bucket", "d", []byte("v1")))
+	ok, err := store.CompareAndSwap("bucket", "d", []byte("v1"), []byte("v2"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.NoError(t, store.Close())
+}
+
+func TestFailingFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	first, err := memory.NewStorage()
+	assert.NoError(t, err)
+	second, err := memory.NewStorage()
+	assert.NoError(t, err)
+	opts := Options{Mode: WriteBack, Queue: filepath.Join(dir, "queue"), FlushInterval: time.Hour}
+	store, err := NewStorageWithOptions(first, second, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateBucket("bucket"))
+	assert.NoError(t, store.CreateBucket("gone"))
+	assert.NoError(t, store.Put("gone", "key", []byte("lost")))
+	assert.NoError(t, store.Put("bucket", "key", []byte("value")))
+	batch := store.NewBatch()
+	batch.Put("bucket", "batched", []byte("value"))
+	batch.Put("gone", "batched", []byte("lost"))
+	assert.NoError(t, batch.Commit())
+	// the bucket of the pending writes disappears from the second level
+	assert.NoError(t, second.DeleteBucket("gone"))
+
+	for i := 0; i < maxFailures; i++ {
+		assert.Error(t, store.Flush())
+		val, err := second.Get("bucket", "key")
+		assert.NoError(t, err, "the failing write does not hold back the others")
+		assert.Equal(t, "value", string(val))
+		_, err = second.Get("bucket", "batched")
+		assert.Error(t, err, "a batch reaches the second level as a whole")
+	}
+	assert.NoError(t, store.Flush(), "the failing writes have been moved aside")
+	data, err := ioutil.ReadFile(opts.Queue + ".failed")
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"bucket":"gone"`)
+	for _, s := range []slot{{"gone", "key"}, {"bucket", "batched"}, {"gone", "batched"}} {
+		_, err = store.Get(s.bucket, s.key)
+		assert.Error(t, err, "the first level does not serve %v", s)
+	}
+	assert.NoError(t, store.Close())
+}
+
+func TestWriteAround(t *testing.T) {
+	first, err := memory.NewStorage()
+	assert.NoError(t, err)
+	second, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorageWithOptions(first, second, Options{Mode: WriteAround, TTL: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket"))
+	assert.NoError(t, store.Put("bucket", "key", []byte("value")))
+	_, err = first.Get("bucket", "key")
+	assert.Error(t, err, "writes go around the first level")
+	val, err := store.Get("bucket", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", string(val))
+	_, err = first.Get("bucket", "key")
+	assert.NoError(t, err, "reads go through the first level")
+	time.Sleep(100 * time.Millisecond)
+	_, err = first.Get("bucket", "key")
+	assert.Error(t, err, "the read value expires from the first level")
+
+	_, err = NewStorageWithOptions(first, second, Options{Mode: "write-behind"})
+	assert.True(t, common.IsError(err, common.InitFailed))
+	_, err = NewStorageWithOptions(first, second, Options{Queue: "queue"})
+	assert.True(t, common.IsError(err, common.InitFailed))
+}
+
+func TestNegativeCaching(t *testing.T) {
+	first, err := memory.NewStorage()
+	assert.NoError(t, err)
+	second, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorageWithOptions(first, second, Options{NegativeTTL: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket"))
+	_, err = store.Get("bucket", "key")
+	assert.True(t, common.IsError(err, common.ReadFailed))
+	// a write bypassing the cache is not seen until the miss expires
+	assert.NoError(t, second.Put("bucket", "key", []byte("value")))
+	_, err = store.Get("bucket", "key")
+	assert.True(t, common.IsError(err, common.ReadFailed))
+	time.Sleep(100 * time.Millisecond)
+	_, err = store.Get("bucket", "key")
+	assert.NoError(t, err)
+	// writes through the cache forget the miss at once
+	_, err = store.Get("bucket", "other")
+	assert.Error(t, err)
+	assert.NoError(t, store.Put("bucket", "other", []byte("value")))
+	_, err = store.Get("bucket", "other")
+	assert.NoError(t, err)
+}
+
+func listKeys(t *testing.T, store *Storage, opts *common.ListOpts) []string {
+	ch, err := store.List("bucket", opts)
+	assert.NoError(t, err)
+	keys := []string{}
+	for doc := range ch {
+		keys = append(keys, doc.Key)
+	}
+	return keys
+}
+
+func TestListMerge(t *testing.T) {
+	first, err := memory.NewStorage()
+	assert.NoError(t, err)
+	second, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorageWithOptions(first, second, Options{Mode: WriteBack, FlushInterval: time.Hour})
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket"))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.NoError(t, second.Put("bucket", key, []byte(key)))
+	}
+	// a partially filled first level does not hide the other keys
+	_, err = store.Get("bucket", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, listKeys(t, store, nil))
+
+	// pending writes are merged in
+	assert.NoError(t, store.Put("bucket", "bb", []byte("new")))
+	assert.NoError(t, store.Put("bucket", "c", []byte("changed")))
+	assert.NoError(t, store.Delete("bucket", "a"))
+	assert.NoError(t, store.Delete("bucket", "x"))
+	assert.Equal(t, []string{"b", "bb", "c", "d"}, listKeys(t, store, nil))
+	assert.Equal(t, []string{"b", "bb"}, listKeys(t, store, &common.ListOpts{Limit: 2}))
+	assert.Equal(t, []string{"d", "c", "bb"}, listKeys(t, store, &common.ListOpts{Reverse: true, Limit: 3}))
+	assert.Equal(t, []string{"c", "d"}, listKeys(t, store, &common.ListOpts{Cursor: common.NewCursor("bb")}))
+	assert.Equal(t, []string{"b", "bb"}, listKeys(t, store, &common.ListOpts{Prefix: "b"}))
+	ch, err := store.List("bucket", &common.ListOpts{Prefix: "c"})
+	assert.NoError(t, err)
+	assert.Equal(t, "changed", string((<-ch).Value))
+	n, err := store.Count("bucket", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	// listing metadata flushes the pending writes
+	ch, err = store.List("bucket", &common.ListOpts{Prefix: "bb", WithMeta: true})
+	assert.NoError(t, err)
+	doc := <-ch
+	assert.NotNil(t, doc.Meta)
+	_, err = second.Get("bucket", "bb")
+	assert.NoError(t, err)
+}
+
+func TestWarm(t *testing.T) {
+	first, err := memory.NewStorage()
+	assert.NoError(t, err)
+	second, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorageWithOptions(first, second, Options{Warm: true})
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket"))
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, second.Put("bucket", key, []byte(key)))
+	}
+	assert.Equal(t, []string{"a", "b"}, listKeys(t, store, &common.ListOpts{Limit: 2}))
+	for key, cached := range map[string]bool{"a": true, "b": true, "c": false} {
+		_, err := first.Get("bucket", key)
+		assert.Equal(t, cached, err == nil, key)
+	}
+	// listing keys only has no values to warm with
+	assert.Equal(t, []string{"a", "b", "c"}, listKeys(t, store, &common.ListOpts{KeysOnly: true}))
+	_, err = first.Get("bucket", "c")
+	assert.Error(t, err)
+}
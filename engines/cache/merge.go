@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// mergeIterator lists the second level merged with the pending writes of write-back mode
+// Pending puts replace or add docs, pending deletes hide them. Docs read from the second level
+// are put into the first level if warming is enabled.
+type mergeIterator struct {
+	ctx     context.Context
+	store   *Storage
+	bucket  string
+	opts    common.ListOpts
+	base    common.Iterator
+	next    *common.DocInfo
+	pending []*write
+	now     time.Time
+	doc     *common.DocInfo
+	count   int
+	err     error
+}
+
+// iterate lists the second level, the limit is applied after merging since pending deletes hide docs
+// The pending writes carry no timestamps, so they are flushed first if metadata is listed.
+func (store *Storage) iterate(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if opts != nil && opts.WithMeta {
+		if err := store.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	it := &mergeIterator{ctx: ctx, store: store, bucket: bucket, now: time.Now()}
+	if opts != nil {
+		it.opts = *opts
+	}
+	pending, err := store.pendingWrites(bucket, &it.opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 && !store.options.Warm {
+		return storage.WithContext(store.second).IterateContext(ctx, bucket, opts)
+	}
+	baseOpts := it.opts
+	if len(pending) > 0 {
+		baseOpts.Limit = 0
+	}
+	if it.base, err = storage.WithContext(store.second).IterateContext(ctx, bucket, &baseOpts); err != nil {
+		return nil, err
+	}
+	it.pending = pending
+	return it, nil
+}
+
+// pendingWrites returns the pending writes of a bucket within the options in listing order
+func (store *Storage) pendingWrites(bucket string, opts *common.ListOpts) ([]*write, error) {
+	if store.options.Mode != WriteBack {
+		return nil, nil
+	}
+	cursor, hasCursor, err := opts.CursorKey()
+	if err != nil {
+		return nil, err
+	}
+	store.mutex.Lock()
+	var writes []*write
+	for s, w := range store.pending {
+		if s.bucket != bucket || !opts.Match(s.key) {
+			continue
+		}
+		if hasCursor && (opts.Reverse && s.key >= cursor || !opts.Reverse && s.key <= cursor) {
+			continue
+		}
+		writes = append(writes, w)
+	}
+	store.mutex.Unlock()
+	sort.Slice(writes, func(i, j int) bool {
+		return before(writes[i].Key, writes[j].Key, opts.Reverse)
+	})
+	return writes, nil
+}
+
+// before compares keys in listing order
+func before(a, b string, reverse bool) bool {
+	if reverse {
+		return a > b
+	}
+	return a < b
+}
+
+func (it *mergeIterator) Next() bool {
+	it.doc = nil
+	if it.err != nil || (it.opts.Limit > 0 && it.count >= it.opts.Limit) {
+		return false
+	}
+	for {
+		if it.next == nil && it.base != nil {
+			if it.base.Next() {
+				it.next = it.base.Doc()
+			} else if it.err = it.base.Err(); it.err != nil {
+				return false
+			} else {
+				it.base.Close()
+				it.base = nil
+			}
+		}
+		var w *write
+		if len(it.pending) > 0 {
+			w = it.pending[0]
+		}
+		switch {
+		case w == nil && it.next == nil:
+			return false
+		case w == nil || (it.next != nil && before(it.next.Key, w.Key, it.opts.Reverse)):
+			it.doc, it.next = it.next, nil
+			it.warm(it.doc)
+		default:
+			it.pending = it.pending[1:]
+			if it.next != nil && it.next.Key == w.Key {
+				it.next = nil
+			}
+			if w.Delete || w.expired(it.now) {
+				continue
+			}
+			it.doc = &common.DocInfo{Key: w.Key}
+			if !it.opts.KeysOnly {
+				it.doc.Value = w.Value
+			}
+		}
+		it.count++
+		return true
+	}
+}
+
+// warm puts a doc read from the second level into the first one, unless a write to its key is pending
+func (it *mergeIterator) warm(doc *common.DocInfo) {
+	if !it.store.options.Warm || it.opts.KeysOnly {
+		return
+	}
+	store := it.store
+	store.forget(it.bucket, doc.Key)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.pending[slot{it.bucket, doc.Key}]; !ok {
+		store.fill(it.ctx, it.bucket, doc.Key, doc.Value)
+	}
+}
+
+func (it *mergeIterator) Doc() *common.DocInfo { return it.doc }
+func (it *mergeIterator) Err() error           { return it.err }
+
+func (it *mergeIterator) Close() error {
+	if it.base == nil {
+		return nil
+	}
+	err := it.base.Close()
+	it.base = nil
+	return err
+}
@@ -0,0 +1,415 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// maxFailures is the number of flushes a pending write may fail before it is moved aside
+const maxFailures = 3
+
+// write is a write of write-back mode which has not reached the second level yet
+type write struct {
+	Bucket  string           `json:"bucket"`
+	Key     string           `json:"key"`
+	Value   []byte           `json:"value"`
+	Delete  bool             `json:"delete,omitempty"`
+	Meta    *common.Metadata `json:"meta,omitempty"`
+	Expires *time.Time       `json:"expires,omitempty"`
+	// Batch numbers the writes of a committed batch, which reach the second level together. It is 0 for single writes.
+	Batch uint64 `json:"batch,omitempty"`
+	// failures counts the failed flushes of the write, it is guarded by the mutex of the storage
+	failures int
+}
+
+func (w *write) slot() slot {
+	return slot{w.Bucket, w.Key}
+}
+
+func (w *write) expired(now time.Time) bool {
+	return w.Expires != nil && !now.Before(*w.Expires)
+}
+
+// queue keeps the pending writes in a file, every line holds the writes of a Put, Delete or batch as JSON array
+// A line cut off by a crash is dropped, so a batch is either queued as a whole or not at all.
+type queue struct {
+	file *os.File
+	size int64
+}
+
+// openQueue opens a queue file and returns the writes left in it, the last one of a key wins
+func openQueue(path string) (*queue, []*write, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	var writes []*write
+	var valid int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		var batch []*write
+		if err = json.Unmarshal(line, &batch); err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("%v: corrupt queue entry at offset %v: %v", path, valid, err)
+		}
+		writes = append(writes, batch...)
+		valid += int64(len(line))
+	}
+	if err = f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return &queue{f, valid}, writes, nil
+}
+
+// append adds writes to the queue, they are on disk when it returns
+func (q *queue) append(writes []*write) error {
+	line, err := json.Marshal(writes)
+	if err != nil {
+		return err
+	}
+	if _, err = q.file.Write(append(line, '\n')); err != nil {
+		q.file.Truncate(q.size)
+		return err
+	}
+	q.size += int64(len(line)) + 1
+	return q.file.Sync()
+}
+
+// rewrite replaces the content of the queue with the given writes
+func (q *queue) rewrite(writes []*write) error {
+	if len(writes) == 0 {
+		if err := q.file.Truncate(0); err != nil {
+			return err
+		}
+		q.size = 0
+		return q.file.Sync()
+	}
+	line, err := json.Marshal(writes)
+	if err != nil {
+		return err
+	}
+	path := q.file.Name()
+	tmp := path + ".tmp"
+	if err = writeFile(tmp, append(line, '\n')); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	q.file.Close()
+	q.file, q.size = f, int64(len(line))+1
+	return nil
+}
+
+// writeFile writes data to a new file and flushes it to disk
+func writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// enqueue applies writes to the first level and queues them for the second level
+// Reads see the pending writes until they are flushed, even if the first level has dropped them.
+func (store *Storage) enqueue(first func() error, writes ...*write) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if len(writes) > 1 {
+		store.batches++
+		for _, w := range writes {
+			w.Batch = store.batches
+		}
+	}
+	if err := first(); err != nil {
+		return common.Error(common.WriteFailed, errors.New("first level fail"), err)
+	}
+	if store.queue != nil {
+		if err := store.queue.append(writes); err != nil {
+			// the first level must not serve a value the second level never gets
+			for _, w := range writes {
+				store.first.Delete(w.Bucket, w.Key)
+			}
+			return common.Error(common.WriteFailed, errors.New("queue fail"), err)
+		}
+	}
+	for _, w := range writes {
+		store.pending[w.slot()] = w
+	}
+	return nil
+}
+
+// pendingWrite returns the pending write of a key in write-back mode
+func (store *Storage) pendingWrite(bucket, key string) (*write, bool) {
+	if store.options.Mode != WriteBack {
+		return nil, false
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	w, ok := store.pending[slot{bucket, key}]
+	return w, ok
+}
+
+// settle flushes the pending writes if one of them is for the given key
+// It is called before operations which read the key from the second level.
+func (store *Storage) settle(bucket, key string) error {
+	if _, ok := store.pendingWrite(bucket, key); ok {
+		return store.Flush()
+	}
+	return nil
+}
+
+// discard drops the pending writes and remembered misses of a bucket
+func (store *Storage) discard(bucket string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for s := range store.misses {
+		if s.bucket == bucket {
+			delete(store.misses, s)
+		}
+	}
+	found := false
+	for s := range store.pending {
+		if s.bucket == bucket {
+			delete(store.pending, s)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return store.rewriteQueue()
+}
+
+// rewriteQueue replaces the queue with the pending writes, the caller must hold the lock
+func (store *Storage) rewriteQueue() error {
+	if store.queue == nil {
+		return nil
+	}
+	writes := make([]*write, 0, len(store.pending))
+	for _, w := range store.pending {
+		writes = append(writes, w)
+	}
+	return store.queue.rewrite(writes)
+}
+
+// Flush writes the pending writes of write-back mode to the second level
+// The writes of a committed batch are applied as one batch again, they succeed or fail together.
+// The other plain puts and deletes are applied as one batch, if it fails they are applied one by one.
+// Writes to the same keys made meanwhile stay pending, a key of a batch overwritten before the flush
+// reaches the second level with the later write. A write failing maxFailures flushes is moved to the
+// dead letter file next to the queue and dropped from the first level, so it does not hold back the others.
+func (store *Storage) Flush() error {
+	store.flushMutex.Lock()
+	defer store.flushMutex.Unlock()
+	store.mutex.Lock()
+	writes := make([]*write, 0, len(store.pending))
+	for _, w := range store.pending {
+		writes = append(writes, w)
+	}
+	store.mutex.Unlock()
+	if len(writes) == 0 {
+		return nil
+	}
+	failed := store.apply(writes)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var dead []*write
+	for _, w := range writes {
+		if store.pending[w.slot()] != w {
+			continue
+		}
+		if _, ok := failed[w]; !ok {
+			delete(store.pending, w.slot())
+			continue
+		}
+		if w.failures++; w.failures >= maxFailures {
+			dead = append(dead, w)
+		}
+	}
+	if len(dead) > 0 {
+		if err := store.deadLetter(dead, failed); err != nil {
+			return common.Error(common.WriteFailed, errors.New("dead letter fail"), err)
+		}
+		for _, w := range dead {
+			delete(store.pending, w.slot())
+			// the first level must not serve a value the second level never gets
+			if err := store.first.Delete(w.Bucket, w.Key); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	if err := store.rewriteQueue(); err != nil {
+		return common.Error(common.WriteFailed, errors.New("queue fail"), err)
+	}
+	for _, err := range failed {
+		return common.Error(common.WriteFailed, fmt.Errorf("second level fail for %v of %v writes", len(failed), len(writes)), err)
+	}
+	return nil
+}
+
+// apply writes to the second level and returns the writes which failed
+func (store *Storage) apply(writes []*write) map[*write]error {
+	now := time.Now()
+	failed := make(map[*write]error)
+	batch := storage.NewBatch(store.second)
+	batches := make(map[uint64]storage.Batch)
+	var plain, single []*write
+	for _, w := range writes {
+		if w.Batch != 0 {
+			b, ok := batches[w.Batch]
+			if !ok {
+				b = storage.NewBatch(store.second)
+				batches[w.Batch] = b
+			}
+			if w.Delete || w.expired(now) {
+				b.Delete(w.Bucket, w.Key)
+			} else {
+				b.Put(w.Bucket, w.Key, w.Value)
+			}
+			continue
+		}
+		if w.Meta != nil || (w.Expires != nil && !w.expired(now)) {
+			single = append(single, w)
+			continue
+		}
+		plain = append(plain, w)
+		if w.Delete || w.expired(now) {
+			batch.Delete(w.Bucket, w.Key)
+		} else {
+			batch.Put(w.Bucket, w.Key, w.Value)
+		}
+	}
+	if len(plain) > 0 && batch.Commit() != nil {
+		// a single bad write fails the whole batch, the others must get through
+		single = append(single, plain...)
+	}
+	for id, b := range batches {
+		if err := b.Commit(); err != nil {
+			for _, w := range writes {
+				if w.Batch == id {
+					failed[w] = err
+				}
+			}
+		}
+	}
+	for _, w := range single {
+		if err := store.applyWrite(w, now); err != nil {
+			failed[w] = err
+		}
+	}
+	return failed
+}
+
+// applyWrite writes a single pending write to the second level
+func (store *Storage) applyWrite(w *write, now time.Time) error {
+	switch {
+	case w.Delete || w.expired(now):
+		return store.second.Delete(w.Bucket, w.Key)
+	case w.Expires != nil:
+		return store.second.(storage.TTLStorage).PutWithTTL(w.Bucket, w.Key, w.Value, w.Expires.Sub(now))
+	case w.Meta != nil:
+		return store.second.(storage.MetaStorage).PutWithMeta(w.Bucket, w.Key, w.Value, w.Meta)
+	}
+	return store.second.Put(w.Bucket, w.Key, w.Value)
+}
+
+// deadLetter logs writes which are given up and appends them to the dead letter file of the queue,
+// which has the format of the queue. The caller must hold the lock.
+func (store *Storage) deadLetter(writes []*write, failed map[*write]error) error {
+	for _, w := range writes {
+		log.Printf("cache: giving up on the write of %v/%v after %v failed flushes: %v", w.Bucket, w.Key, w.failures, failed[w])
+	}
+	if store.queue == nil {
+		return nil
+	}
+	line, err := json.Marshal(writes)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(store.queue.file.Name()+".failed", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// flushInBackground flushes the pending writes every FlushInterval until the returned stop function is called
+func (store *Storage) flushInBackground() (stop func()) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(store.options.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := store.Flush(); err != nil {
+					log.Print(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// closeQueue closes the queue file, the pending writes have been flushed before
+func (store *Storage) closeQueue() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.queue == nil {
+		return nil
+	}
+	err := store.queue.file.Close()
+	store.queue = nil
+	return err
+}
@@ -0,0 +1,726 @@
+package chunked
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// DefaultThreshold is the size above which values are split into chunks if no threshold is given
+const DefaultThreshold = 1 << 20
+
+// ChunkSuffix is appended to the name of a bucket to get the bucket holding its chunks
+// Buckets with this suffix are hidden by ListBuckets.
+const ChunkSuffix = "~chunks"
+
+// the first byte of each value saved in the base storage tells how the rest is to be read
+const (
+	inlineValue   byte = 0
+	manifestValue byte = 1
+)
+
+// Storage wraps another storage and splits values larger than a threshold into chunks.
+// Small values are saved inline, large values as a manifest naming their chunks, which are
+// kept in a companion bucket. Values written to the base storage without the wrapper can not be
+// read through it. Concurrent writes to the same key may leave unreferenced chunks behind.
+type Storage struct {
+	base      storage.Storage
+	threshold int
+}
+
+// NewStorage creates a new chunking storage around base
+// Values larger than threshold are split into chunks of threshold bytes.
+func NewStorage(base storage.Storage, threshold int) (*Storage, error) {
+	if threshold <= 0 {
+		threshold = DefaultThreshold
+	}
+	return &Storage{base: base, threshold: threshold}, nil
+}
+
+// manifest lists the chunks of a value, their keys contain the id of the write
+// so a new value never overwrites the chunks of the current one.
+type manifest struct {
+	ID     string `json:"id"`
+	Chunks int    `json:"chunks"`
+	Size   int64  `json:"size"`
+}
+
+func newManifest() *manifest {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &manifest{ID: hex.EncodeToString(id)}
+}
+
+func (m *manifest) chunkKey(key string, i int) string {
+	return fmt.Sprintf("%s.%s.%08d", key, m.ID, i)
+}
+
+func (m *manifest) bytes() []byte {
+	bs, _ := json.Marshal(m)
+	return append([]byte{manifestValue}, bs...)
+}
+
+// kv is the part of Storage and Tx the chunks are read and written with
+type kv interface {
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+}
+
+// parse splits a value of the base storage into the inline value or the manifest
+func parse(raw []byte) ([]byte, *manifest, error) {
+	if len(raw) == 0 {
+		return []byte{}, nil, nil
+	}
+	switch raw[0] {
+	case inlineValue:
+		return raw[1:], nil, nil
+	case manifestValue:
+		m := &manifest{}
+		if err := json.Unmarshal(raw[1:], m); err != nil {
+			return nil, nil, common.Error(common.ReadFailed, err)
+		}
+		return nil, m, nil
+	}
+	return nil, nil, common.Error(common.ReadFailed, errors.New("malformed value"))
+}
+
+// encode saves the chunks of a large value and returns what is saved under the key itself
+func (store *Storage) encode(db kv, bucket, key string, value []byte) ([]byte, error) {
+	if len(value) <= store.threshold {
+		return append([]byte{inlineValue}, value...), nil
+	}
+	m := newManifest()
+	m.Size = int64(len(value))
+	for offset := 0; offset < len(value); offset += store.threshold {
+		end := offset + store.threshold
+		if end > len(value) {
+			end = len(value)
+		}
+		if err := db.Put(bucket+ChunkSuffix, m.chunkKey(key, m.Chunks), value[offset:end]); err != nil {
+			drop(db, bucket, key, m.bytes())
+			return nil, err
+		}
+		m.Chunks++
+	}
+	return m.bytes(), nil
+}
+
+// decode returns the value saved as raw, the chunks of a large value are loaded from db
+func decode(db kv, bucket, key string, raw []byte) ([]byte, error) {
+	value, m, err := parse(raw)
+	if err != nil || m == nil {
+		return value, err
+	}
+	buf := &bytes.Buffer{}
+	for i := 0; i < m.Chunks; i++ {
+		chunk, err := db.Get(bucket+ChunkSuffix, m.chunkKey(key, i))
+		if err != nil {
+			return nil, common.Error(common.ReadFailed, err)
+		}
+		buf.Write(chunk)
+	}
+	return buf.Bytes(), nil
+}
+
+// drop deletes the chunks of the value saved as raw
+// Errors are ignored, leftover chunks only waste space.
+func drop(db kv, bucket, key string, raw []byte) {
+	_, m, err := parse(raw)
+	if err != nil || m == nil {
+		return
+	}
+	for i := 0; i < m.Chunks; i++ {
+		db.Delete(bucket+ChunkSuffix, m.chunkKey(key, i))
+	}
+}
+
+// size returns the size of the value saved as raw
+func size(raw []byte) (int64, error) {
+	value, m, err := parse(raw)
+	if err != nil {
+		return 0, err
+	}
+	if m != nil {
+		return m.Size, nil
+	}
+	return int64(len(value)), nil
+}
+
+// raw returns the value of key as saved in db or nil if it can not be read
+func raw(db kv, bucket, key string) []byte {
+	val, err := db.Get(bucket, key)
+	if err != nil {
+		return nil
+	}
+	return val
+}
+
+// Put saves a byteslice to the db.
+// Example: Save("/foo/bar", []byte{1,2,3})
+func (store *Storage) Put(bucket, key string, value []byte) error {
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	old := raw(store.base, bucket, key)
+	encoded, err := store.encode(store.base, bucket, key, value)
+	if err != nil {
+		return err
+	}
+	if err = storage.WithContext(store.base).PutContext(ctx, bucket, key, encoded); err != nil {
+		drop(store.base, bucket, key, encoded)
+		return err
+	}
+	drop(store.base, bucket, key, old)
+	return nil
+}
+
+// Get loads data from a key
+func (store *Storage) Get(bucket, key string) ([]byte, error) {
+	return store.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	val, err := storage.WithContext(store.base).GetContext(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return decode(store.base, bucket, key, val)
+}
+
+// Delete deletes a value from the db
+func (store *Storage) Delete(bucket, key string) error {
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	old := raw(store.base, bucket, key)
+	if err := storage.WithContext(store.base).DeleteContext(ctx, bucket, key); err != nil {
+		return err
+	}
+	drop(store.base, bucket, key, old)
+	return nil
+}
+
+// CreateBucket creates a bucket
+func (store *Storage) CreateBucket(bucket string) error {
+	return store.CreateBucketContext(context.Background(), bucket)
+}
+
+// CreateBucketContext creates a bucket and the bucket holding its chunks
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	if err := storage.WithContext(store.base).CreateBucketContext(ctx, bucket); err != nil {
+		return err
+	}
+	return storage.WithContext(store.base).CreateBucketContext(ctx, bucket+ChunkSuffix)
+}
+
+// DeleteBucket deletes a bucket
+func (store *Storage) DeleteBucket(bucket string) error {
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket and all its chunks
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	if err := storage.WithContext(store.base).DeleteBucketContext(ctx, bucket); err != nil {
+		return err
+	}
+	err := storage.WithContext(store.base).DeleteBucketContext(ctx, bucket+ChunkSuffix)
+	if err != nil && !common.IsError(err, common.BucketNotFound) {
+		return err
+	}
+	return nil
+}
+
+// ListBuckets returns the names of all buckets, the buckets holding chunks are skipped
+func (store *Storage) ListBuckets() ([]string, error) {
+	names, err := store.base.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	buckets := []string{}
+	for _, name := range names {
+		if !strings.HasSuffix(name, ChunkSuffix) {
+			buckets = append(buckets, name)
+		}
+	}
+	return buckets, nil
+}
+
+// List returns all Entries of a directory
+// optionally provide arguments to specifiy a key offset and a key limit
+// Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
+func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return store.ListContext(context.Background(), bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.IterateContext(ctx, bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(ctx, iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+// The chunks of large values are loaded by Next.
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	keysOnly := opts != nil && opts.KeysOnly
+	if keysOnly && opts.WithMeta {
+		// the size of a value is only known from what is saved under its key
+		withValues := *opts
+		withValues.KeysOnly = false
+		opts = &withValues
+	}
+	iter, err := storage.WithContext(store.base).IterateContext(ctx, bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &docIterator{Iterator: iter, store: store, bucket: bucket, keysOnly: keysOnly}, nil
+}
+
+// Count returns the number of entries of a bucket
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	return store.base.Count(bucket, opts)
+}
+
+type docIterator struct {
+	common.Iterator
+	store    *Storage
+	bucket   string
+	keysOnly bool
+	doc      *common.DocInfo
+	err      error
+}
+
+func (it *docIterator) Next() bool {
+	it.doc = nil
+	if it.err != nil || !it.Iterator.Next() {
+		return false
+	}
+	doc := it.Iterator.Doc()
+	var meta *common.Metadata
+	if doc.Meta != nil {
+		meta = &common.Metadata{}
+		*meta = *doc.Meta
+		var err error
+		if meta.Size, err = size(doc.Value); err != nil {
+			it.err = err
+			return false
+		}
+	}
+	if it.keysOnly {
+		it.doc = &common.DocInfo{Key: doc.Key, Meta: meta}
+		return true
+	}
+	val, err := decode(it.store.base, it.bucket, doc.Key, doc.Value)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.doc = &common.DocInfo{Key: doc.Key, Value: val, Meta: meta}
+	return true
+}
+
+func (it *docIterator) Doc() *common.DocInfo {
+	return it.doc
+}
+
+func (it *docIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.Iterator.Err()
+}
+
+// NewBatch creates a batch which saves the chunks of large values before committing a batch of the base storage
+// If the base batch fails, the chunks saved for it are removed again.
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+func (b *batch) Commit() error {
+	base := storage.NewBatch(b.store.base)
+	olds := make([][]byte, len(b.Ops))
+	encoded := make([][]byte, len(b.Ops))
+	for i, op := range b.Ops {
+		olds[i] = raw(b.store.base, op.Bucket, op.Key)
+		if op.Delete {
+			base.Delete(op.Bucket, op.Key)
+			continue
+		}
+		val, err := b.store.encode(b.store.base, op.Bucket, op.Key, op.Value)
+		if err != nil {
+			b.drop(encoded)
+			return err
+		}
+		encoded[i] = val
+		base.Put(op.Bucket, op.Key, val)
+	}
+	if err := base.Commit(); err != nil {
+		b.drop(encoded)
+		return err
+	}
+	b.drop(olds)
+	return nil
+}
+
+// drop removes the chunks of the given values of the operations
+func (b *batch) drop(values [][]byte) {
+	for i, val := range values {
+		if val != nil {
+			drop(b.store.base, b.Ops[i].Bucket, b.Ops[i].Key, val)
+		}
+	}
+}
+
+// Begin starts a transaction of the base storage, chunks are written within the transaction
+func (store *Storage) Begin() (storage.Tx, error) {
+	s, ok := store.base.(storage.Transactional)
+	if !ok {
+		return nil, common.Error(common.Unsupported)
+	}
+	base, err := s.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &tx{Tx: base, store: store}, nil
+}
+
+type tx struct {
+	storage.Tx
+	store *Storage
+}
+
+func (t *tx) Get(bucket, key string) ([]byte, error) {
+	val, err := t.Tx.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return decode(t.Tx, bucket, key, val)
+}
+
+func (t *tx) Put(bucket, key string, value []byte) error {
+	old := raw(t.Tx, bucket, key)
+	encoded, err := t.store.encode(t.Tx, bucket, key, value)
+	if err != nil {
+		return err
+	}
+	if err = t.Tx.Put(bucket, key, encoded); err != nil {
+		return err
+	}
+	drop(t.Tx, bucket, key, old)
+	return nil
+}
+
+func (t *tx) Delete(bucket, key string) error {
+	old := raw(t.Tx, bucket, key)
+	if err := t.Tx.Delete(bucket, key); err != nil {
+		return err
+	}
+	drop(t.Tx, bucket, key, old)
+	return nil
+}
+
+func (t *tx) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	ch, err := t.Tx.List(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]*common.DocInfo, 0)
+	for doc := range ch {
+		val, err := decode(t.Tx, bucket, doc.Key, doc.Value)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, &common.DocInfo{Key: doc.Key, Value: val})
+	}
+	return common.DocChannel(docs), nil
+}
+
+// CompareAndSwap saves new if the current value of key equals old
+// The base storage compares the saved manifest, which is unique for each large value.
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	s, ok := store.base.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	current, val, err := store.current(bucket, key)
+	if err != nil || !common.Equal(val, old) {
+		return false, err
+	}
+	encoded, err := store.encode(store.base, bucket, key, new)
+	if err != nil {
+		return false, err
+	}
+	var swapped bool
+	if current == nil {
+		swapped, err = s.PutIfAbsent(bucket, key, encoded)
+	} else {
+		swapped, err = s.CompareAndSwap(bucket, key, current, encoded)
+	}
+	if !swapped {
+		drop(store.base, bucket, key, encoded)
+		return false, err
+	}
+	drop(store.base, bucket, key, current)
+	return true, err
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return store.CompareAndSwap(bucket, key, nil, value)
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	s, ok := store.base.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	current, val, err := store.current(bucket, key)
+	if err != nil || old == nil || !common.Equal(val, old) {
+		return false, err
+	}
+	deleted, err := s.DeleteIfEquals(bucket, key, current)
+	if deleted {
+		drop(store.base, bucket, key, current)
+	}
+	return deleted, err
+}
+
+// current returns the saved and the decoded value of key, both are nil if it does not exist
+func (store *Storage) current(bucket, key string) ([]byte, []byte, error) {
+	current := raw(store.base, bucket, key)
+	if current == nil {
+		return nil, nil, nil
+	}
+	val, err := decode(store.base, bucket, key, current)
+	return current, val, err
+}
+
+// PutWithTTL saves a byteslice which expires after ttl, its chunks expire as well
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	s, ok := store.base.(storage.TTLStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	old := raw(store.base, bucket, key)
+	encoded, err := store.encode(&expiring{Storage: store.base, ttl: ttl}, bucket, key, value)
+	if err != nil {
+		return err
+	}
+	if err = s.PutWithTTL(bucket, key, encoded, ttl); err != nil {
+		drop(store.base, bucket, key, encoded)
+		return err
+	}
+	drop(store.base, bucket, key, old)
+	return nil
+}
+
+// expiring saves chunks with a TTL
+type expiring struct {
+	storage.Storage
+	ttl time.Duration
+}
+
+func (e *expiring) Put(bucket, key string, value []byte) error {
+	return e.Storage.(storage.TTLStorage).PutWithTTL(bucket, key, value, e.ttl)
+}
+
+// PutReader saves everything read from r, chunk by chunk if it is larger than the threshold
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	buf := make([]byte, store.threshold)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return store.Put(bucket, key, buf[:n])
+	}
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	old := raw(store.base, bucket, key)
+	m := newManifest()
+	for n > 0 {
+		m.Size += int64(n)
+		if err = store.base.Put(bucket+ChunkSuffix, m.chunkKey(key, m.Chunks), buf[:n]); err != nil {
+			break
+		}
+		m.Chunks++
+		// the base storage may keep the slice, so each chunk gets its own buffer
+		buf = make([]byte, store.threshold)
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			err = common.Error(common.WriteFailed, err)
+			break
+		}
+	}
+	if err == nil {
+		err = store.base.Put(bucket, key, m.bytes())
+	}
+	if err != nil {
+		drop(store.base, bucket, key, m.bytes())
+		return err
+	}
+	drop(store.base, bucket, key, old)
+	return nil
+}
+
+// GetReader opens a value for reading, the chunks of a large value are loaded while reading
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	val, err := store.base.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	value, m, err := parse(val)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return ioutil.NopCloser(bytes.NewReader(value)), nil
+	}
+	return &chunkReader{base: store.base, m: m, bucket: bucket, key: key}, nil
+}
+
+type chunkReader struct {
+	base   storage.Storage
+	m      *manifest
+	bucket string
+	key    string
+	next   int
+	buf    []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next >= r.m.Chunks {
+			return 0, io.EOF
+		}
+		chunk, err := r.base.Get(r.bucket+ChunkSuffix, r.m.chunkKey(r.key, r.next))
+		if err != nil {
+			return 0, common.Error(common.ReadFailed, err)
+		}
+		r.buf = chunk
+		r.next++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.next = r.m.Chunks
+	r.buf = nil
+	return nil
+}
+
+// PutWithMeta saves a byteslice along with its metadata, the base storage must keep metadata
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	s, ok := store.base.(storage.MetaStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	old := raw(store.base, bucket, key)
+	encoded, err := store.encode(store.base, bucket, key, value)
+	if err != nil {
+		return err
+	}
+	if err = s.PutWithMeta(bucket, key, encoded, meta); err != nil {
+		drop(store.base, bucket, key, encoded)
+		return err
+	}
+	drop(store.base, bucket, key, old)
+	return nil
+}
+
+// Stat returns the metadata of a key, the size is the one of the whole value
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	meta, err := storage.Stat(store.base, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	val, err := store.base.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Size, err = size(val); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Watch streams the changes of the base storage with the values decoded
+// The value of an event is nil if its chunks have been replaced before it is decoded.
+func (store *Storage) Watch(ctx context.Context, bucket, prefix string) (<-chan *common.Event, error) {
+	s, ok := store.base.(storage.Watcher)
+	if !ok {
+		return nil, common.Error(common.Unsupported)
+	}
+	events, err := s.Watch(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *common.Event, 64)
+	go func() {
+		defer close(ch)
+		for event := range events {
+			if event.Value != nil {
+				decoded := *event
+				decoded.Value, _ = decode(store.base, event.Bucket, event.Key, event.Value)
+				event = &decoded
+			}
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Snapshot returns a read-only view as it is now, which reassembles the chunks from a snapshot of the base storage
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	s, ok := store.base.(storage.Snapshotter)
+	if !ok {
+		return nil, common.Error(common.Unsupported)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{base: snap, threshold: store.threshold}, nil
+}
+
+// Close closes the base storage
+func (store *Storage) Close() error {
+	return store.base.Close()
+}
@@ -0,0 +1,61 @@
+package chunked
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/common"
+	"github.com/trusch/storage/engines/memory"
+	"github.com/trusch/storage/testsuite"
+)
+
+type StorageSuite struct {
+	testsuite.Suite
+}
+
+func TestChunkedStorage(t *testing.T) {
+	base, err := memory.NewStorage()
+	assert.NoError(t, err)
+	// a small threshold makes the large values of the testsuite span many chunks
+	store, err := NewStorage(base, 1<<10)
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
+func TestChunksAreRemoved(t *testing.T) {
+	base, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorage(base, 4)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	chunks := func() int {
+		n, err := base.Count("bucket-name"+ChunkSuffix, nil)
+		assert.NoError(t, err)
+		return n
+	}
+	assert.NoError(t, store.Put("bucket-name", "foo", []byte("0123456789")))
+	assert.Equal(t, 3, chunks())
+	val, err := store.Get("bucket-name", "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789", string(val))
+	assert.NoError(t, store.Put("bucket-name", "foo", []byte("01234")))
+	assert.Equal(t, 2, chunks())
+	assert.NoError(t, store.Put("bucket-name", "foo", []byte("0")))
+	assert.Equal(t, 0, chunks())
+	assert.NoError(t, store.Put("bucket-name", "foo", []byte("0123456789")))
+	assert.NoError(t, store.Delete("bucket-name", "foo"))
+	assert.Equal(t, 0, chunks())
+	assert.NoError(t, store.Put("bucket-name", "foo", []byte("0123456789")))
+	assert.NoError(t, store.DeleteBucket("bucket-name"))
+	_, err = base.Count("bucket-name"+ChunkSuffix, nil)
+	assert.True(t, common.IsError(err, common.BucketNotFound))
+	buckets, err := store.ListBuckets()
+	assert.NoError(t, err)
+	assert.Empty(t, buckets)
+}
@@ -0,0 +1,306 @@
+package codec
+
+import (
+	"context"
+	"time"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// Codec transforms values on their way to and from the base storage
+type Codec interface {
+	// Encode returns the representation of value which is saved in the base storage
+	Encode(value []byte) ([]byte, error)
+	// Decode returns the value of a representation created by Encode
+	Decode(raw []byte) ([]byte, error)
+}
+
+// Storage compresses or encrypts the values of another storage with a Codec.
+// Bucket names and keys are passed on unchanged. Metadata reports the size of the decoded values.
+type Storage struct {
+	base  storage.Storage
+	codec Codec
+}
+
+// NewStorage creates a new storage encoding the values saved in base with codec
+func NewStorage(base storage.Storage, codec Codec) (*Storage, error) {
+	return &Storage{base, codec}, nil
+}
+
+func (store *Storage) decode(raw []byte) ([]byte, error) {
+	val, err := store.codec.Decode(raw)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return val, nil
+}
+
+// Put saves a byteslice to the db.
+// Example: Save("/foo/bar", []byte{1,2,3})
+func (store *Storage) Put(bucket, key string, value []byte) error {
+	raw, err := store.codec.Encode(value)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return store.base.Put(bucket, key, raw)
+}
+
+// Get loads data from a key
+func (store *Storage) Get(bucket, key string) ([]byte, error) {
+	raw, err := store.base.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return store.decode(raw)
+}
+
+// Delete deletes a value from the db
+func (store *Storage) Delete(bucket, key string) error {
+	return store.base.Delete(bucket, key)
+}
+
+// CreateBucket creates a bucket
+func (store *Storage) CreateBucket(bucket string) error {
+	return store.base.CreateBucket(bucket)
+}
+
+// DeleteBucket deletes a bucket
+func (store *Storage) DeleteBucket(bucket string) error {
+	return store.base.DeleteBucket(bucket)
+}
+
+// ListBuckets returns the names of all buckets
+func (store *Storage) ListBuckets() ([]string, error) {
+	return store.base.ListBuckets()
+}
+
+// List returns all Entries of a directory
+// optionally provide arguments to specifiy a key offset and a key limit
+// Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
+func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.Iterate(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(context.Background(), iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket, the values are decoded by Next
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	keysOnly := opts != nil && opts.KeysOnly
+	if keysOnly && opts.WithMeta {
+		// the size of a value is only known once it is decoded
+		withValues := *opts
+		withValues.KeysOnly = false
+		opts = &withValues
+	}
+	iter, err := store.base.Iterate(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &docIterator{Iterator: iter, store: store, keysOnly: keysOnly}, nil
+}
+
+// Count returns the number of entries of a bucket
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	return store.base.Count(bucket, opts)
+}
+
+type docIterator struct {
+	common.Iterator
+	store    *Storage
+	keysOnly bool
+	doc      *common.DocInfo
+	err      error
+}
+
+func (it *docIterator) Next() bool {
+	it.doc = nil
+	if it.err != nil || !it.Iterator.Next() {
+		return false
+	}
+	doc := it.Iterator.Doc()
+	if it.keysOnly && doc.Meta == nil {
+		it.doc = &common.DocInfo{Key: doc.Key}
+		return true
+	}
+	val, err := it.store.decode(doc.Value)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.doc = &common.DocInfo{Key: doc.Key, Value: val}
+	if doc.Meta != nil {
+		meta := *doc.Meta
+		meta.Size = int64(len(val))
+		it.doc.Meta = &meta
+	}
+	if it.keysOnly {
+		it.doc.Value = nil
+	}
+	return true
+}
+
+func (it *docIterator) Doc() *common.DocInfo {
+	return it.doc
+}
+
+func (it *docIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.Iterator.Err()
+}
+
+// NewBatch creates a batch of the base storage which encodes the values put into it
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{base: storage.NewBatch(store.base), store: store}
+}
+
+type batch struct {
+	base  storage.Batch
+	store *Storage
+	err   error
+}
+
+func (b *batch) Put(bucket, key string, value []byte) {
+	raw, err := b.store.codec.Encode(value)
+	if err != nil && b.err == nil {
+		b.err = common.Error(common.WriteFailed, err)
+	}
+	b.base.Put(bucket, key, raw)
+}
+
+func (b *batch) Delete(bucket, key string) {
+	b.base.Delete(bucket, key)
+}
+
+func (b *batch) Commit() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.base.Commit()
+}
+
+// CompareAndSwap saves new if the decoded value of key equals old
+// The encoded value read for the comparison is swapped in the base storage, so the swap is atomic
+// even though encrypted values differ from write to write.
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	s, ok := store.base.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	if old == nil {
+		return store.PutIfAbsent(bucket, key, new)
+	}
+	raw, err := store.current(bucket, key, old)
+	if err != nil || raw == nil {
+		return false, err
+	}
+	encoded, err := store.codec.Encode(new)
+	if err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	return s.CompareAndSwap(bucket, key, raw, encoded)
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	s, ok := store.base.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	raw, err := store.codec.Encode(value)
+	if err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	return s.PutIfAbsent(bucket, key, raw)
+}
+
+// DeleteIfEquals deletes key if its decoded value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	s, ok := store.base.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	raw, err := store.current(bucket, key, old)
+	if err != nil || raw == nil {
+		return false, err
+	}
+	return s.DeleteIfEquals(bucket, key, raw)
+}
+
+// current returns the encoded value of key if its decoded value equals old, nil otherwise
+func (store *Storage) current(bucket, key string, old []byte) ([]byte, error) {
+	raw, err := store.base.Get(bucket, key)
+	if common.IsError(err, common.ReadFailed) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	val, err := store.decode(raw)
+	if err != nil || !common.Equal(val, old) {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// PutWithMeta saves an encoded value along with its metadata in the base storage
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	s, ok := store.base.(storage.MetaStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	raw, err := store.codec.Encode(value)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return s.PutWithMeta(bucket, key, raw, meta)
+}
+
+// Stat returns the metadata of a key, the value is loaded and decoded to report its size
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	meta, err := storage.Stat(store.base, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	val, err := store.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	meta.Size = int64(len(val))
+	return meta, nil
+}
+
+// PutWithTTL saves an encoded value which expires after ttl in the base storage
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	s, ok := store.base.(storage.TTLStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	raw, err := store.codec.Encode(value)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return s.PutWithTTL(bucket, key, raw, ttl)
+}
+
+// Snapshot returns a read-only view of the base storage which decodes the values
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	s, ok := store.base.(storage.Snapshotter)
+	if !ok {
+		return nil, common.Error(common.Unsupported)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{base: snap, codec: store.codec}, nil
+}
+
+// Close closes the base storage
+func (store *Storage) Close() error {
+	return store.base.Close()
+}
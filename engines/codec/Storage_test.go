@@ -0,0 +1,67 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/engines/memory"
+	"github.com/trusch/storage/testsuite"
+)
+
+type StorageSuite struct {
+	testsuite.Suite
+}
+
+func TestCodecStorage(t *testing.T) {
+	gz, err := Gzip(gzip.DefaultCompression)
+	assert.NoError(t, err)
+	key := bytes.Repeat([]byte{1}, 32)
+	aes, err := AES(key)
+	assert.NoError(t, err)
+	for name, codec := range map[string]Codec{"gzip": gz, "snappy": Snappy(), "aes": aes} {
+		t.Run(name, func(t *testing.T) {
+			base, err := memory.NewStorage()
+			assert.NoError(t, err)
+			store, err := NewStorage(base, codec)
+			assert.NoError(t, err)
+			s := &StorageSuite{}
+			s.Store = store
+			suite.Run(t, s)
+			assert.NoError(t, store.Close())
+		})
+	}
+}
+
+func TestValuesAreEncoded(t *testing.T) {
+	base, err := memory.NewStorage()
+	assert.NoError(t, err)
+	aes, err := AES(bytes.Repeat([]byte{1}, 16))
+	assert.NoError(t, err)
+	store, err := NewStorage(base, aes)
+	assert.NoError(t, err)
+	defer store.Close()
+	value := bytes.Repeat([]byte("secret "), 100)
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	assert.NoError(t, store.Put("bucket-name", "key", value))
+	raw, err := base.Get("bucket-name", "key")
+	assert.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret")))
+
+	other, err := AES(bytes.Repeat([]byte{2}, 16))
+	assert.NoError(t, err)
+	_, err = (&Storage{base, other}).Get("bucket-name", "key")
+	assert.Error(t, err, "a wrong key is detected")
+
+	store.codec = Snappy()
+	assert.NoError(t, store.Put("bucket-name", "key", value))
+	raw, err = base.Get("bucket-name", "key")
+	assert.NoError(t, err)
+	assert.True(t, len(raw) < len(value)/10)
+	assert.NoError(t, store.Put("bucket-name", "short", []byte("x")))
+	raw, err = base.Get("bucket-name", "short")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{plain, 'x'}, raw)
+}
@@ -0,0 +1,124 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// compressed values start with a byte telling whether the rest is compressed,
+// values which do not get smaller are saved as they are
+const (
+	plain      = 0
+	compressed = 1
+)
+
+type compressor struct {
+	compress   func(value []byte) ([]byte, error)
+	decompress func(data []byte) ([]byte, error)
+}
+
+func (c *compressor) Encode(value []byte) ([]byte, error) {
+	data, err := c.compress(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= len(value) {
+		return append([]byte{plain}, value...), nil
+	}
+	return append([]byte{compressed}, data...), nil
+}
+
+func (c *compressor) Decode(raw []byte) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("missing compression header")
+	}
+	switch raw[0] {
+	case plain:
+		return raw[1:], nil
+	case compressed:
+		return c.decompress(raw[1:])
+	}
+	return nil, errors.New("unknown compression header")
+}
+
+// Gzip returns a codec compressing values with gzip at the given level, see compress/gzip
+func Gzip(level int) (Codec, error) {
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	return &compressor{
+		compress: func(value []byte) ([]byte, error) {
+			buf := &bytes.Buffer{}
+			w, _ := gzip.NewWriterLevel(buf, level)
+			if _, err := w.Write(value); err != nil {
+				return nil, err
+			}
+			if err := w.Close(); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		},
+		decompress: func(data []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		},
+	}, nil
+}
+
+// Snappy returns a codec compressing values with snappy, which is faster but compresses less than gzip
+func Snappy() Codec {
+	return &compressor{
+		compress: func(value []byte) ([]byte, error) {
+			return snappy.Encode(nil, value), nil
+		},
+		decompress: func(data []byte) ([]byte, error) {
+			return snappy.Decode(nil, data)
+		},
+	}
+}
+
+type aesCodec struct {
+	aead cipher.AEAD
+}
+
+// AES returns a codec encrypting values with AES-GCM, key must be 16, 24 or 32 bytes long
+// Every value gets a random nonce, which is saved in front of it.
+func AES(key []byte) (Codec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesCodec{aead}, nil
+}
+
+func (c *aesCodec) Encode(value []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, value, nil), nil
+}
+
+func (c *aesCodec) Decode(raw []byte) ([]byte, error) {
+	size := c.aead.NonceSize()
+	if len(raw) < size {
+		return nil, errors.New("encrypted value too short")
+	}
+	return c.aead.Open(nil, raw[:size], raw[size:], nil)
+}
@@ -1,44 +1,136 @@
 package file
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/trusch/storage"
 	"github.com/trusch/storage/common"
 )
 
+// journalName is the file in the base directory holding a batch while it is applied
+const journalName = ".batch-journal"
+
+// expiryDir is the directory in the base directory holding the deadlines of keys with a TTL
+const expiryDir = ".expiry"
+
+// metaDir is the directory in the base directory holding the JSON encoded metadata of the values
+const metaDir = ".meta"
+
+// uploadPrefix prefixes the temporary files in the base directory which PutReader writes to
+const uploadPrefix = ".upload-"
+
 // Storage creates the apropriate store from an URI
 type Storage struct {
-	base string
+	base       string
+	options    Options
+	mutex      sync.Mutex
+	stopReaper func()
 }
 
+// Options tune a file storage
+type Options struct {
+	// Fsync flushes every written file to disk before a write returns
+	Fsync bool
+	// Perm is the permission of written files, directories get the execute bits where files are readable
+	Perm os.FileMode
+}
+
+// DefaultOptions are the options NewStorage uses
+var DefaultOptions = Options{Perm: 0600}
+
 // NewStorage creates a new storage from a URI
+// A batch journal left over by a crash is replayed, unfinished uploads are removed.
 func NewStorage(base string) (*Storage, error) {
-	err := os.MkdirAll(base, 0700)
+	return NewStorageWithOptions(base, DefaultOptions)
+}
+
+// NewStorageWithOptions creates a new storage with the given options
+func NewStorageWithOptions(base string, options Options) (*Storage, error) {
+	if options.Perm == 0 {
+		options.Perm = DefaultOptions.Perm
+	}
+	store := &Storage{base: base, options: options}
+	err := os.MkdirAll(base, store.dirPerm())
 	if err != nil {
 		return nil, err
 	}
-	return &Storage{base}, nil
+	if err = store.replayJournal(); err != nil {
+		return nil, common.Error(common.InitFailed, err)
+	}
+	uploads, _ := filepath.Glob(filepath.Join(base, uploadPrefix+"*"))
+	for _, path := range uploads {
+		os.Remove(path)
+	}
+	store.stopReaper = common.StartReaper(store.reap)
+	return store, nil
 }
 
 // Put saves a byteslice to the db.
 // Example: Save("/foo/bar", []byte{1,2,3})
 func (store *Storage) Put(bucket, key string, value []byte) error {
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.put(bucket, key, value, nil)
+}
+
+// put saves a value along with its metadata
+func (store *Storage) put(bucket, key string, value []byte, meta *common.Metadata) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 	path := filepath.Join(store.base, bucket, key)
-	return ioutil.WriteFile(path, value, 0600)
+	if err := store.writeFile(path, value); err != nil {
+		return err
+	}
+	store.clearTTL(bucket, key)
+	return store.touch(bucket, key, int64(len(value)), meta)
 }
 
 // Get loads data from a key
 func (store *Storage) Get(bucket, key string) ([]byte, error) {
+	return store.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	path := filepath.Join(store.base, bucket, key)
+	if store.expired(bucket, key, time.Now()) {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
 	return ioutil.ReadFile(path)
 }
 
 // Delete deletes a value from the db
 func (store *Storage) Delete(bucket, key string) error {
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 	path := filepath.Join(store.base, bucket, key)
 	if _, err := os.Stat(path); err != nil {
 		if _, err = os.Stat(filepath.Join(store.base, bucket)); err != nil {
@@ -46,28 +138,91 @@ func (store *Storage) Delete(bucket, key string) error {
 		}
 		return nil
 	}
+	store.clearTTL(bucket, key)
+	store.clearMeta(bucket, key)
 	return os.Remove(path)
 }
 
 // CreateBucket creates a bucket
 func (store *Storage) CreateBucket(bucket string) error {
+	return store.CreateBucketContext(context.Background(), bucket)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	path := filepath.Join(store.base, bucket)
-	return os.MkdirAll(path, 0700)
+	return os.MkdirAll(path, store.dirPerm())
 }
 
 // DeleteBucket deletes a bucket
 func (store *Storage) DeleteBucket(bucket string) error {
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	path := filepath.Join(store.base, bucket)
 	if _, err := os.Stat(path); err != nil {
 		return common.Error(common.BucketNotFound, err)
 	}
+	for _, dir := range []string{expiryDir, metaDir} {
+		if err := os.RemoveAll(filepath.Join(store.base, dir, bucket)); err != nil {
+			return err
+		}
+	}
 	return os.RemoveAll(path)
 }
 
+// ListBuckets returns the names of all buckets in lexical order
+// Hidden directories like the expiry index are skipped.
+func (store *Storage) ListBuckets() ([]string, error) {
+	infos, err := ioutil.ReadDir(store.base)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	buckets := []string{}
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			buckets = append(buckets, info.Name())
+		}
+	}
+	return buckets, nil
+}
+
 // List returns all Entries of a directory
 // optionally provide arguments to specifiy a key offset and a key limit
 // Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
 func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return store.ListContext(context.Background(), bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.IterateContext(ctx, bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(ctx, iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+// The matching files are determined up front, their content is read by Next.
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	path := filepath.Join(store.base, bucket)
 	if _, err := os.Stat(path); err != nil {
 		return nil, common.Error(common.BucketNotFound, err)
@@ -75,46 +230,465 @@ func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.D
 	if opts == nil {
 		opts = &common.ListOpts{}
 	}
-	ch := make(chan *common.DocInfo, 64)
+	// docs only carry the keys here, the values are read by Next
+	docs := []*common.DocInfo{}
+	paths := make(map[string]string)
+	now := time.Now()
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := filepath.Base(path)
+		if !info.IsDir() && opts.Match(key) && !store.expired(bucket, key, now) {
+			docs = append(docs, &common.DocInfo{Key: key})
+			paths[key] = path
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Key < docs[j].Key })
+	if docs, err = common.Paginate(docs, opts); err != nil {
+		return nil, err
+	}
+	if opts.WithMeta {
+		for _, doc := range docs {
+			// docs deleted since the walk are skipped by Next
+			if doc.Meta, err = store.stat(bucket, doc.Key); err != nil && !os.IsNotExist(err) {
+				return nil, common.Error(common.ReadFailed, err)
+			}
+		}
+	}
+	if opts.KeysOnly {
+		return common.ContextIterator(ctx, common.SliceIterator(docs)), nil
+	}
+	return common.ContextIterator(ctx, &docIterator{docs: docs, paths: paths}), nil
+}
 
-	go func() {
-		filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				return nil
+// Count returns the number of entries of a bucket, values are not loaded
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	iter, err := store.Iterate(bucket, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	return common.Count(iter)
+}
+
+type docIterator struct {
+	docs  []*common.DocInfo
+	paths map[string]string
+	doc   *common.DocInfo
+	err   error
+}
+
+func (it *docIterator) Next() bool {
+	it.doc = nil
+	for it.err == nil && len(it.docs) > 0 {
+		doc := it.docs[0]
+		it.docs = it.docs[1:]
+		val, err := ioutil.ReadFile(it.paths[doc.Key])
+		if os.IsNotExist(err) {
+			// deleted since the iteration started
+			continue
+		}
+		if err != nil {
+			it.err = common.Error(common.ReadFailed, err)
+			return false
+		}
+		doc.Value = val
+		it.doc = doc
+		return true
+	}
+	return false
+}
+
+func (it *docIterator) Doc() *common.DocInfo {
+	return it.doc
+}
+
+func (it *docIterator) Err() error {
+	return it.err
+}
+
+func (it *docIterator) Close() error {
+	it.docs = nil
+	return nil
+}
+
+// NewBatch creates an empty batch which is applied using a journal file
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+// Commit writes the operations to the journal before applying them.
+// If the process dies while applying, the next NewStorage call finishes the batch.
+func (b *batch) Commit() error {
+	for _, bucket := range b.Buckets() {
+		if _, err := os.Stat(filepath.Join(b.store.base, bucket)); err != nil {
+			return common.Error(common.BucketNotFound, err)
+		}
+	}
+	b.store.mutex.Lock()
+	defer b.store.mutex.Unlock()
+	bs, err := json.Marshal(b.Ops)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err = b.store.writeJournal(bs); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err = b.store.apply(b.Ops); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return os.Remove(filepath.Join(b.store.base, journalName))
+}
+
+// writeJournal durably writes the journal, it only shows up under its final name when complete
+func (store *Storage) writeJournal(bs []byte) error {
+	path := filepath.Join(store.base, journalName)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (store *Storage) replayJournal() error {
+	path := filepath.Join(store.base, journalName)
+	os.Remove(path + ".tmp")
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var ops []*common.BatchOp
+	if err = json.Unmarshal(bs, &ops); err != nil {
+		return err
+	}
+	if err = store.apply(ops); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// apply executes the given operations, puts and deletes are idempotent so they can be replayed
+func (store *Storage) apply(ops []*common.BatchOp) error {
+	for _, op := range ops {
+		path := filepath.Join(store.base, op.Bucket, op.Key)
+		store.clearTTL(op.Bucket, op.Key)
+		if op.Delete {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
 			}
-			key := filepath.Base(path)
-			val, err := ioutil.ReadFile(path)
-			if err != nil {
+			store.clearMeta(op.Bucket, op.Key)
+			continue
+		}
+		if err := store.writeFile(path, op.Value); err != nil {
+			return err
+		}
+		if err := store.touch(op.Bucket, op.Key, int64(len(op.Value)), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompareAndSwap saves new if the current value of key equals old
+// The check is atomic within this process only.
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	current, err := store.current(bucket, key)
+	if err != nil || !common.Equal(current, old) {
+		return false, err
+	}
+	if err = store.writeFile(filepath.Join(store.base, bucket, key), new); err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	store.clearTTL(bucket, key)
+	if err = store.touch(bucket, key, int64(len(new)), nil); err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	return true, nil
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return store.CompareAndSwap(bucket, key, nil, value)
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+// The check is atomic within this process only.
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	current, err := store.current(bucket, key)
+	if err != nil || old == nil || !common.Equal(current, old) {
+		return false, err
+	}
+	if err = os.Remove(filepath.Join(store.base, bucket, key)); err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	store.clearTTL(bucket, key)
+	store.clearMeta(bucket, key)
+	return true, nil
+}
+
+// current returns the value of key or nil if it does not exist
+func (store *Storage) current(bucket, key string) ([]byte, error) {
+	if _, err := os.Stat(filepath.Join(store.base, bucket)); err != nil {
+		return nil, common.Error(common.BucketNotFound, err)
+	}
+	val, err := ioutil.ReadFile(filepath.Join(store.base, bucket, key))
+	if os.IsNotExist(err) || store.expired(bucket, key, time.Now()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if val == nil {
+		val = []byte{}
+	}
+	return val, nil
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+// The deadline is kept in a file next to the buckets.
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, err := os.Stat(filepath.Join(store.base, bucket)); err != nil {
+		return common.Error(common.BucketNotFound, err)
+	}
+	if err := store.writeFile(filepath.Join(store.base, bucket, key), value); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if err := store.touch(bucket, key, int64(len(value)), nil); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	path := store.expiryPath(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), store.dirPerm()); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	deadline := strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10)
+	if err := store.writeFile(path, []byte(deadline)); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// writeFile writes a file with the permission of the options and flushes it if the options ask for it
+func (store *Storage) writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, store.options.Perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil && store.options.Fsync {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// dirPerm returns the permission of directories, files can be listed where they can be read
+func (store *Storage) dirPerm() os.FileMode {
+	return store.options.Perm | (store.options.Perm&0444)>>2
+}
+
+func (store *Storage) expiryPath(bucket, key string) string {
+	return filepath.Join(store.base, expiryDir, bucket, key)
+}
+
+func (store *Storage) clearTTL(bucket, key string) {
+	os.Remove(store.expiryPath(bucket, key))
+}
+
+// expired reports whether key has a deadline which is not after now
+func (store *Storage) expired(bucket, key string, now time.Time) bool {
+	bs, err := ioutil.ReadFile(store.expiryPath(bucket, key))
+	if err != nil {
+		return false
+	}
+	deadline, err := strconv.ParseInt(string(bs), 10, 64)
+	return err == nil && deadline <= now.UnixNano()
+}
+
+// reap removes all expired keys
+func (store *Storage) reap() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	root := filepath.Join(store.base, expiryDir)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		bucket, key := filepath.Dir(rel), filepath.Base(rel)
+		if store.expired(bucket, key, now) {
+			if err := os.Remove(filepath.Join(store.base, bucket, key)); err != nil && !os.IsNotExist(err) {
 				log.Print(err)
 				return nil
 			}
-			switch {
-			case opts.Prefix != "":
-				{
-					if strings.HasPrefix(key, opts.Prefix) {
-						ch <- &common.DocInfo{Key: key, Value: val}
-					}
-				}
-			case opts.Start != "":
-				{
-					if strings.Compare(opts.Start, key) <= 0 && strings.Compare(key, opts.End) < 0 {
-						ch <- &common.DocInfo{Key: key, Value: val}
-					}
-				}
-			default:
-				{
-					ch <- &common.DocInfo{Key: key, Value: val}
-				}
-			}
-			return nil
-		})
-		close(ch)
-	}()
+			os.Remove(path)
+			store.clearMeta(bucket, key)
+		}
+		return nil
+	})
+}
+
+// PutReader saves everything read from r
+// The content is written to a temporary file which replaces the value once r is drained.
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	if _, err := os.Stat(filepath.Join(store.base, bucket)); err != nil {
+		return common.Error(common.BucketNotFound, err)
+	}
+	f, err := ioutil.TempFile(store.base, uploadPrefix)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	size, err := io.Copy(f, r)
+	if err == nil && store.options.Fsync {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), store.options.Perm)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return common.Error(common.WriteFailed, err)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err = os.Rename(f.Name(), filepath.Join(store.base, bucket, key)); err != nil {
+		os.Remove(f.Name())
+		return common.Error(common.WriteFailed, err)
+	}
+	store.clearTTL(bucket, key)
+	if err = store.touch(bucket, key, size, nil); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// GetReader opens the file of a value for reading
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	path := filepath.Join(store.base, bucket, key)
+	if store.expired(bucket, key, time.Now()) {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return os.Open(path)
+}
+
+// PutWithMeta saves a byteslice along with the content type and attributes of meta
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	if _, err := os.Stat(filepath.Join(store.base, bucket)); err != nil {
+		return common.Error(common.BucketNotFound, err)
+	}
+	if err := store.put(bucket, key, value, meta); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// Stat returns the metadata of a key
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	if _, err := os.Stat(filepath.Join(store.base, bucket)); err != nil {
+		return nil, common.Error(common.BucketNotFound, err)
+	}
+	if store.expired(bucket, key, time.Now()) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	meta, err := store.stat(bucket, key)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return meta, nil
+}
+
+func (store *Storage) metaPath(bucket, key string) string {
+	return filepath.Join(store.base, metaDir, bucket, key)
+}
+
+// touch writes the metadata of a new value of size bytes, keeping the creation time of the old one
+func (store *Storage) touch(bucket, key string, size int64, meta *common.Metadata) error {
+	path := store.metaPath(bucket, key)
+	old := &common.Metadata{}
+	if bs, err := ioutil.ReadFile(path); err != nil || json.Unmarshal(bs, old) != nil {
+		old = nil
+	}
+	bs, err := json.Marshal(common.Touch(old, meta, size, time.Now()))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), store.dirPerm()); err != nil {
+		return err
+	}
+	return store.writeFile(path, bs)
+}
+
+func (store *Storage) clearMeta(bucket, key string) {
+	os.Remove(store.metaPath(bucket, key))
+}
+
+// stat returns the metadata of a value
+// Values written before metadata was kept report the modification time and size of their file.
+func (store *Storage) stat(bucket, key string) (*common.Metadata, error) {
+	info, err := os.Stat(filepath.Join(store.base, bucket, key))
+	if err != nil {
+		return nil, err
+	}
+	bs, err := ioutil.ReadFile(store.metaPath(bucket, key))
+	if os.IsNotExist(err) {
+		return &common.Metadata{Created: info.ModTime(), Modified: info.ModTime(), Size: info.Size()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &common.Metadata{}
+	if err = json.Unmarshal(bs, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
 
-	return ch, nil
+// Begin is not supported by the file storage
+func (store *Storage) Begin() (storage.Tx, error) {
+	return nil, common.Error(common.Unsupported)
 }
 
 // Close closes the storage
 func (store *Storage) Close() error {
+	store.stopReaper()
 	return nil
 }
@@ -1,7 +1,9 @@
 package file
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -25,3 +27,23 @@ func TestFileStorage(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.RemoveAll("./test-store.db")
 }
+
+func TestJournalReplay(t *testing.T) {
+	defer os.RemoveAll("./journal-test.db")
+	err := os.MkdirAll("./journal-test.db/bucket-name", 0700)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile("./journal-test.db/bucket-name/old", []byte("old"), 0600)
+	assert.NoError(t, err)
+	journal := `[{"bucket":"bucket-name","key":"foo","value":"aGVsbG8="},{"bucket":"bucket-name","key":"old","delete":true}]`
+	err = ioutil.WriteFile(filepath.Join("./journal-test.db", journalName), []byte(journal), 0600)
+	assert.NoError(t, err)
+	store, err := NewStorage("./journal-test.db")
+	assert.NoError(t, err)
+	val, err := store.Get("bucket-name", "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(val))
+	_, err = store.Get("bucket-name", "old")
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join("./journal-test.db", journalName))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,30 @@
+// Package register makes the file engine available to meta.NewStorage under the file scheme.
+package register
+
+import (
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/engines/file"
+	"github.com/trusch/storage/engines/meta"
+)
+
+// file:///data?fsync=true&perm=0640
+func init() {
+	meta.Register("file", func(uri string, options ...interface{}) (storage.Storage, error) {
+		p, err := meta.Path(uri)
+		if err != nil {
+			return nil, err
+		}
+		q, err := meta.ParseQuery("file", uri)
+		if err != nil {
+			return nil, err
+		}
+		opts := file.Options{
+			Fsync: q.Boolean("fsync", file.DefaultOptions.Fsync),
+			Perm:  q.Perm("perm", file.DefaultOptions.Perm),
+		}
+		if err = q.Done(); err != nil {
+			return nil, err
+		}
+		return file.NewStorageWithOptions(p, opts)
+	})
+}
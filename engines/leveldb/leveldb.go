@@ -1,39 +1,133 @@
 package leveldb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/trusch/storage"
 	"github.com/trusch/storage/common"
 )
 
 // Storage is a leveldb implementation of the storage interface
 type Storage struct {
-	db *leveldb.DB
+	// uploads is the id of the last stream upload, it is accessed atomically
+	uploads uint64
+	db      *leveldb.DB
+	// locks serialize writes to the same key so conditional writes can read and write atomically
+	locks      [64]sync.Mutex
+	stopReaper func()
+}
+
+// ttlPrefix prefixes the expiry index, it maps bucket/key to the deadline in unix nanoseconds
+const ttlPrefix = "\x00ttl/"
+
+// streamPrefix prefixes the manifests of streamed values, it maps bucket/key to the upload id and chunk count
+const streamPrefix = "\x00stream/"
+
+// chunkPrefix prefixes the chunks of streamed values
+const chunkPrefix = "\x00chunk/"
+
+// metaPrefix prefixes the metadata index, it maps bucket/key to the JSON encoded metadata
+const metaPrefix = "\x00meta/"
+
+// versionPrefix prefixes the history of versioned buckets, it maps bucket/key, a zero byte and the
+// big endian version number to the modification time, a tombstone flag and the value
+const versionPrefix = "\x00version/"
+
+// headPrefix prefixes the number of the last version of each key of a versioned bucket
+const headPrefix = "\x00head/"
+
+// versionedPrefix marks the buckets whose history is kept
+const versionedPrefix = "\x00versioned/"
+
+// ChunkSize is the size of the chunks streamed values are split into
+var ChunkSize = 1 << 20
+
+// Options tune a leveldb database
+type Options struct {
+	// CacheSize is the size of the block cache in bytes, 0 keeps the leveldb default of 8MiB
+	CacheSize int
+	// BloomBits is the number of bits per key of the bloom filter, 0 disables the filter
+	BloomBits int
+	// NoCompression stores blocks without snappy compression
+	NoCompression bool
 }
 
+// DefaultOptions are the options NewStorage uses
+var DefaultOptions = Options{BloomBits: 10}
+
 // NewStorage opens a new leveldb database
 func NewStorage(path string) (*Storage, error) {
-	o := &opt.Options{
-		Filter: filter.NewBloomFilter(10),
+	return NewStorageWithOptions(path, DefaultOptions)
+}
+
+// NewStorageWithOptions opens a new leveldb database with the given options
+func NewStorageWithOptions(path string, options Options) (*Storage, error) {
+	o := &opt.Options{BlockCacheCapacity: options.CacheSize}
+	if options.BloomBits > 0 {
+		o.Filter = filter.NewBloomFilter(options.BloomBits)
+	}
+	if options.NoCompression {
+		o.Compression = opt.NoCompression
 	}
 	db, err := leveldb.OpenFile(path, o)
 	if err != nil {
 		return nil, err
 	}
-	store := &Storage{db}
+	store := &Storage{db: db, uploads: uint64(time.Now().UnixNano())}
+	store.stopReaper = common.StartReaper(store.reap)
 	return store, nil
 }
 
 // Put saves a byteslice to the db.
 // Example: Save("/foo/bar", []byte{1,2,3})
 func (store *Storage) Put(bucket, key string, value []byte) error {
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := store.checkBucket(bucket); err != nil {
 		return err
 	}
-	err := store.db.Put([]byte(bucket+"/"+key), value, nil)
+	return store.put(bucket, key, value, nil)
+}
+
+// put saves a value along with its metadata
+func (store *Storage) put(bucket, key string, value []byte, meta *common.Metadata) error {
+	defer store.lock(bucket, key)()
+	b := new(leveldb.Batch)
+	if err := dropStream(store.db, b, bucket, key); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err := touch(store.db, b, bucket, key, int64(len(value)), meta); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err := newHistory(store.db).add(b, bucket, key, value, false); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	b.Put([]byte(bucket+"/"+key), value)
+	b.Delete(ttlKey(bucket, key))
+	err := store.db.Write(b, nil)
 	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
@@ -42,19 +136,63 @@ func (store *Storage) Put(bucket, key string, value []byte) error {
 
 // Get loads data from a key
 func (store *Storage) Get(bucket, key string) ([]byte, error) {
-	val, err := store.db.Get([]byte(bucket+"/"+key), nil)
+	return store.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the snapshot keeps the chunks of a streamed value while it is replaced
+	snap, err := store.db.GetSnapshot()
 	if err != nil {
 		return nil, common.Error(common.ReadFailed, err)
 	}
+	defer snap.Release()
+	return get(snap, bucket, key, time.Now())
+}
+
+// get loads the value of a key which has not expired at now
+func get(snap *leveldb.Snapshot, bucket, key string, now time.Time) ([]byte, error) {
+	val, err := snap.Get([]byte(bucket+"/"+key), nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if expired(snap, bucket, key, now) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	if val, err = load(snap, bucket, key, val); err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
 	return val, nil
 }
 
 // Delete deletes a value from the db
 func (store *Storage) Delete(bucket, key string) error {
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := store.checkBucket(bucket); err != nil {
 		return err
 	}
-	err := store.db.Delete([]byte(bucket+"/"+key), nil)
+	defer store.lock(bucket, key)()
+	b := new(leveldb.Batch)
+	if err := dropStream(store.db, b, bucket, key); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err := newHistory(store.db).add(b, bucket, key, nil, true); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	b.Delete([]byte(bucket + "/" + key))
+	b.Delete(ttlKey(bucket, key))
+	b.Delete(metaKey(bucket, key))
+	err := store.db.Write(b, nil)
 	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
@@ -63,6 +201,14 @@ func (store *Storage) Delete(bucket, key string) error {
 
 // CreateBucket creates a bucket
 func (store *Storage) CreateBucket(bucket string) error {
+	return store.CreateBucketContext(context.Background(), bucket)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	err := store.db.Put([]byte(bucket), []byte{}, nil)
 	if err != nil {
 		return common.Error(common.WriteFailed, err)
@@ -72,79 +218,413 @@ func (store *Storage) CreateBucket(bucket string) error {
 
 // DeleteBucket deletes a bucket
 func (store *Storage) DeleteBucket(bucket string) error {
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
 	if err := store.checkBucket(bucket); err != nil {
 		return err
 	}
-	ch, err := store.List(bucket, nil)
-	if err != nil {
-		return err
-	}
-	for item := range ch {
-		store.Delete(bucket, item.Key)
+	b := new(leveldb.Batch)
+	for _, prefix := range []string{bucket + "/", ttlPrefix + bucket + "/", metaPrefix + bucket + "/", streamPrefix + bucket + "/", chunkPrefix + bucket + "/", versionPrefix + bucket + "/", headPrefix + bucket + "/"} {
+		iter := store.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		for iter.Next() {
+			b.Delete(iter.Key())
+		}
+		iter.Release()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 	}
-	err = store.db.Delete([]byte(bucket), nil)
+	b.Delete([]byte(bucket))
+	b.Delete(versionedKey(bucket))
+	err := store.db.Write(b, nil)
 	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
 	return nil
 }
 
+// ListBuckets returns the names of all buckets in lexical order
+// Buckets are found by their marker keys, the data of each bucket is skipped.
+func (store *Storage) ListBuckets() ([]string, error) {
+	return listBuckets(store.db.NewIterator(nil, nil))
+}
+
+// listBuckets returns the names of the buckets found by iter, which is released afterwards
+func listBuckets(iter iterator.Iterator) ([]string, error) {
+	defer iter.Release()
+	buckets := []string{}
+	for ok := iter.Seek([]byte{1}); ok; {
+		key := string(iter.Key())
+		if i := strings.IndexByte(key, '/'); i >= 0 {
+			// '0' is the byte after '/', so this jumps behind all data keys of the bucket.
+			// Buckets like "a-b" sort between "a" and "a/", so the jump is only taken from a data key.
+			ok = iter.Seek([]byte(key[:i] + "0"))
+			continue
+		}
+		buckets = append(buckets, key)
+		ok = iter.Next()
+	}
+	if err := iter.Error(); err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return buckets, nil
+}
+
 // List returns all Entries of a directory
 // optionally provide arguments to specifiy a key offset and a key limit
 // Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
 func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
-	err := store.checkBucket(bucket)
+	return store.ListContext(context.Background(), bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.IterateContext(ctx, bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(ctx, iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+// Errors of the underlying leveldb iterator are reported by Err.
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := store.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	snap, err := store.db.GetSnapshot()
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	iter, err := iterate(snap, bucket, opts, time.Now(), snap.Release)
 	if err != nil {
+		snap.Release()
 		return nil, err
 	}
+	return common.ContextIterator(ctx, iter), nil
+}
+
+// iterate returns an iterator over the entries of a bucket in r which have not expired at now
+// If release is set, the iterator calls it when it is closed.
+func iterate(r iterReader, bucket string, opts *common.ListOpts, now time.Time, release func()) (common.Iterator, error) {
 	if opts == nil {
 		opts = &common.ListOpts{}
 	}
-	var iter iterator.Iterator
-	switch {
-	case opts.Prefix != "":
-		{
-			iter = store.db.NewIterator(util.BytesPrefix([]byte(bucket+"/"+opts.Prefix)), nil)
+	rng := keyRange(bucket, opts)
+	cursor, ok, err := opts.CursorKey()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// the cursor narrows the range to the keys behind it
+		if opts.Reverse {
+			if limit := []byte(bucket + "/" + cursor); rng.Limit == nil || bytes.Compare(limit, rng.Limit) < 0 {
+				rng.Limit = limit
+			}
+		} else {
+			if start := []byte(bucket + "/" + cursor + "\x00"); bytes.Compare(start, rng.Start) > 0 {
+				rng.Start = start
+			}
 		}
-	case opts.Start != "":
-		{
-			iter = store.db.NewIterator(&util.Range{Start: []byte(bucket + "/" + opts.Start), Limit: []byte(bucket + "/" + opts.End)}, nil)
+	}
+	return &docIterator{
+		iter:     r.NewIterator(rng, nil),
+		r:        r,
+		release:  release,
+		bucket:   bucket,
+		now:      now,
+		reverse:  opts.Reverse,
+		limit:    opts.Limit,
+		keysOnly: opts.KeysOnly,
+		withMeta: opts.WithMeta,
+	}, nil
+}
+
+// Count returns the number of entries of a bucket, values are not loaded
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	iter, err := store.Iterate(bucket, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	return common.Count(iter)
+}
+
+type docIterator struct {
+	iter     iterator.Iterator
+	r        reader
+	release  func()
+	bucket   string
+	now      time.Time
+	reverse  bool
+	limit    int
+	keysOnly bool
+	withMeta bool
+	count    int
+	started  bool
+	doc      *common.DocInfo
+	err      error
+}
+
+// move positions the iterator on the next key in iteration order
+func (it *docIterator) move() bool {
+	if !it.started {
+		it.started = true
+		if it.reverse {
+			return it.iter.Last()
+		}
+		return it.iter.First()
+	}
+	if it.reverse {
+		return it.iter.Prev()
+	}
+	return it.iter.Next()
+}
+
+func (it *docIterator) Next() bool {
+	if it.err != nil || (it.limit > 0 && it.count >= it.limit) {
+		it.doc = nil
+		return false
+	}
+	for it.move() {
+		key := string(it.iter.Key()[len(it.bucket)+1:])
+		if expired(it.r, it.bucket, key, it.now) {
+			continue
+		}
+		it.count++
+		it.doc = &common.DocInfo{Key: key}
+		if it.withMeta {
+			if it.doc.Meta, it.err = stat(it.r, it.bucket, key, it.iter.Value()); it.err != nil {
+				break
+			}
 		}
-	default:
-		{
-			iter = store.db.NewIterator(util.BytesPrefix([]byte(bucket+"/")), nil)
+		if it.keysOnly {
+			return true
 		}
+		// the iterator reuses its buffers, so the value must be copied
+		val := it.iter.Value()
+		it.doc.Value = make([]byte, len(val))
+		copy(it.doc.Value, val)
+		if it.doc.Value, it.err = load(it.r, it.bucket, key, it.doc.Value); it.err != nil {
+			break
+		}
+		return true
 	}
-	res := make(chan *common.DocInfo, 64)
-	bucketNameLen := len(bucket) + 1
-	go func() {
-		for iter.Next() {
-			key := string(iter.Key()[bucketNameLen:])
-			val := iter.Value()
-			doc := &common.DocInfo{Key: key, Value: make([]byte, len(val))}
-			copy(doc.Value, val)
-			res <- doc
+	it.doc = nil
+	return false
+}
+
+func (it *docIterator) Doc() *common.DocInfo {
+	return it.doc
+}
+
+func (it *docIterator) Err() error {
+	if it.err != nil {
+		return common.Error(common.ReadFailed, it.err)
+	}
+	if err := it.iter.Error(); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	return nil
+}
+
+func (it *docIterator) Close() error {
+	it.iter.Release()
+	if it.release != nil {
+		it.release()
+	}
+	return nil
+}
+
+// NewBatch creates an empty batch which is applied atomically as a leveldb.Batch
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+// Commit writes all operations of the batch atomically
+func (b *batch) Commit() error {
+	for _, bucket := range b.Buckets() {
+		if err := b.store.checkBucket(bucket); err != nil {
+			return err
 		}
-		iter.Release()
-		close(res)
-	}()
-	return res, nil
+	}
+	defer b.lock()()
+	lb := new(leveldb.Batch)
+	h := newHistory(b.store.db)
+	for _, op := range b.Ops {
+		if err := dropStream(b.store.db, lb, op.Bucket, op.Key); err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+		if err := h.add(lb, op.Bucket, op.Key, op.Value, op.Delete); err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+		if op.Delete {
+			lb.Delete([]byte(op.Bucket + "/" + op.Key))
+			lb.Delete(metaKey(op.Bucket, op.Key))
+		} else {
+			if err := touch(b.store.db, lb, op.Bucket, op.Key, int64(len(op.Value)), nil); err != nil {
+				return common.Error(common.ReadFailed, err)
+			}
+			lb.Put([]byte(op.Bucket+"/"+op.Key), op.Value)
+		}
+		lb.Delete(ttlKey(op.Bucket, op.Key))
+	}
+	if err := b.store.db.Write(lb, nil); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
 }
 
-// Close closes the storage
-func (store *Storage) Close() error {
-	err := store.db.Close()
-	if err != nil {
-		if err == leveldb.ErrClosed {
-			return nil
+// lock locks the stripes of all keys of the batch in order and returns the unlock function
+func (b *batch) lock() func() {
+	stripes := make(map[int]bool)
+	for _, op := range b.Ops {
+		stripes[stripe(op.Bucket+"/"+op.Key)] = true
+	}
+	ordered := make([]int, 0, len(stripes))
+	for i := range stripes {
+		ordered = append(ordered, i)
+	}
+	sort.Ints(ordered)
+	for _, i := range ordered {
+		b.store.locks[i].Lock()
+	}
+	return func() {
+		for _, i := range ordered {
+			b.store.locks[i].Unlock()
 		}
-		return common.Error(common.CloseFailed, err)
+	}
+}
+
+// Begin opens a leveldb transaction
+// A leveldb transaction is exclusive: writes to the storage block until it is committed or rolled back.
+func (store *Storage) Begin() (storage.Tx, error) {
+	t, err := store.db.OpenTransaction()
+	if err != nil {
+		return nil, common.Error(common.WriteFailed, err)
+	}
+	return &tx{t}, nil
+}
+
+type tx struct {
+	tx *leveldb.Transaction
+}
+
+// Get loads data from a key
+func (t *tx) Get(bucket, key string) ([]byte, error) {
+	if err := t.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	val, err := t.tx.Get([]byte(bucket+"/"+key), nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if expired(t.tx, bucket, key, time.Now()) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	if val, err = load(t.tx, bucket, key, val); err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return val, nil
+}
+
+// Put saves a byteslice to the db
+func (t *tx) Put(bucket, key string, value []byte) error {
+	if err := t.checkBucket(bucket); err != nil {
+		return err
+	}
+	b := &leveldb.Batch{}
+	if err := dropStream(t.tx, b, bucket, key); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err := touch(t.tx, b, bucket, key, int64(len(value)), nil); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err := newHistory(t.tx).add(b, bucket, key, value, false); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	b.Put([]byte(bucket+"/"+key), value)
+	b.Delete(ttlKey(bucket, key))
+	if err := t.tx.Write(b, nil); err != nil {
+		return common.Error(common.WriteFailed, err)
 	}
 	return nil
 }
 
-func (store *Storage) checkBucket(bucket string) error {
-	ok, err := store.db.Has([]byte(bucket), nil)
+// Delete deletes a value from the db
+func (t *tx) Delete(bucket, key string) error {
+	if err := t.checkBucket(bucket); err != nil {
+		return err
+	}
+	b := &leveldb.Batch{}
+	if err := dropStream(t.tx, b, bucket, key); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err := newHistory(t.tx).add(b, bucket, key, nil, true); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	b.Delete([]byte(bucket + "/" + key))
+	b.Delete(ttlKey(bucket, key))
+	b.Delete(metaKey(bucket, key))
+	if err := t.tx.Write(b, nil); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// List returns all Entries of a directory
+// The entries are collected before returning since the iterator must not outlive the transaction.
+func (t *tx) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	if err := t.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	iter, err := iterate(t.tx, bucket, opts, time.Now(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	docs := make([]*common.DocInfo, 0)
+	for iter.Next() {
+		docs = append(docs, iter.Doc())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return common.DocChannel(docs), nil
+}
+
+// Commit commits the transaction
+func (t *tx) Commit() error {
+	if err := t.tx.Commit(); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// Rollback discards the transaction
+func (t *tx) Rollback() error {
+	t.tx.Discard()
+	return nil
+}
+
+func (t *tx) checkBucket(bucket string) error {
+	ok, err := t.tx.Has([]byte(bucket), nil)
 	if err != nil {
 		return common.Error(common.ReadFailed, err)
 	}
@@ -153,3 +633,750 @@ func (store *Storage) checkBucket(bucket string) error {
 	}
 	return nil
 }
+
+// CompareAndSwap saves new if the current value of key equals old
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	if err := store.checkBucket(bucket); err != nil {
+		return false, err
+	}
+	defer store.lock(bucket, key)()
+	current, err := store.current(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if !common.Equal(current, old) {
+		return false, nil
+	}
+	b := &leveldb.Batch{}
+	if err = dropStream(store.db, b, bucket, key); err != nil {
+		return false, common.Error(common.ReadFailed, err)
+	}
+	if err = touch(store.db, b, bucket, key, int64(len(new)), nil); err != nil {
+		return false, common.Error(common.ReadFailed, err)
+	}
+	if err = newHistory(store.db).add(b, bucket, key, new, false); err != nil {
+		return false, common.Error(common.ReadFailed, err)
+	}
+	b.Put([]byte(bucket+"/"+key), new)
+	b.Delete(ttlKey(bucket, key))
+	if err = store.db.Write(b, nil); err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	return true, nil
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return store.CompareAndSwap(bucket, key, nil, value)
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	if err := store.checkBucket(bucket); err != nil {
+		return false, err
+	}
+	defer store.lock(bucket, key)()
+	current, err := store.current(bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if old == nil || !common.Equal(current, old) {
+		return false, nil
+	}
+	b := new(leveldb.Batch)
+	if err = dropStream(store.db, b, bucket, key); err != nil {
+		return false, common.Error(common.ReadFailed, err)
+	}
+	if err = newHistory(store.db).add(b, bucket, key, nil, true); err != nil {
+		return false, common.Error(common.ReadFailed, err)
+	}
+	b.Delete([]byte(bucket + "/" + key))
+	b.Delete(ttlKey(bucket, key))
+	b.Delete(metaKey(bucket, key))
+	if err = store.db.Write(b, nil); err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	return true, nil
+}
+
+// current returns the value of key or nil if it does not exist
+func (store *Storage) current(bucket, key string) ([]byte, error) {
+	val, err := store.db.Get([]byte(bucket+"/"+key), nil)
+	if err == leveldb.ErrNotFound || (err == nil && expired(store.db, bucket, key, time.Now())) {
+		return nil, nil
+	}
+	if err == nil {
+		val, err = load(store.db, bucket, key, val)
+	}
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if val == nil {
+		val = []byte{}
+	}
+	return val, nil
+}
+
+// lock locks the stripe of a key and returns the unlock function
+func (store *Storage) lock(bucket, key string) func() {
+	return store.lockKey(bucket + "/" + key)
+}
+
+func (store *Storage) lockKey(dataKey string) func() {
+	m := &store.locks[stripe(dataKey)]
+	m.Lock()
+	return m.Unlock
+}
+
+// stripe returns the index of the lock of a data key
+func stripe(dataKey string) int {
+	h := fnv.New32a()
+	h.Write([]byte(dataKey))
+	return int(h.Sum32() % 64)
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	if err := store.checkBucket(bucket); err != nil {
+		return err
+	}
+	defer store.lock(bucket, key)()
+	deadline := make([]byte, 8)
+	binary.BigEndian.PutUint64(deadline, uint64(time.Now().Add(ttl).UnixNano()))
+	b := new(leveldb.Batch)
+	if err := dropStream(store.db, b, bucket, key); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err := touch(store.db, b, bucket, key, int64(len(value)), nil); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err := newHistory(store.db).add(b, bucket, key, value, false); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	b.Put([]byte(bucket+"/"+key), value)
+	b.Put(ttlKey(bucket, key), deadline)
+	if err := store.db.Write(b, nil); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// reap removes all expired keys listed in the expiry index
+func (store *Storage) reap() {
+	iter := store.db.NewIterator(util.BytesPrefix([]byte(ttlPrefix)), nil)
+	defer iter.Release()
+	now := time.Now()
+	for iter.Next() {
+		dataKey := string(iter.Key()[len(ttlPrefix):])
+		if !now.After(deadline(iter.Value())) {
+			continue
+		}
+		store.reapKey(dataKey, now)
+	}
+}
+
+// reapKey deletes an expired key, the deadline is checked again while holding the key lock
+func (store *Storage) reapKey(dataKey string, now time.Time) {
+	unlock := store.lockKey(dataKey)
+	defer unlock()
+	val, err := store.db.Get([]byte(ttlPrefix+dataKey), nil)
+	if err != nil || !now.After(deadline(val)) {
+		return
+	}
+	b := new(leveldb.Batch)
+	if parts := strings.SplitN(dataKey, "/", 2); len(parts) == 2 {
+		if dropStream(store.db, b, parts[0], parts[1]) != nil {
+			return
+		}
+		// expired keys of versioned buckets leave a tombstone like deleted ones
+		if newHistory(store.db).add(b, parts[0], parts[1], nil, true) != nil {
+			return
+		}
+	}
+	b.Delete([]byte(dataKey))
+	b.Delete([]byte(ttlPrefix + dataKey))
+	b.Delete([]byte(metaPrefix + dataKey))
+	store.db.Write(b, nil)
+}
+
+// PutReader saves everything read from r
+// Values larger than ChunkSize are written chunk by chunk and replace the old value atomically once r is drained.
+// In versioned buckets the value is read into memory, since the history keeps a copy of it.
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	if err := store.checkBucket(bucket); err != nil {
+		return err
+	}
+	if ok, _ := store.db.Has(versionedKey(bucket), nil); ok {
+		value, err := ioutil.ReadAll(r)
+		if err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		return store.Put(bucket, key, value)
+	}
+	buf := make([]byte, ChunkSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return store.Put(bucket, key, buf[:n])
+	}
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	m := &manifest{id: atomic.AddUint64(&store.uploads, 1)}
+	size := int64(0)
+	for n > 0 {
+		if err = store.db.Put(m.chunkKey(bucket, key, m.chunks), buf[:n], nil); err != nil {
+			break
+		}
+		m.chunks++
+		size += int64(n)
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			break
+		}
+	}
+	defer store.lock(bucket, key)()
+	b := new(leveldb.Batch)
+	if err == nil {
+		err = dropStream(store.db, b, bucket, key)
+	}
+	if err == nil {
+		err = touch(store.db, b, bucket, key, size, nil)
+	}
+	if err != nil {
+		// remove the chunks written so far
+		b.Reset()
+		m.drop(b, bucket, key)
+		store.db.Write(b, nil)
+		return common.Error(common.WriteFailed, err)
+	}
+	b.Put([]byte(bucket+"/"+key), []byte{})
+	b.Put(streamKey(bucket, key), m.bytes())
+	b.Delete(ttlKey(bucket, key))
+	if err = store.db.Write(b, nil); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// PutWithMeta saves a byteslice along with the content type and attributes of meta
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	if err := store.checkBucket(bucket); err != nil {
+		return err
+	}
+	return store.put(bucket, key, value, meta)
+}
+
+// Stat returns the metadata of a key
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	snap, err := store.db.GetSnapshot()
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	defer snap.Release()
+	return statKey(snap, bucket, key, time.Now())
+}
+
+// statKey returns the metadata of a key which has not expired at now
+func statKey(snap *leveldb.Snapshot, bucket, key string, now time.Time) (*common.Metadata, error) {
+	if ok, err := snap.Has([]byte(bucket), nil); err != nil || !ok {
+		return nil, common.Error(common.BucketNotFound, err)
+	}
+	val, err := snap.Get([]byte(bucket+"/"+key), nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if expired(snap, bucket, key, now) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	meta, err := stat(snap, bucket, key, val)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return meta, nil
+}
+
+// GetReader opens a value for reading
+// Streamed values are read chunk by chunk from a snapshot, which is released by Close.
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	snap, err := store.db.GetSnapshot()
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	val, err := snap.Get([]byte(bucket+"/"+key), nil)
+	if err == nil && expired(snap, bucket, key, time.Now()) {
+		err = leveldb.ErrNotFound
+	}
+	var m *manifest
+	if err == nil {
+		m, err = readManifest(snap, bucket, key)
+	}
+	if err != nil || m == nil {
+		snap.Release()
+		if err != nil {
+			return nil, common.Error(common.ReadFailed, err)
+		}
+		return ioutil.NopCloser(bytes.NewReader(val)), nil
+	}
+	return &chunkReader{snap: snap, m: m, bucket: bucket, key: key}, nil
+}
+
+type chunkReader struct {
+	snap   *leveldb.Snapshot
+	m      *manifest
+	bucket string
+	key    string
+	next   uint64
+	buf    []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next >= r.m.chunks {
+			return 0, io.EOF
+		}
+		chunk, err := r.snap.Get(r.m.chunkKey(r.bucket, r.key, r.next), nil)
+		if err != nil {
+			return 0, common.Error(common.ReadFailed, err)
+		}
+		r.buf = chunk
+		r.next++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.snap.Release()
+	return nil
+}
+
+// Snapshot returns a read-only view of the storage as it is now, backed by a leveldb snapshot
+// Keys are expired as of the time the snapshot was taken. Iterators must be closed before the snapshot.
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	snap, err := store.db.GetSnapshot()
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return &snapshot{snap: snap, at: time.Now()}, nil
+}
+
+type snapshot struct {
+	common.ReadOnlyStorage
+	snap *leveldb.Snapshot
+	at   time.Time
+}
+
+// Get loads data from a key
+func (s *snapshot) Get(bucket, key string) ([]byte, error) {
+	if err := s.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	return get(s.snap, bucket, key, s.at)
+}
+
+// Stat returns the metadata of a key
+func (s *snapshot) Stat(bucket, key string) (*common.Metadata, error) {
+	return statKey(s.snap, bucket, key, s.at)
+}
+
+// ListBuckets returns the names of all buckets in lexical order
+func (s *snapshot) ListBuckets() ([]string, error) {
+	return listBuckets(s.snap.NewIterator(nil, nil))
+}
+
+// List returns all Entries of a bucket
+func (s *snapshot) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := s.Iterate(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(context.Background(), iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (s *snapshot) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if err := s.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	return iterate(s.snap, bucket, opts, s.at, nil)
+}
+
+// Count returns the number of entries of a bucket, values are not loaded
+func (s *snapshot) Count(bucket string, opts *common.ListOpts) (int, error) {
+	iter, err := s.Iterate(bucket, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	return common.Count(iter)
+}
+
+// Close releases the snapshot
+func (s *snapshot) Close() error {
+	s.snap.Release()
+	return nil
+}
+
+func (s *snapshot) checkBucket(bucket string) error {
+	ok, err := s.snap.Has([]byte(bucket), nil)
+	if err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if !ok {
+		return common.Error(common.BucketNotFound)
+	}
+	return nil
+}
+
+// EnableVersioning starts keeping the history of all keys of a bucket
+// The current values become the first versions of their keys.
+func (store *Storage) EnableVersioning(bucket string) error {
+	if err := store.checkBucket(bucket); err != nil {
+		return err
+	}
+	if ok, err := store.db.Has(versionedKey(bucket), nil); ok || err != nil {
+		return err
+	}
+	snap, err := store.db.GetSnapshot()
+	if err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	defer snap.Release()
+	b := new(leveldb.Batch)
+	b.Put(versionedKey(bucket), []byte{})
+	h := &history{r: snap, heads: make(map[string]uint64), live: make(map[string]bool), versioned: map[string]bool{bucket: true}}
+	iter := snap.NewIterator(util.BytesPrefix([]byte(bucket+"/")), nil)
+	defer iter.Release()
+	now := time.Now()
+	for iter.Next() {
+		key := string(iter.Key()[len(bucket)+1:])
+		if expired(snap, bucket, key, now) {
+			continue
+		}
+		val, err := load(snap, bucket, key, iter.Value())
+		if err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+		if err = h.add(b, bucket, key, val, false); err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+	}
+	if err = iter.Error(); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if err = store.db.Write(b, nil); err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return nil
+}
+
+// GetVersion loads a former value of a key
+func (store *Storage) GetVersion(bucket, key string, version uint64) ([]byte, error) {
+	if err := store.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	val, err := store.db.Get(versionKey(bucket, key, version), nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if len(val) < 9 || val[8] != 0 {
+		return nil, common.Error(common.ReadFailed, errors.New("version is a tombstone"))
+	}
+	return val[9:], nil
+}
+
+// ListVersions returns the history of a key, oldest first
+func (store *Storage) ListVersions(bucket, key string) ([]*common.Version, error) {
+	if err := store.checkBucket(bucket); err != nil {
+		return nil, err
+	}
+	prefix := versionKey(bucket, key, 0)
+	iter := store.db.NewIterator(util.BytesPrefix(prefix[:len(prefix)-8]), nil)
+	defer iter.Release()
+	versions := []*common.Version{}
+	for iter.Next() {
+		k, val := iter.Key(), iter.Value()
+		if len(val) < 9 {
+			return nil, common.Error(common.ReadFailed, errors.New("malformed version"))
+		}
+		versions = append(versions, &common.Version{
+			Version:  binary.BigEndian.Uint64(k[len(k)-8:]),
+			Modified: time.Unix(0, int64(binary.BigEndian.Uint64(val))),
+			Size:     int64(len(val) - 9),
+			Deleted:  val[8] != 0,
+		})
+	}
+	if err := iter.Error(); err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return versions, nil
+}
+
+// Close closes the storage
+func (store *Storage) Close() error {
+	store.stopReaper()
+	err := store.db.Close()
+	if err != nil {
+		if err == leveldb.ErrClosed {
+			return nil
+		}
+		return common.Error(common.CloseFailed, err)
+	}
+	return nil
+}
+
+func (store *Storage) checkBucket(bucket string) error {
+	ok, err := store.db.Has([]byte(bucket), nil)
+	if err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	if !ok {
+		return common.Error(common.BucketNotFound)
+	}
+	return nil
+}
+
+// keyRange returns the leveldb key range of a bucket matching the options
+func keyRange(bucket string, opts *common.ListOpts) *util.Range {
+	if opts == nil {
+		opts = &common.ListOpts{}
+	}
+	switch {
+	case opts.Prefix != "":
+		return util.BytesPrefix([]byte(bucket + "/" + opts.Prefix))
+	case opts.Start != "":
+		return &util.Range{Start: []byte(bucket + "/" + opts.Start), Limit: []byte(bucket + "/" + opts.End)}
+	}
+	return util.BytesPrefix([]byte(bucket + "/"))
+}
+
+func ttlKey(bucket, key string) []byte {
+	return []byte(ttlPrefix + bucket + "/" + key)
+}
+
+// reader is implemented by leveldb.DB, leveldb.Snapshot and leveldb.Transaction
+type reader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+}
+
+// iterReader is a reader which iterates, it is implemented by leveldb.Snapshot and leveldb.Transaction
+type iterReader interface {
+	reader
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// expired checks the expiry index of a key
+func expired(r reader, bucket, key string, now time.Time) bool {
+	val, err := r.Get(ttlKey(bucket, key), nil)
+	if err != nil {
+		return false
+	}
+	return !now.Before(deadline(val))
+}
+
+func deadline(val []byte) time.Time {
+	if len(val) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(val)))
+}
+
+// manifest describes a streamed value, its chunks are stored under the id of the upload
+// so a new upload never overwrites the chunks of the current value.
+type manifest struct {
+	id     uint64
+	chunks uint64
+}
+
+func (m *manifest) bytes() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, m.id)
+	binary.BigEndian.PutUint64(b[8:], m.chunks)
+	return b
+}
+
+func (m *manifest) chunkKey(bucket, key string, i uint64) []byte {
+	suffix := make([]byte, 16)
+	binary.BigEndian.PutUint64(suffix, m.id)
+	binary.BigEndian.PutUint64(suffix[8:], i)
+	return append([]byte(chunkPrefix+bucket+"/"+key+"\x00"), suffix...)
+}
+
+// drop adds the deletion of all chunks to b
+func (m *manifest) drop(b *leveldb.Batch, bucket, key string) {
+	for i := uint64(0); i < m.chunks; i++ {
+		b.Delete(m.chunkKey(bucket, key, i))
+	}
+}
+
+func streamKey(bucket, key string) []byte {
+	return []byte(streamPrefix + bucket + "/" + key)
+}
+
+// readManifest returns the manifest of a streamed value or nil for a plain value
+func readManifest(r reader, bucket, key string) (*manifest, error) {
+	val, err := r.Get(streamKey(bucket, key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(val) != 16 {
+		return nil, errors.New("malformed stream manifest")
+	}
+	return &manifest{id: binary.BigEndian.Uint64(val), chunks: binary.BigEndian.Uint64(val[8:])}, nil
+}
+
+// dropStream adds the deletion of the chunks and the manifest of a streamed value to b
+func dropStream(r reader, b *leveldb.Batch, bucket, key string) error {
+	m, err := readManifest(r, bucket, key)
+	if err != nil || m == nil {
+		return err
+	}
+	m.drop(b, bucket, key)
+	b.Delete(streamKey(bucket, key))
+	return nil
+}
+
+// load returns val, or the reassembled chunks if key holds a streamed value
+func load(r reader, bucket, key string, val []byte) ([]byte, error) {
+	m, err := readManifest(r, bucket, key)
+	if err != nil || m == nil {
+		return val, err
+	}
+	buf := &bytes.Buffer{}
+	for i := uint64(0); i < m.chunks; i++ {
+		chunk, err := r.Get(m.chunkKey(bucket, key, i), nil)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(chunk)
+	}
+	return buf.Bytes(), nil
+}
+
+func metaKey(bucket, key string) []byte {
+	return []byte(metaPrefix + bucket + "/" + key)
+}
+
+// readMeta returns the metadata of a key or nil if it has none
+func readMeta(r reader, bucket, key string) (*common.Metadata, error) {
+	val, err := r.Get(metaKey(bucket, key), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &common.Metadata{}
+	if err = json.Unmarshal(val, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// touch adds the metadata of a new value of size bytes to b
+func touch(r reader, b *leveldb.Batch, bucket, key string, size int64, meta *common.Metadata) error {
+	old, err := readMeta(r, bucket, key)
+	if err != nil {
+		return err
+	}
+	val, err := json.Marshal(common.Touch(old, meta, size, time.Now()))
+	if err != nil {
+		return err
+	}
+	b.Put(metaKey(bucket, key), val)
+	return nil
+}
+
+// stat returns the metadata of key, val is its raw value
+// Values written before metadata was kept only report their size.
+func stat(r reader, bucket, key string, val []byte) (*common.Metadata, error) {
+	meta, err := readMeta(r, bucket, key)
+	if err != nil || meta != nil {
+		return meta, err
+	}
+	if val, err = load(r, bucket, key, val); err != nil {
+		return nil, err
+	}
+	return &common.Metadata{Size: int64(len(val))}, nil
+}
+
+func versionedKey(bucket string) []byte {
+	return []byte(versionedPrefix + bucket)
+}
+
+func headKey(bucket, key string) []byte {
+	return []byte(headPrefix + bucket + "/" + key)
+}
+
+func versionKey(bucket, key string, version uint64) []byte {
+	suffix := make([]byte, 8)
+	binary.BigEndian.PutUint64(suffix, version)
+	return append([]byte(versionPrefix+bucket+"/"+key+"\x00"), suffix...)
+}
+
+// history adds the versions of the keys of versioned buckets to a batch
+// It remembers the keys it has seen, so a batch may change a key more than once.
+type history struct {
+	r         reader
+	heads     map[string]uint64
+	live      map[string]bool
+	versioned map[string]bool
+}
+
+func newHistory(r reader) *history {
+	return &history{r: r, heads: make(map[string]uint64), live: make(map[string]bool), versioned: make(map[string]bool)}
+}
+
+// add adds a version of key to b if its bucket is versioned
+// Deleting a key which does not exist adds no tombstone.
+func (h *history) add(b *leveldb.Batch, bucket, key string, value []byte, deleted bool) error {
+	versioned, ok := h.versioned[bucket]
+	if !ok {
+		_, err := h.r.Get(versionedKey(bucket), nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			return err
+		}
+		versioned = err == nil
+		h.versioned[bucket] = versioned
+	}
+	if !versioned {
+		return nil
+	}
+	id := bucket + "/" + key
+	head, ok := h.heads[id]
+	if !ok {
+		val, err := h.r.Get(headKey(bucket, key), nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			return err
+		}
+		if len(val) == 8 {
+			head = binary.BigEndian.Uint64(val)
+		}
+		_, err = h.r.Get([]byte(id), nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			return err
+		}
+		h.live[id] = err == nil
+	}
+	if deleted && !h.live[id] {
+		return nil
+	}
+	head++
+	h.heads[id] = head
+	h.live[id] = !deleted
+	val := make([]byte, 9, 9+len(value))
+	binary.BigEndian.PutUint64(val, uint64(time.Now().UnixNano()))
+	if deleted {
+		val[8] = 1
+	}
+	b.Put(versionKey(bucket, key, head), append(val, value...))
+	num := make([]byte, 8)
+	binary.BigEndian.PutUint64(num, head)
+	b.Put(headKey(bucket, key), num)
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/common"
 	"github.com/trusch/storage/testsuite"
 )
 
@@ -30,6 +31,38 @@ func (suite *StorageSuite) TestClose() {
 	os.RemoveAll("./close-test.db")
 }
 
+func (suite *StorageSuite) TestTransactionListOptions() {
+	suite.NoError(suite.Store.CreateBucket("tx-list"))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		suite.NoError(suite.Store.Put("tx-list", key, []byte(key)))
+	}
+	tx, err := suite.Store.(*Storage).Begin()
+	suite.NoError(err)
+	for _, c := range []struct {
+		opts     *common.ListOpts
+		expected []string
+	}{
+		{&common.ListOpts{Limit: 2}, []string{"a", "b"}},
+		{&common.ListOpts{Reverse: true, Limit: 3}, []string{"d", "c", "b"}},
+		{&common.ListOpts{Cursor: common.NewCursor("b")}, []string{"c", "d"}},
+		{&common.ListOpts{Reverse: true, Cursor: common.NewCursor("c")}, []string{"b", "a"}},
+	} {
+		ch, err := tx.List("tx-list", c.opts)
+		suite.NoError(err)
+		keys := []string{}
+		for doc := range ch {
+			keys = append(keys, doc.Key)
+		}
+		suite.Equal(c.expected, keys, "%+v", c.opts)
+	}
+	ch, err := tx.List("tx-list", &common.ListOpts{KeysOnly: true})
+	suite.NoError(err)
+	suite.Nil((<-ch).Value)
+	// the transaction blocks the writes of the storage until it is done
+	suite.NoError(tx.Rollback())
+	suite.NoError(suite.Store.DeleteBucket("tx-list"))
+}
+
 func TestLevelDBStorage(t *testing.T) {
 	store, err := NewStorage("./test-store.db")
 	assert.NoError(t, err)
@@ -0,0 +1,30 @@
+// Package register makes the leveldb engine available to meta.NewStorage under the leveldb scheme.
+package register
+
+import (
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/engines/leveldb"
+	"github.com/trusch/storage/engines/meta"
+)
+
+// leveldb:///data?cache=64MB&bloom=10&compression=snappy
+func init() {
+	meta.Register("leveldb", func(uri string, options ...interface{}) (storage.Storage, error) {
+		p, err := meta.Path(uri)
+		if err != nil {
+			return nil, err
+		}
+		q, err := meta.ParseQuery("leveldb", uri)
+		if err != nil {
+			return nil, err
+		}
+		opts := leveldb.DefaultOptions
+		opts.CacheSize = q.Size("cache", opts.CacheSize)
+		opts.BloomBits = q.Integer("bloom", opts.BloomBits)
+		opts.NoCompression = q.Choice("compression", "snappy", "snappy", "none") == "none"
+		if err = q.Done(); err != nil {
+			return nil, err
+		}
+		return leveldb.NewStorageWithOptions(p, opts)
+	})
+}
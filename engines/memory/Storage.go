@@ -1,128 +1,923 @@
 package memory
 
 import (
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
 	"sort"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/btree"
+	"github.com/trusch/storage"
 	"github.com/trusch/storage/common"
 )
 
 // Storage creates the apropriate store from an URI
+// Every bucket is a btree sorted by key, so prefix and range listings only visit the matching keys.
+// With a path the storage is persisted to a snapshot file and an append-only log of the writes since.
 type Storage struct {
-	buckets map[string]map[string][]byte
+	// the counters come first, so they are aligned for atomic access on 32 bit platforms
+	hits, misses, evictions uint64
+	mutex                   sync.RWMutex
+	view
+	// deadlines is a min-heap over the expiries for the reaper
+	deadlines  expiryHeap
+	stopReaper func()
+	options    Options
+	// aof is the append-only log of a persistent storage
+	aof *appendLog
+	// compactMutex serializes compactions, compacting is set while one runs in the background
+	compactMutex sync.Mutex
+	compacting   bool
+	// policy chooses the entries to evict if the storage is bounded, reads update it under policyMutex
+	policy      policy
+	policyMutex sync.Mutex
+	entries     int
+	bytes       int64
 }
 
+// view holds the btrees of all buckets
+// Snapshots get lazy clones of the btrees, which share their nodes until either side writes.
+type view struct {
+	buckets map[string]*btree.BTree
+}
+
+// degree is the degree of the bucket btrees
+const degree = 32
+
+// entry is an item of a bucket btree, entries are replaced instead of being modified
+type entry struct {
+	key   string
+	value []byte
+	meta  *common.Metadata
+	// expires is the deadline of an expiring key, it is zero for keys without a TTL
+	expires time.Time
+}
+
+// Less orders the entries by key
+func (e *entry) Less(than btree.Item) bool {
+	return e.key < than.(*entry).key
+}
+
+// size is the number of bytes an entry counts towards MaxBytes
+func (e *entry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// metadata returns a copy of the metadata of the entry
+func (e *entry) metadata() *common.Metadata {
+	if e.meta == nil {
+		return &common.Metadata{Size: int64(len(e.value))}
+	}
+	cp := *e.meta
+	return &cp
+}
+
+// lookup returns the entry of a key or nil, b may be nil
+func lookup(b *btree.BTree, key string) *entry {
+	if b == nil {
+		return nil
+	}
+	if item := b.Get(&entry{key: key}); item != nil {
+		return item.(*entry)
+	}
+	return nil
+}
+
+// Options tune a memory storage
+type Options struct {
+	// Path is the snapshot file of a persistent storage, the log is kept next to it with the suffix .aof
+	// The storage is not persisted if it is empty.
+	Path string
+	// Fsync flushes the log to disk before a write returns
+	Fsync bool
+	// CompactSize is the log size at which a new snapshot is written in the background, 0 disables it
+	CompactSize int
+	// MaxBytes bounds the size of all keys and values, 0 means no bound
+	MaxBytes int
+	// MaxEntries bounds the number of entries in all buckets, 0 means no bound
+	MaxEntries int
+	// Eviction chooses the entries removed to stay within the bounds, the default is LRU
+	Eviction Policy
+}
+
+// DefaultOptions are the options NewStorage uses
+var DefaultOptions = Options{CompactSize: 64 << 20}
+
 // NewStorage creates a new storage from a URI
 func NewStorage() (*Storage, error) {
-	return &Storage{make(map[string]map[string][]byte)}, nil
+	return NewStorageWithOptions(DefaultOptions)
+}
+
+// NewStorageWithOptions creates a new storage with the given options
+// A persistent storage loads its snapshot and replays its log first.
+func NewStorageWithOptions(options Options) (*Storage, error) {
+	store := &Storage{
+		view:    view{buckets: make(map[string]*btree.BTree)},
+		options: options,
+	}
+	if options.MaxBytes > 0 || options.MaxEntries > 0 {
+		p, err := newPolicy(options.Eviction)
+		if err != nil {
+			return nil, common.Error(common.InitFailed, err)
+		}
+		store.policy = p
+	}
+	if options.Path != "" {
+		if err := store.load(); err != nil {
+			return nil, common.Error(common.InitFailed, err)
+		}
+	}
+	store.stopReaper = common.StartReaper(store.reap)
+	return store, nil
 }
 
 // Put saves a byteslice to the db.
 // Example: Save("/foo/bar", []byte{1,2,3})
 func (store *Storage) Put(bucket, key string, value []byte) error {
-	b, ok := store.buckets[bucket]
-	if !ok {
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.buckets[bucket]; !ok {
 		return common.Error(common.BucketNotFound)
 	}
-	b[key] = value
-	return nil
+	return store.commit(store.put(bucket, key, value, nil))
 }
 
 // Get loads data from a key
 func (store *Storage) Get(bucket, key string) ([]byte, error) {
+	return store.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
 	b, ok := store.buckets[bucket]
 	if !ok {
 		return nil, common.Error(common.BucketNotFound)
 	}
-	v, ok := b[key]
-	if !ok {
+	e := lookup(b, key)
+	if e == nil || e.expired(time.Now()) {
+		atomic.AddUint64(&store.misses, 1)
 		return nil, common.Error(common.ReadFailed)
 	}
-	return v, nil
+	atomic.AddUint64(&store.hits, 1)
+	if store.policy != nil {
+		store.policyMutex.Lock()
+		store.policy.touch(slot{bucket, key})
+		store.policyMutex.Unlock()
+	}
+	return e.value, nil
 }
 
 // Delete deletes a value from the db
 func (store *Storage) Delete(bucket, key string) error {
-	b, ok := store.buckets[bucket]
-	if !ok {
-		return common.Error(common.BucketNotFound)
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	_, ok = b[key]
-	if !ok {
-		return nil
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.buckets[bucket]; !ok {
+		return common.Error(common.BucketNotFound)
 	}
-	delete(b, key)
-	return nil
+	return store.commit(&record{Op: opDelete, Bucket: bucket, Key: key})
 }
 
 // CreateBucket creates a bucket
 func (store *Storage) CreateBucket(bucket string) error {
+	return store.CreateBucketContext(context.Background(), bucket)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 	if _, ok := store.buckets[bucket]; ok {
 		return nil
 	}
-	store.buckets[bucket] = make(map[string][]byte)
-	return nil
+	return store.commit(&record{Op: opCreate, Bucket: bucket})
 }
 
 // DeleteBucket deletes a bucket
 func (store *Storage) DeleteBucket(bucket string) error {
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 	if _, ok := store.buckets[bucket]; !ok {
 		return common.Error(common.BucketNotFound)
 	}
-	delete(store.buckets, bucket)
-	return nil
+	return store.commit(&record{Op: opDrop, Bucket: bucket})
+}
+
+// ListBuckets returns the names of all buckets in lexical order
+func (store *Storage) ListBuckets() ([]string, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.view.listBuckets(), nil
+}
+
+func (v *view) listBuckets() []string {
+	buckets := make([]string, 0, len(v.buckets))
+	for bucket := range v.buckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
 }
 
 // List returns all Entries of a directory
 // optionally provide arguments to specifiy a key offset and a key limit
 // Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
 func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
-	b, ok := store.buckets[bucket]
+	return store.ListContext(context.Background(), bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.IterateContext(ctx, bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(ctx, iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket as they were when it was called
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &common.ListOpts{}
+	}
+	docs, err := store.collect(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.ContextIterator(ctx, common.SliceIterator(docs)), nil
+}
+
+// Count returns the number of entries of a bucket, values are not loaded
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	iter, err := store.Iterate(bucket, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	return common.Count(iter)
+}
+
+// collect returns the sorted docs of a bucket matching opts
+func (store *Storage) collect(bucket string, opts *common.ListOpts) ([]*common.DocInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.view.collect(bucket, opts, time.Now())
+}
+
+// collect returns the docs of a bucket matching opts which have not expired at now in listing order
+// The matching keys form a range beginning at the prefix or the start key. The btree is walked from the
+// cursor or the end of that range in the direction of opts and the walk stops once Limit docs are found.
+func (v *view) collect(bucket string, opts *common.ListOpts, now time.Time) ([]*common.DocInfo, error) {
+	b, ok := v.buckets[bucket]
 	if !ok {
 		return nil, common.Error(common.BucketNotFound)
 	}
+	cursor, hasCursor, err := opts.CursorKey()
+	if err != nil {
+		return nil, err
+	}
+	from := opts.Prefix
+	if from == "" {
+		from = opts.Start
+	}
+	docs := make([]*common.DocInfo, 0)
+	visit := func(item btree.Item) bool {
+		e := item.(*entry)
+		if !opts.Match(e.key) {
+			// a descending walk may start above the range
+			return opts.Reverse && e.key >= from
+		}
+		if hasCursor && (opts.Reverse && e.key >= cursor || !opts.Reverse && e.key <= cursor) {
+			return true
+		}
+		if !e.expired(now) {
+			doc := &common.DocInfo{Key: e.key}
+			if !opts.KeysOnly {
+				doc.Value = e.value
+			}
+			if opts.WithMeta {
+				doc.Meta = e.metadata()
+			}
+			docs = append(docs, doc)
+		}
+		return opts.Limit <= 0 || len(docs) < opts.Limit
+	}
+	if !opts.Reverse {
+		if hasCursor && cursor > from {
+			from = cursor
+		}
+		b.AscendGreaterOrEqual(&entry{key: from}, visit)
+		return docs, nil
+	}
+	to, bounded := upperBound(opts)
+	if hasCursor && (!bounded || cursor < to) {
+		to, bounded = cursor, true
+	}
+	if bounded {
+		b.DescendLessOrEqual(&entry{key: to}, visit)
+	} else {
+		b.Descend(visit)
+	}
+	return docs, nil
+}
+
+// upperBound returns a key above all keys matching the prefix or range of opts, ok is false if there is none
+func upperBound(opts *common.ListOpts) (key string, ok bool) {
+	switch {
+	case opts.Prefix != "":
+		// the prefix with its last byte below 0xff incremented
+		p := []byte(opts.Prefix)
+		for i := len(p) - 1; i >= 0; i-- {
+			if p[i] < 0xff {
+				p[i]++
+				return string(p[:i+1]), true
+			}
+		}
+	case opts.Start != "":
+		return opts.End, true
+	}
+	return "", false
+}
+
+// NewBatch creates an empty batch which is applied while holding the storage lock
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+// Commit writes all operations of the batch atomically
+func (b *batch) Commit() error {
+	b.store.mutex.Lock()
+	defer b.store.mutex.Unlock()
+	for _, bucket := range b.Buckets() {
+		if _, ok := b.store.buckets[bucket]; !ok {
+			return common.Error(common.BucketNotFound)
+		}
+	}
+	rec := &record{Op: opBatch}
+	for _, op := range b.Ops {
+		if op.Delete {
+			rec.Ops = append(rec.Ops, &record{Op: opDelete, Bucket: op.Bucket, Key: op.Key})
+		} else {
+			rec.Ops = append(rec.Ops, b.store.put(op.Bucket, op.Key, op.Value, nil))
+		}
+	}
+	return b.store.commit(rec)
+}
+
+// put returns the record writing a value along with its metadata, the creation time of the current value is kept
+// The caller must hold the write lock.
+func (store *Storage) put(bucket, key string, value []byte, meta *common.Metadata) *record {
+	var old *common.Metadata
+	if e := lookup(store.buckets[bucket], key); e != nil {
+		old = e.meta
+	}
+	return &record{
+		Op:     opPut,
+		Bucket: bucket,
+		Key:    key,
+		Value:  value,
+		Meta:   common.Touch(old, meta, int64(len(value)), time.Now()),
+	}
+}
+
+// commit appends a record to the log of a persistent storage and applies it
+// The caller must hold the write lock.
+func (store *Storage) commit(rec *record) error {
+	if store.aof != nil {
+		if err := store.aof.append(rec); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		store.compactInBackground()
+	}
+	store.apply(rec)
+	store.evict()
+	return nil
+}
+
+// evict removes the entries chosen by the policy until the storage is within its bounds
+// Evictions are not logged, a persistent storage evicts again once it is loaded.
+// The caller must hold the write lock.
+func (store *Storage) evict() {
+	if store.policy == nil {
+		return
+	}
+	for (store.options.MaxBytes > 0 && store.bytes > int64(store.options.MaxBytes)) ||
+		(store.options.MaxEntries > 0 && store.entries > store.options.MaxEntries) {
+		s, ok := store.policy.evict()
+		if !ok {
+			return
+		}
+		store.apply(&record{Op: opDelete, Bucket: s.bucket, Key: s.key})
+		atomic.AddUint64(&store.evictions, 1)
+	}
+}
+
+// Stats are the counters of a storage
+type Stats struct {
+	// Entries and Bytes are the number of entries and their size as it counts towards the bounds
+	Entries int
+	Bytes   int64
+	// Hits and Misses count the reads of existing and missing keys by Get
+	Hits   uint64
+	Misses uint64
+	// Evictions counts the entries removed to stay within the bounds
+	Evictions uint64
+}
+
+// Stats returns the counters of the storage
+func (store *Storage) Stats() Stats {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return Stats{
+		Entries:   store.entries,
+		Bytes:     store.bytes,
+		Hits:      atomic.LoadUint64(&store.hits),
+		Misses:    atomic.LoadUint64(&store.misses),
+		Evictions: atomic.LoadUint64(&store.evictions),
+	}
+}
+
+// apply executes a record, puts into missing buckets are ignored
+// It is used for writes and to load a persistent storage. The caller must hold the write lock.
+func (store *Storage) apply(rec *record) {
+	switch rec.Op {
+	case opCreate:
+		if _, ok := store.buckets[rec.Bucket]; !ok {
+			store.buckets[rec.Bucket] = btree.New(degree)
+		}
+	case opDrop:
+		if b, ok := store.buckets[rec.Bucket]; ok {
+			b.Ascend(func(item btree.Item) bool {
+				store.forget(rec.Bucket, item.(*entry))
+				return true
+			})
+			delete(store.buckets, rec.Bucket)
+		}
+	case opPut:
+		b, ok := store.buckets[rec.Bucket]
+		if !ok {
+			return
+		}
+		e := &entry{key: rec.Key, value: rec.Value, meta: rec.Meta}
+		if rec.Expires != nil {
+			e.expires = *rec.Expires
+			heap.Push(&store.deadlines, &expiry{rec.Bucket, rec.Key, e.expires})
+		}
+		if old := b.ReplaceOrInsert(e); old != nil {
+			store.entries--
+			store.bytes -= old.(*entry).size()
+		}
+		store.entries++
+		store.bytes += e.size()
+		if store.policy != nil {
+			store.policy.add(slot{rec.Bucket, rec.Key})
+		}
+	case opDelete:
+		if b, ok := store.buckets[rec.Bucket]; ok {
+			if old := b.Delete(&entry{key: rec.Key}); old != nil {
+				store.forget(rec.Bucket, old.(*entry))
+			}
+		}
+	case opBatch:
+		for _, op := range rec.Ops {
+			store.apply(op)
+		}
+	}
+}
+
+// forget removes a deleted entry from the counts and the policy, the caller must hold the write lock
+func (store *Storage) forget(bucket string, e *entry) {
+	store.entries--
+	store.bytes -= e.size()
+	if store.policy != nil {
+		store.policy.remove(slot{bucket, e.key})
+	}
+}
+
+// clone returns a view with lazy clones of all buckets
+// The caller must hold the write lock, since cloning a btree changes it.
+func (v *view) clone() view {
+	cp := view{buckets: make(map[string]*btree.BTree, len(v.buckets))}
+	for name, b := range v.buckets {
+		cp.buckets[name] = b.Clone()
+	}
+	return cp
+}
+
+// snapshot returns a copy-on-write view of the current buckets
+func (store *Storage) snapshot() view {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.view.clone()
+}
+
+// Begin starts a transaction working on a copy-on-write snapshot of the storage
+// Transactions are optimistic: Commit fails with a Conflict error if a key written by the
+// transaction has been changed by someone else since Begin.
+func (store *Storage) Begin() (storage.Tx, error) {
+	return &tx{
+		store:    store,
+		snapshot: store.snapshot(),
+		writes:   make(map[string]map[string]*write),
+	}, nil
+}
+
+type write struct {
+	value   []byte
+	deleted bool
+}
+
+type tx struct {
+	store    *Storage
+	snapshot view
+	writes   map[string]map[string]*write
+	closed   bool
+}
+
+// Get loads data from a key
+func (t *tx) Get(bucket, key string) ([]byte, error) {
+	b, ok := t.snapshot.buckets[bucket]
+	if !ok {
+		return nil, common.Error(common.BucketNotFound)
+	}
+	if w, ok := t.writes[bucket][key]; ok {
+		if w.deleted {
+			return nil, common.Error(common.ReadFailed)
+		}
+		return w.value, nil
+	}
+	e := lookup(b, key)
+	if e == nil || e.expired(time.Now()) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	return e.value, nil
+}
+
+// Put saves a byteslice to the db
+func (t *tx) Put(bucket, key string, value []byte) error {
+	return t.set(bucket, key, &write{value: value})
+}
+
+// Delete deletes a value from the db
+func (t *tx) Delete(bucket, key string) error {
+	return t.set(bucket, key, &write{deleted: true})
+}
+
+func (t *tx) set(bucket, key string, w *write) error {
+	if t.closed {
+		return common.Error(common.WriteFailed, errors.New("transaction closed"))
+	}
+	if _, ok := t.snapshot.buckets[bucket]; !ok {
+		return common.Error(common.BucketNotFound)
+	}
+	if _, ok := t.writes[bucket]; !ok {
+		t.writes[bucket] = make(map[string]*write)
+	}
+	t.writes[bucket][key] = w
+	return nil
+}
+
+// List returns all Entries of a directory including the writes of the transaction
+func (t *tx) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
 	if opts == nil {
 		opts = &common.ListOpts{}
 	}
+	match := &common.ListOpts{Prefix: opts.Prefix, Start: opts.Start, End: opts.End}
+	snapshot, err := t.snapshot.collect(bucket, match, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]*common.DocInfo, 0, len(snapshot))
+	for _, doc := range snapshot {
+		if _, written := t.writes[bucket][doc.Key]; !written {
+			docs = append(docs, doc)
+		}
+	}
+	for key, w := range t.writes[bucket] {
+		if !w.deleted && match.Match(key) {
+			docs = append(docs, &common.DocInfo{Key: key, Value: w.value})
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Key < docs[j].Key })
+	return common.DocChannel(docs), nil
+}
 
-	keys := make([]string, len(b))
-	i := 0
-	for key := range b {
-		keys[i] = key
-		i++
-	}
-	sort.Strings(keys)
-
-	ch := make(chan *common.DocInfo, 64)
-	go func() {
-		for _, key := range keys {
-			val := b[key]
-			switch {
-			case opts.Prefix != "":
-				{
-					if strings.HasPrefix(key, opts.Prefix) {
-						ch <- &common.DocInfo{Key: key, Value: val}
-					}
-				}
-			case opts.Start != "":
-				{
-					if strings.Compare(opts.Start, key) <= 0 && strings.Compare(key, opts.End) < 0 {
-						ch <- &common.DocInfo{Key: key, Value: val}
-					}
-				}
-			default:
-				{
-					ch <- &common.DocInfo{Key: key, Value: val}
-				}
+// Commit applies the writes if none of the written keys has been changed since Begin
+func (t *tx) Commit() error {
+	if t.closed {
+		return common.Error(common.WriteFailed, errors.New("transaction closed"))
+	}
+	t.closed = true
+	t.store.mutex.Lock()
+	defer t.store.mutex.Unlock()
+	for bucket, writes := range t.writes {
+		current, ok := t.store.buckets[bucket]
+		if !ok {
+			return common.Error(common.BucketNotFound)
+		}
+		for key := range writes {
+			old, now := lookup(t.snapshot.buckets[bucket], key), lookup(current, key)
+			if (old == nil) != (now == nil) || (old != nil && !bytes.Equal(old.value, now.value)) {
+				return common.Error(common.Conflict, fmt.Errorf("%v/%v changed since begin", bucket, key))
 			}
 		}
-		close(ch)
-	}()
+	}
+	rec := &record{Op: opBatch}
+	for bucket, writes := range t.writes {
+		for key, w := range writes {
+			if w.deleted {
+				rec.Ops = append(rec.Ops, &record{Op: opDelete, Bucket: bucket, Key: key})
+			} else {
+				rec.Ops = append(rec.Ops, t.store.put(bucket, key, w.value, nil))
+			}
+		}
+	}
+	return t.store.commit(rec)
+}
 
-	return ch, nil
+// Rollback discards the transaction
+func (t *tx) Rollback() error {
+	t.closed = true
+	t.writes = nil
+	return nil
 }
 
-// Close closes the storage
+// CompareAndSwap saves new if the current value of key equals old
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.buckets[bucket]; !ok {
+		return false, common.Error(common.BucketNotFound)
+	}
+	if !common.Equal(store.current(bucket, key), old) {
+		return false, nil
+	}
+	if err := store.commit(store.put(bucket, key, new, nil)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return store.CompareAndSwap(bucket, key, nil, value)
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.buckets[bucket]; !ok {
+		return false, common.Error(common.BucketNotFound)
+	}
+	if old == nil || !common.Equal(store.current(bucket, key), old) {
+		return false, nil
+	}
+	if err := store.commit(&record{Op: opDelete, Bucket: bucket, Key: key}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// current returns the value of key or nil if it does not exist
+// The caller must hold the lock.
+func (store *Storage) current(bucket, key string) []byte {
+	e := lookup(store.buckets[bucket], key)
+	if e == nil || e.expired(time.Now()) {
+		return nil
+	}
+	if e.value == nil {
+		return []byte{}
+	}
+	return e.value
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.buckets[bucket]; !ok {
+		return common.Error(common.BucketNotFound)
+	}
+	rec := store.put(bucket, key, value, nil)
+	deadline := time.Now().Add(ttl)
+	rec.Expires = &deadline
+	return store.commit(rec)
+}
+
+// PutWithMeta saves a byteslice along with the content type and attributes of meta
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.buckets[bucket]; !ok {
+		return common.Error(common.BucketNotFound)
+	}
+	return store.commit(store.put(bucket, key, value, meta))
+}
+
+// Stat returns the metadata of a key
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	b, ok := store.buckets[bucket]
+	if !ok {
+		return nil, common.Error(common.BucketNotFound)
+	}
+	e := lookup(b, key)
+	if e == nil || e.expired(time.Now()) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	return e.metadata(), nil
+}
+
+// reap removes all expired keys
+// Heap entries whose deadline is outdated because the key was rewritten are skipped.
+// Removals are not logged, expired keys are dropped when a persistent storage is loaded.
+func (store *Storage) reap() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	for store.deadlines.Len() > 0 && !now.Before(store.deadlines[0].deadline) {
+		e := heap.Pop(&store.deadlines).(*expiry)
+		if current := lookup(store.buckets[e.bucket], e.key); current != nil && current.expires.Equal(e.deadline) {
+			store.apply(&record{Op: opDelete, Bucket: e.bucket, Key: e.key})
+		}
+	}
+}
+
+type expiry struct {
+	bucket   string
+	key      string
+	deadline time.Time
+}
+
+// expiryHeap implements heap.Interface ordered by deadline
+type expiryHeap []*expiry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(*expiry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Snapshot returns a read-only view of the storage as it is now
+// The btrees are shared with the storage until they are written, which copies the touched nodes first.
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	return &snapshot{view: store.snapshot(), at: time.Now()}, nil
+}
+
+// snapshot is a frozen view, keys are expired as of the time the snapshot was taken
+type snapshot struct {
+	common.ReadOnlyStorage
+	view
+	at time.Time
+}
+
+// Get loads data from a key
+func (snap *snapshot) Get(bucket, key string) ([]byte, error) {
+	e, err := snap.entry(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return e.value, nil
+}
+
+// Stat returns the metadata of a key
+func (snap *snapshot) Stat(bucket, key string) (*common.Metadata, error) {
+	e, err := snap.entry(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return e.metadata(), nil
+}
+
+func (snap *snapshot) entry(bucket, key string) (*entry, error) {
+	b, ok := snap.buckets[bucket]
+	if !ok {
+		return nil, common.Error(common.BucketNotFound)
+	}
+	e := lookup(b, key)
+	if e == nil || e.expired(snap.at) {
+		return nil, common.Error(common.ReadFailed)
+	}
+	return e, nil
+}
+
+// ListBuckets returns the names of all buckets in lexical order
+func (snap *snapshot) ListBuckets() ([]string, error) {
+	return snap.listBuckets(), nil
+}
+
+// List returns all Entries of a bucket
+func (snap *snapshot) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := snap.Iterate(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(context.Background(), iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (snap *snapshot) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if opts == nil {
+		opts = &common.ListOpts{}
+	}
+	docs, err := snap.collect(bucket, opts, snap.at)
+	if err != nil {
+		return nil, err
+	}
+	return common.SliceIterator(docs), nil
+}
+
+// Count returns the number of entries of a bucket
+func (snap *snapshot) Count(bucket string, opts *common.ListOpts) (int, error) {
+	iter, err := snap.Iterate(bucket, common.KeysOnly(opts))
+	if err != nil {
+		return 0, err
+	}
+	return common.Count(iter)
+}
+
+// Close releases the snapshot
+func (snap *snapshot) Close() error {
+	snap.view = view{}
+	return nil
+}
+
+// Close closes the storage, a persistent storage writes a new snapshot and empties its log first
 func (store *Storage) Close() error {
+	store.stopReaper()
+	store.compactMutex.Lock()
+	defer store.compactMutex.Unlock()
+	err := store.compact()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.aof != nil {
+		if e := store.aof.file.Close(); err == nil {
+			err = e
+		}
+		store.aof = nil
+	}
+	if err != nil {
+		return common.Error(common.CloseFailed, err)
+	}
 	return nil
 }
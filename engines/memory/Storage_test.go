@@ -1,11 +1,17 @@
 package memory
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/common"
 	"github.com/trusch/storage/testsuite"
 )
 
@@ -25,3 +31,278 @@ func TestFileStorage(t *testing.T) {
 	assert.NoError(t, err)
 	defer os.RemoveAll("./test-store.db")
 }
+
+func TestTransactionIsolation(t *testing.T) {
+	store, err := NewStorage()
+	assert.NoError(t, err)
+	err = store.CreateBucket("bucket-name")
+	assert.NoError(t, err)
+	err = store.Put("bucket-name", "foo", []byte("v1"))
+	assert.NoError(t, err)
+	tx1, err := store.Begin()
+	assert.NoError(t, err)
+	tx2, err := store.Begin()
+	assert.NoError(t, err)
+	// writes outside of tx1 are invisible to it
+	err = store.Put("bucket-name", "bar", []byte("outside"))
+	assert.NoError(t, err)
+	_, err = tx1.Get("bucket-name", "bar")
+	assert.Error(t, err)
+	err = tx1.Put("bucket-name", "foo", []byte("tx1"))
+	assert.NoError(t, err)
+	err = tx2.Put("bucket-name", "foo", []byte("tx2"))
+	assert.NoError(t, err)
+	err = tx1.Commit()
+	assert.NoError(t, err)
+	// first committer wins
+	err = tx2.Commit()
+	assert.True(t, common.IsError(err, common.Conflict))
+	val, err := store.Get("bucket-name", "foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "tx1", string(val))
+}
+
+func TestReaper(t *testing.T) {
+	interval := common.ReapInterval
+	common.ReapInterval = 10 * time.Millisecond
+	defer func() { common.ReapInterval = interval }()
+	store, err := NewStorage()
+	assert.NoError(t, err)
+	defer store.Close()
+	err = store.CreateBucket("bucket-name")
+	assert.NoError(t, err)
+	err = store.PutWithTTL("bucket-name", "foo", []byte("v1"), 20*time.Millisecond)
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	assert.Zero(t, store.buckets["bucket-name"].Len())
+	assert.Zero(t, store.deadlines.Len())
+}
+
+func TestPersistentStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewStorageWithOptions(Options{Path: filepath.Join(dir, "snapshot")})
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := Options{Path: filepath.Join(dir, "snapshot")}
+	store, err := NewStorageWithOptions(opts)
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	assert.NoError(t, store.CreateBucket("dropped"))
+	assert.NoError(t, store.PutWithMeta("bucket-name", "foo", []byte("v1"), &common.Metadata{ContentType: "text/plain"}))
+	assert.NoError(t, store.PutWithTTL("bucket-name", "expired", []byte("v1"), time.Millisecond))
+	assert.NoError(t, store.PutWithTTL("bucket-name", "ttl", []byte("v1"), time.Hour))
+	assert.NoError(t, store.Compact())
+	// everything after the compaction is replayed from the log
+	batch := store.NewBatch()
+	batch.Put("bucket-name", "bar", []byte("v2"))
+	batch.Delete("bucket-name", "foo")
+	assert.NoError(t, batch.Commit())
+	assert.NoError(t, store.DeleteBucket("dropped"))
+	// simulate a crash in the middle of a write
+	store.stopReaper()
+	_, err = store.aof.file.Write([]byte(`{"op":"put","bucket":"bucket-na`))
+	assert.NoError(t, err)
+	store.aof.file.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	store, err = NewStorageWithOptions(opts)
+	assert.NoError(t, err)
+	buckets, err := store.ListBuckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bucket-name"}, buckets)
+	_, err = store.Get("bucket-name", "foo")
+	assert.True(t, common.IsError(err, common.ReadFailed))
+	val, err := store.Get("bucket-name", "bar")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(val))
+	_, err = store.Get("bucket-name", "expired")
+	assert.Error(t, err)
+	_, err = store.Get("bucket-name", "ttl")
+	assert.NoError(t, err)
+	// the cut off record is gone, so new writes are readable again
+	assert.NoError(t, store.PutWithMeta("bucket-name", "baz", []byte("v3"), &common.Metadata{ContentType: "text/plain"}))
+	store.stopReaper()
+	store.aof.file.Close()
+
+	store, err = NewStorageWithOptions(opts)
+	assert.NoError(t, err)
+	defer store.Close()
+	meta, err := store.Stat("bucket-name", "baz")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+}
+
+func TestCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := Options{Path: filepath.Join(dir, "snapshot"), CompactSize: 1024}
+	store, err := NewStorageWithOptions(opts)
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	for i := 0; i < 1000; i++ {
+		assert.NoError(t, store.Put("bucket-name", fmt.Sprintf("key-%03d", i%100), []byte(fmt.Sprint(i))))
+	}
+	assert.NoError(t, store.Compact())
+	info, err := os.Stat(opts.Path + ".aof")
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size())
+	assert.NoError(t, store.Close())
+
+	store, err = NewStorageWithOptions(opts)
+	assert.NoError(t, err)
+	defer store.Close()
+	n, err := store.Count("bucket-name", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+	val, err := store.Get("bucket-name", "key-099")
+	assert.NoError(t, err)
+	assert.Equal(t, "999", string(val))
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	store, err := NewStorage()
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				assert.NoError(t, store.Put("bucket-name", fmt.Sprintf("%v-%03d", i, j), []byte("v")))
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ch, err := store.List("bucket-name", &common.ListOpts{Prefix: fmt.Sprint(i)})
+				assert.NoError(t, err)
+				for range ch {
+				}
+				snap, err := store.Snapshot()
+				assert.NoError(t, err)
+				_, err = snap.Count("bucket-name", nil)
+				assert.NoError(t, err)
+				snap.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+	n, err := store.Count("bucket-name", &common.ListOpts{Prefix: "2-"})
+	assert.NoError(t, err)
+	assert.Equal(t, 200, n)
+}
+
+func TestEviction(t *testing.T) {
+	for policy, expected := range map[Policy]struct {
+		missing   []string
+		evictions uint64
+	}{
+		// d pushes out the least recently used b
+		LRU: {[]string{"b"}, 1},
+		// b and d have been used once, b longer ago, then e pushes out d
+		LFU: {[]string{"b", "d"}, 2},
+		// d pushes b out of the recent list, writing b again grows the target size of that list,
+		// so the next victim is the least recently used a of the frequent list
+		ARC: {[]string{"a"}, 2},
+	} {
+		store, err := NewStorageWithOptions(Options{MaxEntries: 3, Eviction: policy})
+		assert.NoError(t, err)
+		assert.NoError(t, store.CreateBucket("bucket-name"))
+		for _, key := range []string{"a", "b", "c"} {
+			assert.NoError(t, store.Put("bucket-name", key, []byte(key)))
+		}
+		for _, key := range []string{"a", "a", "c"} {
+			_, err = store.Get("bucket-name", key)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, store.Put("bucket-name", "d", []byte("d")))
+		switch policy {
+		case LFU:
+			assert.NoError(t, store.Put("bucket-name", "e", []byte("e")))
+		case ARC:
+			assert.NoError(t, store.Put("bucket-name", "b", []byte("b")))
+		}
+		for _, key := range expected.missing {
+			_, err = store.Get("bucket-name", key)
+			assert.True(t, common.IsError(err, common.ReadFailed), "%v should have evicted %v", policy, key)
+		}
+		stats := store.Stats()
+		assert.Equal(t, 3, stats.Entries, policy)
+		assert.Equal(t, uint64(3), stats.Hits, policy)
+		assert.Equal(t, uint64(len(expected.missing)), stats.Misses, policy)
+		assert.Equal(t, expected.evictions, stats.Evictions, policy)
+		assert.NoError(t, store.Close())
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	store, err := NewStorageWithOptions(Options{MaxBytes: 100})
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("a"))
+	assert.NoError(t, store.CreateBucket("b"))
+	// every entry counts 2 bytes of key and 8 bytes of value, the buckets share the bound
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, store.Put(string('a'+rune(i%2)), fmt.Sprintf("%02d", i), make([]byte, 8)))
+		assert.True(t, store.Stats().Bytes <= 100)
+	}
+	stats := store.Stats()
+	assert.Equal(t, 10, stats.Entries)
+	assert.Equal(t, uint64(10), stats.Evictions)
+	assert.NoError(t, store.DeleteBucket("a"))
+	stats = store.Stats()
+	assert.Equal(t, 5, stats.Entries)
+	assert.Equal(t, int64(50), stats.Bytes)
+
+	_, err = NewStorageWithOptions(Options{MaxEntries: 1, Eviction: "fifo"})
+	assert.True(t, common.IsError(err, common.InitFailed))
+}
+
+func TestCollect(t *testing.T) {
+	store, err := NewStorage()
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket"))
+	keys := []string{"a", "a\xff", "a\xff\xff", "b", "ba", "bb", "bc", "c", "d"}
+	for _, key := range keys {
+		assert.NoError(t, store.Put("bucket", key, []byte(key)))
+	}
+	// the walk from the cursor with the limit yields what paginating all matching docs does
+	for _, opts := range []common.ListOpts{
+		{Limit: 2},
+		{Reverse: true, Limit: 3},
+		{Prefix: "b", Reverse: true},
+		{Prefix: "a\xff", Reverse: true},
+		{Prefix: "b", Cursor: common.NewCursor("ba"), Limit: 1},
+		{Prefix: "b", Reverse: true, Cursor: common.NewCursor("bc")},
+		{Start: "a\xff", End: "bc", Reverse: true, Limit: 2},
+		{Start: "b", End: "d", Cursor: common.NewCursor("a")},
+		{Reverse: true, Cursor: common.NewCursor("bb"), Limit: 2},
+	} {
+		opts := opts
+		docs, err := store.collect("bucket", &opts)
+		assert.NoError(t, err)
+		all, err := store.collect("bucket", &common.ListOpts{Prefix: opts.Prefix, Start: opts.Start, End: opts.End})
+		assert.NoError(t, err)
+		expected, err := common.Paginate(all, &opts)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, docs, "%+v", opts)
+	}
+}
@@ -0,0 +1,278 @@
+package memory
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// Policy selects the entries a bounded storage evicts
+type Policy string
+
+const (
+	// LRU evicts the least recently used entry
+	LRU Policy = "lru"
+	// LFU evicts the least frequently used entry, ties are broken by age
+	LFU Policy = "lfu"
+	// ARC balances between recency and frequency, adapting to the hits on recently evicted entries
+	ARC Policy = "arc"
+)
+
+// slot identifies an entry across all buckets
+type slot struct {
+	bucket string
+	key    string
+}
+
+// policy keeps track of the entries of a bounded storage
+// Writes and evictions change it while holding the write lock of the storage, reads lock policyMutex.
+type policy interface {
+	// add records a write of an entry
+	add(s slot)
+	// touch records a read of an entry
+	touch(s slot)
+	// remove forgets an entry which has been deleted
+	remove(s slot)
+	// evict removes the entry to evict next, ok is false if there is none
+	evict() (s slot, ok bool)
+}
+
+func newPolicy(p Policy) (policy, error) {
+	switch p {
+	case LRU, "":
+		return newLRU(), nil
+	case LFU:
+		return &lfu{nodes: make(map[slot]*lfuNode)}, nil
+	case ARC:
+		return newARC(), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", p)
+}
+
+// lruList is a list of slots, the front is the most recently used one
+type lruList struct {
+	list  *list.List
+	elems map[slot]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{list.New(), make(map[slot]*list.Element)}
+}
+
+func (l *lruList) has(s slot) bool {
+	_, ok := l.elems[s]
+	return ok
+}
+
+func (l *lruList) push(s slot) {
+	if elem, ok := l.elems[s]; ok {
+		l.list.MoveToFront(elem)
+		return
+	}
+	l.elems[s] = l.list.PushFront(s)
+}
+
+func (l *lruList) remove(s slot) bool {
+	elem, ok := l.elems[s]
+	if ok {
+		l.list.Remove(elem)
+		delete(l.elems, s)
+	}
+	return ok
+}
+
+// pop removes the least recently used slot
+func (l *lruList) pop() (slot, bool) {
+	elem := l.list.Back()
+	if elem == nil {
+		return slot{}, false
+	}
+	s := elem.Value.(slot)
+	l.remove(s)
+	return s, true
+}
+
+func (l *lruList) len() int {
+	return l.list.Len()
+}
+
+type lru struct {
+	*lruList
+}
+
+func newLRU() *lru {
+	return &lru{newLRUList()}
+}
+
+func (p *lru) add(s slot) {
+	p.push(s)
+}
+
+func (p *lru) touch(s slot) {
+	if p.has(s) {
+		p.push(s)
+	}
+}
+
+func (p *lru) remove(s slot) {
+	p.lruList.remove(s)
+}
+
+func (p *lru) evict() (slot, bool) {
+	return p.pop()
+}
+
+// lfu is a min-heap over the use counts, entries of the same count are ordered by their last use
+type lfu struct {
+	heap  lfuHeap
+	nodes map[slot]*lfuNode
+	clock uint64
+}
+
+type lfuNode struct {
+	slot  slot
+	count uint64
+	used  uint64
+	index int
+}
+
+func (p *lfu) add(s slot) {
+	p.use(s, true)
+}
+
+func (p *lfu) touch(s slot) {
+	p.use(s, false)
+}
+
+func (p *lfu) use(s slot, create bool) {
+	p.clock++
+	node, ok := p.nodes[s]
+	switch {
+	case ok:
+		node.count++
+		node.used = p.clock
+		heap.Fix(&p.heap, node.index)
+	case create:
+		node = &lfuNode{slot: s, count: 1, used: p.clock}
+		p.nodes[s] = node
+		heap.Push(&p.heap, node)
+	}
+}
+
+func (p *lfu) remove(s slot) {
+	if node, ok := p.nodes[s]; ok {
+		heap.Remove(&p.heap, node.index)
+		delete(p.nodes, s)
+	}
+}
+
+func (p *lfu) evict() (slot, bool) {
+	if p.heap.Len() == 0 {
+		return slot{}, false
+	}
+	node := heap.Pop(&p.heap).(*lfuNode)
+	delete(p.nodes, node.slot)
+	return node.slot, true
+}
+
+// lfuHeap implements heap.Interface ordered by count and last use
+type lfuHeap []*lfuNode
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].used < h[j].used
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	node := x.(*lfuNode)
+	node.index = len(*h)
+	*h = append(*h, node)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	node := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return node
+}
+
+// arc is the adaptive replacement cache policy of Megiddo and Modha.
+// Entries used once live in t1, entries used again in t2. Evicted entries are remembered in the ghost
+// lists b1 and b2, a write of a ghost moves the target size p of t1 towards the list it was evicted from.
+// The capacity is the number of resident entries, since the storage is bounded by bytes as well.
+type arc struct {
+	t1, t2, b1, b2 *lruList
+	p              int
+}
+
+func newARC() *arc {
+	return &arc{t1: newLRUList(), t2: newLRUList(), b1: newLRUList(), b2: newLRUList()}
+}
+
+func (p *arc) add(s slot) {
+	switch {
+	case p.t1.remove(s) || p.t2.has(s):
+		p.t2.push(s)
+	case p.b1.remove(s):
+		p.p = minInt(p.p+maxInt(1, p.b2.len()/maxInt(1, p.b1.len())), p.t1.len()+p.t2.len())
+		p.t2.push(s)
+	case p.b2.remove(s):
+		p.p = maxInt(p.p-maxInt(1, p.b1.len()/maxInt(1, p.b2.len())), 0)
+		p.t2.push(s)
+	default:
+		p.t1.push(s)
+	}
+}
+
+func (p *arc) touch(s slot) {
+	if p.t1.remove(s) || p.t2.has(s) {
+		p.t2.push(s)
+	}
+}
+
+func (p *arc) remove(s slot) {
+	if !p.t1.remove(s) {
+		p.t2.remove(s)
+	}
+}
+
+func (p *arc) evict() (slot, bool) {
+	var s slot
+	var ok bool
+	if p.t1.len() > 0 && (p.t1.len() > p.p || p.t2.len() == 0) {
+		if s, ok = p.t1.pop(); ok {
+			p.b1.push(s)
+		}
+	} else if s, ok = p.t2.pop(); ok {
+		p.b2.push(s)
+	}
+	// the ghosts are bounded by the number of resident entries
+	for p.b1.len()+p.b2.len() > maxInt(1, p.t1.len()+p.t2.len()) {
+		if p.b1.len() > p.b2.len() {
+			p.b1.pop()
+		} else {
+			p.b2.pop()
+		}
+	}
+	return s, ok
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
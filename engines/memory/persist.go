@@ -0,0 +1,237 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/btree"
+	"github.com/trusch/storage/common"
+)
+
+// the operations of records
+const (
+	opCreate = "create"
+	opDrop   = "drop"
+	opPut    = "put"
+	opDelete = "delete"
+	opBatch  = "batch"
+)
+
+// record is a line of the snapshot file or the log of a persistent storage, both are JSON lines.
+// A snapshot creates the buckets and puts their entries, the log holds all writes since the snapshot.
+// Batches and transactions are logged as a single batch record, so they are replayed atomically.
+type record struct {
+	Op      string           `json:"op"`
+	Bucket  string           `json:"bucket,omitempty"`
+	Key     string           `json:"key,omitempty"`
+	Value   []byte           `json:"value"`
+	Meta    *common.Metadata `json:"meta,omitempty"`
+	Expires *time.Time       `json:"expires,omitempty"`
+	Ops     []*record        `json:"ops,omitempty"`
+}
+
+// appendLog is the log of a persistent storage, it is written while holding the storage lock
+type appendLog struct {
+	file  *os.File
+	size  int64
+	fsync bool
+}
+
+func (l *appendLog) append(rec *record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.Write(append(line, '\n')); err != nil {
+		// drop what has been written of the record, so the log stays readable
+		l.file.Truncate(l.size)
+		return err
+	}
+	l.size += int64(len(line)) + 1
+	if l.fsync {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+// drop removes the first n bytes of the log, the rest is written to a new file which replaces it
+func (l *appendLog) drop(n int64) error {
+	rest := make([]byte, l.size-n)
+	if _, err := l.file.ReadAt(rest, n); err != nil {
+		return err
+	}
+	path := l.file.Name()
+	if err := writeAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(rest)
+		return err
+	}); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file, l.size = f, int64(len(rest))
+	return nil
+}
+
+// load reads the snapshot and replays the log of a persistent storage
+// A record cut off at the end of the log by a crash is dropped.
+func (store *Storage) load() error {
+	path := store.options.Path
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if _, err := replay(path, store.apply); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	valid, err := replay(path+".aof", store.apply)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path+".aof", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err = f.Truncate(valid); err != nil {
+		f.Close()
+		return err
+	}
+	store.aof = &appendLog{file: f, size: valid, fsync: store.options.Fsync}
+	store.evict()
+	return nil
+}
+
+// replay applies the records of a file and returns the length of its complete lines
+func replay(path string, apply func(rec *record)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var valid int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+		rec := &record{}
+		if err = json.Unmarshal(line, rec); err != nil {
+			return valid, fmt.Errorf("%v: corrupt record at offset %v: %v", path, valid, err)
+		}
+		apply(rec)
+		valid += int64(len(line))
+	}
+}
+
+// Compact writes a new snapshot of a persistent storage and removes the records it contains from the log
+// Writes go on while the snapshot is written. It runs in the background once the log grows beyond
+// CompactSize and when the storage is closed.
+func (store *Storage) Compact() error {
+	store.compactMutex.Lock()
+	defer store.compactMutex.Unlock()
+	return store.compact()
+}
+
+// compact does the work of Compact, the caller must hold the compaction lock
+func (store *Storage) compact() error {
+	store.mutex.Lock()
+	if store.aof == nil {
+		store.mutex.Unlock()
+		return nil
+	}
+	v, offset := store.view.clone(), store.aof.size
+	store.mutex.Unlock()
+	if err := writeSnapshot(store.options.Path, v, time.Now()); err != nil {
+		return err
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.aof.drop(offset)
+}
+
+// compactInBackground starts a compaction if the log is too large and none is running
+// The caller must hold the write lock.
+func (store *Storage) compactInBackground() {
+	limit := int64(store.options.CompactSize)
+	if limit <= 0 || store.aof.size < limit || store.compacting {
+		return
+	}
+	store.compacting = true
+	go func() {
+		if err := store.Compact(); err != nil {
+			log.Print(err)
+		}
+		store.mutex.Lock()
+		store.compacting = false
+		store.mutex.Unlock()
+	}()
+}
+
+// writeSnapshot saves the entries of a view which have not expired at now
+func writeSnapshot(path string, v view, now time.Time) error {
+	return writeAtomic(path, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, name := range v.listBuckets() {
+			if err := enc.Encode(&record{Op: opCreate, Bucket: name}); err != nil {
+				return err
+			}
+			var err error
+			v.buckets[name].Ascend(func(item btree.Item) bool {
+				e := item.(*entry)
+				if e.expired(now) {
+					return true
+				}
+				rec := &record{Op: opPut, Bucket: name, Key: e.key, Value: e.value, Meta: e.meta}
+				if !e.expires.IsZero() {
+					expires := e.expires
+					rec.Expires = &expires
+				}
+				err = enc.Encode(rec)
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeAtomic writes a file next to path and renames it, so path is either old or complete
+func writeAtomic(path string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
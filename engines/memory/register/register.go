@@ -0,0 +1,34 @@
+// Package register makes the memory engine available to meta.NewStorage under the memory scheme.
+package register
+
+import (
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/engines/memory"
+	"github.com/trusch/storage/engines/meta"
+)
+
+// memory:///data/snapshot?fsync=true&compact=64MB is persisted, memory:// is not
+// memory://?maxbytes=256MB&maxentries=100000&eviction=lru evicts entries to stay within the bounds
+func init() {
+	meta.Register("memory", func(uri string, options ...interface{}) (storage.Storage, error) {
+		p, err := meta.Path(uri)
+		if err != nil {
+			return nil, err
+		}
+		q, err := meta.ParseQuery("memory", uri)
+		if err != nil {
+			return nil, err
+		}
+		opts := memory.DefaultOptions
+		opts.Path = p
+		opts.Fsync = q.Boolean("fsync", opts.Fsync)
+		opts.CompactSize = q.Size("compact", opts.CompactSize)
+		opts.MaxBytes = q.Size("maxbytes", opts.MaxBytes)
+		opts.MaxEntries = q.Integer("maxentries", opts.MaxEntries)
+		opts.Eviction = memory.Policy(q.Choice("eviction", string(memory.LRU), string(memory.LRU), string(memory.LFU), string(memory.ARC)))
+		if err = q.Done(); err != nil {
+			return nil, err
+		}
+		return memory.NewStorageWithOptions(opts)
+	})
+}
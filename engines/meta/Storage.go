@@ -1,19 +1,18 @@
 package meta
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"io"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/trusch/storage"
 	"github.com/trusch/storage/common"
-	"github.com/trusch/storage/engines/boltdb"
-	"github.com/trusch/storage/engines/cache"
-	"github.com/trusch/storage/engines/file"
-	"github.com/trusch/storage/engines/leveldb"
-	"github.com/trusch/storage/engines/memory"
-	"github.com/trusch/storage/engines/mongodb"
-	"github.com/trusch/storage/engines/storaged"
+	"github.com/trusch/storage/engines/chunked"
+	"github.com/trusch/storage/engines/notify"
+	"github.com/trusch/storage/engines/versioned"
 )
 
 // Storage creates the apropriate store from an URI
@@ -27,45 +26,38 @@ func NewStorage(uriStr string, options ...interface{}) (*Storage, error) {
 	if err != nil {
 		return nil, err
 	}
-	var base storage.Storage
-	switch uri.Scheme {
-	case "memory":
-		base, err = memory.NewStorage()
-	case "cache":
-		parts := strings.Split(uriStr[8:], ",")
-		first, e := NewStorage(parts[0])
-		if e != nil {
-			return nil, e
+	if strings.HasPrefix(uri.Scheme, "chunked+") {
+		// chunked+boltdb://... splits large values before they reach the storage of the rest of the URI
+		inner, err := NewStorage(strings.TrimPrefix(uriStr, "chunked+"), options...)
+		if err != nil {
+			return nil, err
 		}
-		second, e := NewStorage(parts[1])
-		if e != nil {
-			return nil, e
-		}
-		base, err = cache.NewStorage(first, second)
-	case "leveldb":
-		base, err = leveldb.NewStorage(uri.Host + uri.Path)
-	case "boltdb":
-		base, err = boltdb.NewStorage(uri.Host + uri.Path)
-	case "mongodb":
-		base, err = mongodb.NewStorage(uriStr)
-	case "file":
-		base, err = file.NewStorage(uri.Host + uri.Path)
-	case "storaged":
-		base, err = storaged.NewStorage(uriStr)
-	case "sstoraged":
-		if len(options) > 0 {
-			if token, ok := options[0].(string); ok {
-				base, err = storaged.NewStorage(uriStr, token)
-				break
-			}
+		base, _ := chunked.NewStorage(inner, chunked.DefaultThreshold)
+		return &Storage{base}, nil
+	}
+	if strings.HasPrefix(uri.Scheme, "versioned+") {
+		// versioned+memory://... keeps the history of versioned buckets for engines without native support
+		inner, err := NewStorage(strings.TrimPrefix(uriStr, "versioned+"), options...)
+		if err != nil {
+			return nil, err
 		}
-		base, err = storaged.NewStorage(uriStr)
-	default:
-		err = errors.New("unknown uri scheme, try bolt:// or leveldb://")
+		base, _ := versioned.NewStorage(inner)
+		return &Storage{base}, nil
+	}
+	registryMutex.RLock()
+	factory, ok := registry[uri.Scheme]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown uri scheme %q, registered schemes are %v", uri.Scheme, strings.Join(Schemes(), ", "))
 	}
+	base, err := factory(uriStr, options...)
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := base.(storage.Watcher); !ok {
+		// engines without a native change feed are watched through the notifying wrapper
+		base, _ = notify.NewStorage(base)
+	}
 	return &Storage{base}, nil
 }
 
@@ -95,6 +87,26 @@ func (store *Storage) DeleteBucket(bucket string) error {
 	return store.base.DeleteBucket(bucket)
 }
 
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.base.Iterate(bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return storage.WithContext(store.base).IterateContext(ctx, bucket, opts)
+}
+
+// Count returns the number of entries of a bucket
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	return store.base.Count(bucket, opts)
+}
+
+// ListBuckets returns the names of all buckets
+func (store *Storage) ListBuckets() ([]string, error) {
+	return store.base.ListBuckets()
+}
+
 // List returns all Entries of a directory
 // optionally provide arguments to specifiy a key offset and a key limit
 // Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
@@ -102,6 +114,146 @@ func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.D
 	return store.base.List(bucket, opts)
 }
 
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	return storage.WithContext(store.base).PutContext(ctx, bucket, key, value)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	return storage.WithContext(store.base).GetContext(ctx, bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	return storage.WithContext(store.base).DeleteContext(ctx, bucket, key)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	return storage.WithContext(store.base).CreateBucketContext(ctx, bucket)
+}
+
+// DeleteBucketContext deletes a bucket
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	return storage.WithContext(store.base).DeleteBucketContext(ctx, bucket)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return storage.WithContext(store.base).ListContext(ctx, bucket, opts)
+}
+
+// NewBatch creates an empty batch
+// If the underlying storage has no native batch support, the operations are applied one by one.
+func (store *Storage) NewBatch() storage.Batch {
+	return storage.NewBatch(store.base)
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	if s, ok := store.base.(storage.TTLStorage); ok {
+		return s.PutWithTTL(bucket, key, value, ttl)
+	}
+	return common.Error(common.Unsupported)
+}
+
+// Watch streams an event for every change of a key in bucket starting with prefix
+func (store *Storage) Watch(ctx context.Context, bucket, prefix string) (<-chan *common.Event, error) {
+	if s, ok := store.base.(storage.Watcher); ok {
+		return s.Watch(ctx, bucket, prefix)
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// PutReader saves everything read from r, it is buffered if the storage can not stream
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	return storage.PutReader(store.base, bucket, key, r)
+}
+
+// GetReader opens a value for reading
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	return storage.GetReader(store.base, bucket, key)
+}
+
+// PutWithMeta saves a byteslice along with its metadata
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	if s, ok := store.base.(storage.MetaStorage); ok {
+		return s.PutWithMeta(bucket, key, value, meta)
+	}
+	return common.Error(common.Unsupported)
+}
+
+// Stat returns the metadata of a key
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	return storage.Stat(store.base, bucket, key)
+}
+
+// EnableVersioning starts keeping the history of the keys of a bucket
+func (store *Storage) EnableVersioning(bucket string) error {
+	if s, ok := store.base.(storage.VersionedStorage); ok {
+		return s.EnableVersioning(bucket)
+	}
+	return common.Error(common.Unsupported)
+}
+
+// GetVersion loads a former value of a key
+func (store *Storage) GetVersion(bucket, key string, version uint64) ([]byte, error) {
+	if s, ok := store.base.(storage.VersionedStorage); ok {
+		return s.GetVersion(bucket, key, version)
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// ListVersions returns the history of a key, oldest first
+func (store *Storage) ListVersions(bucket, key string) ([]*common.Version, error) {
+	if s, ok := store.base.(storage.VersionedStorage); ok {
+		return s.ListVersions(bucket, key)
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// CompareAndSwap saves new if the current value of key equals old
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	if s, ok := store.base.(storage.ConditionalStorage); ok {
+		return s.CompareAndSwap(bucket, key, old, new)
+	}
+	return false, common.Error(common.Unsupported)
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	if s, ok := store.base.(storage.ConditionalStorage); ok {
+		return s.PutIfAbsent(bucket, key, value)
+	}
+	return false, common.Error(common.Unsupported)
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	if s, ok := store.base.(storage.ConditionalStorage); ok {
+		return s.DeleteIfEquals(bucket, key, old)
+	}
+	return false, common.Error(common.Unsupported)
+}
+
+// Begin starts a transaction if the underlying storage supports it
+func (store *Storage) Begin() (storage.Tx, error) {
+	if s, ok := store.base.(storage.Transactional); ok {
+		return s.Begin()
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// Snapshot returns a read-only view of the storage as it is now
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	if s, ok := store.base.(storage.Snapshotter); ok {
+		return s.Snapshot()
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
 // Close closes the storage
 func (store *Storage) Close() error {
 	return store.base.Close()
@@ -1,12 +1,17 @@
-package meta
+package meta_test
 
 import (
 	"os"
 	"os/exec"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage"
+	_ "github.com/trusch/storage/engines/all"
+	"github.com/trusch/storage/engines/memory"
+	"github.com/trusch/storage/engines/meta"
 	"github.com/trusch/storage/server"
 	"github.com/trusch/storage/testsuite"
 )
@@ -17,7 +22,7 @@ type StorageSuite struct {
 
 func TestBoltDBStorage(t *testing.T) {
 	defer os.RemoveAll("./test-store.db")
-	store, err := NewStorage("boltdb://test-store.db")
+	store, err := meta.NewStorage("boltdb://test-store.db")
 	assert.NoError(t, err)
 	s := &StorageSuite{}
 	s.Store = store
@@ -30,7 +35,7 @@ func TestBoltDBStorage(t *testing.T) {
 
 func TestLevelDBStorage(t *testing.T) {
 	defer os.RemoveAll("./test-store.db")
-	store, err := NewStorage("leveldb://test-store.db")
+	store, err := meta.NewStorage("leveldb://test-store.db")
 	assert.NoError(t, err)
 	s := &StorageSuite{}
 	s.Store = store
@@ -41,9 +46,42 @@ func TestLevelDBStorage(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestChunkedBoltDBStorage(t *testing.T) {
+	defer os.RemoveAll("./test-store.db")
+	store, err := meta.NewStorage("chunked+boltdb://test-store.db")
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
+func TestVersionedMemoryStorage(t *testing.T) {
+	store, err := meta.NewStorage("versioned+memory://")
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
+func TestMirrorStorage(t *testing.T) {
+	store, err := meta.NewStorage("mirror://memory://,memory://")
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
 func TestMongoDBStorage(t *testing.T) {
 	defer exec.Command("mongo", "test", "--eval", "db.dropDatabase()")
-	store, err := NewStorage("mongodb://localhost/test")
+	store, err := meta.NewStorage("mongodb://localhost/test")
 	assert.NoError(t, err)
 	s := &StorageSuite{}
 	s.Store = store
@@ -56,7 +94,7 @@ func TestMongoDBStorage(t *testing.T) {
 
 func TestFileStorage(t *testing.T) {
 	defer os.RemoveAll("./test-store.db")
-	store, err := NewStorage("file://test-store.db")
+	store, err := meta.NewStorage("file://test-store.db")
 	assert.NoError(t, err)
 	s := &StorageSuite{}
 	s.Store = store
@@ -68,7 +106,7 @@ func TestFileStorage(t *testing.T) {
 }
 
 func TestMemoryStorage(t *testing.T) {
-	store, err := NewStorage("memory://")
+	store, err := meta.NewStorage("memory://")
 	assert.NoError(t, err)
 	s := &StorageSuite{}
 	s.Store = store
@@ -80,12 +118,13 @@ func TestMemoryStorage(t *testing.T) {
 }
 
 func TestStoragedStorage(t *testing.T) {
-	baseStore, err := NewStorage("leveldb://test-store.db")
+	baseStore, err := meta.NewStorage("leveldb://test-store.db")
 	assert.NoError(t, err)
-	server := server.New(":8080", baseStore)
+	server := server.New(":8082", baseStore)
 	go server.ListenAndServe()
 	defer server.Stop()
-	store, err := NewStorage("storaged://localhost:8080/project1")
+	time.Sleep(200 * time.Millisecond)
+	store, err := meta.NewStorage("storaged://localhost:8082/project1")
 	assert.NoError(t, err)
 	defer os.RemoveAll("./test-store.db")
 	s := &StorageSuite{}
@@ -99,7 +138,7 @@ func TestStoragedStorage(t *testing.T) {
 
 func TestCacheStorage(t *testing.T) {
 	defer os.RemoveAll("./test-store.db")
-	store, err := NewStorage("cache://memory://,leveldb://test-store.db")
+	store, err := meta.NewStorage("cache://memory://,leveldb://test-store.db")
 	assert.NoError(t, err)
 	s := &StorageSuite{}
 	s.Store = store
@@ -110,9 +149,56 @@ func TestCacheStorage(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNestedURI(t *testing.T) {
+	store, err := meta.NewStorage("mirror://(cache://?negative=1m,memory://,(mirror://memory://,memory://)),memory://")
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket"))
+	assert.NoError(t, store.Put("bucket", "key", []byte("value")))
+	val, err := store.Get("bucket", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", string(val))
+	_, err = meta.NewStorage("cache://memory://,(mirror://memory://,memory://")
+	assert.Error(t, err)
+}
+
 func TestMalformedURI(t *testing.T) {
-	_, err := NewStorage("???")
+	_, err := meta.NewStorage("???")
+	assert.Error(t, err)
+	_, err = meta.NewStorage(":")
 	assert.Error(t, err)
-	_, err = NewStorage(":")
+}
+
+func TestRegister(t *testing.T) {
+	meta.Register("test-engine", func(uri string, options ...interface{}) (storage.Storage, error) {
+		assert.Equal(t, "test-engine://foo", uri)
+		assert.Equal(t, []interface{}{"token"}, options)
+		return memory.NewStorage()
+	})
+	store, err := meta.NewStorage("test-engine://foo", "token")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+	assert.Panics(t, func() {
+		meta.Register("test-engine", nil)
+	})
+	assert.Contains(t, meta.Schemes(), "test-engine")
+}
+
+func TestNestedOptions(t *testing.T) {
+	var uris []string
+	meta.Register("options-engine", func(uri string, options ...interface{}) (storage.Storage, error) {
+		uris = append(uris, uri)
+		assert.Equal(t, []interface{}{"token"}, options, uri)
+		return memory.NewStorage()
+	})
+	store, err := meta.NewStorage("cache://options-engine://a,(mirror://options-engine://b,options-engine://c)", "token")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+	assert.Equal(t, []string{"options-engine://a", "options-engine://b", "options-engine://c"}, uris)
+}
+
+func TestUnknownScheme(t *testing.T) {
+	_, err := meta.NewStorage("unknown:///data")
 	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "boltdb, cache, file, leveldb, memory")
 }
@@ -0,0 +1,198 @@
+package meta
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/engines/cache"
+	"github.com/trusch/storage/engines/chunked"
+	"github.com/trusch/storage/engines/codec"
+	"github.com/trusch/storage/engines/mirror"
+	"github.com/trusch/storage/engines/notify"
+	"github.com/trusch/storage/engines/shard"
+	"github.com/trusch/storage/engines/versioned"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config describes a tree of engines and wrappers, it is read from YAML or JSON.
+// A node either opens the engine of an URI like NewStorage, or wraps its children:
+//
+//	type: cache
+//	children:
+//	  - uri: memory://
+//	  - type: compression
+//	    options: {algorithm: snappy}
+//	    children:
+//	      - uri: leveldb:///data?cache=64MB
+//
+// The types are cache (first and second level, mode, ttl, negative, queue, flush and warm), replication (primary and replicas), sharding (shards),
+// encryption (key or keyfile with a hex encoded AES key), compression (algorithm gzip or snappy, level for gzip),
+// chunked (threshold) and versioned, see the engines of the same name.
+type Config struct {
+	URI      string                 `yaml:"uri,omitempty" json:"uri,omitempty"`
+	Type     string                 `yaml:"type,omitempty" json:"type,omitempty"`
+	Options  map[string]interface{} `yaml:"options,omitempty" json:"options,omitempty"`
+	Children []*Config              `yaml:"children,omitempty" json:"children,omitempty"`
+}
+
+// LoadConfig reads a config file, JSON is read as YAML
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err = yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// NewStorageFromConfig creates the tree of storages described by cfg
+// The options are passed to NewStorage for every URI of the tree.
+func NewStorageFromConfig(cfg *Config, options ...interface{}) (*Storage, error) {
+	base, err := build(cfg, options)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := base.(storage.Watcher); !ok {
+		base, _ = notify.NewStorage(base)
+	}
+	return &Storage{base}, nil
+}
+
+// build creates the storage of a node, the storages created before a failure are closed again
+func build(cfg *Config, options []interface{}) (storage.Storage, error) {
+	if cfg.URI != "" {
+		if cfg.Type != "" || len(cfg.Children) > 0 || len(cfg.Options) > 0 {
+			return nil, fmt.Errorf("config node with uri %v can not have a type, options or children", cfg.URI)
+		}
+		return NewStorage(cfg.URI, options...)
+	}
+	min, max := 1, 1
+	switch cfg.Type {
+	case "cache":
+		min, max = 2, 2
+	case "replication":
+		min, max = 2, -1
+	case "sharding":
+		max = -1
+	case "encryption", "compression", "chunked", "versioned":
+	case "":
+		return nil, fmt.Errorf("config node needs an uri or a type")
+	default:
+		return nil, fmt.Errorf("unknown config type %q", cfg.Type)
+	}
+	if len(cfg.Children) < min || (max > 0 && len(cfg.Children) > max) {
+		return nil, fmt.Errorf("%v needs %v children, got %v", cfg.Type, count(min, max), len(cfg.Children))
+	}
+	q := &Query{engine: cfg.Type, values: url.Values{}}
+	for name, value := range cfg.Options {
+		q.values.Set(name, fmt.Sprint(value))
+	}
+	children := make([]storage.Storage, 0, len(cfg.Children))
+	closeChildren := func() {
+		for _, child := range children {
+			child.Close()
+		}
+	}
+	for _, child := range cfg.Children {
+		store, err := build(child, options)
+		if err != nil {
+			closeChildren()
+			return nil, err
+		}
+		children = append(children, store)
+	}
+	store, err := wrap(cfg.Type, q, children)
+	if err != nil {
+		closeChildren()
+		return nil, err
+	}
+	if err = q.Done(); err != nil {
+		// the wrapper owns the children now and closes them along with itself
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func count(min, max int) string {
+	switch {
+	case min == max:
+		return fmt.Sprint(min)
+	case max < 0:
+		return fmt.Sprintf("at least %v", min)
+	}
+	return fmt.Sprintf("%v to %v", min, max)
+}
+
+// wrap creates the wrapper of a config node around its children
+func wrap(typ string, q *Query, children []storage.Storage) (storage.Storage, error) {
+	switch typ {
+	case "cache":
+		// the options are checked first, a write-back cache would not be closed again
+		opts := cacheOptions(q)
+		if err := q.Done(); err != nil {
+			return nil, err
+		}
+		return cache.NewStorageWithOptions(children[0], children[1], opts)
+	case "replication":
+		// the replicas are chained, every mirror reads from its primary only
+		store := children[len(children)-1]
+		for i := len(children) - 2; i >= 0; i-- {
+			store, _ = mirror.NewStorage(children[i], store)
+		}
+		return store, nil
+	case "sharding":
+		return shard.NewStorage(children...)
+	case "encryption":
+		key, err := encryptionKey(q)
+		if err != nil {
+			return nil, err
+		}
+		c, err := codec.AES(key)
+		if err != nil {
+			return nil, err
+		}
+		return codec.NewStorage(children[0], c)
+	case "compression":
+		// level is only taken for gzip, so it is reported as unknown option for snappy
+		switch q.Choice("algorithm", "snappy", "snappy", "gzip") {
+		case "gzip":
+			c, err := codec.Gzip(q.Integer("level", gzip.DefaultCompression))
+			if err != nil {
+				return nil, err
+			}
+			return codec.NewStorage(children[0], c)
+		}
+		return codec.NewStorage(children[0], codec.Snappy())
+	case "chunked":
+		return chunked.NewStorage(children[0], q.Size("threshold", chunked.DefaultThreshold))
+	case "versioned":
+		return versioned.NewStorage(children[0])
+	}
+	return nil, fmt.Errorf("unknown config type %q", typ)
+}
+
+// encryptionKey reads the hex encoded key of an encryption node from its options or from a file
+func encryptionKey(q *Query) ([]byte, error) {
+	key, hasKey := q.Take("key")
+	path, hasFile := q.Take("keyfile")
+	switch {
+	case hasKey == hasFile:
+		return nil, fmt.Errorf("encryption needs either a key or a keyfile option")
+	case hasFile:
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	return hex.DecodeString(key)
+}
@@ -0,0 +1,118 @@
+package meta_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/engines/meta"
+)
+
+const testConfig = `
+type: cache
+children:
+  - uri: memory://
+  - type: replication
+    children:
+      - type: compression
+        options: {algorithm: gzip, level: 9}
+        children:
+          - type: encryption
+            options:
+              key: 000102030405060708090a0b0c0d0e0f
+            children:
+              - uri: memory://
+      - type: sharding
+        children:
+          - uri: memory://
+          - type: cache
+            options: {mode: write-around, negative: 1m}
+            children:
+              - uri: memory://
+              - uri: memory://
+`
+
+func writeConfig(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestConfigStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg, err := meta.LoadConfig(writeConfig(t, dir, "storage.yaml", testConfig))
+	assert.NoError(t, err)
+	store, err := meta.NewStorageFromConfig(cfg)
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	assert.NoError(t, store.Close())
+}
+
+func TestJSONConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg, err := meta.LoadConfig(writeConfig(t, dir, "storage.json", `{
+		"type": "versioned",
+		"children": [{"type": "chunked", "options": {"threshold": "1KB"}, "children": [{"uri": "leveldb://`+dir+`/db?bloom=0"}]}]
+	}`))
+	assert.NoError(t, err)
+	store, err := meta.NewStorageFromConfig(cfg)
+	assert.NoError(t, err)
+	assert.NoError(t, store.CreateBucket("bucket"))
+	assert.NoError(t, store.EnableVersioning("bucket"))
+	assert.NoError(t, store.Put("bucket", "key", make([]byte, 4096)))
+	versions, err := store.ListVersions("bucket", "key")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.NoError(t, store.Close())
+}
+
+func TestInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"unknown field":   "uri: memory://\nfoo: bar",
+		"no uri or type":  "options: {}",
+		"unknown type":    "type: magic\nchildren: [{uri: 'memory://'}]",
+		"uri with type":   "uri: memory://\ntype: cache",
+		"children":        "type: cache\nchildren: [{uri: 'memory://'}]",
+		"cache mode":      "type: cache\noptions: {mode: write-behind}\nchildren: [{uri: 'memory://'}, {uri: 'memory://'}]",
+		"unknown option":  "type: compression\noptions: {speed: 1}\nchildren: [{uri: 'memory://'}]",
+		"snappy level":    "type: compression\noptions: {algorithm: snappy, level: 9}\nchildren: [{uri: 'memory://'}]",
+		"no key":          "type: encryption\nchildren: [{uri: 'memory://'}]",
+		"short key":       "type: encryption\noptions: {key: abcd}\nchildren: [{uri: 'memory://'}]",
+		"bad child":       "type: versioned\nchildren: [{uri: 'nothing://'}]",
+		"bad replication": "type: replication\nchildren: [{uri: 'memory://'}]",
+	} {
+		cfg, err := meta.LoadConfig(writeConfig(t, dir, "storage.yaml", content))
+		if err == nil {
+			_, err = meta.NewStorageFromConfig(cfg)
+		}
+		assert.Error(t, err, name)
+	}
+}
+
+func TestInvalidConfigClosesStorages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	uri := "leveldb://" + dir + "/db"
+	cfg, err := meta.LoadConfig(writeConfig(t, dir, "storage.yaml", "type: chunked\noptions: {speed: 1}\nchildren: [{uri: '"+uri+"'}]"))
+	assert.NoError(t, err)
+	_, err = meta.NewStorageFromConfig(cfg)
+	assert.Error(t, err)
+	// the database is locked until it is closed
+	store, err := meta.NewStorage(uri)
+	if assert.NoError(t, err) {
+		assert.NoError(t, store.Close())
+	}
+}
@@ -0,0 +1,178 @@
+package meta
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trusch/storage/engines/cache"
+)
+
+// Query reads the engine options from the query of an URI like leveldb:///data?cache=64MB&bloom=10
+// Every read option is removed, so the options left over when Done is called are unknown.
+// The first invalid option is reported by Done, the readers return the default value for it.
+type Query struct {
+	engine string
+	values url.Values
+	err    error
+}
+
+// ParseQuery parses the query of an URI, engine names the engine in error messages
+func ParseQuery(engine, uri string) (*Query, error) {
+	q := &Query{engine: engine, values: url.Values{}}
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		values, err := url.ParseQuery(uri[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		q.values = values
+	}
+	return q, nil
+}
+
+// Take removes an option and returns its value, ok is false if it is not set
+func (q *Query) Take(name string) (string, bool) {
+	value, ok := q.values[name]
+	delete(q.values, name)
+	if !ok || q.err != nil {
+		return "", false
+	}
+	return value[len(value)-1], true
+}
+
+func (q *Query) fail(name, value string, err error) {
+	q.err = fmt.Errorf("invalid %v option %v=%v: %v", q.engine, name, value, err)
+}
+
+// Size reads a number of bytes like 1024, 64KB, 64MB or 1GB, the units are powers of 1024
+func (q *Query) Size(name string, def int) int {
+	value, ok := q.Take(name)
+	if !ok {
+		return def
+	}
+	number, unit := strings.ToUpper(value), 1
+	for i, suffix := range []string{"KB", "MB", "GB"} {
+		if strings.HasSuffix(number, suffix) {
+			number, unit = strings.TrimSuffix(number, suffix), 1<<(10*uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(number, "B"))
+	if err != nil || n < 0 {
+		q.fail(name, value, fmt.Errorf("not a size"))
+		return def
+	}
+	return n * unit
+}
+
+// Integer reads a number
+func (q *Query) Integer(name string, def int) int {
+	value, ok := q.Take(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		q.fail(name, value, err)
+		return def
+	}
+	return n
+}
+
+// Boolean reads a boolean like true, false, 1 or 0
+func (q *Query) Boolean(name string, def bool) bool {
+	value, ok := q.Take(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		q.fail(name, value, err)
+		return def
+	}
+	return b
+}
+
+// Duration reads a go duration like 1m30s
+func (q *Query) Duration(name string, def time.Duration) time.Duration {
+	value, ok := q.Take(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		q.fail(name, value, err)
+		return def
+	}
+	return d
+}
+
+// Perm reads an octal file permission like 0640
+func (q *Query) Perm(name string, def os.FileMode) os.FileMode {
+	value, ok := q.Take(name)
+	if !ok {
+		return def
+	}
+	perm, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || perm > 0777 {
+		q.fail(name, value, fmt.Errorf("not a permission"))
+		return def
+	}
+	return os.FileMode(perm)
+}
+
+// Choice reads one of the given values
+func (q *Query) Choice(name string, def string, choices ...string) string {
+	value, ok := q.Take(name)
+	if !ok {
+		return def
+	}
+	for _, choice := range choices {
+		if value == choice {
+			return value
+		}
+	}
+	q.fail(name, value, fmt.Errorf("must be one of %v", strings.Join(choices, ", ")))
+	return def
+}
+
+// Err returns the first invalid option read so far
+func (q *Query) Err() error {
+	return q.err
+}
+
+// Values returns the options which have not been read, engines can pass them on to their drivers
+func (q *Query) Values() url.Values {
+	return q.values
+}
+
+// Done returns the first invalid option or an error naming the unknown options
+func (q *Query) Done() error {
+	if q.err != nil || len(q.values) == 0 {
+		return q.err
+	}
+	unknown := make([]string, 0, len(q.values))
+	for name := range q.values {
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown %v options %v", q.engine, strings.Join(unknown, ", "))
+}
+
+// cacheOptions reads the options of a cache from an URI or a config node
+func cacheOptions(q *Query) cache.Options {
+	opts := cache.DefaultOptions
+	opts.Mode = cache.Mode(q.Choice("mode", string(opts.Mode), string(cache.WriteThrough), string(cache.WriteBack), string(cache.WriteAround)))
+	opts.TTL = q.Duration("ttl", opts.TTL)
+	opts.NegativeTTL = q.Duration("negative", opts.NegativeTTL)
+	opts.FlushInterval = q.Duration("flush", opts.FlushInterval)
+	opts.Warm = q.Boolean("warm", opts.Warm)
+	if queue, ok := q.Take("queue"); ok {
+		opts.Queue = queue
+	}
+	return opts
+}
@@ -0,0 +1,109 @@
+package meta_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trusch/storage/engines/meta"
+)
+
+func TestQuery(t *testing.T) {
+	q, err := meta.ParseQuery("test", "test:///data?cache=64MB&small=512&bloom=10&sync=true&timeout=1s&perm=0640&compression=none")
+	assert.NoError(t, err)
+	assert.Equal(t, 64<<20, q.Size("cache", 0))
+	assert.Equal(t, 512, q.Size("small", 0))
+	assert.Equal(t, 7, q.Size("missing", 7))
+	assert.Equal(t, 10, q.Integer("bloom", 0))
+	assert.True(t, q.Boolean("sync", false))
+	assert.Equal(t, time.Second, q.Duration("timeout", 0))
+	assert.Equal(t, os.FileMode(0640), q.Perm("perm", 0600))
+	assert.Equal(t, "none", q.Choice("compression", "snappy", "snappy", "none"))
+	assert.NoError(t, q.Done())
+
+	q, err = meta.ParseQuery("test", "test:///data?cache=lots")
+	assert.NoError(t, err)
+	q.Size("cache", 0)
+	assert.EqualError(t, q.Done(), "invalid test option cache=lots: not a size")
+
+	q, err = meta.ParseQuery("test", "test:///data?cache=1KB&bogus=1&other=2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1024, q.Size("cache", 0))
+	assert.EqualError(t, q.Done(), "unknown test options bogus, other")
+}
+
+func TestEngineOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meta")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := meta.NewStorage("leveldb://" + dir + "/leveldb?cache=1MB&bloom=0&compression=none")
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+	_, err = meta.NewStorage("leveldb://" + dir + "/leveldb?compression=zstd")
+	assert.Error(t, err)
+
+	store, err = meta.NewStorage("boltdb://" + dir + "/bolt.db?nosync=true&timeout=100ms")
+	assert.NoError(t, err)
+	_, err = meta.NewStorage("boltdb://" + dir + "/bolt.db?timeout=100ms")
+	assert.Error(t, err, "the file is locked by the first storage")
+	assert.NoError(t, store.Close())
+
+	store, err = meta.NewStorage("file://" + dir + "/files?fsync=true&perm=0640")
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket"))
+	assert.NoError(t, store.Put("bucket", "key", []byte("value")))
+	info, err := os.Stat(filepath.Join(dir, "files", "bucket", "key"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dir, "files", "bucket"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	_, err = meta.NewStorage("file://" + dir + "/files?perm=999")
+	assert.Error(t, err)
+
+	mem, err := meta.NewStorage("memory://" + dir + "/memory/snapshot?fsync=true&compact=1MB")
+	assert.NoError(t, err)
+	assert.NoError(t, mem.CreateBucket("bucket"))
+	assert.NoError(t, mem.Close())
+	mem, err = meta.NewStorage("memory://" + dir + "/memory/snapshot")
+	assert.NoError(t, err)
+	defer mem.Close()
+	buckets, err := mem.ListBuckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bucket"}, buckets)
+	_, err = meta.NewStorage("memory://" + dir + "/memory/other?compact=soon")
+	assert.Error(t, err)
+
+	bounded, err := meta.NewStorage("memory://?maxentries=2&eviction=lfu")
+	assert.NoError(t, err)
+	defer bounded.Close()
+	assert.NoError(t, bounded.CreateBucket("bucket"))
+	for _, key := range []string{"a", "b", "c"} {
+		assert.NoError(t, bounded.Put("bucket", key, []byte(key)))
+	}
+	n, err := bounded.Count("bucket", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	_, err = meta.NewStorage("memory://?eviction=random")
+	assert.Error(t, err)
+
+	cached, err := meta.NewStorage("cache://?mode=write-back&queue=" + dir + "/queue&flush=10ms&negative=1m,memory://,memory://")
+	assert.NoError(t, err)
+	assert.NoError(t, cached.CreateBucket("bucket"))
+	assert.NoError(t, cached.Put("bucket", "key", []byte("value")))
+	assert.NoError(t, cached.Close())
+	_, err = os.Stat(dir + "/queue")
+	assert.NoError(t, err)
+	warmed, err := meta.NewStorage("cache://?warm=true,memory://,memory://")
+	assert.NoError(t, err)
+	assert.NoError(t, warmed.Close())
+	_, err = meta.NewStorage("cache://?mode=write-behind,memory://,memory://")
+	assert.Error(t, err)
+	_, err = meta.NewStorage("cache://?mode=write-around&queue=" + dir + "/queue,memory://,memory://")
+	assert.Error(t, err, "only write-back mode has a queue")
+}
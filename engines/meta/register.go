@@ -0,0 +1,123 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/engines/cache"
+	"github.com/trusch/storage/engines/mirror"
+)
+
+// cache and mirror combine the storages of other URIs, the engines are registered by their register packages
+func init() {
+	Register("cache", func(uri string, options ...interface{}) (storage.Storage, error) {
+		// cache://<first>,<second>
+		// cache://?mode=write-back&queue=/data/queue&flush=1s,<first>,<second> sets the cache options
+		parts, err := splitURIs(strings.TrimPrefix(uri, "cache://"))
+		if err != nil {
+			return nil, err
+		}
+		query := ""
+		if len(parts) == 3 && strings.HasPrefix(parts[0], "?") {
+			query, parts = parts[0], parts[1:]
+		}
+		if len(parts) != 2 {
+			return nil, errors.New("cache uri needs a first and a second uri")
+		}
+		q, err := ParseQuery("cache", query)
+		if err != nil {
+			return nil, err
+		}
+		opts := cacheOptions(q)
+		if err := q.Done(); err != nil {
+			return nil, err
+		}
+		first, err := NewStorage(parts[0], options...)
+		if err != nil {
+			return nil, err
+		}
+		second, err := NewStorage(parts[1], options...)
+		if err != nil {
+			first.Close()
+			return nil, err
+		}
+		store, err := cache.NewStorageWithOptions(first, second, opts)
+		if err != nil {
+			first.Close()
+			second.Close()
+			return nil, err
+		}
+		return store, nil
+	})
+	Register("mirror", func(uri string, options ...interface{}) (storage.Storage, error) {
+		// mirror://<primary>,<secondary> writes to both and reads from the primary
+		parts, err := splitURIs(strings.TrimPrefix(uri, "mirror://"))
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, errors.New("mirror uri needs a primary and a secondary uri")
+		}
+		primary, err := NewStorage(parts[0], options...)
+		if err != nil {
+			return nil, err
+		}
+		secondary, err := NewStorage(parts[1], options...)
+		if err != nil {
+			primary.Close()
+			return nil, err
+		}
+		return mirror.NewStorage(primary, secondary)
+	})
+}
+
+// splitURIs splits the comma separated URIs of a cache or mirror URI
+// An URI containing commas itself, like another cache or mirror URI, is put in parentheses:
+// cache://memory://,(mirror://leveldb:///a,leveldb:///b)
+func splitURIs(s string) ([]string, error) {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in %v", s)
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, unwrap(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses in %v", s)
+	}
+	return append(parts, unwrap(s[start:])), nil
+}
+
+// unwrap removes the parentheses around an URI
+func unwrap(part string) string {
+	if !strings.HasPrefix(part, "(") || !strings.HasSuffix(part, ")") {
+		return part
+	}
+	depth := 0
+	for i := 0; i < len(part)-1; i++ {
+		switch part[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+		if depth == 0 {
+			// the first parenthesis closes before the end, like in (a)b(c)
+			return part
+		}
+	}
+	return part[1 : len(part)-1]
+}
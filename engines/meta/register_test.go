@@ -0,0 +1,24 @@
+package meta
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitURIs(t *testing.T) {
+	for uri, expected := range map[string][]string{
+		"memory://,leveldb:///data":                          {"memory://", "leveldb:///data"},
+		"memory://,(mirror://memory://,memory://)":           {"memory://", "mirror://memory://,memory://"},
+		"(cache://?ttl=1m,memory://,(mirror://a,b)),file://": {"cache://?ttl=1m,memory://,(mirror://a,b)", "file://"},
+		"(a)b(c),d": {"(a)b(c)", "d"},
+	} {
+		parts, err := splitURIs(uri)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, parts, uri)
+	}
+	for _, uri := range []string{"(memory://,memory://", "memory://),memory://"} {
+		_, err := splitURIs(uri)
+		assert.Error(t, err, uri)
+	}
+}
@@ -0,0 +1,50 @@
+package meta
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/trusch/storage"
+)
+
+// Factory creates a storage from an URI, the options are the ones given to NewStorage
+type Factory func(uri string, options ...interface{}) (storage.Storage, error)
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]Factory)
+)
+
+// Register makes an engine available to NewStorage under an URI scheme.
+// It is meant to be called from the init function of a package providing the engine, like the register
+// packages of the engines of this repository, it panics if the scheme is registered twice.
+func Register(scheme string, factory Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[scheme]; ok {
+		panic("meta: scheme " + scheme + " is registered twice")
+	}
+	registry[scheme] = factory
+}
+
+// Schemes returns the registered URI schemes in lexical order
+func Schemes() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Path returns the file system path of an URI like leveldb:///data or leveldb://./data
+func Path(uriStr string) (string, error) {
+	uri, err := url.Parse(uriStr)
+	if err != nil {
+		return "", err
+	}
+	return uri.Host + uri.Path, nil
+}
@@ -0,0 +1,237 @@
+package mirror
+
+import (
+	"errors"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// Storage writes to a primary and a secondary storage and reads from the primary only.
+// It keeps a storage which is being migrated to up to date until the clients are switched over.
+// Buckets missing in the secondary are created on the first write, deletes of keys or buckets
+// the secondary does not have yet are ignored.
+type Storage struct {
+	primary   storage.Storage
+	secondary storage.Storage
+}
+
+// NewStorage creates a new mirroring storage
+func NewStorage(primary, secondary storage.Storage) (*Storage, error) {
+	return &Storage{primary, secondary}, nil
+}
+
+// mirror applies a write to the secondary storage, creating the bucket if needed
+func (store *Storage) mirror(bucket string, write func() error) error {
+	err := write()
+	if common.IsError(err, common.BucketNotFound) {
+		if err = store.secondary.CreateBucket(bucket); err == nil {
+			err = write()
+		}
+	}
+	if err != nil {
+		return common.Error(common.WriteFailed, errors.New("secondary fail"), err)
+	}
+	return nil
+}
+
+// missing reports errors of the secondary storage which only mean it has not caught up yet
+func missing(err error) bool {
+	return common.IsError(err, common.ReadFailed) || common.IsError(err, common.BucketNotFound)
+}
+
+// Put saves a byteslice to the db.
+// Example: Save("/foo/bar", []byte{1,2,3})
+func (store *Storage) Put(bucket, key string, value []byte) error {
+	if err := store.primary.Put(bucket, key, value); err != nil {
+		return err
+	}
+	return store.mirror(bucket, func() error {
+		return store.secondary.Put(bucket, key, value)
+	})
+}
+
+// Get loads data from a key
+func (store *Storage) Get(bucket, key string) ([]byte, error) {
+	return store.primary.Get(bucket, key)
+}
+
+// Delete deletes a value from the db
+func (store *Storage) Delete(bucket, key string) error {
+	if err := store.primary.Delete(bucket, key); err != nil {
+		return err
+	}
+	if err := store.secondary.Delete(bucket, key); err != nil && !missing(err) {
+		return common.Error(common.WriteFailed, errors.New("secondary fail"), err)
+	}
+	return nil
+}
+
+// CreateBucket creates a bucket
+func (store *Storage) CreateBucket(bucket string) error {
+	if err := store.primary.CreateBucket(bucket); err != nil {
+		return err
+	}
+	if err := store.secondary.CreateBucket(bucket); err != nil {
+		return common.Error(common.WriteFailed, errors.New("secondary fail"), err)
+	}
+	return nil
+}
+
+// DeleteBucket deletes a bucket
+func (store *Storage) DeleteBucket(bucket string) error {
+	if err := store.primary.DeleteBucket(bucket); err != nil {
+		return err
+	}
+	if err := store.secondary.DeleteBucket(bucket); err != nil && !missing(err) {
+		return common.Error(common.WriteFailed, errors.New("secondary fail"), err)
+	}
+	return nil
+}
+
+// ListBuckets returns the names of all buckets of the primary storage
+func (store *Storage) ListBuckets() ([]string, error) {
+	return store.primary.ListBuckets()
+}
+
+// List returns all Entries of a bucket of the primary storage
+func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return store.primary.List(bucket, opts)
+}
+
+// Iterate returns an iterator over the entries of a bucket of the primary storage
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.primary.Iterate(bucket, opts)
+}
+
+// Count returns the number of entries of a bucket of the primary storage
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	return store.primary.Count(bucket, opts)
+}
+
+// NewBatch returns a batch which is committed to the primary and then to the secondary storage
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{primary: storage.NewBatch(store.primary), store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	primary storage.Batch
+	store   *Storage
+}
+
+func (b *batch) Put(bucket, key string, value []byte) {
+	b.BatchOps.Put(bucket, key, value)
+	b.primary.Put(bucket, key, value)
+}
+
+func (b *batch) Delete(bucket, key string) {
+	b.BatchOps.Delete(bucket, key)
+	b.primary.Delete(bucket, key)
+}
+
+func (b *batch) Commit() error {
+	if err := b.primary.Commit(); err != nil {
+		return err
+	}
+	// the secondary gets the operations one by one, so missing buckets and keys are handled
+	for _, op := range b.Ops {
+		var err error
+		if op.Delete {
+			err = b.store.secondary.Delete(op.Bucket, op.Key)
+			if missing(err) {
+				err = nil
+			}
+		} else {
+			op := op
+			err = b.store.mirror(op.Bucket, func() error {
+				return b.store.secondary.Put(op.Bucket, op.Key, op.Value)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompareAndSwap replaces the value of a key in the primary storage and mirrors the new value on success
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	s, ok := store.primary.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	swapped, err := s.CompareAndSwap(bucket, key, old, new)
+	if err != nil || !swapped {
+		return swapped, err
+	}
+	return true, store.mirror(bucket, func() error {
+		return store.secondary.Put(bucket, key, new)
+	})
+}
+
+// PutIfAbsent saves a value in the primary storage if the key does not exist and mirrors it on success
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	s, ok := store.primary.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	saved, err := s.PutIfAbsent(bucket, key, value)
+	if err != nil || !saved {
+		return saved, err
+	}
+	return true, store.mirror(bucket, func() error {
+		return store.secondary.Put(bucket, key, value)
+	})
+}
+
+// DeleteIfEquals deletes a key of the primary storage if it has the given value and mirrors the delete on success
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	s, ok := store.primary.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	deleted, err := s.DeleteIfEquals(bucket, key, old)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	if err = store.secondary.Delete(bucket, key); err != nil && !missing(err) {
+		return true, common.Error(common.WriteFailed, errors.New("secondary fail"), err)
+	}
+	return true, nil
+}
+
+// PutWithMeta saves a value along with its metadata in both storages
+// The secondary storage only gets the value if it does not keep metadata.
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	s, ok := store.primary.(storage.MetaStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	if err := s.PutWithMeta(bucket, key, value, meta); err != nil {
+		return err
+	}
+	return store.mirror(bucket, func() error {
+		if s, ok := store.secondary.(storage.MetaStorage); ok {
+			err := s.PutWithMeta(bucket, key, value, meta)
+			if !common.IsError(err, common.Unsupported) {
+				return err
+			}
+		}
+		return store.secondary.Put(bucket, key, value)
+	})
+}
+
+// Stat returns the metadata of a key of the primary storage
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	return storage.Stat(store.primary, bucket, key)
+}
+
+// Close closes both storages
+func (store *Storage) Close() error {
+	err := store.primary.Close()
+	if e := store.secondary.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package mirror
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/engines/memory"
+	"github.com/trusch/storage/testsuite"
+)
+
+type StorageSuite struct {
+	testsuite.Suite
+}
+
+func TestMirrorStorage(t *testing.T) {
+	primary, err := memory.NewStorage()
+	assert.NoError(t, err)
+	secondary, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorage(primary, secondary)
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
+func TestSecondaryCatchesUp(t *testing.T) {
+	primary, err := memory.NewStorage()
+	assert.NoError(t, err)
+	secondary, err := memory.NewStorage()
+	assert.NoError(t, err)
+	assert.NoError(t, primary.CreateBucket("bucket-name"))
+	assert.NoError(t, primary.Put("bucket-name", "old", []byte("old")))
+	store, err := NewStorage(primary, secondary)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.Put("bucket-name", "new", []byte("new")))
+	val, err := secondary.Get("bucket-name", "new")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(val))
+	assert.NoError(t, store.Delete("bucket-name", "old"))
+	_, err = primary.Get("bucket-name", "old")
+	assert.Error(t, err)
+
+	batch := store.NewBatch()
+	batch.Put("other-bucket", "key", []byte("value"))
+	assert.NoError(t, primary.CreateBucket("other-bucket"))
+	assert.NoError(t, batch.Commit())
+	val, err = secondary.Get("other-bucket", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", string(val))
+}
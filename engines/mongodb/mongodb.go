@@ -1,28 +1,59 @@
 package mongodb
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/trusch/storage"
 	"github.com/trusch/storage/common"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 // Storage is a MongoDB implementation of the Storage interface
+// It has no native change feed: the mgo driver lacks change streams, so it is watched through the notifying wrapper.
 type Storage struct {
 	session *mgo.Session
 	db      *mgo.Database
 }
 
 type dbEntry struct {
-	Key   string
-	Value []byte
+	Key      string
+	Value    []byte
+	ExpireAt *time.Time `bson:"expireAt,omitempty"`
+	// File is the GridFS id of a value saved by PutReader
+	File interface{}      `bson:"file,omitempty"`
+	Meta *common.Metadata `bson:"meta,omitempty"`
+}
+
+// gridFSPrefix is the prefix of the GridFS collections holding streamed values
+const gridFSPrefix = "_streams"
+
+// Options tune the connection to mongodb
+type Options struct {
+	// Timeout is the time to wait for the servers when connecting and for each operation, 0 keeps the mgo default
+	Timeout time.Duration
 }
 
 // NewStorage creates a new mongodb storage
 func NewStorage(url string) (*Storage, error) {
+	return NewStorageWithOptions(url, Options{})
+}
+
+// NewStorageWithOptions creates a new mongodb storage with the given options
+func NewStorageWithOptions(url string, options Options) (*Storage, error) {
 	info, err := mgo.ParseURL(url)
 	if err != nil {
 		return nil, err
 	}
+	if options.Timeout > 0 {
+		info.Timeout = options.Timeout
+	}
 	s, err := mgo.DialWithInfo(info)
 	if err != nil {
 		return nil, err
@@ -33,97 +64,676 @@ func NewStorage(url string) (*Storage, error) {
 // Put saves a byteslice to the db.
 // Example: Save("/foo/bar", []byte{1,2,3})
 func (store *Storage) Put(bucket, key string, value []byte) error {
-	if err := store.checkBucket(bucket); err != nil {
-		return err
-	}
-	if _, err := store.db.C(bucket).Upsert(bson.M{"key": key}, &dbEntry{key, value}); err != nil {
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	return store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		return put(db, bucket, key, value, nil)
+	})
+}
+
+// put saves a value along with its metadata, the bucket must exist
+func put(db *mgo.Database, bucket, key string, value []byte, meta *common.Metadata) error {
+	old := streamedFile(db, bucket, key)
+	entry := &dbEntry{Key: key, Value: value, Meta: touch(db, bucket, key, int64(len(value)), meta)}
+	if _, err := db.C(bucket).Upsert(bson.M{"key": key}, entry); err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
+	removeFile(db, old)
 	return nil
 }
 
 // Get loads data from a key
 func (store *Storage) Get(bucket, key string) ([]byte, error) {
-	if err := store.checkBucket(bucket); err != nil {
-		return nil, err
-	}
+	return store.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
 	var res dbEntry
-	if err := store.db.C(bucket).Find(bson.M{"key": key}).One(&res); err != nil {
-		return nil, common.Error(common.ReadFailed, err)
+	err := store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		if err := db.C(bucket).Find(notExpired(bson.M{"key": key})).One(&res); err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+		if res.File != nil {
+			var err error
+			res.Value, err = readFile(db, res.File)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return res.Value, nil
 }
 
 // Delete deletes a value from the db
 func (store *Storage) Delete(bucket, key string) error {
-	if err := store.checkBucket(bucket); err != nil {
-		return err
-	}
-	if err := store.db.C(bucket).Remove(bson.M{"key": key}); err != nil {
-		if err != mgo.ErrNotFound {
-			return common.Error(common.WriteFailed, err)
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	return store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
 		}
-	}
-	return nil
+		old := streamedFile(db, bucket, key)
+		if err := db.C(bucket).Remove(bson.M{"key": key}); err != nil {
+			if err != mgo.ErrNotFound {
+				return common.Error(common.WriteFailed, err)
+			}
+		}
+		removeFile(db, old)
+		return nil
+	})
 }
 
 // CreateBucket creates a bucket
 func (store *Storage) CreateBucket(bucket string) error {
-	if err := store.checkBucket(bucket); err == nil {
+	return store.CreateBucketContext(context.Background(), bucket)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	return store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err == nil {
+			return nil
+		}
+		if err := db.C(bucket).Insert(bson.M{}); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		if err := ensureKeyIndex(db, bucket); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
 		return nil
-	}
-	if err := store.db.C(bucket).Insert(bson.M{}); err != nil {
-		return common.Error(common.WriteFailed, err)
-	}
-	return nil
+	})
 }
 
 // DeleteBucket deletes a bucket
 func (store *Storage) DeleteBucket(bucket string) error {
-	if err := store.db.C(bucket).DropCollection(); err != nil {
-		return common.Error(common.WriteFailed, err)
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	return store.do(ctx, func(db *mgo.Database) error {
+		if err := db.C(bucket).DropCollection(); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		var file struct {
+			ID interface{} `bson:"_id"`
+		}
+		fs := db.GridFS(gridFSPrefix)
+		iter := fs.Find(bson.M{"metadata.bucket": bucket}).Select(bson.M{"_id": 1}).Iter()
+		for iter.Next(&file) {
+			fs.RemoveId(file.ID)
+		}
+		if err := iter.Close(); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		return nil
+	})
+}
+
+// ListBuckets returns the names of all buckets in lexical order
+func (store *Storage) ListBuckets() ([]string, error) {
+	return store.ListBucketsContext(context.Background())
+}
+
+// ListBucketsContext returns the names of all buckets in lexical order
+func (store *Storage) ListBucketsContext(ctx context.Context) ([]string, error) {
+	buckets := []string{}
+	err := store.do(ctx, func(db *mgo.Database) error {
+		names, err := db.CollectionNames()
+		if err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, "system.") && !strings.HasPrefix(name, gridFSPrefix+".") {
+				buckets = append(buckets, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return buckets, nil
 }
 
 // List returns all Entries of a directory
 // optionally provide arguments to specifiy a key offset and a key limit
 // Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
 func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
-	if err := store.checkBucket(bucket); err != nil {
+	return store.ListContext(context.Background(), bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed and the cursor is released as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.IterateContext(ctx, bucket, opts)
+	if err != nil {
 		return nil, err
 	}
+	return common.IteratorChannel(ctx, iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+// Errors of the mgo cursor are reported by Err and Close.
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if opts == nil {
+		opts = &common.ListOpts{}
+	}
+	err := store.do(ctx, func(db *mgo.Database) error {
+		return checkBucket(db, bucket)
+	})
+	if err != nil {
+		return nil, err
+	}
+	query, err := listQuery(opts)
+	if err != nil {
+		return nil, err
+	}
+	sort := "key"
+	if opts.Reverse {
+		sort = "-key"
+	}
+	// the iterator outlives this call, so it gets its own session
+	session := store.session.Copy()
+	q := store.db.With(session).C(bucket).Find(query).Sort(sort).Limit(opts.Limit)
+	if opts.KeysOnly && opts.WithMeta {
+		q = q.Select(bson.M{"key": 1, "meta": 1})
+	} else if opts.KeysOnly {
+		q = q.Select(bson.M{"key": 1})
+	}
+	iter := q.Iter()
+	return common.ContextIterator(ctx, &docIterator{iter: iter, session: session, db: store.db.With(session), withMeta: opts.WithMeta}), nil
+}
+
+// Count returns the number of entries of a bucket
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	return store.CountContext(context.Background(), bucket, opts)
+}
+
+// CountContext returns the number of entries of a bucket
+func (store *Storage) CountContext(ctx context.Context, bucket string, opts *common.ListOpts) (int, error) {
 	if opts == nil {
 		opts = &common.ListOpts{}
 	}
-	var iter *mgo.Iter
+	query, err := listQuery(opts)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		if n, err = db.C(bucket).Find(query).Limit(opts.Limit).Count(); err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// listQuery builds the query selecting the documents described by opts
+func listQuery(opts *common.ListOpts) (bson.M, error) {
+	var query bson.M
 	switch {
 	case opts.Prefix != "":
 		{
-			iter = store.db.C(bucket).Find(bson.M{"key": bson.M{"$regex": "^" + opts.Prefix}}).Iter()
+			query = bson.M{"key": bson.M{"$regex": "^" + regexp.QuoteMeta(opts.Prefix)}}
 		}
 	case opts.Start != "":
 		{
-			iter = store.db.C(bucket).Find(bson.M{"key": bson.M{"$gte": opts.Start, "$lt": opts.End}}).Iter()
+			query = bson.M{"key": bson.M{"$gte": opts.Start, "$lt": opts.End}}
 		}
 	default:
 		{
-			iter = store.db.C(bucket).Find(bson.M{"key": bson.M{"$exists": true}}).Iter()
+			query = bson.M{"key": bson.M{"$exists": true}}
+		}
+	}
+	cursor, ok, err := opts.CursorKey()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		keyQuery := query["key"].(bson.M)
+		if !opts.Reverse {
+			keyQuery["$gt"] = cursor
+		} else if end, ok := keyQuery["$lt"].(string); !ok || cursor < end {
+			keyQuery["$lt"] = cursor
 		}
 	}
-	res := make(chan *common.DocInfo, 64)
+	return notExpired(query), nil
+}
+
+type docIterator struct {
+	iter     *mgo.Iter
+	session  *mgo.Session
+	db       *mgo.Database
+	withMeta bool
+	doc      *common.DocInfo
+	closed   bool
+	err      error
+}
+
+func (it *docIterator) Next() bool {
 	var entry dbEntry
-	go func() {
-		for iter.Next(&entry) {
-			key := entry.Key
-			val := entry.Value
-			doc := &common.DocInfo{Key: key, Value: val}
-			res <- doc
-		}
-		iter.Close()
-		close(res)
-	}()
-	return res, nil
+	if it.closed || it.err != nil || !it.iter.Next(&entry) {
+		it.doc = nil
+		return false
+	}
+	if entry.File != nil {
+		if entry.Value, it.err = readFile(it.db, entry.File); it.err != nil {
+			it.doc = nil
+			return false
+		}
+	}
+	it.doc = &common.DocInfo{Key: entry.Key, Value: entry.Value}
+	if it.withMeta {
+		it.doc.Meta = entry.Meta
+		if it.doc.Meta == nil {
+			it.doc.Meta = &common.Metadata{Size: int64(len(entry.Value))}
+		}
+	}
+	return true
+}
+
+func (it *docIterator) Doc() *common.DocInfo {
+	return it.doc
+}
+
+func (it *docIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	if err := it.iter.Err(); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	return nil
+}
+
+func (it *docIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	defer it.session.Close()
+	if err := it.iter.Close(); err != nil {
+		return common.Error(common.ReadFailed, err)
+	}
+	return nil
+}
+
+// NewBatch creates an empty batch
+// MongoDB has no multi document transactions, so the batch is applied on a best-effort basis:
+// all buckets are checked up front, then the operations are applied in order.
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+// Commit applies all operations of the batch
+func (b *batch) Commit() error {
+	return b.CommitContext(context.Background())
+}
+
+// CommitContext applies all operations of the batch, the operations following the cancellation of ctx are not applied
+func (b *batch) CommitContext(ctx context.Context) error {
+	return b.store.do(ctx, func(db *mgo.Database) error {
+		for _, bucket := range b.Buckets() {
+			if err := checkBucket(db, bucket); err != nil {
+				return err
+			}
+		}
+		for _, op := range b.Ops {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			old := streamedFile(db, op.Bucket, op.Key)
+			if op.Delete {
+				if err := db.C(op.Bucket).Remove(bson.M{"key": op.Key}); err != nil && err != mgo.ErrNotFound {
+					return common.Error(common.WriteFailed, err)
+				}
+			} else if _, err := db.C(op.Bucket).Upsert(bson.M{"key": op.Key}, &dbEntry{
+				Key:   op.Key,
+				Value: op.Value,
+				Meta:  touch(db, op.Bucket, op.Key, int64(len(op.Value)), nil),
+			}); err != nil {
+				return common.Error(common.WriteFailed, err)
+			}
+			removeFile(db, old)
+		}
+		return nil
+	})
+}
+
+// CompareAndSwap saves new if the current value of key equals old
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	return store.CompareAndSwapContext(context.Background(), bucket, key, old, new)
+}
+
+// CompareAndSwapContext saves new if the current value of key equals old
+func (store *Storage) CompareAndSwapContext(ctx context.Context, bucket, key string, old, new []byte) (bool, error) {
+	if old == nil {
+		return store.PutIfAbsentContext(ctx, bucket, key, new)
+	}
+	swapped := false
+	err := store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		err := db.C(bucket).Update(
+			notExpired(bson.M{"key": key, "value": old}),
+			bson.M{
+				"$set":   bson.M{"value": new, "meta.modified": time.Now(), "meta.size": int64(len(new))},
+				"$unset": bson.M{"expireAt": "", "meta.contenttype": "", "meta.attributes": ""},
+			},
+		)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+// PutIfAbsent saves value if key does not exist yet
+// It relies on the unique index on key to resolve concurrent inserts.
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return store.PutIfAbsentContext(context.Background(), bucket, key, value)
+}
+
+// PutIfAbsentContext saves value if key does not exist yet
+func (store *Storage) PutIfAbsentContext(ctx context.Context, bucket, key string, value []byte) (bool, error) {
+	inserted := false
+	err := store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		if err := ensureKeyIndex(db, bucket); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		// an expired document which has not been removed yet does not count
+		if err := db.C(bucket).Remove(bson.M{"key": key, "expireAt": bson.M{"$lte": time.Now()}}); err != nil && err != mgo.ErrNotFound {
+			return common.Error(common.WriteFailed, err)
+		}
+		entry := &dbEntry{Key: key, Value: value, Meta: common.Touch(nil, nil, int64(len(value)), time.Now())}
+		info, err := db.C(bucket).Upsert(bson.M{"key": key}, bson.M{"$setOnInsert": entry})
+		if mgo.IsDup(err) {
+			return nil
+		}
+		if err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		inserted = info.UpsertedId != nil
+		return nil
+	})
+	return inserted, err
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	return store.DeleteIfEqualsContext(context.Background(), bucket, key, old)
+}
+
+// DeleteIfEqualsContext deletes key if its current value equals old
+func (store *Storage) DeleteIfEqualsContext(ctx context.Context, bucket, key string, old []byte) (bool, error) {
+	if old == nil {
+		return false, nil
+	}
+	deleted := false
+	err := store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		err := db.C(bucket).Remove(notExpired(bson.M{"key": key, "value": old}))
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		deleted = true
+		return nil
+	})
+	return deleted, err
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+// Expired documents are removed by a MongoDB TTL index.
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	return store.PutWithTTLContext(context.Background(), bucket, key, value, ttl)
+}
+
+// PutWithTTLContext saves a byteslice which expires after ttl
+func (store *Storage) PutWithTTLContext(ctx context.Context, bucket, key string, value []byte, ttl time.Duration) error {
+	expireAt := time.Now().Add(ttl)
+	return store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		if err := db.C(bucket).EnsureIndex(mgo.Index{Key: []string{"expireAt"}, ExpireAfter: time.Second}); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		old := streamedFile(db, bucket, key)
+		entry := &dbEntry{Key: key, Value: value, ExpireAt: &expireAt, Meta: touch(db, bucket, key, int64(len(value)), nil)}
+		if _, err := db.C(bucket).Upsert(bson.M{"key": key}, entry); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		removeFile(db, old)
+		return nil
+	})
+}
+
+// PutReader saves everything read from r as a GridFS file
+// Conditional writes never match values saved this way, since their content is not part of the document.
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	return store.PutReaderContext(context.Background(), bucket, key, r)
+}
+
+// PutReaderContext saves everything read from r as a GridFS file
+func (store *Storage) PutReaderContext(ctx context.Context, bucket, key string, r io.Reader) error {
+	return store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		fs := db.GridFS(gridFSPrefix)
+		file, err := fs.Create(bucket + "/" + key)
+		if err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		file.SetMeta(bson.M{"bucket": bucket})
+		size, err := io.Copy(file, r)
+		if err != nil {
+			file.Abort()
+			file.Close()
+			return common.Error(common.WriteFailed, err)
+		}
+		if err = file.Close(); err != nil {
+			return common.Error(common.WriteFailed, err)
+		}
+		old := streamedFile(db, bucket, key)
+		entry := &dbEntry{Key: key, File: file.Id(), Meta: touch(db, bucket, key, size, nil)}
+		if _, err = db.C(bucket).Upsert(bson.M{"key": key}, entry); err != nil {
+			fs.RemoveId(file.Id())
+			return common.Error(common.WriteFailed, err)
+		}
+		removeFile(db, old)
+		return nil
+	})
+}
+
+// GetReader opens a value for reading, GridFS files are streamed
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	return store.GetReaderContext(context.Background(), bucket, key)
+}
+
+// GetReaderContext opens a value for reading, GridFS files are streamed
+func (store *Storage) GetReaderContext(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	var res dbEntry
+	err := store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		if err := db.C(bucket).Find(notExpired(bson.M{"key": key})).One(&res); err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.File == nil {
+		return ioutil.NopCloser(bytes.NewReader(res.Value)), nil
+	}
+	// the reader outlives this call, so it gets its own session
+	session := store.session.Copy()
+	file, err := store.db.With(session).GridFS(gridFSPrefix).OpenId(res.File)
+	if err != nil {
+		session.Close()
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return &fileReader{GridFile: file, session: session}, nil
+}
+
+type fileReader struct {
+	*mgo.GridFile
+	session *mgo.Session
+}
+
+func (r *fileReader) Close() error {
+	defer r.session.Close()
+	return r.GridFile.Close()
+}
+
+// PutWithMeta saves a byteslice along with the content type and attributes of meta
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	return store.PutWithMetaContext(context.Background(), bucket, key, value, meta)
+}
+
+// PutWithMetaContext saves a byteslice along with the content type and attributes of meta
+func (store *Storage) PutWithMetaContext(ctx context.Context, bucket, key string, value []byte, meta *common.Metadata) error {
+	return store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		return put(db, bucket, key, value, meta)
+	})
+}
+
+// Stat returns the metadata of a key
+// Documents written before metadata was kept only report the size of their value.
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	return store.StatContext(context.Background(), bucket, key)
+}
+
+// StatContext returns the metadata of a key
+func (store *Storage) StatContext(ctx context.Context, bucket, key string) (*common.Metadata, error) {
+	var res dbEntry
+	err := store.do(ctx, func(db *mgo.Database) error {
+		if err := checkBucket(db, bucket); err != nil {
+			return err
+		}
+		if err := db.C(bucket).Find(notExpired(bson.M{"key": key})).One(&res); err != nil {
+			return common.Error(common.ReadFailed, err)
+		}
+		if res.Meta == nil && res.File != nil {
+			var err error
+			res.Value, err = readFile(db, res.File)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Meta == nil {
+		return &common.Metadata{Size: int64(len(res.Value))}, nil
+	}
+	return res.Meta, nil
+}
+
+// touch returns the metadata of a new value of size bytes, keeping the creation time of the old one
+func touch(db *mgo.Database, bucket, key string, size int64, meta *common.Metadata) *common.Metadata {
+	var entry dbEntry
+	db.C(bucket).Find(bson.M{"key": key}).Select(bson.M{"meta": 1}).One(&entry)
+	return common.Touch(entry.Meta, meta, size, time.Now())
+}
+
+// streamedFile returns the GridFS id of the value of key if it was saved by PutReader
+func streamedFile(db *mgo.Database, bucket, key string) interface{} {
+	var entry dbEntry
+	if err := db.C(bucket).Find(bson.M{"key": key, "file": bson.M{"$exists": true}}).Select(bson.M{"file": 1}).One(&entry); err != nil {
+		return nil
+	}
+	return entry.File
+}
+
+// removeFile removes a GridFS file which is no longer referenced
+func removeFile(db *mgo.Database, id interface{}) {
+	if id != nil {
+		db.GridFS(gridFSPrefix).RemoveId(id)
+	}
+}
+
+func readFile(db *mgo.Database, id interface{}) ([]byte, error) {
+	file, err := db.GridFS(gridFSPrefix).OpenId(id)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	defer file.Close()
+	val, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return val, nil
+}
+
+// notExpired extends a query so it does not match expired documents
+// MongoDB removes expired documents only once a minute.
+func notExpired(query bson.M) bson.M {
+	query["$or"] = []bson.M{
+		{"expireAt": bson.M{"$exists": false}},
+		{"expireAt": bson.M{"$gt": time.Now()}},
+	}
+	return query
+}
+
+// ensureKeyIndex makes sure a bucket has a unique index on key
+// The index is sparse because the bucket marker document has no key.
+func ensureKeyIndex(db *mgo.Database, bucket string) error {
+	return db.C(bucket).EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true, Sparse: true})
+}
+
+// Begin is not supported by the mongodb storage
+func (store *Storage) Begin() (storage.Tx, error) {
+	return nil, common.Error(common.Unsupported)
 }
 
 // Close closes the storage
@@ -132,8 +742,44 @@ func (store *Storage) Close() error {
 	return nil
 }
 
-func (store *Storage) checkBucket(bucket string) error {
-	names, err := store.db.CollectionNames()
+// do runs fn on a copy of the session.
+// If ctx is done before fn returns, the session is closed to abort the pending operation and do
+// waits for fn before it returns ctx.Err(), so no operation runs on behalf of a cancelled call.
+// An operation which already reached the server may still have been applied.
+func (store *Storage) do(ctx context.Context, fn func(db *mgo.Database) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	session := store.session.Copy()
+	defer session.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		session.SetSocketTimeout(time.Until(deadline))
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			// operations on the session closed because ctx is done panic
+			if r := recover(); r != nil {
+				if ctx.Err() == nil {
+					panic(r)
+				}
+				done <- ctx.Err()
+			}
+		}()
+		done <- fn(store.db.With(session))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func checkBucket(db *mgo.Database, bucket string) error {
+	names, err := db.CollectionNames()
 	if err != nil {
 		return common.Error(common.ReadFailed, err)
 	}
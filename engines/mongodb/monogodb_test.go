@@ -2,11 +2,14 @@ package mongodb
 
 import (
 	"os/exec"
+	"regexp"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/common"
 	"github.com/trusch/storage/testsuite"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type StorageSuite struct {
@@ -31,3 +34,13 @@ func TestMongoDBStorage(t *testing.T) {
 	suite.Run(t, s)
 	exec.Command("mongo", "test", "--eval", "db.dropDatabase()")
 }
+
+func TestListQueryQuotesPrefix(t *testing.T) {
+	query, err := listQuery(&common.ListOpts{Prefix: "a.b*("})
+	assert.NoError(t, err)
+	pattern := query["key"].(bson.M)["$regex"].(string)
+	re, err := regexp.Compile(pattern)
+	assert.NoError(t, err)
+	assert.True(t, re.MatchString("a.b*(c"))
+	assert.False(t, re.MatchString("axbb("))
+}
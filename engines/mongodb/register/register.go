@@ -0,0 +1,29 @@
+// Package register makes the mongodb engine available to meta.NewStorage under the mongodb scheme.
+package register
+
+import (
+	"strings"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/engines/meta"
+	"github.com/trusch/storage/engines/mongodb"
+)
+
+// mongodb://host/db?timeout=10s, the other options of the URI are passed on to the driver
+func init() {
+	meta.Register("mongodb", func(uri string, options ...interface{}) (storage.Storage, error) {
+		q, err := meta.ParseQuery("mongodb", uri)
+		if err != nil {
+			return nil, err
+		}
+		opts := mongodb.Options{Timeout: q.Duration("timeout", 0)}
+		if err = q.Err(); err != nil {
+			return nil, err
+		}
+		uri = strings.SplitN(uri, "?", 2)[0]
+		if values := q.Values(); len(values) > 0 {
+			uri += "?" + values.Encode()
+		}
+		return mongodb.NewStorageWithOptions(uri, opts)
+	})
+}
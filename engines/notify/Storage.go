@@ -0,0 +1,433 @@
+package notify
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// BufferSize is the number of events a watcher may lag behind before its channel is closed
+var BufferSize = 256
+
+// Storage wraps another storage and reports all writes made through it to watchers.
+// Writes which bypass the wrapper, like keys expiring in the base storage or writes of other processes
+// to a shared database, are not reported.
+type Storage struct {
+	base     storage.Storage
+	mutex    sync.Mutex
+	watchers map[*watcher]bool
+	// locks are held across a write and the publishing of its events, so the events of a key are
+	// reported in the order its writes were made
+	locks [64]sync.Mutex
+}
+
+type watcher struct {
+	bucket string
+	prefix string
+	ch     chan *common.Event
+}
+
+// NewStorage creates a new notifying storage around base
+func NewStorage(base storage.Storage) (*Storage, error) {
+	return &Storage{base: base, watchers: make(map[*watcher]bool)}, nil
+}
+
+// Watch streams an event for every change of a key in bucket starting with prefix
+func (store *Storage) Watch(ctx context.Context, bucket, prefix string) (<-chan *common.Event, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	w := &watcher{bucket: bucket, prefix: prefix, ch: make(chan *common.Event, BufferSize)}
+	store.mutex.Lock()
+	store.watchers[w] = true
+	store.mutex.Unlock()
+	go func() {
+		<-ctx.Done()
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		store.remove(w)
+	}()
+	return w.ch, nil
+}
+
+// publish hands the events to all matching watchers, a watcher which can not take them is dropped
+func (store *Storage) publish(events ...*common.Event) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, event := range events {
+		for w := range store.watchers {
+			if w.bucket != event.Bucket || (event.Type != common.DeleteBucketEvent && !strings.HasPrefix(event.Key, w.prefix)) {
+				continue
+			}
+			select {
+			case w.ch <- event:
+			default:
+				store.remove(w)
+			}
+		}
+	}
+}
+
+// lock locks the stripes of the keys of the events in order and returns the unlock function
+// The deletion of a bucket locks all stripes.
+func (store *Storage) lock(events ...*common.Event) func() {
+	stripes := make(map[int]bool)
+	for _, event := range events {
+		if event.Type == common.DeleteBucketEvent {
+			for i := range store.locks {
+				stripes[i] = true
+			}
+			break
+		}
+		stripes[stripe(event.Bucket+"/"+event.Key)] = true
+	}
+	ordered := make([]int, 0, len(stripes))
+	for i := range stripes {
+		ordered = append(ordered, i)
+	}
+	sort.Ints(ordered)
+	for _, i := range ordered {
+		store.locks[i].Lock()
+	}
+	return func() {
+		for _, i := range ordered {
+			store.locks[i].Unlock()
+		}
+	}
+}
+
+// stripe returns the index of the lock of a key
+func stripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % 64)
+}
+
+// write runs a write of the base storage and publishes its events if it succeeds
+func (store *Storage) write(fn func() error, events ...*common.Event) error {
+	defer store.lock(events...)()
+	if err := fn(); err != nil {
+		return err
+	}
+	store.publish(events...)
+	return nil
+}
+
+// remove closes the channel of a watcher, the caller must hold the lock
+func (store *Storage) remove(w *watcher) {
+	if store.watchers[w] {
+		delete(store.watchers, w)
+		close(w.ch)
+	}
+}
+
+func putEvent(bucket, key string, value []byte) *common.Event {
+	return &common.Event{Type: common.PutEvent, Bucket: bucket, Key: key, Value: value}
+}
+
+func deleteEvent(bucket, key string) *common.Event {
+	return &common.Event{Type: common.DeleteEvent, Bucket: bucket, Key: key}
+}
+
+// Put saves a byteslice to the db.
+// Example: Save("/foo/bar", []byte{1,2,3})
+func (store *Storage) Put(bucket, key string, value []byte) error {
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	return store.write(func() error {
+		return storage.WithContext(store.base).PutContext(ctx, bucket, key, value)
+	}, putEvent(bucket, key, value))
+}
+
+// Get loads data from a key
+func (store *Storage) Get(bucket, key string) ([]byte, error) {
+	return store.base.Get(bucket, key)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	return storage.WithContext(store.base).GetContext(ctx, bucket, key)
+}
+
+// Delete deletes a value from the db
+func (store *Storage) Delete(bucket, key string) error {
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	return store.write(func() error {
+		return storage.WithContext(store.base).DeleteContext(ctx, bucket, key)
+	}, deleteEvent(bucket, key))
+}
+
+// CreateBucket creates a bucket
+func (store *Storage) CreateBucket(bucket string) error {
+	return store.base.CreateBucket(bucket)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	return storage.WithContext(store.base).CreateBucketContext(ctx, bucket)
+}
+
+// DeleteBucket deletes a bucket
+func (store *Storage) DeleteBucket(bucket string) error {
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	return store.write(func() error {
+		return storage.WithContext(store.base).DeleteBucketContext(ctx, bucket)
+	}, &common.Event{Type: common.DeleteBucketEvent, Bucket: bucket})
+}
+
+// ListBuckets returns the names of all buckets
+func (store *Storage) ListBuckets() ([]string, error) {
+	return store.base.ListBuckets()
+}
+
+// List returns all Entries of a directory
+// optionally provide arguments to specifiy a key offset and a key limit
+// Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
+func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return store.base.List(bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return storage.WithContext(store.base).ListContext(ctx, bucket, opts)
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.base.Iterate(bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return storage.WithContext(store.base).IterateContext(ctx, bucket, opts)
+}
+
+// Count returns the number of entries of a bucket
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	return store.base.Count(bucket, opts)
+}
+
+// NewBatch creates a batch of the base storage which reports its writes once committed
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{base: storage.NewBatch(store.base), store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	base  storage.Batch
+	store *Storage
+}
+
+func (b *batch) Put(bucket, key string, value []byte) {
+	b.BatchOps.Put(bucket, key, value)
+	b.base.Put(bucket, key, value)
+}
+
+func (b *batch) Delete(bucket, key string) {
+	b.BatchOps.Delete(bucket, key)
+	b.base.Delete(bucket, key)
+}
+
+func (b *batch) Commit() error {
+	return b.store.write(b.base.Commit, events(b.Ops)...)
+}
+
+// Begin starts a transaction of the base storage which reports its writes once committed
+// The key locks are not held across the commit, since the base storage may block other writes while
+// a transaction is open. A write made right after the commit may therefore be reported before it.
+func (store *Storage) Begin() (storage.Tx, error) {
+	s, ok := store.base.(storage.Transactional)
+	if !ok {
+		return nil, common.Error(common.Unsupported)
+	}
+	base, err := s.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &tx{Tx: base, store: store}, nil
+}
+
+type tx struct {
+	storage.Tx
+	ops   common.BatchOps
+	store *Storage
+}
+
+func (t *tx) Put(bucket, key string, value []byte) error {
+	if err := t.Tx.Put(bucket, key, value); err != nil {
+		return err
+	}
+	t.ops.Put(bucket, key, value)
+	return nil
+}
+
+func (t *tx) Delete(bucket, key string) error {
+	if err := t.Tx.Delete(bucket, key); err != nil {
+		return err
+	}
+	t.ops.Delete(bucket, key)
+	return nil
+}
+
+func (t *tx) Commit() error {
+	if err := t.Tx.Commit(); err != nil {
+		return err
+	}
+	t.store.publish(events(t.ops.Ops)...)
+	return nil
+}
+
+func events(ops []*common.BatchOp) []*common.Event {
+	res := make([]*common.Event, len(ops))
+	for i, op := range ops {
+		if op.Delete {
+			res[i] = deleteEvent(op.Bucket, op.Key)
+		} else {
+			res[i] = putEvent(op.Bucket, op.Key, op.Value)
+		}
+	}
+	return res
+}
+
+// CompareAndSwap saves new if the current value of key equals old
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	s, ok := store.base.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	defer store.lock(putEvent(bucket, key, nil))()
+	swapped, err := s.CompareAndSwap(bucket, key, old, new)
+	if swapped {
+		store.publish(putEvent(bucket, key, new))
+	}
+	return swapped, err
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	s, ok := store.base.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	defer store.lock(putEvent(bucket, key, nil))()
+	done, err := s.PutIfAbsent(bucket, key, value)
+	if done {
+		store.publish(putEvent(bucket, key, value))
+	}
+	return done, err
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	s, ok := store.base.(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	defer store.lock(deleteEvent(bucket, key))()
+	deleted, err := s.DeleteIfEquals(bucket, key, old)
+	if deleted {
+		store.publish(deleteEvent(bucket, key))
+	}
+	return deleted, err
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+// Only the put is reported, not the expiry.
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	s, ok := store.base.(storage.TTLStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	return store.write(func() error {
+		return s.PutWithTTL(bucket, key, value, ttl)
+	}, putEvent(bucket, key, value))
+}
+
+// PutReader saves everything read from r in the base storage
+// The value is not buffered, so the reported event carries no value.
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	return store.write(func() error {
+		return storage.PutReader(store.base, bucket, key, r)
+	}, putEvent(bucket, key, nil))
+}
+
+// GetReader opens a value of the base storage for reading
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	return storage.GetReader(store.base, bucket, key)
+}
+
+// PutWithMeta saves a byteslice along with its metadata in the base storage
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	s, ok := store.base.(storage.MetaStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	return store.write(func() error {
+		return s.PutWithMeta(bucket, key, value, meta)
+	}, putEvent(bucket, key, value))
+}
+
+// Stat returns the metadata of a key of the base storage
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	return storage.Stat(store.base, bucket, key)
+}
+
+// EnableVersioning starts keeping the history of the keys of a bucket in the base storage
+func (store *Storage) EnableVersioning(bucket string) error {
+	if s, ok := store.base.(storage.VersionedStorage); ok {
+		return s.EnableVersioning(bucket)
+	}
+	return common.Error(common.Unsupported)
+}
+
+// GetVersion loads a former value of a key
+func (store *Storage) GetVersion(bucket, key string, version uint64) ([]byte, error) {
+	if s, ok := store.base.(storage.VersionedStorage); ok {
+		return s.GetVersion(bucket, key, version)
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// ListVersions returns the history of a key, oldest first
+func (store *Storage) ListVersions(bucket, key string) ([]*common.Version, error) {
+	if s, ok := store.base.(storage.VersionedStorage); ok {
+		return s.ListVersions(bucket, key)
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// Snapshot returns a read-only view of the base storage as it is now
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	if s, ok := store.base.(storage.Snapshotter); ok {
+		return s.Snapshot()
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// Close closes all watches and the base storage
+func (store *Storage) Close() error {
+	store.mutex.Lock()
+	for w := range store.watchers {
+		store.remove(w)
+	}
+	store.mutex.Unlock()
+	return store.base.Close()
+}
@@ -0,0 +1,96 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/engines/memory"
+	"github.com/trusch/storage/testsuite"
+)
+
+type StorageSuite struct {
+	testsuite.Suite
+}
+
+func TestNotifyStorage(t *testing.T) {
+	base, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorage(base)
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
+func TestSlowWatcherIsDropped(t *testing.T) {
+	base, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorage(base)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	events, err := store.Watch(context.Background(), "bucket-name", "")
+	assert.NoError(t, err)
+	for i := 0; i <= BufferSize; i++ {
+		assert.NoError(t, store.Put("bucket-name", fmt.Sprintf("key-%v", i), nil))
+	}
+	count := 0
+	for range events {
+		count++
+	}
+	assert.Equal(t, BufferSize, count)
+}
+
+// slowStorage pauses after each write, so a write can be overtaken before its event is published
+type slowStorage struct {
+	*memory.Storage
+}
+
+func (s *slowStorage) Put(bucket, key string, value []byte) error {
+	return s.PutContext(context.Background(), bucket, key, value)
+}
+
+func (s *slowStorage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	err := s.Storage.PutContext(ctx, bucket, key, value)
+	time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+	return err
+}
+
+func TestEventsFollowWriteOrder(t *testing.T) {
+	base, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorage(&slowStorage{base})
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	for round := 0; round < 50; round++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := store.Watch(ctx, "bucket-name", "")
+		assert.NoError(t, err)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, store.Put("bucket-name", "key", []byte(fmt.Sprint(i))))
+			}(i)
+		}
+		wg.Wait()
+		var last []byte
+		for i := 0; i < 8; i++ {
+			last = (<-events).Value
+		}
+		value, err := store.Get("bucket-name", "key")
+		assert.NoError(t, err)
+		assert.Equal(t, value, last)
+		cancel()
+	}
+}
@@ -0,0 +1,249 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strings"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// Storage spreads the keys of every bucket over several other storages by a hash of bucket and key.
+// Every bucket exists in all shards, listings merge the shards in key order.
+// The shards can not be changed once keys are saved, since keys would be looked up in the wrong shard.
+type Storage struct {
+	shards []storage.Storage
+}
+
+// NewStorage creates a new sharded storage
+func NewStorage(shards ...storage.Storage) (*Storage, error) {
+	if len(shards) == 0 {
+		return nil, common.Error(common.InitFailed, errors.New("no shards"))
+	}
+	return &Storage{shards}, nil
+}
+
+// shard returns the storage holding a key
+func (store *Storage) shard(bucket, key string) storage.Storage {
+	h := fnv.New32a()
+	h.Write([]byte(bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return store.shards[h.Sum32()%uint32(len(store.shards))]
+}
+
+// Put saves a byteslice to the db.
+// Example: Save("/foo/bar", []byte{1,2,3})
+func (store *Storage) Put(bucket, key string, value []byte) error {
+	return store.shard(bucket, key).Put(bucket, key, value)
+}
+
+// Get loads data from a key
+func (store *Storage) Get(bucket, key string) ([]byte, error) {
+	return store.shard(bucket, key).Get(bucket, key)
+}
+
+// Delete deletes a value from the db
+func (store *Storage) Delete(bucket, key string) error {
+	return store.shard(bucket, key).Delete(bucket, key)
+}
+
+// CreateBucket creates a bucket in all shards
+func (store *Storage) CreateBucket(bucket string) error {
+	for _, shard := range store.shards {
+		if err := shard.CreateBucket(bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteBucket deletes a bucket from all shards
+func (store *Storage) DeleteBucket(bucket string) error {
+	for _, shard := range store.shards {
+		if err := shard.DeleteBucket(bucket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListBuckets returns the names of all buckets
+func (store *Storage) ListBuckets() ([]string, error) {
+	return store.shards[0].ListBuckets()
+}
+
+// List returns all Entries of a directory
+// optionally provide arguments to specifiy a key offset and a key limit
+// Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
+func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.Iterate(bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(context.Background(), iter), nil
+}
+
+// Iterate returns an iterator merging the entries of a bucket of all shards
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	if opts == nil {
+		opts = &common.ListOpts{}
+	}
+	it := &mergeIterator{reverse: opts.Reverse, limit: opts.Limit}
+	for _, shard := range store.shards {
+		iter, err := shard.Iterate(bucket, opts)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		it.iters = append(it.iters, iter)
+		it.heads = append(it.heads, nil)
+	}
+	for i := range it.iters {
+		it.advance(i)
+	}
+	return it, nil
+}
+
+// Count returns the number of entries of a bucket in all shards
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	total := 0
+	for _, shard := range store.shards {
+		n, err := shard.Count(bucket, opts)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	if opts != nil && opts.Limit > 0 && total > opts.Limit {
+		total = opts.Limit
+	}
+	return total, nil
+}
+
+// mergeIterator yields the docs of several iterators in key order, the smallest head is next
+type mergeIterator struct {
+	iters   []common.Iterator
+	heads   []*common.DocInfo
+	reverse bool
+	limit   int
+	count   int
+	doc     *common.DocInfo
+	err     error
+}
+
+// advance loads the next doc of an iterator as its head
+func (it *mergeIterator) advance(i int) {
+	it.heads[i] = nil
+	if it.iters[i].Next() {
+		it.heads[i] = it.iters[i].Doc()
+	} else if err := it.iters[i].Err(); err != nil && it.err == nil {
+		it.err = err
+	}
+}
+
+func (it *mergeIterator) Next() bool {
+	it.doc = nil
+	if it.err != nil || (it.limit > 0 && it.count >= it.limit) {
+		return false
+	}
+	next := -1
+	for i, head := range it.heads {
+		if head == nil {
+			continue
+		}
+		if next < 0 {
+			next = i
+			continue
+		}
+		cmp := strings.Compare(head.Key, it.heads[next].Key)
+		if (cmp < 0 && !it.reverse) || (cmp > 0 && it.reverse) {
+			next = i
+		}
+	}
+	if next < 0 {
+		return false
+	}
+	it.doc = it.heads[next]
+	it.count++
+	it.advance(next)
+	return true
+}
+
+func (it *mergeIterator) Doc() *common.DocInfo {
+	return it.doc
+}
+
+func (it *mergeIterator) Err() error {
+	return it.err
+}
+
+func (it *mergeIterator) Close() error {
+	var err error
+	for _, iter := range it.iters {
+		if e := iter.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// CompareAndSwap saves new in the shard of key if its current value equals old
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	s, ok := store.shard(bucket, key).(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	return s.CompareAndSwap(bucket, key, old, new)
+}
+
+// PutIfAbsent saves value in the shard of key if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	s, ok := store.shard(bucket, key).(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	return s.PutIfAbsent(bucket, key, value)
+}
+
+// DeleteIfEquals deletes key from its shard if its value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	s, ok := store.shard(bucket, key).(storage.ConditionalStorage)
+	if !ok {
+		return false, common.Error(common.Unsupported)
+	}
+	return s.DeleteIfEquals(bucket, key, old)
+}
+
+// Snapshot returns a sharded storage over snapshots of all shards
+// The snapshots are taken one after the other, so they are only consistent per shard.
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	snaps := make([]storage.Storage, 0, len(store.shards))
+	for _, shard := range store.shards {
+		s, ok := shard.(storage.Snapshotter)
+		if !ok {
+			(&Storage{snaps}).Close()
+			return nil, common.Error(common.Unsupported)
+		}
+		snap, err := s.Snapshot()
+		if err != nil {
+			(&Storage{snaps}).Close()
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	return &Storage{snaps}, nil
+}
+
+// Close closes all shards
+func (store *Storage) Close() error {
+	var err error
+	for _, shard := range store.shards {
+		if e := shard.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+	"github.com/trusch/storage/engines/memory"
+	"github.com/trusch/storage/testsuite"
+)
+
+type StorageSuite struct {
+	testsuite.Suite
+}
+
+func newShards(t *testing.T, n int) []storage.Storage {
+	shards := make([]storage.Storage, n)
+	for i := range shards {
+		shard, err := memory.NewStorage()
+		assert.NoError(t, err)
+		shards[i] = shard
+	}
+	return shards
+}
+
+func TestShardStorage(t *testing.T) {
+	store, err := NewStorage(newShards(t, 3)...)
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
+func TestKeysAreSpread(t *testing.T) {
+	shards := newShards(t, 3)
+	store, err := NewStorage(shards...)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, store.Put("bucket-name", fmt.Sprintf("key-%03d", i), nil))
+	}
+	for _, shard := range shards {
+		n, err := shard.Count("bucket-name", nil)
+		assert.NoError(t, err)
+		assert.True(t, n > 10 && n < 60, n)
+	}
+	iter, err := store.Iterate("bucket-name", &common.ListOpts{Reverse: true, Limit: 5, Cursor: common.NewCursor("key-050")})
+	assert.NoError(t, err)
+	keys := []string{}
+	for iter.Next() {
+		keys = append(keys, iter.Doc().Key)
+	}
+	assert.NoError(t, iter.Close())
+	assert.Equal(t, []string{"key-049", "key-048", "key-047", "key-046", "key-045"}, keys)
+	n, err := store.Count("bucket-name", &common.ListOpts{Prefix: "key-01"})
+	assert.NoError(t, err)
+	assert.Equal(t, 10, n)
+}
+
+func TestNoShards(t *testing.T) {
+	_, err := NewStorage()
+	assert.Error(t, err)
+}
@@ -3,13 +3,18 @@ package storaged
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/trusch/storage"
 	"github.com/trusch/storage/common"
 )
 
@@ -47,33 +52,45 @@ func NewStorage(uriStr string, token ...string) (*Storage, error) {
 // Put saves a byteslice to the db.
 // Example: Save("/foo/bar", []byte{1,2,3})
 func (store *Storage) Put(bucket, key string, value []byte) error {
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), bytes.NewReader(value))
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	req, err := store.newRequest(ctx, "PUT", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), bytes.NewReader(value))
 	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
-	if store.token != "" {
-		req.Header.Set("Autorization", fmt.Sprintf("bearer %v", store.token))
-	}
 	resp, err := store.client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.Error(common.WriteFailed)
+	}
 	return nil
 }
 
 // Get loads data from a key
 func (store *Storage) Get(bucket, key string) ([]byte, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), nil)
+	return store.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	req, err := store.newRequest(ctx, "GET", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), nil)
 	if err != nil {
 		return nil, common.Error(common.ReadFailed, err)
 	}
-	if store.token != "" {
-		req.Header.Set("Autorization", fmt.Sprintf("bearer %v", store.token))
-	}
 	resp, err := store.client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
 		return nil, common.Error(common.ReadFailed, err)
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, common.Error(common.ReadFailed)
+	}
 	val, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, common.Error(common.ReadFailed, err)
@@ -83,107 +100,557 @@ func (store *Storage) Get(bucket, key string) ([]byte, error) {
 
 // Delete deletes a value from the db
 func (store *Storage) Delete(bucket, key string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), nil)
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	req, err := store.newRequest(ctx, "DELETE", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), nil)
 	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
-	if store.token != "" {
-		req.Header.Set("Autorization", fmt.Sprintf("bearer %v", store.token))
-	}
 	resp, err := store.client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.Error(common.WriteFailed)
+	}
 	return nil
 }
 
 // CreateBucket creates a bucket
 func (store *Storage) CreateBucket(bucket string) error {
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%v/%v", store.baseURL, bucket), nil)
+	return store.CreateBucketContext(context.Background(), bucket)
+}
+
+// CreateBucketContext creates a bucket
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	req, err := store.newRequest(ctx, "PUT", fmt.Sprintf("%v/%v", store.baseURL, bucket), nil)
 	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
-	if store.token != "" {
-		req.Header.Set("Autorization", fmt.Sprintf("bearer %v", store.token))
-	}
 	resp, err := store.client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.Error(common.WriteFailed)
+	}
 	return nil
 }
 
 // DeleteBucket deletes a bucket
 func (store *Storage) DeleteBucket(bucket string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%v/%v", store.baseURL, bucket), nil)
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	req, err := store.newRequest(ctx, "DELETE", fmt.Sprintf("%v/%v", store.baseURL, bucket), nil)
 	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
-	if store.token != "" {
-		req.Header.Set("Autorization", fmt.Sprintf("bearer %v", store.token))
-	}
 	resp, err := store.client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
 		return common.Error(common.WriteFailed, err)
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.Error(common.WriteFailed)
+	}
 	return nil
 }
 
+// ListBuckets returns the names of all buckets of the project
+func (store *Storage) ListBuckets() ([]string, error) {
+	req, err := store.newRequest(context.Background(), "GET", store.baseURL, nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, common.Error(common.ReadFailed)
+	}
+	buckets := []string{}
+	if err = json.NewDecoder(resp.Body).Decode(&buckets); err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return buckets, nil
+}
+
 // List returns all Entries of a directory
 // optionally provide arguments to specifiy a key offset and a key limit
 // Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
 func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return store.ListContext(context.Background(), bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed and the request is aborted as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	iter, err := store.IterateContext(ctx, bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	return common.IteratorChannel(ctx, iter), nil
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+// The response is decoded while iterating, a truncated or malformed response is reported by Err.
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
 	uri := fmt.Sprintf("%v/%v", store.baseURL, bucket)
+	if query := listQuery(opts); len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := store.newRequest(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, common.Error(common.ReadFailed)
+	}
+	dec := json.NewDecoder(resp.Body)
+	if _, err = dec.Token(); err != nil {
+		resp.Body.Close()
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return common.ContextIterator(ctx, &docIterator{body: resp.Body, dec: dec}), nil
+}
+
+// Count returns the number of entries of a bucket
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	query := listQuery(opts)
+	query.Set("count", "true")
+	req, err := store.newRequest(context.Background(), "GET", fmt.Sprintf("%v/%v?%v", store.baseURL, bucket, query.Encode()), nil)
+	if err != nil {
+		return 0, common.Error(common.ReadFailed, err)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return 0, common.Error(common.ReadFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, common.Error(common.ReadFailed)
+	}
+	n := 0
+	if err = json.NewDecoder(resp.Body).Decode(&n); err != nil {
+		return 0, common.Error(common.ReadFailed, err)
+	}
+	return n, nil
+}
+
+// listQuery encodes the list options as query parameters
+func listQuery(opts *common.ListOpts) url.Values {
 	if opts == nil {
 		opts = &common.ListOpts{}
 	}
+	query := url.Values{}
 	if opts.Prefix != "" {
-		uri = fmt.Sprintf("%v?prefix=%v", uri, opts.Prefix)
+		query.Set("prefix", opts.Prefix)
 	} else if opts.Start != "" {
-		uri = fmt.Sprintf("%v?start=%v&end=%v", uri, opts.Start, opts.End)
+		query.Set("start", opts.Start)
+		query.Set("end", opts.End)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Reverse {
+		query.Set("reverse", "true")
+	}
+	if opts.Cursor != "" {
+		query.Set("cursor", opts.Cursor)
+	}
+	if opts.KeysOnly {
+		query.Set("keys", "true")
+	}
+	if opts.WithMeta {
+		query.Set("meta", "true")
+	}
+	return query
+}
+
+// docIterator decodes the JSON array of a list response one document at a time
+type docIterator struct {
+	body io.ReadCloser
+	dec  *json.Decoder
+	doc  *common.DocInfo
+	done bool
+	err  error
+}
+
+func (it *docIterator) Next() bool {
+	it.doc = nil
+	if it.done || it.err != nil {
+		return false
+	}
+	if !it.dec.More() {
+		// the closing bracket is missing if the server failed while streaming
+		if _, err := it.dec.Token(); err != nil {
+			it.err = common.Error(common.ReadFailed, err)
+		}
+		it.done = true
+		return false
+	}
+	doc := &common.DocInfo{}
+	if err := it.dec.Decode(doc); err != nil {
+		it.err = common.Error(common.ReadFailed, err)
+		return false
 	}
-	req, err := http.NewRequest("GET", uri, nil)
+	it.doc = doc
+	return true
+}
+
+func (it *docIterator) Doc() *common.DocInfo {
+	return it.doc
+}
+
+func (it *docIterator) Err() error {
+	return it.err
+}
+
+func (it *docIterator) Close() error {
+	it.done = true
+	return it.body.Close()
+}
+
+// NewBatch creates an empty batch which is sent to the server in a single request
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+// Commit sends all operations to the server which applies them atomically
+func (b *batch) Commit() error {
+	bs, err := json.Marshal(b.Ops)
 	if err != nil {
-		return nil, common.Error(common.ReadFailed, err)
+		return common.Error(common.WriteFailed, err)
 	}
-	if store.token != "" {
-		req.Header.Set("Autorization", fmt.Sprintf("bearer %v", store.token))
+	req, err := b.store.newRequest(context.Background(), "POST", fmt.Sprintf("%v/_batch", b.store.baseURL), bytes.NewReader(bs))
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.store.client.Do(req)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.Error(common.WriteFailed)
+	}
+	return nil
+}
+
+// CompareAndSwap saves new if the current value of key equals old
+// The condition is sent as If-Match (or If-None-Match for a missing key) header.
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	req, err := store.newRequest(context.Background(), "PUT", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), bytes.NewReader(new))
+	if err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	if old == nil {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", common.ETag(old))
+	}
+	return store.conditional(req)
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return store.CompareAndSwap(bucket, key, nil, value)
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	if old == nil {
+		return false, nil
+	}
+	req, err := store.newRequest(context.Background(), "DELETE", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), nil)
+	if err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	req.Header.Set("If-Match", common.ETag(old))
+	return store.conditional(req)
+}
+
+// conditional executes a conditional request, a failed precondition is not an error
+func (store *Storage) conditional(req *http.Request) (bool, error) {
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return false, common.Error(common.WriteFailed, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusPreconditionFailed:
+		return false, nil
+	}
+	return false, common.Error(common.WriteFailed)
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	req, err := store.newRequest(context.Background(), "PUT", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), bytes.NewReader(value))
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
 	}
+	req.Header.Set("X-TTL", ttl.String())
 	resp, err := store.client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotImplemented:
+		return common.Error(common.Unsupported)
+	}
+	return common.Error(common.WriteFailed)
+}
+
+// Watch streams an event for every change of a key in bucket starting with prefix
+// The events are read from the server-sent event stream of the server.
+func (store *Storage) Watch(ctx context.Context, bucket, prefix string) (<-chan *common.Event, error) {
+	uri := fmt.Sprintf("%v/%v/_watch?%v", store.baseURL, bucket, url.Values{"prefix": {prefix}}.Encode())
+	req, err := store.newRequest(ctx, "GET", uri, nil)
+	if err != nil {
 		return nil, common.Error(common.ReadFailed, err)
 	}
-	ch := make(chan *common.DocInfo, 64)
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotImplemented:
+		resp.Body.Close()
+		return nil, common.Error(common.Unsupported)
+	default:
+		resp.Body.Close()
+		return nil, common.Error(common.ReadFailed)
+	}
+	ch := make(chan *common.Event, 64)
 	go func() {
 		defer close(ch)
+		defer resp.Body.Close()
 		reader := bufio.NewReader(resp.Body)
-		b, err := reader.ReadByte()
-		if err != nil || b != '[' {
-			return
-		}
+		var data []byte
 		for {
-			next, err := reader.ReadSlice('}')
+			line, err := reader.ReadBytes('\n')
 			if err != nil {
-				log.Print(err)
 				return
 			}
-			info := &common.DocInfo{}
-			err = json.Unmarshal(next, info)
-			if err != nil {
-				log.Print(err)
-				return
-			}
-			ch <- info
-			b, err := reader.ReadByte()
-			if err != nil || b != ',' {
-				return
+			line = bytes.TrimRight(line, "\r\n")
+			switch {
+			case bytes.HasPrefix(line, []byte("data: ")):
+				data = append(data, line[len("data: "):]...)
+			case len(line) == 0 && len(data) > 0:
+				// a blank line ends an event
+				event := &common.Event{}
+				if err := json.Unmarshal(data, event); err != nil {
+					log.Print(err)
+					return
+				}
+				data = data[:0]
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
 	return ch, nil
 }
 
+// PutReader sends everything read from r as request body, without buffering it
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	req, err := store.newRequest(context.Background(), "PUT", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), r)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.Error(common.WriteFailed)
+	}
+	return nil
+}
+
+// GetReader returns the response body of a value, the caller must close it
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	req, err := store.newRequest(context.Background(), "GET", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, common.Error(common.ReadFailed)
+	}
+	return resp.Body, nil
+}
+
+// PutWithMeta saves a byteslice, the metadata is sent as Content-Type and X-Meta-* headers
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	req, err := store.newRequest(context.Background(), "PUT", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), bytes.NewReader(value))
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	if meta != nil {
+		common.WriteMetaHeader(req.Header, &common.Metadata{ContentType: meta.ContentType, Attributes: meta.Attributes})
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotImplemented:
+		return common.Error(common.Unsupported)
+	}
+	return common.Error(common.WriteFailed)
+}
+
+// Stat returns the metadata of a key as sent by the server in response to a HEAD request
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	req, err := store.newRequest(context.Background(), "HEAD", fmt.Sprintf("%v/%v/%v", store.baseURL, bucket, key), nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, common.Error(common.ReadFailed)
+	}
+	meta := common.ReadMetaHeader(resp.Header)
+	meta.Size = resp.ContentLength
+	return meta, nil
+}
+
+// EnableVersioning starts keeping the history of the keys of a bucket
+func (store *Storage) EnableVersioning(bucket string) error {
+	req, err := store.newRequest(context.Background(), "PUT", fmt.Sprintf("%v/%v?versioning=true", store.baseURL, bucket), nil)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotImplemented:
+		return common.Error(common.Unsupported)
+	case http.StatusNotFound:
+		return common.Error(common.BucketNotFound)
+	}
+	return common.Error(common.WriteFailed)
+}
+
+// GetVersion loads a former value of a key
+func (store *Storage) GetVersion(bucket, key string, version uint64) ([]byte, error) {
+	resp, err := store.getVersions(bucket, key, fmt.Sprintf("version=%d", version))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return bs, nil
+}
+
+// ListVersions returns the history of a key, oldest first
+func (store *Storage) ListVersions(bucket, key string) ([]*common.Version, error) {
+	resp, err := store.getVersions(bucket, key, "versions=true")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	versions := []*common.Version{}
+	if err = json.NewDecoder(resp.Body).Decode(&versions); err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	return versions, nil
+}
+
+// getVersions sends a GET request for key with the given query, the caller has to close the body
+func (store *Storage) getVersions(bucket, key, query string) (*http.Response, error) {
+	req, err := store.newRequest(context.Background(), "GET", fmt.Sprintf("%v/%v/%v?%v", store.baseURL, bucket, key, query), nil)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotImplemented {
+			return nil, common.Error(common.Unsupported)
+		}
+		return nil, common.Error(common.ReadFailed)
+	}
+	return resp, nil
+}
+
+// Begin is not supported by the storaged client
+func (store *Storage) Begin() (storage.Tx, error) {
+	return nil, common.Error(common.Unsupported)
+}
+
 // Close closes the storage
 func (store *Storage) Close() error {
 	return nil
 }
+
+func (store *Storage) newRequest(ctx context.Context, method, uri string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	if store.token != "" {
+		req.Header.Set("Autorization", fmt.Sprintf("bearer %v", store.token))
+	}
+	return req.WithContext(ctx), nil
+}
@@ -1,8 +1,12 @@
 package storaged
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -18,10 +22,11 @@ type StorageSuite struct {
 func TestStoragedStorage(t *testing.T) {
 	baseStore, err := leveldb.NewStorage("./test-store.db")
 	assert.NoError(t, err)
-	server := server.New(":8080", baseStore)
+	server := server.New(":8081", baseStore)
 	go server.ListenAndServe()
 	defer server.Stop()
-	store, err := NewStorage("storaged://localhost:8080/project1", "sample-token")
+	time.Sleep(200 * time.Millisecond)
+	store, err := NewStorage("storaged://localhost:8081/project1", "sample-token")
 	assert.NoError(t, err)
 	defer os.RemoveAll("./test-store.db")
 	s := &StorageSuite{}
@@ -32,3 +37,21 @@ func TestStoragedStorage(t *testing.T) {
 	err = store.Close()
 	assert.NoError(t, err)
 }
+
+func TestIterateTruncatedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"Key":"a","Value":"Zm9v"},{"Key":"b","Value":"YmFy"}`))
+	}))
+	defer srv.Close()
+	store, err := NewStorage("storaged://" + strings.TrimPrefix(srv.URL, "http://") + "/project1")
+	assert.NoError(t, err)
+	iter, err := store.Iterate("bucket", nil)
+	assert.NoError(t, err)
+	keys := []string{}
+	for iter.Next() {
+		keys = append(keys, iter.Doc().Key)
+	}
+	assert.Equal(t, []string{"a", "b"}, keys)
+	assert.Error(t, iter.Err())
+	assert.NoError(t, iter.Close())
+}
@@ -0,0 +1,23 @@
+// Package register makes the storaged client available to meta.NewStorage under the storaged and sstoraged schemes.
+package register
+
+import (
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/engines/meta"
+	"github.com/trusch/storage/engines/storaged"
+)
+
+// storaged://host:port/project, sstoraged:// takes the token as first option of meta.NewStorage
+func init() {
+	meta.Register("storaged", func(uri string, options ...interface{}) (storage.Storage, error) {
+		return storaged.NewStorage(uri)
+	})
+	meta.Register("sstoraged", func(uri string, options ...interface{}) (storage.Storage, error) {
+		if len(options) > 0 {
+			if token, ok := options[0].(string); ok {
+				return storaged.NewStorage(uri, token)
+			}
+		}
+		return storaged.NewStorage(uri)
+	})
+}
@@ -0,0 +1,582 @@
+package versioned
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// VersionSuffix is appended to the name of a bucket to get the bucket holding its history
+// A bucket is versioned if its history bucket exists, buckets with this suffix are hidden by ListBuckets.
+const VersionSuffix = "~versions"
+
+// Storage wraps another storage and keeps the history of the keys of versioned buckets.
+// Each version is saved in the history bucket under the key, a zero byte and the version number.
+// Writes to versioned buckets are serialized per key, so they are only consistent as long as
+// all writers use the wrapper. Keys expiring in the base storage get no tombstone.
+type Storage struct {
+	base  storage.Storage
+	locks [64]sync.Mutex
+}
+
+// NewStorage creates a new versioning storage around base
+func NewStorage(base storage.Storage) (*Storage, error) {
+	return &Storage{base: base}, nil
+}
+
+// record is a version as saved in the history bucket
+type record struct {
+	Modified time.Time `json:"modified"`
+	Deleted  bool      `json:"deleted,omitempty"`
+	Value    []byte    `json:"value,omitempty"`
+}
+
+func encode(value []byte, deleted bool) []byte {
+	bs, _ := json.Marshal(&record{Modified: time.Now(), Deleted: deleted, Value: value})
+	return bs
+}
+
+func historyKey(key string, version uint64) string {
+	return fmt.Sprintf("%s\x00%016x", key, version)
+}
+
+// parseVersion returns the version number of a key of the history bucket
+func parseVersion(historyKey string) uint64 {
+	i := strings.LastIndexByte(historyKey, 0)
+	version, _ := strconv.ParseUint(historyKey[i+1:], 16, 64)
+	return version
+}
+
+// lock locks the stripe of a key and returns the unlock function
+func (store *Storage) lock(bucket, key string) func() {
+	m := &store.locks[stripe(bucket, key)]
+	m.Lock()
+	return m.Unlock
+}
+
+func stripe(bucket, key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(bucket + "/" + key))
+	return h.Sum32() % 64
+}
+
+// versioned checks if the history of a bucket is kept
+func (store *Storage) versioned(bucket string) bool {
+	iter, err := store.base.Iterate(bucket+VersionSuffix, &common.ListOpts{Limit: 1, KeysOnly: true})
+	if err != nil {
+		return false
+	}
+	iter.Close()
+	return true
+}
+
+// next returns the number of the next version of key
+func (store *Storage) next(bucket, key string) (uint64, error) {
+	iter, err := store.base.Iterate(bucket+VersionSuffix, &common.ListOpts{
+		Prefix:   key + "\x00",
+		Reverse:  true,
+		Limit:    1,
+		KeysOnly: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	if iter.Next() {
+		return parseVersion(iter.Doc().Key) + 1, nil
+	}
+	return 1, iter.Err()
+}
+
+// EnableVersioning starts keeping the history of all keys of an existing bucket
+// The current values become the first versions of their keys.
+func (store *Storage) EnableVersioning(bucket string) error {
+	iter, err := store.base.Iterate(bucket, nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	if store.versioned(bucket) {
+		return nil
+	}
+	if err = store.base.CreateBucket(bucket + VersionSuffix); err != nil {
+		return err
+	}
+	batch := storage.NewBatch(store.base)
+	for iter.Next() {
+		batch.Put(bucket+VersionSuffix, historyKey(iter.Doc().Key, 1), encode(iter.Doc().Value, false))
+	}
+	if err = iter.Err(); err != nil {
+		return err
+	}
+	return batch.Commit()
+}
+
+// GetVersion loads a former value of a key
+func (store *Storage) GetVersion(bucket, key string, version uint64) ([]byte, error) {
+	bs, err := store.base.Get(bucket+VersionSuffix, historyKey(key, version))
+	if err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	rec := &record{}
+	if err = json.Unmarshal(bs, rec); err != nil {
+		return nil, common.Error(common.ReadFailed, err)
+	}
+	if rec.Deleted {
+		return nil, common.Error(common.ReadFailed, errors.New("version is a tombstone"))
+	}
+	if rec.Value == nil {
+		rec.Value = []byte{}
+	}
+	return rec.Value, nil
+}
+
+// ListVersions returns the history of a key, oldest first
+func (store *Storage) ListVersions(bucket, key string) ([]*common.Version, error) {
+	versions := []*common.Version{}
+	iter, err := store.base.Iterate(bucket+VersionSuffix, &common.ListOpts{Prefix: key + "\x00"})
+	if common.IsError(err, common.BucketNotFound) {
+		// keys of buckets without versioning have no history
+		if _, err = store.base.Count(bucket, &common.ListOpts{Limit: 1}); err != nil {
+			return nil, err
+		}
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	for iter.Next() {
+		rec := &record{}
+		if err = json.Unmarshal(iter.Doc().Value, rec); err != nil {
+			return nil, common.Error(common.ReadFailed, err)
+		}
+		versions = append(versions, &common.Version{
+			Version:  parseVersion(iter.Doc().Key),
+			Modified: rec.Modified,
+			Size:     int64(len(rec.Value)),
+			Deleted:  rec.Deleted,
+		})
+	}
+	return versions, iter.Err()
+}
+
+// write saves value, or deletes key if deleted is set, along with a new version
+// The caller must hold the key lock.
+func (store *Storage) write(bucket, key string, value []byte, deleted bool) error {
+	version, err := store.next(bucket, key)
+	if err != nil {
+		return err
+	}
+	batch := storage.NewBatch(store.base)
+	if deleted {
+		batch.Delete(bucket, key)
+	} else {
+		batch.Put(bucket, key, value)
+	}
+	batch.Put(bucket+VersionSuffix, historyKey(key, version), encode(value, deleted))
+	return batch.Commit()
+}
+
+// addVersion saves a version of key without touching the key itself
+// The caller must hold the key lock.
+func (store *Storage) addVersion(bucket, key string, value []byte) error {
+	version, err := store.next(bucket, key)
+	if err != nil {
+		return err
+	}
+	return store.base.Put(bucket+VersionSuffix, historyKey(key, version), encode(value, false))
+}
+
+// Put saves a byteslice to the db.
+// Example: Save("/foo/bar", []byte{1,2,3})
+func (store *Storage) Put(bucket, key string, value []byte) error {
+	return store.PutContext(context.Background(), bucket, key, value)
+}
+
+// PutContext saves a byteslice to the db, in a versioned bucket the value is added to the history
+func (store *Storage) PutContext(ctx context.Context, bucket, key string, value []byte) error {
+	if !store.versioned(bucket) {
+		return storage.WithContext(store.base).PutContext(ctx, bucket, key, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer store.lock(bucket, key)()
+	return store.write(bucket, key, value, false)
+}
+
+// Get loads data from a key
+func (store *Storage) Get(bucket, key string) ([]byte, error) {
+	return store.GetContext(context.Background(), bucket, key)
+}
+
+// GetContext loads data from a key
+func (store *Storage) GetContext(ctx context.Context, bucket, key string) ([]byte, error) {
+	return storage.WithContext(store.base).GetContext(ctx, bucket, key)
+}
+
+// Delete deletes a value from the db
+func (store *Storage) Delete(bucket, key string) error {
+	return store.DeleteContext(context.Background(), bucket, key)
+}
+
+// DeleteContext deletes a value from the db, in a versioned bucket a tombstone is added to the history
+func (store *Storage) DeleteContext(ctx context.Context, bucket, key string) error {
+	if !store.versioned(bucket) {
+		return storage.WithContext(store.base).DeleteContext(ctx, bucket, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer store.lock(bucket, key)()
+	if _, err := store.base.Get(bucket, key); err != nil {
+		// nothing to delete, so there is no tombstone either
+		return store.base.Delete(bucket, key)
+	}
+	return store.write(bucket, key, nil, true)
+}
+
+// CreateBucket creates a bucket
+func (store *Storage) CreateBucket(bucket string) error {
+	return store.CreateBucketContext(context.Background(), bucket)
+}
+
+// CreateBucketContext creates a bucket, versioning is enabled by EnableVersioning
+func (store *Storage) CreateBucketContext(ctx context.Context, bucket string) error {
+	return storage.WithContext(store.base).CreateBucketContext(ctx, bucket)
+}
+
+// DeleteBucket deletes a bucket
+func (store *Storage) DeleteBucket(bucket string) error {
+	return store.DeleteBucketContext(context.Background(), bucket)
+}
+
+// DeleteBucketContext deletes a bucket along with its history
+func (store *Storage) DeleteBucketContext(ctx context.Context, bucket string) error {
+	if err := storage.WithContext(store.base).DeleteBucketContext(ctx, bucket); err != nil {
+		return err
+	}
+	err := storage.WithContext(store.base).DeleteBucketContext(ctx, bucket+VersionSuffix)
+	if err != nil && !common.IsError(err, common.BucketNotFound) {
+		return err
+	}
+	return nil
+}
+
+// ListBuckets returns the names of all buckets, the buckets holding histories are skipped
+func (store *Storage) ListBuckets() ([]string, error) {
+	names, err := store.base.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	buckets := []string{}
+	for _, name := range names {
+		if !strings.HasSuffix(name, VersionSuffix) {
+			buckets = append(buckets, name)
+		}
+	}
+	return buckets, nil
+}
+
+// List returns all Entries of a directory
+// optionally provide arguments to specifiy a key offset and a key limit
+// Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
+func (store *Storage) List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return store.ListContext(context.Background(), bucket, opts)
+}
+
+// ListContext returns all Entries of a directory
+// The channel is closed as soon as ctx is done
+func (store *Storage) ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error) {
+	return storage.WithContext(store.base).ListContext(ctx, bucket, opts)
+}
+
+// Iterate returns an iterator over the entries of a bucket
+func (store *Storage) Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return store.IterateContext(context.Background(), bucket, opts)
+}
+
+// IterateContext returns an iterator over the entries of a bucket
+func (store *Storage) IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error) {
+	return storage.WithContext(store.base).IterateContext(ctx, bucket, opts)
+}
+
+// Count returns the number of entries of a bucket
+func (store *Storage) Count(bucket string, opts *common.ListOpts) (int, error) {
+	return store.base.Count(bucket, opts)
+}
+
+// NewBatch creates a batch which adds the versions of keys in versioned buckets to a batch of the base storage
+func (store *Storage) NewBatch() storage.Batch {
+	return &batch{store: store}
+}
+
+type batch struct {
+	common.BatchOps
+	store *Storage
+}
+
+// Commit applies all operations and their versions atomically if the base storage supports batches
+func (b *batch) Commit() error {
+	defer b.lock()()
+	base := storage.NewBatch(b.store.base)
+	versioned := make(map[string]bool)
+	next := make(map[string]uint64)
+	for _, op := range b.Ops {
+		if op.Delete {
+			base.Delete(op.Bucket, op.Key)
+		} else {
+			base.Put(op.Bucket, op.Key, op.Value)
+		}
+		if _, ok := versioned[op.Bucket]; !ok {
+			versioned[op.Bucket] = b.store.versioned(op.Bucket)
+		}
+		if !versioned[op.Bucket] {
+			continue
+		}
+		id := op.Bucket + "/" + op.Key
+		if _, ok := next[id]; !ok {
+			version, err := b.store.next(op.Bucket, op.Key)
+			if err != nil {
+				return err
+			}
+			next[id] = version
+		}
+		base.Put(op.Bucket+VersionSuffix, historyKey(op.Key, next[id]), encode(op.Value, op.Delete))
+		next[id]++
+	}
+	return base.Commit()
+}
+
+// lock locks the stripes of all keys of the batch in order and returns the unlock function
+func (b *batch) lock() func() {
+	stripes := make(map[uint32]bool)
+	for _, op := range b.Ops {
+		stripes[stripe(op.Bucket, op.Key)] = true
+	}
+	ordered := make([]int, 0, len(stripes))
+	for s := range stripes {
+		ordered = append(ordered, int(s))
+	}
+	sort.Ints(ordered)
+	for _, s := range ordered {
+		b.store.locks[s].Lock()
+	}
+	return func() {
+		for _, s := range ordered {
+			b.store.locks[s].Unlock()
+		}
+	}
+}
+
+// Begin starts a transaction of the base storage, versions are added within the transaction
+func (store *Storage) Begin() (storage.Tx, error) {
+	s, ok := store.base.(storage.Transactional)
+	if !ok {
+		return nil, common.Error(common.Unsupported)
+	}
+	base, err := s.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &tx{Tx: base, store: store, versioned: make(map[string]bool)}, nil
+}
+
+type tx struct {
+	storage.Tx
+	store     *Storage
+	versioned map[string]bool
+}
+
+func (t *tx) Put(bucket, key string, value []byte) error {
+	if err := t.Tx.Put(bucket, key, value); err != nil {
+		return err
+	}
+	return t.addVersion(bucket, key, value, false)
+}
+
+func (t *tx) Delete(bucket, key string) error {
+	_, err := t.Tx.Get(bucket, key)
+	existed := err == nil
+	if err = t.Tx.Delete(bucket, key); err != nil || !existed {
+		return err
+	}
+	return t.addVersion(bucket, key, nil, true)
+}
+
+// addVersion saves a version within the transaction, its number is the one behind the last version seen by it
+func (t *tx) addVersion(bucket, key string, value []byte, deleted bool) error {
+	if _, ok := t.versioned[bucket]; !ok {
+		t.versioned[bucket] = t.store.versioned(bucket)
+	}
+	if !t.versioned[bucket] {
+		return nil
+	}
+	ch, err := t.Tx.List(bucket+VersionSuffix, &common.ListOpts{Prefix: key + "\x00", KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	version := uint64(1)
+	for doc := range ch {
+		if v := parseVersion(doc.Key); v >= version {
+			version = v + 1
+		}
+	}
+	return t.Tx.Put(bucket+VersionSuffix, historyKey(key, version), encode(value, deleted))
+}
+
+// CompareAndSwap saves new if the current value of key equals old
+// In versioned buckets the comparison is done by the wrapper while holding the key lock.
+func (store *Storage) CompareAndSwap(bucket, key string, old, new []byte) (bool, error) {
+	if !store.versioned(bucket) {
+		s, ok := store.base.(storage.ConditionalStorage)
+		if !ok {
+			return false, common.Error(common.Unsupported)
+		}
+		return s.CompareAndSwap(bucket, key, old, new)
+	}
+	defer store.lock(bucket, key)()
+	current, err := store.current(bucket, key)
+	if err != nil || !common.Equal(current, old) {
+		return false, err
+	}
+	if err = store.write(bucket, key, new, false); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutIfAbsent saves value if key does not exist yet
+func (store *Storage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return store.CompareAndSwap(bucket, key, nil, value)
+}
+
+// DeleteIfEquals deletes key if its current value equals old
+func (store *Storage) DeleteIfEquals(bucket, key string, old []byte) (bool, error) {
+	if !store.versioned(bucket) {
+		s, ok := store.base.(storage.ConditionalStorage)
+		if !ok {
+			return false, common.Error(common.Unsupported)
+		}
+		return s.DeleteIfEquals(bucket, key, old)
+	}
+	defer store.lock(bucket, key)()
+	current, err := store.current(bucket, key)
+	if err != nil || old == nil || !common.Equal(current, old) {
+		return false, err
+	}
+	if err = store.write(bucket, key, nil, true); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// current returns the value of key or nil if it does not exist
+func (store *Storage) current(bucket, key string) ([]byte, error) {
+	val, err := store.base.Get(bucket, key)
+	if common.IsError(err, common.BucketNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, nil
+	}
+	if val == nil {
+		val = []byte{}
+	}
+	return val, nil
+}
+
+// PutWithTTL saves a byteslice which expires after ttl
+// The version added to the history does not expire.
+func (store *Storage) PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error {
+	s, ok := store.base.(storage.TTLStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	if !store.versioned(bucket) {
+		return s.PutWithTTL(bucket, key, value, ttl)
+	}
+	defer store.lock(bucket, key)()
+	if err := s.PutWithTTL(bucket, key, value, ttl); err != nil {
+		return err
+	}
+	return store.addVersion(bucket, key, value)
+}
+
+// PutWithMeta saves a byteslice along with its metadata
+func (store *Storage) PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error {
+	s, ok := store.base.(storage.MetaStorage)
+	if !ok {
+		return common.Error(common.Unsupported)
+	}
+	if !store.versioned(bucket) {
+		return s.PutWithMeta(bucket, key, value, meta)
+	}
+	defer store.lock(bucket, key)()
+	if err := s.PutWithMeta(bucket, key, value, meta); err != nil {
+		return err
+	}
+	return store.addVersion(bucket, key, value)
+}
+
+// Stat returns the metadata of a key
+func (store *Storage) Stat(bucket, key string) (*common.Metadata, error) {
+	return storage.Stat(store.base, bucket, key)
+}
+
+// PutReader saves everything read from r
+// Values of versioned buckets are read into memory, since the history keeps a copy of them.
+func (store *Storage) PutReader(bucket, key string, r io.Reader) error {
+	if !store.versioned(bucket) {
+		return storage.PutReader(store.base, bucket, key, r)
+	}
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return store.Put(bucket, key, value)
+}
+
+// GetReader opens a value for reading
+func (store *Storage) GetReader(bucket, key string) (io.ReadCloser, error) {
+	return storage.GetReader(store.base, bucket, key)
+}
+
+// Watch streams an event for every change of a key in bucket starting with prefix
+func (store *Storage) Watch(ctx context.Context, bucket, prefix string) (<-chan *common.Event, error) {
+	if s, ok := store.base.(storage.Watcher); ok {
+		return s.Watch(ctx, bucket, prefix)
+	}
+	return nil, common.Error(common.Unsupported)
+}
+
+// Snapshot returns a read-only view as it is now, which includes the history kept in a snapshot of the base storage
+func (store *Storage) Snapshot() (storage.Storage, error) {
+	s, ok := store.base.(storage.Snapshotter)
+	if !ok {
+		return nil, common.Error(common.Unsupported)
+	}
+	snap, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return NewStorage(snap)
+}
+
+// Close closes the base storage
+func (store *Storage) Close() error {
+	return store.base.Close()
+}
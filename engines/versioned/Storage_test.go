@@ -0,0 +1,57 @@
+package versioned
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/common"
+	"github.com/trusch/storage/engines/memory"
+	"github.com/trusch/storage/testsuite"
+)
+
+type StorageSuite struct {
+	testsuite.Suite
+}
+
+func TestVersionedStorage(t *testing.T) {
+	base, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorage(base)
+	assert.NoError(t, err)
+	s := &StorageSuite{}
+	s.Store = store
+	suite.Run(t, s)
+	err = store.Close()
+	assert.NoError(t, err)
+}
+
+func TestHistoryIsHidden(t *testing.T) {
+	base, err := memory.NewStorage()
+	assert.NoError(t, err)
+	store, err := NewStorage(base)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.CreateBucket("bucket-name"))
+	assert.NoError(t, store.EnableVersioning("bucket-name"))
+	assert.NoError(t, store.Put("bucket-name", "foo", []byte("a")))
+	assert.NoError(t, store.Put("bucket-name", "foo", []byte("b")))
+	n, err := base.Count("bucket-name"+VersionSuffix, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	buckets, err := store.ListBuckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bucket-name"}, buckets)
+	tx, err := store.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Put("bucket-name", "foo", []byte("c")))
+	assert.NoError(t, tx.Delete("bucket-name", "foo"))
+	assert.NoError(t, tx.Commit())
+	versions, err := store.ListVersions("bucket-name", "foo")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 4)
+	assert.True(t, versions[3].Deleted)
+	assert.NoError(t, store.DeleteBucket("bucket-name"))
+	_, err = base.Count("bucket-name"+VersionSuffix, nil)
+	assert.True(t, common.IsError(err, common.BucketNotFound))
+}
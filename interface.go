@@ -1,6 +1,12 @@
 package storage
 
-import "github.com/trusch/storage/common"
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/trusch/storage/common"
+)
 
 // Storage specifies the commandset for each storage
 type Storage interface {
@@ -15,10 +21,144 @@ type Storage interface {
 	CreateBucket(bucket string) error
 	// DeleteBucket deletes a bucket
 	DeleteBucket(bucket string) error
+	// ListBuckets returns the names of all buckets in lexical order
+	ListBuckets() ([]string, error)
 	// List returns all Entries of a directory
 	// optionally provide arguments to specifiy a key offset and a key limit
 	// Example: List("/foo", "abc", "xyz") -> DocInfo{Key: abc} ... DocInfo{Key: ggg} ... DocInfo{Key: xyz}
 	List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error)
+	// Iterate returns an iterator over the entries of a bucket, it takes the same options as List.
+	// Unlike List, errors during the iteration are reported by the iterator.
+	Iterate(bucket string, opts *common.ListOpts) (common.Iterator, error)
+	// Count returns the number of entries of a bucket, it takes the same options as List
+	Count(bucket string, opts *common.ListOpts) (int, error)
 	// Close closes the storage
 	Close() error
 }
+
+// ContextStorage is the context aware variant of Storage.
+// Cancelling the context aborts the operation, channels returned by ListContext get closed.
+type ContextStorage interface {
+	Storage
+	// PutContext saves a byteslice to the db
+	PutContext(ctx context.Context, bucket, key string, value []byte) error
+	// GetContext loads data from a key
+	GetContext(ctx context.Context, bucket, key string) ([]byte, error)
+	// DeleteContext deletes a value from the db
+	DeleteContext(ctx context.Context, bucket, key string) error
+	// CreateBucketContext creates a bucket
+	CreateBucketContext(ctx context.Context, bucket string) error
+	// DeleteBucketContext deletes a bucket
+	DeleteBucketContext(ctx context.Context, bucket string) error
+	// ListContext returns all Entries of a directory
+	// The channel is closed as soon as ctx is done
+	ListContext(ctx context.Context, bucket string, opts *common.ListOpts) (chan *common.DocInfo, error)
+	// IterateContext returns an iterator over the entries of a bucket
+	// The iteration stops with the context error as soon as ctx is done
+	IterateContext(ctx context.Context, bucket string, opts *common.ListOpts) (common.Iterator, error)
+}
+
+// Batch collects puts and deletes spanning one or more buckets.
+// Commit applies all of them atomically, if one bucket does not exist nothing is applied.
+type Batch interface {
+	// Put adds a put operation to the batch
+	Put(bucket, key string, value []byte)
+	// Delete adds a delete operation to the batch
+	Delete(bucket, key string)
+	// Commit applies all operations of the batch
+	Commit() error
+}
+
+// Batcher is implemented by storages supporting atomic batch writes
+type Batcher interface {
+	// NewBatch creates an empty batch
+	NewBatch() Batch
+}
+
+// Tx is a read/write transaction with snapshot isolation.
+// Reads see the state of the storage at the time the transaction began plus its own writes.
+type Tx interface {
+	// Get loads data from a key
+	Get(bucket, key string) ([]byte, error)
+	// Put saves a byteslice to the db
+	Put(bucket, key string, value []byte) error
+	// Delete deletes a value from the db
+	Delete(bucket, key string) error
+	// List returns all Entries of a directory
+	List(bucket string, opts *common.ListOpts) (chan *common.DocInfo, error)
+	// Commit applies all writes of the transaction as a unit
+	Commit() error
+	// Rollback discards all writes of the transaction
+	Rollback() error
+}
+
+// Transactional is implemented by storages which may support transactions
+type Transactional interface {
+	// Begin starts a new transaction
+	// Storages which can not provide transactions return an Unsupported error.
+	Begin() (Tx, error)
+}
+
+// ConditionalStorage is implemented by storages supporting atomic conditional writes.
+// Each method reports whether the write happened, a nil old value stands for a missing key.
+type ConditionalStorage interface {
+	// CompareAndSwap saves new if the current value of key equals old
+	CompareAndSwap(bucket, key string, old, new []byte) (bool, error)
+	// PutIfAbsent saves value if key does not exist yet
+	PutIfAbsent(bucket, key string, value []byte) (bool, error)
+	// DeleteIfEquals deletes key if its current value equals old
+	DeleteIfEquals(bucket, key string, old []byte) (bool, error)
+}
+
+// TTLStorage is implemented by storages supporting expiring keys.
+// Expired keys are never returned by Get or List, even before they are removed in the background.
+// A plain Put on an expiring key removes its TTL.
+type TTLStorage interface {
+	// PutWithTTL saves a byteslice which expires after ttl
+	PutWithTTL(bucket, key string, value []byte, ttl time.Duration) error
+}
+
+// Watcher is implemented by storages which report changes.
+// Storages without native support can be wrapped with engines/notify.
+type Watcher interface {
+	// Watch streams an event for every change of a key in bucket starting with prefix.
+	// The channel is closed when ctx is done, or if the consumer falls too far behind;
+	// in the latter case the consumer should list the bucket again and start a new watch.
+	Watch(ctx context.Context, bucket, prefix string) (<-chan *common.Event, error)
+}
+
+// StreamStorage is implemented by storages which can store and load values without holding them in memory.
+// Streamed values are ordinary values: they can be read by Get and List and overwritten by Put.
+type StreamStorage interface {
+	// PutReader saves everything read from r until io.EOF
+	PutReader(bucket, key string, r io.Reader) error
+	// GetReader opens a value for reading, the caller must close it
+	GetReader(bucket, key string) (io.ReadCloser, error)
+}
+
+// MetaStorage is implemented by storages keeping metadata of their values.
+// Every write renews the metadata, values saved without metadata get no content type and attributes.
+type MetaStorage interface {
+	// PutWithMeta saves a byteslice along with the content type and attributes of meta
+	PutWithMeta(bucket, key string, value []byte, meta *common.Metadata) error
+	// Stat returns the metadata of a key without loading its value
+	Stat(bucket, key string) (*common.Metadata, error)
+}
+
+// VersionedStorage is implemented by storages which can keep the history of the keys of a bucket.
+// Once versioning is enabled for a bucket, every write adds a version and deletes add a tombstone.
+type VersionedStorage interface {
+	// EnableVersioning starts keeping the history of all keys of an existing bucket
+	EnableVersioning(bucket string) error
+	// GetVersion loads a former value of a key, it fails for tombstones
+	GetVersion(bucket, key string, version uint64) ([]byte, error)
+	// ListVersions returns the history of a key, oldest first
+	ListVersions(bucket, key string) ([]*common.Version, error)
+}
+
+// Snapshotter is implemented by storages which can provide a consistent read-only view of all buckets.
+// Writes made after Snapshot returned are not visible through the view, writes to the view fail.
+type Snapshotter interface {
+	// Snapshot freezes the current state, the returned storage must be closed to release it
+	Snapshot() (Storage, error)
+}
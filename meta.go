@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"github.com/trusch/storage/common"
+)
+
+// Stat returns the metadata of a value of the given storage.
+// If the storage is not a MetaStorage, the value is loaded with Get and only its size is reported.
+func Stat(store Storage, bucket, key string) (*common.Metadata, error) {
+	if s, ok := store.(MetaStorage); ok {
+		return s.Stat(bucket, key)
+	}
+	value, err := store.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Metadata{Size: int64(len(value))}, nil
+}
@@ -0,0 +1,314 @@
+// Package migrate copies all buckets from one storage to another and verifies the copy.
+//
+// The source is read from a snapshot if it supports them. The progress can be recorded in a
+// checkpoint file, so an interrupted migration resumes behind the last recorded key of every bucket.
+// While clients keep writing during the migration, they should write to both storages through the
+// mirror engine and the migration should be run with KeepExisting.
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/trusch/storage"
+	"github.com/trusch/storage/common"
+)
+
+// CheckpointInterval is the number of keys copied between two saves of the checkpoint
+var CheckpointInterval = 1000
+
+// Options configure a migration
+type Options struct {
+	// Workers is the number of buckets copied or verified in parallel, 1 if not set
+	Workers int
+	// Checkpoint is the file recording the progress, empty for none
+	Checkpoint string
+	// KeepExisting leaves keys alone which already exist in the target, e.g. because clients dual-write
+	KeepExisting bool
+	// Progress is called after a bucket is copied, it may be called concurrently
+	Progress func(bucket string, copied int)
+}
+
+// Result is the outcome of the verification of a bucket
+type Result struct {
+	Bucket      string
+	Count       int
+	TargetCount int
+	Sum         string
+	TargetSum   string
+}
+
+// OK reports whether both storages hold the same keys and values in the bucket
+func (res *Result) OK() bool {
+	return res.Count == res.TargetCount && res.Sum == res.TargetSum
+}
+
+// Copy copies all buckets of from to to
+// Existing keys of the target are overwritten unless opts.KeepExisting is set, other keys are left alone.
+func Copy(from, to storage.Storage, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	from, release, err := storage.Snapshot(from)
+	if err != nil {
+		return err
+	}
+	defer release()
+	cp, err := loadCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return err
+	}
+	buckets, err := from.ListBuckets()
+	if err != nil {
+		return err
+	}
+	return parallel(buckets, opts.Workers, func(bucket string) error {
+		if cp.done(bucket) {
+			return nil
+		}
+		copied, err := copyBucket(from, to, bucket, cp, opts.KeepExisting)
+		if err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(bucket, copied)
+		}
+		return cp.finish(bucket)
+	})
+}
+
+func copyBucket(from, to storage.Storage, bucket string, cp *checkpoint, keepExisting bool) (int, error) {
+	if err := to.CreateBucket(bucket); err != nil {
+		return 0, err
+	}
+	listOpts := &common.ListOpts{WithMeta: true}
+	if last, ok := cp.last(bucket); ok {
+		listOpts.Cursor = common.NewCursor(last)
+	}
+	iter, err := from.Iterate(bucket, listOpts)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+	copied := 0
+	for iter.Next() {
+		doc := iter.Doc()
+		if err = copyDoc(to, bucket, doc, keepExisting); err != nil {
+			return copied, err
+		}
+		copied++
+		if copied%CheckpointInterval == 0 {
+			if err = cp.advance(bucket, doc.Key); err != nil {
+				return copied, err
+			}
+		}
+	}
+	return copied, iter.Err()
+}
+
+func copyDoc(to storage.Storage, bucket string, doc *common.DocInfo, keepExisting bool) error {
+	if keepExisting {
+		_, err := storage.Stat(to, bucket, doc.Key)
+		if err == nil {
+			return nil
+		}
+		if !common.IsError(err, common.ReadFailed) {
+			return err
+		}
+	}
+	if s, ok := to.(storage.MetaStorage); ok && doc.Meta != nil {
+		err := s.PutWithMeta(bucket, doc.Key, doc.Value, doc.Meta)
+		if !common.IsError(err, common.Unsupported) {
+			return err
+		}
+	}
+	return to.Put(bucket, doc.Key, doc.Value)
+}
+
+// Verify compares the number of keys and a hash over the keys and values of every bucket of from
+// with the same bucket of to. Buckets which only exist in to are not reported.
+func Verify(from, to storage.Storage, opts *Options) ([]*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	from, releaseFrom, err := storage.Snapshot(from)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseFrom()
+	to, releaseTo, err := storage.Snapshot(to)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseTo()
+	buckets, err := from.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*Result, len(buckets))
+	index := make(map[string]int, len(buckets))
+	for i, bucket := range buckets {
+		index[bucket] = i
+	}
+	err = parallel(buckets, opts.Workers, func(bucket string) error {
+		res := &Result{Bucket: bucket}
+		var err error
+		if res.Count, res.Sum, err = digest(from, bucket); err != nil {
+			return err
+		}
+		res.TargetCount, res.TargetSum, err = digest(to, bucket)
+		if err != nil && !common.IsError(err, common.BucketNotFound) {
+			return err
+		}
+		results[index[bucket]] = res
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// digest returns the number of keys of a bucket and a SHA-256 hash over its keys and values
+func digest(store storage.Storage, bucket string) (int, string, error) {
+	iter, err := store.Iterate(bucket, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer iter.Close()
+	sum := sha256.New()
+	count := 0
+	for iter.Next() {
+		doc := iter.Doc()
+		write(sum, []byte(doc.Key))
+		write(sum, doc.Value)
+		count++
+	}
+	if err = iter.Err(); err != nil {
+		return 0, "", err
+	}
+	return count, hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// write adds a length prefixed field to a hash
+func write(sum hash.Hash, data []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(data)))
+	sum.Write(size[:])
+	sum.Write(data)
+}
+
+// parallel calls fn for all buckets with the given number of workers and returns the first error
+func parallel(buckets []string, workers int, fn func(bucket string) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	queue := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for bucket := range queue {
+				if err := fn(bucket); err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, bucket := range buckets {
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed {
+			break
+		}
+		queue <- bucket
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+// checkpoint records the finished buckets and the last copied key of the others
+type checkpoint struct {
+	path  string
+	mutex sync.Mutex
+	Done  map[string]bool   `json:"done"`
+	Last  map[string]string `json:"last"`
+}
+
+func loadCheckpoint(path string) (*checkpoint, error) {
+	cp := &checkpoint{path: path, Done: make(map[string]bool), Last: make(map[string]string)}
+	if path == "" {
+		return cp, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (cp *checkpoint) done(bucket string) bool {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	return cp.Done[bucket]
+}
+
+func (cp *checkpoint) last(bucket string) (string, bool) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	key, ok := cp.Last[bucket]
+	return key, ok
+}
+
+func (cp *checkpoint) advance(bucket, key string) error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.Last[bucket] = key
+	return cp.save()
+}
+
+func (cp *checkpoint) finish(bucket string) error {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	delete(cp.Last, bucket)
+	cp.Done[bucket] = true
+	return cp.save()
+}
+
+// save writes the checkpoint to a temporary file first, so a crash never leaves a broken one
+func (cp *checkpoint) save() error {
+	if cp.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(cp.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(cp.path+".tmp", cp.path)
+}
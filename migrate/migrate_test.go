@@ -0,0 +1,126 @@
+package migrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/trusch/storage/common"
+	"github.com/trusch/storage/engines/memory"
+)
+
+func fill(t *testing.T) *memory.Storage {
+	store, err := memory.NewStorage()
+	assert.NoError(t, err)
+	for _, bucket := range []string{"a", "b", "c", "empty"} {
+		assert.NoError(t, store.CreateBucket(bucket))
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		assert.NoError(t, store.Put("a", key, []byte(key)))
+		assert.NoError(t, store.Put("b", key, []byte(key)))
+	}
+	assert.NoError(t, store.PutWithMeta("c", "doc", []byte("hello"), &common.Metadata{ContentType: "text/plain"}))
+	return store
+}
+
+func TestCopyVerify(t *testing.T) {
+	from := fill(t)
+	defer from.Close()
+	to, err := memory.NewStorage()
+	assert.NoError(t, err)
+	defer to.Close()
+	copied := make(chan int, 4)
+	opts := &Options{Workers: 3, Progress: func(bucket string, n int) { copied <- n }}
+	assert.NoError(t, Copy(from, to, opts))
+	assert.Len(t, copied, 4)
+	buckets, err := to.ListBuckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "empty"}, buckets)
+	meta, err := to.Stat("c", "doc")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", meta.ContentType)
+
+	results, err := Verify(from, to, opts)
+	assert.NoError(t, err)
+	assert.Len(t, results, 4)
+	for _, res := range results {
+		assert.True(t, res.OK(), res.Bucket)
+	}
+	assert.NoError(t, to.Put("b", "key-3", []byte("changed")))
+	assert.NoError(t, to.DeleteBucket("empty"))
+	results, err = Verify(from, to, opts)
+	assert.NoError(t, err)
+	assert.True(t, results[0].OK())
+	assert.False(t, results[1].OK())
+	assert.Equal(t, 10, results[1].TargetCount)
+	assert.False(t, results[3].OK())
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"done":{"a":true},"last":{"b":"key-4"}}`), 0600))
+
+	from := fill(t)
+	defer from.Close()
+	to, err := memory.NewStorage()
+	assert.NoError(t, err)
+	defer to.Close()
+	assert.NoError(t, Copy(from, to, &Options{Checkpoint: path}))
+	_, err = to.Count("a", nil)
+	assert.Error(t, err)
+	keys, err := to.Count("b", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, keys)
+
+	cp, err := loadCheckpoint(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true, "empty": true}, cp.Done)
+	assert.Empty(t, cp.Last)
+}
+
+func TestCheckpointInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	defer func(interval int) { CheckpointInterval = interval }(CheckpointInterval)
+	CheckpointInterval = 3
+
+	from := fill(t)
+	defer from.Close()
+	to, err := memory.NewStorage()
+	assert.NoError(t, err)
+	defer to.Close()
+	cp, err := loadCheckpoint(path)
+	assert.NoError(t, err)
+	copied, err := copyBucket(from, to, "a", cp, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, copied)
+	cp, err = loadCheckpoint(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "key-8"}, cp.Last)
+}
+
+func TestKeepExisting(t *testing.T) {
+	from := fill(t)
+	defer from.Close()
+	to, err := memory.NewStorage()
+	assert.NoError(t, err)
+	defer to.Close()
+	assert.NoError(t, to.CreateBucket("a"))
+	assert.NoError(t, to.Put("a", "key-1", []byte("newer")))
+	assert.NoError(t, Copy(from, to, &Options{KeepExisting: true}))
+	val, err := to.Get("a", "key-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "newer", string(val))
+	val, err = to.Get("a", "key-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "key-2", string(val))
+}
@@ -1,24 +1,32 @@
 package server
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/trusch/storage"
+	"github.com/trusch/storage/backup"
 	"github.com/trusch/storage/common"
+	"github.com/trusch/storage/engines/notify"
 )
 
 // Server represents the storaged webserver
 type Server struct {
-	store  storage.Storage
-	ln     net.Listener
-	server *http.Server
+	store       storage.Storage
+	ln          net.Listener
+	server      *http.Server
+	backupToken string
 }
 
 // New creates a new webserver
@@ -30,11 +38,26 @@ func New(addr string, store storage.Storage) *Server {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	server := &Server{store, nil, srv}
+	server := &Server{store: watchable(store), server: srv}
 	server.constructRouter()
 	return server
 }
 
+// EnableBackup serves the archive of all projects at /v1/_backup to requests with the header
+// "Authorization: Bearer <token>". The endpoint is disabled until then, since it bypasses the projects.
+func (srv *Server) EnableBackup(token string) {
+	srv.backupToken = token
+}
+
+// watchable wraps stores which can not report changes themselves, so every store can be watched
+func watchable(store storage.Storage) storage.Storage {
+	if _, ok := store.(storage.Watcher); ok {
+		return store
+	}
+	notifying, _ := notify.NewStorage(store)
+	return notifying
+}
+
 // ListenAndServe starts the webserver
 func (srv *Server) ListenAndServe() error {
 	ln, err := net.Listen("tcp", srv.server.Addr)
@@ -57,12 +80,27 @@ func (srv *Server) Stop() error {
 func (srv *Server) constructRouter() {
 	router := mux.NewRouter()
 	// main ops
+	router.Path("/v1/_backup").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleBackup(w, r)
+	})
+	router.Path("/v1/{project}").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleListBuckets(w, r)
+	})
+	router.Path("/v1/{project}/_batch").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleBatch(w, r)
+	})
+	router.Path("/v1/{project}/{bucket}/_watch").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleWatch(w, r)
+	})
 	router.PathPrefix("/v1/{project}/{bucket}/{key}").Methods("PUT").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		srv.handlePut(w, r)
 	})
 	router.PathPrefix("/v1/{project}/{bucket}/{key}").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		srv.handleGet(w, r)
 	})
+	router.PathPrefix("/v1/{project}/{bucket}/{key}").Methods("HEAD").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.handleHead(w, r)
+	})
 	router.PathPrefix("/v1/{project}/{bucket}/{key}").Methods("DELETE").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		srv.handleDelete(w, r)
 	})
@@ -78,41 +116,225 @@ func (srv *Server) constructRouter() {
 	srv.server.Handler = router
 }
 
+// handlePut saves the request body
+// Bodies larger than streamThreshold or of unknown length are streamed into the store,
+// unless a header requires the whole value. Conditional headers, X-TTL and metadata exclude each other.
 func (srv *Server) handlePut(w http.ResponseWriter, r *http.Request) {
-	bs, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Print("failed put: ", r.URL.Path, err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
 	vars := mux.Vars(r)
 	bucket := vars["project"] + ":" + vars["bucket"]
 	key := vars["key"]
-	err = srv.store.Put(bucket, key, bs)
+	conditional := r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+	small := r.ContentLength >= 0 && r.ContentLength <= streamThreshold
+	meta := common.ReadMetaHeader(r.Header)
+	withMeta := meta.ContentType != "" || len(meta.Attributes) > 0
+	withTTL := r.Header.Get("X-TTL") != ""
+	if (conditional && withTTL) || (conditional && withMeta) || (withTTL && withMeta) {
+		// no engine can apply them together, dropping one silently would lose the condition, expiry or metadata
+		log.Print("failed put: ", r.URL.Path, " conditional headers, X-TTL and metadata can not be combined")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if conditional || withTTL || withMeta || small {
+		bs, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Print("failed put: ", r.URL.Path, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case conditional:
+			srv.handleConditional(w, r, bucket, key, bs)
+		case withTTL:
+			srv.handlePutWithTTL(w, r, bucket, key, bs)
+		case withMeta:
+			srv.handlePutWithMeta(w, r, bucket, key, bs, meta)
+		default:
+			if err = srv.store.Put(bucket, key, bs); err != nil {
+				log.Print("failed put: ", r.URL.Path, " ", err)
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}
+		return
+	}
+	// large values take longer than the timeouts of the server to transfer
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	if err := storage.PutReader(srv.store, bucket, key, r.Body); err != nil {
+		log.Print("failed put: ", r.URL.Path, " ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+// handlePutWithTTL saves a value which expires after the duration given in the X-TTL header
+// The header holds a go duration like "1m30s" or a number of seconds.
+func (srv *Server) handlePutWithTTL(w http.ResponseWriter, r *http.Request, bucket, key string, value []byte) {
+	store, ok := srv.store.(storage.TTLStorage)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	ttl, err := parseTTL(r.Header.Get("X-TTL"))
 	if err != nil {
 		log.Print("failed put: ", r.URL.Path, " ", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if err = store.PutWithTTL(bucket, key, value, ttl); err != nil {
+		log.Print("failed put: ", r.URL.Path, " ", err)
+		if common.IsError(err, common.Unsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+// handlePutWithMeta saves a value along with its Content-Type and X-Meta-* headers
+// Stores which do not keep metadata save the value only.
+func (srv *Server) handlePutWithMeta(w http.ResponseWriter, r *http.Request, bucket, key string, value []byte, meta *common.Metadata) {
+	err := common.Error(common.Unsupported)
+	if store, ok := srv.store.(storage.MetaStorage); ok {
+		err = store.PutWithMeta(bucket, key, value, meta)
+	}
+	if common.IsError(err, common.Unsupported) {
+		err = srv.store.Put(bucket, key, value)
+	}
+	if err != nil {
+		log.Print("failed put: ", r.URL.Path, " ", err)
+		w.WriteHeader(http.StatusBadRequest)
+	}
 }
 
+func parseTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(value)
+	if seconds, e := strconv.ParseInt(value, 10, 64); e == nil {
+		ttl, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+	return ttl, nil
+}
+
+// streamThreshold is the size up to which values are buffered by PUT and GET.
+// Larger values are streamed, GET sends their ETag as trailer instead of header.
+const streamThreshold = 1 << 16
+
 func (srv *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["project"] + ":" + vars["bucket"]
 	key := vars["key"]
-	bs, err := srv.store.Get(bucket, key)
+	query := r.URL.Query()
+	if query.Get("version") != "" || query.Get("versions") == "true" {
+		srv.handleGetVersion(w, r, bucket, key)
+		return
+	}
+	value, err := storage.GetReader(srv.store, bucket, key)
 	if err != nil {
 		log.Print("failed get: ", r.URL.Path)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	w.Write(bs)
+	defer value.Close()
+	if store, ok := srv.store.(storage.MetaStorage); ok {
+		if meta, err := store.Stat(bucket, key); err == nil {
+			common.WriteMetaHeader(w.Header(), meta)
+		}
+	}
+	head := make([]byte, streamThreshold)
+	n, err := io.ReadFull(value, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		w.Header().Set("ETag", common.ETag(head[:n]))
+		w.Write(head[:n])
+		return
+	}
+	if err != nil {
+		log.Print("failed get: ", r.URL.Path, " ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// large values take longer than the write timeout of the server to transfer
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Trailer", "ETag")
+	h := common.NewETagHash()
+	out := io.MultiWriter(w, h)
+	out.Write(head)
+	if _, err = io.Copy(out, value); err != nil {
+		log.Print("failed get: ", r.URL.Path, " ", err)
+		// abort the response, so the client does not mistake the truncated value for the whole
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Set("ETag", common.HashETag(h))
+}
+
+// handleGetVersion serves ?version=N with a former value of a key and ?versions=true with its history as JSON
+func (srv *Server) handleGetVersion(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	store, ok := srv.store.(storage.VersionedStorage)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if r.URL.Query().Get("versions") == "true" {
+		versions, err := store.ListVersions(bucket, key)
+		if err != nil {
+			log.Print("failed list versions: ", r.URL.Path, " ", err)
+			w.WriteHeader(versionStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+		return
+	}
+	version, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	value, err := store.GetVersion(bucket, key, version)
+	if err != nil {
+		log.Print("failed get version: ", r.URL.Path, " ", err)
+		w.WriteHeader(versionStatus(err))
+		return
+	}
+	w.Header().Set("ETag", common.ETag(value))
+	w.Write(value)
+}
+
+func versionStatus(err error) int {
+	if common.IsError(err, common.Unsupported) {
+		return http.StatusNotImplemented
+	}
+	return http.StatusNotFound
+}
+
+// handleHead sends the headers of a GET response without loading the value
+// The size of the value is sent as Content-Length.
+func (srv *Server) handleHead(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["project"] + ":" + vars["bucket"]
+	meta, err := storage.Stat(srv.store, bucket, vars["key"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	common.WriteMetaHeader(w.Header(), meta)
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
 }
 
 func (srv *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["project"] + ":" + vars["bucket"]
 	key := vars["key"]
+	if r.Header.Get("If-Match") != "" {
+		srv.handleConditional(w, r, bucket, key, nil)
+		return
+	}
 	err := srv.store.Delete(bucket, key)
 	if err != nil {
 		log.Print("failed delete: ", r.URL.Path)
@@ -121,9 +343,58 @@ func (srv *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleConditional serves PUT and DELETE requests carrying If-Match or If-None-Match headers
+// If-Match takes an ETag as returned by GET or "*", If-None-Match only supports "*".
+func (srv *Server) handleConditional(w http.ResponseWriter, r *http.Request, bucket, key string, value []byte) {
+	store, ok := srv.store.(storage.ConditionalStorage)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	var (
+		done bool
+		err  error
+	)
+	ifMatch := r.Header.Get("If-Match")
+	switch {
+	case r.Header.Get("If-None-Match") == "*" && r.Method == "PUT":
+		done, err = store.PutIfAbsent(bucket, key, value)
+	case ifMatch != "":
+		current, e := srv.store.Get(bucket, key)
+		if e != nil || (ifMatch != "*" && ifMatch != common.ETag(current)) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Method == "DELETE" {
+			done, err = store.DeleteIfEquals(bucket, key, current)
+		} else {
+			done, err = store.CompareAndSwap(bucket, key, current, value)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Print("failed conditional write: ", r.URL.Path, " ", err)
+		if common.IsError(err, common.Unsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !done {
+		w.WriteHeader(http.StatusPreconditionFailed)
+	}
+}
+
 func (srv *Server) handleCreateBucket(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["project"] + ":" + vars["bucket"]
+	if r.URL.Query().Get("versioning") == "true" {
+		srv.handleEnableVersioning(w, r, bucket)
+		return
+	}
 	err := srv.store.CreateBucket(bucket)
 	if err != nil {
 		log.Print("failed create bucket: ", r.URL.Path)
@@ -132,6 +403,18 @@ func (srv *Server) handleCreateBucket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleEnableVersioning serves PUT ?versioning=true, which enables versioning for an existing bucket
+func (srv *Server) handleEnableVersioning(w http.ResponseWriter, r *http.Request, bucket string) {
+	err := common.Error(common.Unsupported)
+	if store, ok := srv.store.(storage.VersionedStorage); ok {
+		err = store.EnableVersioning(bucket)
+	}
+	if err != nil {
+		log.Print("failed enable versioning: ", r.URL.Path, " ", err)
+		w.WriteHeader(versionStatus(err))
+	}
+}
+
 func (srv *Server) handleDeleteBucket(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["project"] + ":" + vars["bucket"]
@@ -143,15 +426,131 @@ func (srv *Server) handleDeleteBucket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (srv *Server) handleListBuckets(w http.ResponseWriter, r *http.Request) {
+	prefix := mux.Vars(r)["project"] + ":"
+	buckets, err := srv.store.ListBuckets()
+	if err != nil {
+		log.Print("failed list buckets: ", r.URL.Path, " ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	names := []string{}
+	for _, bucket := range buckets {
+		if strings.HasPrefix(bucket, prefix) {
+			names = append(names, strings.TrimPrefix(bucket, prefix))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// handleBackup streams an archive of all buckets of all projects, see package backup
+// The archive is taken from a snapshot, so writes can go on meanwhile. Storages without snapshots
+// answer 501 unless ?consistent=false is given, the archive is marked by X-Backup-Consistent then.
+func (srv *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	token := []byte("Bearer " + srv.backupToken)
+	if srv.backupToken == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// the archive takes longer than the write timeout of the server to transfer
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/gzip")
+	err := backup.WriteSnapshot(srv.store, w)
+	if common.IsError(err, common.Unsupported) {
+		if r.URL.Query().Get("consistent") != "false" {
+			log.Print("failed backup: ", err)
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("X-Backup-Consistent", "false")
+		err = backup.Write(srv.store, w)
+	}
+	if err != nil {
+		log.Print("failed backup: ", err)
+		// abort the response, so the client does not mistake the truncated archive for the whole
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (srv *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var ops []*common.BatchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		log.Print("failed batch: ", r.URL.Path, " ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	batch := storage.NewBatch(srv.store)
+	for _, op := range ops {
+		bucket := vars["project"] + ":" + op.Bucket
+		if op.Delete {
+			batch.Delete(bucket, op.Key)
+		} else {
+			batch.Put(bucket, op.Key, op.Value)
+		}
+	}
+	if err := batch.Commit(); err != nil {
+		log.Print("failed batch: ", r.URL.Path, " ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+// handleWatch streams the changes of a bucket as server-sent events
+// Each event is named after its type and carries the JSON encoded common.Event as data.
+func (srv *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bucket := vars["project"] + ":" + vars["bucket"]
+	store, ok := srv.store.(storage.Watcher)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	events, err := store.Watch(r.Context(), bucket, r.FormValue("prefix"))
+	if err != nil {
+		log.Print("failed watch: ", r.URL.Path, " ", err)
+		if common.IsError(err, common.Unsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// the stream is long lived, so the write timeout of the server must not apply
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	for event := range events {
+		// the event is shared with other watchers, so the project prefix is stripped on a copy
+		e := *event
+		e.Bucket = vars["bucket"]
+		bs, err := json.Marshal(&e)
+		if err != nil {
+			continue
+		}
+		if _, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", e.Type, bs); err != nil {
+			return
+		}
+		rc.Flush()
+	}
+}
+
 func (srv *Server) handleList(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	bucket := vars["project"] + ":" + vars["bucket"]
-	everyStr := r.FormValue("every")
-	start := r.FormValue("start")
-	end := r.FormValue("end")
-	prefix := r.FormValue("prefix")
+	opts := &common.ListOpts{
+		Start:  r.FormValue("start"),
+		End:    r.FormValue("end"),
+		Prefix: r.FormValue("prefix"),
+		Cursor: r.FormValue("cursor"),
+	}
 	var every int64
-	if everyStr != "" {
+	if everyStr := r.FormValue("every"); everyStr != "" {
 		dp, e := strconv.ParseInt(everyStr, 10, 64)
 		if e != nil {
 			log.Print("malformed every option")
@@ -160,20 +559,79 @@ func (srv *Server) handleList(w http.ResponseWriter, r *http.Request) {
 		}
 		every = dp
 	}
-	ch, err := srv.store.List(bucket, &common.ListOpts{Start: start, End: end, Prefix: prefix})
-	if err != nil || ch == nil {
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		limit, e := strconv.Atoi(limitStr)
+		if e != nil || limit < 0 {
+			log.Print("malformed limit option")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		opts.Limit = limit
+	}
+	var count bool
+	for name, flag := range map[string]*bool{"reverse": &opts.Reverse, "keys": &opts.KeysOnly, "meta": &opts.WithMeta, "count": &count} {
+		if str := r.FormValue(name); str != "" {
+			value, e := strconv.ParseBool(str)
+			if e != nil {
+				log.Print("malformed ", name, " option")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			*flag = value
+		}
+	}
+	if count {
+		n, err := srv.store.Count(bucket, opts)
+		if err != nil {
+			log.Print("fail counting bucket")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n)
+		return
+	}
+	limit := opts.Limit
+	if limit > 0 {
+		// one more doc tells whether there is a next page
+		opts.Limit++
+	}
+	iter, err := srv.store.Iterate(bucket, opts)
+	if err != nil {
 		log.Print("fail listing bucket")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if every > 0 {
-		ch = reduceStream(ch, every)
+	defer iter.Close()
+	var page []*common.DocInfo
+	if limit > 0 {
+		// the next cursor header must be sent before the body, so the page is buffered
+		for len(page) <= limit && iter.Next() {
+			page = append(page, iter.Doc())
+		}
+		if err := iter.Err(); err != nil {
+			log.Print("failed listing bucket: ", r.URL.Path, " ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if len(page) > limit {
+			page = page[:limit]
+			w.Header().Set("X-Next-Cursor", common.NewCursor(page[limit-1].Key))
+		}
+		iter = common.SliceIterator(page)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte("["))
 	first := true
-	for pair := range ch {
-		if bs, err := json.Marshal(pair); err == nil {
+	counter := int64(0)
+	for iter.Next() {
+		if every > 0 {
+			counter++
+			if counter%every != 0 {
+				continue
+			}
+		}
+		if bs, err := json.Marshal(iter.Doc()); err == nil {
 			if first {
 				first = false
 			} else {
@@ -182,21 +640,10 @@ func (srv *Server) handleList(w http.ResponseWriter, r *http.Request) {
 			w.Write(bs)
 		}
 	}
+	if err := iter.Err(); err != nil {
+		// the status is already sent, so the missing bracket tells the client the listing is incomplete
+		log.Print("failed listing bucket: ", r.URL.Path, " ", err)
+		return
+	}
 	w.Write([]byte("]"))
 }
-
-func reduceStream(input chan *common.DocInfo, every int64) chan *common.DocInfo {
-	output := make(chan *common.DocInfo, 64)
-	counter := int64(0)
-	go func() {
-		for pair := range input {
-			counter++
-			if counter%every == 0 {
-				counter = 0
-				output <- pair
-			}
-		}
-		close(output)
-	}()
-	return output
-}
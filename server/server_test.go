@@ -1,8 +1,10 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -10,8 +12,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"github.com/trusch/storage/backup"
 	"github.com/trusch/storage/common"
+	_ "github.com/trusch/storage/engines/leveldb/register"
+	"github.com/trusch/storage/engines/memory"
 	"github.com/trusch/storage/engines/meta"
 )
 
@@ -25,6 +31,7 @@ func (suite *ServerSuite) SetupSuite() {
 	suite.NoError(err)
 	suite.NotEmpty(store)
 	suite.srv = New(":8080", store)
+	suite.srv.EnableBackup("secret")
 	go suite.srv.ListenAndServe()
 	time.Sleep(200 * time.Millisecond)
 }
@@ -37,7 +44,7 @@ func (suite *ServerSuite) TearDownTest() {
 	store, err := meta.NewStorage("leveldb://test-store.db")
 	suite.NoError(err)
 	suite.NotEmpty(store)
-	suite.srv.store = store
+	suite.srv.store = watchable(store)
 }
 
 func (suite *ServerSuite) TearDownSuite() {
@@ -160,13 +167,209 @@ func (suite *ServerSuite) TestGetRangeWithEvery() {
 	suite.True(len(slice) == count/every)
 }
 
+func (suite *ServerSuite) TestBatch() {
+	_, err := suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	_, err = suite.request("PUT", "/p1/index", "")
+	suite.NoError(err)
+	ops := `[{"bucket":"mybucket","key":"foo","value":"aGVsbG8="},{"bucket":"index","key":"hello","value":"Zm9v"}]`
+	_, err = suite.request("POST", "/p1/_batch", ops)
+	suite.NoError(err)
+	res, err := suite.request("GET", "/p1/mybucket/foo", "")
+	suite.NoError(err)
+	suite.Equal("hello", res)
+	res, err = suite.request("GET", "/p1/index/hello", "")
+	suite.NoError(err)
+	suite.Equal("foo", res)
+	ops = `[{"bucket":"mybucket","key":"bar","value":"aGVsbG8="},{"bucket":"unknown","key":"bar","value":"aGVsbG8="}]`
+	_, err = suite.request("POST", "/p1/_batch", ops)
+	suite.Error(err)
+	_, err = suite.request("GET", "/p1/mybucket/bar", "")
+	suite.Error(err)
+}
+
+func (suite *ServerSuite) TestConditionalPut() {
+	_, err := suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	_, err = suite.requestWithHeader("PUT", "/p1/mybucket/foo", "a", "If-None-Match", "*")
+	suite.NoError(err)
+	_, err = suite.requestWithHeader("PUT", "/p1/mybucket/foo", "b", "If-None-Match", "*")
+	suite.Equal("412", err.Error())
+	_, err = suite.requestWithHeader("PUT", "/p1/mybucket/foo", "b", "If-Match", common.ETag([]byte("x")))
+	suite.Equal("412", err.Error())
+	_, err = suite.requestWithHeader("PUT", "/p1/mybucket/foo", "b", "If-Match", common.ETag([]byte("a")))
+	suite.NoError(err)
+	res, err := suite.request("GET", "/p1/mybucket/foo", "")
+	suite.NoError(err)
+	suite.Equal("b", res)
+	_, err = suite.requestWithHeader("DELETE", "/p1/mybucket/foo", "", "If-Match", common.ETag([]byte("a")))
+	suite.Equal("412", err.Error())
+	_, err = suite.requestWithHeader("DELETE", "/p1/mybucket/foo", "", "If-Match", common.ETag([]byte("b")))
+	suite.NoError(err)
+	_, err = suite.request("GET", "/p1/mybucket/foo", "")
+	suite.Error(err)
+}
+
+func (suite *ServerSuite) TestConflictingPutHeaders() {
+	_, err := suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	_, err = suite.requestWithHeader("PUT", "/p1/mybucket/foo", "a", "If-None-Match", "*", "X-TTL", "1m")
+	suite.Equal("400", err.Error())
+	_, err = suite.requestWithHeader("PUT", "/p1/mybucket/foo", "a", "If-None-Match", "*", "Content-Type", "text/plain")
+	suite.Equal("400", err.Error())
+	_, err = suite.requestWithHeader("PUT", "/p1/mybucket/foo", "a", "X-TTL", "1m", "X-Meta-Owner", "me")
+	suite.Equal("400", err.Error())
+	_, err = suite.request("GET", "/p1/mybucket/foo", "")
+	suite.Error(err)
+}
+
+func (suite *ServerSuite) TestListBuckets() {
+	_, err := suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	_, err = suite.request("PUT", "/p1/index", "")
+	suite.NoError(err)
+	_, err = suite.request("PUT", "/p2/other", "")
+	suite.NoError(err)
+	res, err := suite.request("GET", "/p1", "")
+	suite.NoError(err)
+	suite.JSONEq(`["index","mybucket"]`, res)
+}
+
+func (suite *ServerSuite) TestGetPage() {
+	_, err := suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = suite.request("PUT", "/p1/mybucket/"+key, key)
+		suite.NoError(err)
+	}
+	resp, err := http.Get("http://localhost:8080/v1/p1/mybucket?limit=2&reverse=true")
+	suite.NoError(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	suite.NoError(err)
+	suite.JSONEq(`[{"Key":"c","Value":"Yw=="},{"Key":"b","Value":"Yg=="}]`, string(body))
+	cursor := resp.Header.Get("X-Next-Cursor")
+	suite.NotEmpty(cursor)
+	resp, err = http.Get("http://localhost:8080/v1/p1/mybucket?limit=2&reverse=true&cursor=" + cursor)
+	suite.NoError(err)
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	suite.NoError(err)
+	suite.JSONEq(`[{"Key":"a","Value":"YQ=="}]`, string(body))
+	suite.Empty(resp.Header.Get("X-Next-Cursor"))
+}
+
+func (suite *ServerSuite) TestCountAndKeys() {
+	_, err := suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err = suite.request("PUT", "/p1/mybucket/"+key, key)
+		suite.NoError(err)
+	}
+	res, err := suite.request("GET", "/p1/mybucket?count=true&start=b&end=z", "")
+	suite.NoError(err)
+	suite.Equal("2\n", res)
+	res, err = suite.request("GET", "/p1/mybucket?keys=true&prefix=a", "")
+	suite.NoError(err)
+	suite.JSONEq(`[{"Key":"a","Value":null}]`, res)
+}
+
+func (suite *ServerSuite) TestMetaHeaders() {
+	_, err := suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	_, err = suite.requestWithHeader("PUT", "/p1/mybucket/doc", "hello", "Content-Type", "text/plain", "X-Meta-Author", "alice")
+	suite.NoError(err)
+	for _, method := range []string{"GET", "HEAD"} {
+		req, err := http.NewRequest(method, "http://localhost:8080/v1/p1/mybucket/doc", nil)
+		suite.NoError(err)
+		resp, err := http.DefaultClient.Do(req)
+		suite.NoError(err)
+		resp.Body.Close()
+		suite.Equal(http.StatusOK, resp.StatusCode)
+		suite.Equal("text/plain", resp.Header.Get("Content-Type"))
+		suite.Equal("alice", resp.Header.Get("X-Meta-Author"))
+		suite.NotEmpty(resp.Header.Get("Last-Modified"))
+		suite.Equal(int64(5), resp.ContentLength)
+	}
+	res, err := suite.request("GET", "/p1/mybucket?keys=true&meta=true", "")
+	suite.NoError(err)
+	suite.Contains(res, `"contentType":"text/plain"`)
+	resp, err := http.Head("http://localhost:8080/v1/p1/mybucket/missing")
+	suite.NoError(err)
+	suite.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (suite *ServerSuite) TestVersions() {
+	_, err := suite.request("PUT", "/p1/mybucket?versioning=true", "")
+	suite.EqualError(err, "404")
+	_, err = suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	_, err = suite.request("PUT", "/p1/mybucket?versioning=true", "")
+	suite.NoError(err)
+	_, err = suite.request("PUT", "/p1/mybucket/doc", "v1")
+	suite.NoError(err)
+	_, err = suite.request("PUT", "/p1/mybucket/doc", "v2")
+	suite.NoError(err)
+	_, err = suite.request("DELETE", "/p1/mybucket/doc", "")
+	suite.NoError(err)
+	res, err := suite.request("GET", "/p1/mybucket/doc?version=1", "")
+	suite.NoError(err)
+	suite.Equal("v1", res)
+	_, err = suite.request("GET", "/p1/mybucket/doc?version=3", "")
+	suite.EqualError(err, "404")
+	_, err = suite.request("GET", "/p1/mybucket/doc?version=latest", "")
+	suite.EqualError(err, "400")
+	res, err = suite.request("GET", "/p1/mybucket/doc?versions=true", "")
+	suite.NoError(err)
+	versions := []*common.Version{}
+	suite.NoError(json.Unmarshal([]byte(res), &versions))
+	if suite.Len(versions, 3) {
+		suite.Equal(int64(2), versions[1].Size)
+		suite.True(versions[2].Deleted)
+	}
+}
+
+func (suite *ServerSuite) TestBackup() {
+	_, err := suite.request("PUT", "/p1/mybucket", "")
+	suite.NoError(err)
+	_, err = suite.request("PUT", "/p1/mybucket/doc", "hello")
+	suite.NoError(err)
+	resp, err := http.Get("http://localhost:8080/v1/_backup")
+	suite.NoError(err)
+	resp.Body.Close()
+	suite.Equal(http.StatusForbidden, resp.StatusCode, "the backup needs the token")
+	req, err := http.NewRequest("GET", "http://localhost:8080/v1/_backup", nil)
+	suite.NoError(err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	suite.NoError(err)
+	defer resp.Body.Close()
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.Equal("application/gzip", resp.Header.Get("Content-Type"))
+	store, err := memory.NewStorage()
+	suite.NoError(err)
+	suite.NoError(backup.Restore(store, resp.Body))
+	val, err := store.Get("p1:mybucket", "doc")
+	suite.NoError(err)
+	suite.Equal("hello", string(val))
+}
+
 func (suite *ServerSuite) request(method, path string, data string) (string, error) {
+	return suite.requestWithHeader(method, path, data)
+}
+
+func (suite *ServerSuite) requestWithHeader(method, path string, data string, header ...string) (string, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:8080/v1%v", path), strings.NewReader(data))
 	if err != nil {
 		return "", err
 	}
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if len(header) == 0 {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", err
@@ -184,3 +387,76 @@ func (suite *ServerSuite) request(method, path string, data string) (string, err
 func TestServer(t *testing.T) {
 	suite.Run(t, new(ServerSuite))
 }
+
+func TestStreamingTimeout(t *testing.T) {
+	store, err := memory.NewStorage()
+	assert.NoError(t, err)
+	srv := New("localhost:8084", store)
+	srv.server.ReadTimeout = 100 * time.Millisecond
+	srv.server.WriteTimeout = 100 * time.Millisecond
+	go srv.ListenAndServe()
+	defer srv.Stop()
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, store.CreateBucket("p:bucket"))
+
+	// a body of unknown length is streamed, it arrives slower than the timeouts allow
+	value := bytes.Repeat([]byte("x"), 16<<20)
+	r, w := io.Pipe()
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(100 * time.Millisecond)
+			w.Write(value[i*len(value)/4 : (i+1)*len(value)/4])
+		}
+		w.Close()
+	}()
+	req, err := http.NewRequest("PUT", "http://localhost:8084/v1/p/bucket/key", r)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	stored, err := store.Get("p:bucket", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, len(value), len(stored))
+
+	// the value is read slower than the write timeout allows
+	resp, err = http.Get("http://localhost:8084/v1/p/bucket/key")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	time.Sleep(300 * time.Millisecond)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, len(value), len(body))
+}
+
+// unconditionalStorage implements the conditional interface but can not serve it, like wrappers around such engines
+type unconditionalStorage struct {
+	*memory.Storage
+}
+
+func (s *unconditionalStorage) PutIfAbsent(bucket, key string, value []byte) (bool, error) {
+	return false, common.Error(common.Unsupported)
+}
+
+func TestConditionalUnsupported(t *testing.T) {
+	store, err := memory.NewStorage()
+	assert.NoError(t, err)
+	srv := New("localhost:8083", &unconditionalStorage{store})
+	go srv.ListenAndServe()
+	defer srv.Stop()
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, store.CreateBucket("p:bucket"))
+	req, err := http.NewRequest("PUT", "http://localhost:8083/v1/p/bucket/key", strings.NewReader("a"))
+	assert.NoError(t, err)
+	req.Header.Set("If-None-Match", "*")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+}
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"github.com/trusch/storage/common"
+)
+
+// Snapshot returns a read-only view of store and a function releasing it.
+// If the storage is not a Snapshotter, store itself is returned and release does nothing,
+// so reads through the view see concurrent writes.
+func Snapshot(store Storage) (view Storage, release func() error, err error) {
+	if s, ok := store.(Snapshotter); ok {
+		snap, err := s.Snapshot()
+		if err == nil {
+			return snap, snap.Close, nil
+		}
+		if !common.IsError(err, common.Unsupported) {
+			return nil, nil, err
+		}
+	}
+	return store, func() error { return nil }, nil
+}
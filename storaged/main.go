@@ -3,23 +3,60 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
 
+	"github.com/trusch/storage/backup"
+	"github.com/trusch/storage/common"
+	_ "github.com/trusch/storage/engines/all"
 	"github.com/trusch/storage/engines/meta"
 	"github.com/trusch/storage/server"
 )
 
 var listen = flag.String("listen", ":80", "listen address")
 var backend = flag.String("backend", "leveldb:///usr/share/storaged", "backend uri")
+var config = flag.String("config", "", "storage composition config (yaml or json), replaces -backend")
+var backupToken = flag.String("backup-token", "", "bearer token for GET /v1/_backup, which is disabled without it")
 
 func main() {
 	flag.Parse()
-	store, err := meta.NewStorage(*backend)
+	store, err := openStorage()
 	if err != nil {
 		log.Fatal(err)
 	}
+	switch flag.Arg(0) {
+	case "backup":
+		// a running storaged started with -backup-token serves the same archive at GET /v1/_backup
+		err = backup.WriteSnapshot(store, os.Stdout)
+		if common.IsError(err, common.Unsupported) {
+			log.Print("the backend can not take snapshots, the backup is not consistent if it is written meanwhile")
+			err = backup.Write(store, os.Stdout)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		store.Close()
+		return
+	case "restore":
+		if err = backup.Restore(store, os.Stdin); err != nil {
+			log.Fatal(err)
+		}
+		store.Close()
+		return
+	}
 	server := server.New(*listen, store)
-	if err != nil {
-		log.Fatal(err)
+	if *backupToken != "" {
+		server.EnableBackup(*backupToken)
 	}
 	log.Fatal(server.ListenAndServe())
 }
+
+func openStorage() (*meta.Storage, error) {
+	if *config == "" {
+		return meta.NewStorage(*backend)
+	}
+	cfg, err := meta.LoadConfig(*config)
+	if err != nil {
+		return nil, err
+	}
+	return meta.NewStorageFromConfig(cfg)
+}
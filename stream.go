@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	"github.com/trusch/storage/common"
+)
+
+// PutReader saves everything read from r in the given storage.
+// If the storage is not a StreamStorage, the value is read into memory and saved with Put.
+func PutReader(store Storage, bucket, key string, r io.Reader) error {
+	if s, ok := store.(StreamStorage); ok {
+		return s.PutReader(bucket, key, r)
+	}
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		return common.Error(common.WriteFailed, err)
+	}
+	return store.Put(bucket, key, value)
+}
+
+// GetReader opens a value of the given storage for reading.
+// If the storage is not a StreamStorage, the value is loaded with Get.
+func GetReader(store Storage, bucket, key string) (io.ReadCloser, error) {
+	if s, ok := store.(StreamStorage); ok {
+		return s.GetReader(bucket, key)
+	}
+	value, err := store.Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
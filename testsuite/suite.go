@@ -1,7 +1,13 @@
 package testsuite
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 	"github.com/trusch/storage"
@@ -164,3 +170,637 @@ func (suite *Suite) TestRecreateBucket() {
 	err = suite.Store.DeleteBucket("bucket-name")
 	suite.NoError(err)
 }
+
+func (suite *Suite) TestCancelledContext() {
+	store, ok := suite.Store.(storage.ContextStorage)
+	if !ok {
+		suite.T().Skip("storage is not context aware")
+	}
+	err := suite.Store.CreateBucket("bucket-name")
+	suite.NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.PutContext(ctx, "bucket-name", "foo", []byte("hello"))
+	suite.Error(err)
+	_, err = store.GetContext(ctx, "bucket-name", "foo")
+	suite.Error(err)
+	_, err = store.ListContext(ctx, "bucket-name", nil)
+	suite.Error(err)
+	err = suite.Store.DeleteBucket("bucket-name")
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestListContextCancel() {
+	store, ok := suite.Store.(storage.ContextStorage)
+	if !ok {
+		suite.T().Skip("storage is not context aware")
+	}
+	err := suite.Store.CreateBucket("bucket-name")
+	suite.NoError(err)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("%03d", i)
+		err = suite.Store.Put("bucket-name", key, []byte(key))
+		suite.NoError(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := store.ListContext(ctx, "bucket-name", nil)
+	suite.NoError(err)
+	_, ok = <-ch
+	suite.True(ok)
+	cancel()
+	// the channel must get closed without reading all remaining entries
+	timeout := time.After(5 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-ch:
+			closed = !ok
+		case <-timeout:
+			suite.FailNow("channel was not closed after cancel")
+		}
+	}
+	err = suite.Store.DeleteBucket("bucket-name")
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestBatch() {
+	store, ok := suite.Store.(storage.Batcher)
+	if !ok {
+		suite.T().Skip("storage does not support batches")
+	}
+	err := suite.Store.CreateBucket("bucket-name")
+	suite.NoError(err)
+	err = suite.Store.CreateBucket("index")
+	suite.NoError(err)
+	err = suite.Store.Put("bucket-name", "old", []byte("old"))
+	suite.NoError(err)
+	batch := store.NewBatch()
+	batch.Put("bucket-name", "foo", []byte("hello"))
+	batch.Put("index", "hello", []byte("foo"))
+	batch.Delete("bucket-name", "old")
+	err = batch.Commit()
+	suite.NoError(err)
+	val, err := suite.Store.Get("bucket-name", "foo")
+	suite.NoError(err)
+	suite.Equal("hello", string(val))
+	val, err = suite.Store.Get("index", "hello")
+	suite.NoError(err)
+	suite.Equal("foo", string(val))
+	_, err = suite.Store.Get("bucket-name", "old")
+	suite.Error(err)
+	// a batch touching an unknown bucket must not apply anything
+	batch = store.NewBatch()
+	batch.Put("bucket-name", "bar", []byte("hello"))
+	batch.Put("unknown", "bar", []byte("hello"))
+	err = batch.Commit()
+	suite.Error(err)
+	_, err = suite.Store.Get("bucket-name", "bar")
+	suite.Error(err)
+	err = suite.Store.DeleteBucket("bucket-name")
+	suite.NoError(err)
+	err = suite.Store.DeleteBucket("index")
+	suite.NoError(err)
+}
+
+func (suite *Suite) begin() storage.Tx {
+	store, ok := suite.Store.(storage.Transactional)
+	if !ok {
+		suite.T().Skip("storage does not support transactions")
+	}
+	tx, err := store.Begin()
+	if common.IsError(err, common.Unsupported) {
+		suite.T().Skip("storage does not support transactions")
+	}
+	suite.NoError(err)
+	return tx
+}
+
+func (suite *Suite) TestTransaction() {
+	err := suite.Store.CreateBucket("bucket-name")
+	suite.NoError(err)
+	err = suite.Store.Put("bucket-name", "old", []byte("old"))
+	suite.NoError(err)
+	tx := suite.begin()
+	err = tx.Put("bucket-name", "foo", []byte("hello"))
+	suite.NoError(err)
+	err = tx.Delete("bucket-name", "old")
+	suite.NoError(err)
+	err = tx.Put("unknown", "foo", []byte("hello"))
+	suite.Error(err)
+	// read your writes
+	val, err := tx.Get("bucket-name", "foo")
+	suite.NoError(err)
+	suite.Equal("hello", string(val))
+	_, err = tx.Get("bucket-name", "old")
+	suite.Error(err)
+	ch, err := tx.List("bucket-name", nil)
+	suite.NoError(err)
+	info, ok := <-ch
+	suite.True(ok)
+	suite.Equal("foo", info.Key)
+	_, ok = <-ch
+	suite.False(ok)
+	err = tx.Commit()
+	suite.NoError(err)
+	val, err = suite.Store.Get("bucket-name", "foo")
+	suite.NoError(err)
+	suite.Equal("hello", string(val))
+	_, err = suite.Store.Get("bucket-name", "old")
+	suite.Error(err)
+	err = suite.Store.DeleteBucket("bucket-name")
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestTransactionRollback() {
+	err := suite.Store.CreateBucket("bucket-name")
+	suite.NoError(err)
+	tx := suite.begin()
+	err = tx.Put("bucket-name", "foo", []byte("hello"))
+	suite.NoError(err)
+	err = tx.Rollback()
+	suite.NoError(err)
+	_, err = suite.Store.Get("bucket-name", "foo")
+	suite.Error(err)
+	err = suite.Store.DeleteBucket("bucket-name")
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestCompareAndSwap() {
+	store, ok := suite.Store.(storage.ConditionalStorage)
+	if !ok {
+		suite.T().Skip("storage does not support conditional writes")
+	}
+	err := suite.Store.CreateBucket("bucket-name")
+	suite.NoError(err)
+	done, err := store.PutIfAbsent("bucket-name", "lease", []byte("a"))
+	suite.NoError(err)
+	suite.True(done)
+	done, err = store.PutIfAbsent("bucket-name", "lease", []byte("b"))
+	suite.NoError(err)
+	suite.False(done)
+	done, err = store.CompareAndSwap("bucket-name", "lease", []byte("b"), []byte("c"))
+	suite.NoError(err)
+	suite.False(done)
+	done, err = store.CompareAndSwap("bucket-name", "lease", []byte("a"), []byte("c"))
+	suite.NoError(err)
+	suite.True(done)
+	val, err := suite.Store.Get("bucket-name", "lease")
+	suite.NoError(err)
+	suite.Equal("c", string(val))
+	done, err = store.DeleteIfEquals("bucket-name", "lease", []byte("a"))
+	suite.NoError(err)
+	suite.False(done)
+	done, err = store.DeleteIfEquals("bucket-name", "lease", []byte("c"))
+	suite.NoError(err)
+	suite.True(done)
+	_, err = suite.Store.Get("bucket-name", "lease")
+	suite.Error(err)
+	_, err = store.CompareAndSwap("unknown", "lease", nil, []byte("a"))
+	suite.Error(err)
+	err = suite.Store.DeleteBucket("bucket-name")
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestPutWithTTL() {
+	store, ok := suite.Store.(storage.TTLStorage)
+	if !ok {
+		suite.T().Skip("storage does not support ttl")
+	}
+	err := suite.Store.CreateBucket("bucket-name")
+	suite.NoError(err)
+	err = store.PutWithTTL("bucket-name", "session", []byte("a"), 100*time.Millisecond)
+	if common.IsError(err, common.Unsupported) {
+		suite.T().Skip("storage does not support ttl")
+	}
+	suite.NoError(err)
+	err = store.PutWithTTL("bucket-name", "renewed", []byte("b"), 100*time.Millisecond)
+	suite.NoError(err)
+	err = suite.Store.Put("bucket-name", "renewed", []byte("c"))
+	suite.NoError(err)
+	val, err := suite.Store.Get("bucket-name", "session")
+	suite.NoError(err)
+	suite.Equal("a", string(val))
+	time.Sleep(200 * time.Millisecond)
+	_, err = suite.Store.Get("bucket-name", "session")
+	suite.Error(err)
+	val, err = suite.Store.Get("bucket-name", "renewed")
+	suite.NoError(err)
+	suite.Equal("c", string(val))
+	ch, err := suite.Store.List("bucket-name", nil)
+	suite.NoError(err)
+	keys := []string{}
+	for doc := range ch {
+		keys = append(keys, doc.Key)
+	}
+	suite.Equal([]string{"renewed"}, keys)
+	err = suite.Store.DeleteBucket("bucket-name")
+	suite.NoError(err)
+}
+
+func (suite *Suite) TestListBuckets() {
+	suite.NoError(suite.Store.CreateBucket("bucket-b"))
+	suite.NoError(suite.Store.CreateBucket("bucket-a"))
+	suite.NoError(suite.Store.Put("bucket-a", "foo", []byte("bar")))
+	buckets, err := suite.Store.ListBuckets()
+	suite.NoError(err)
+	suite.Subset(buckets, []string{"bucket-a", "bucket-b"})
+	suite.True(sort.StringsAreSorted(buckets))
+	suite.NoError(suite.Store.DeleteBucket("bucket-a"))
+	suite.NoError(suite.Store.DeleteBucket("bucket-b"))
+	buckets, err = suite.Store.ListBuckets()
+	suite.NoError(err)
+	suite.NotContains(buckets, "bucket-a")
+	suite.NotContains(buckets, "bucket-b")
+}
+
+func (suite *Suite) TestListBucketsSharedPrefix() {
+	names := []string{"a", "a-b", "a.b"}
+	for _, name := range names {
+		suite.NoError(suite.Store.CreateBucket(name))
+		suite.NoError(suite.Store.Put(name, "key", []byte(name)))
+	}
+	buckets, err := suite.Store.ListBuckets()
+	suite.NoError(err)
+	suite.Subset(buckets, names)
+	for _, name := range names {
+		suite.NoError(suite.Store.DeleteBucket(name))
+	}
+}
+
+func (suite *Suite) TestIterate() {
+	suite.NoError(suite.Store.CreateBucket("bucket-name"))
+	for i := 0; i < 300; i++ {
+		suite.NoError(suite.Store.Put("bucket-name", fmt.Sprintf("key-%03d", i), []byte{byte(i)}))
+	}
+	iter, err := suite.Store.Iterate("bucket-name", nil)
+	suite.NoError(err)
+	count := 0
+	for iter.Next() {
+		suite.Equal(fmt.Sprintf("key-%03d", count), iter.Doc().Key)
+		suite.Equal([]byte{byte(count)}, iter.Doc().Value)
+		count++
+	}
+	suite.NoError(iter.Err())
+	suite.NoError(iter.Close())
+	suite.Equal(300, count)
+	iter, err = suite.Store.Iterate("bucket-name", &common.ListOpts{Start: "key-100", End: "key-110"})
+	suite.NoError(err)
+	count = 0
+	for iter.Next() {
+		count++
+	}
+	suite.NoError(iter.Err())
+	suite.NoError(iter.Close())
+	suite.Equal(10, count)
+	_, err = suite.Store.Iterate("unknown", nil)
+	suite.Error(err)
+	suite.NoError(suite.Store.DeleteBucket("bucket-name"))
+}
+
+// page lists one page and returns its keys and the cursor for the next one
+func (suite *Suite) page(bucket string, opts *common.ListOpts) ([]string, string) {
+	iter, err := suite.Store.Iterate(bucket, opts)
+	suite.NoError(err)
+	keys := []string{}
+	for iter.Next() {
+		keys = append(keys, iter.Doc().Key)
+	}
+	suite.NoError(iter.Err())
+	suite.NoError(iter.Close())
+	if len(keys) == 0 {
+		return keys, ""
+	}
+	return keys, common.NewCursor(keys[len(keys)-1])
+}
+
+func (suite *Suite) TestPagination() {
+	suite.NoError(suite.Store.CreateBucket("bucket-name"))
+	for _, key := range []string{"a1", "a2", "a3", "b1", "b2", "b3", "b4", "c1"} {
+		suite.NoError(suite.Store.Put("bucket-name", key, []byte(key)))
+	}
+	keys, cursor := suite.page("bucket-name", &common.ListOpts{Limit: 3})
+	suite.Equal([]string{"a1", "a2", "a3"}, keys)
+	keys, cursor = suite.page("bucket-name", &common.ListOpts{Limit: 3, Cursor: cursor})
+	suite.Equal([]string{"b1", "b2", "b3"}, keys)
+	keys, _ = suite.page("bucket-name", &common.ListOpts{Limit: 3, Cursor: cursor})
+	suite.Equal([]string{"b4", "c1"}, keys)
+	keys, cursor = suite.page("bucket-name", &common.ListOpts{Limit: 3, Reverse: true})
+	suite.Equal([]string{"c1", "b4", "b3"}, keys)
+	keys, _ = suite.page("bucket-name", &common.ListOpts{Limit: 3, Reverse: true, Cursor: cursor})
+	suite.Equal([]string{"b2", "b1", "a3"}, keys)
+	keys, cursor = suite.page("bucket-name", &common.ListOpts{Prefix: "b", Limit: 2, Reverse: true})
+	suite.Equal([]string{"b4", "b3"}, keys)
+	keys, _ = suite.page("bucket-name", &common.ListOpts{Prefix: "b", Limit: 5, Reverse: true, Cursor: cursor})
+	suite.Equal([]string{"b2", "b1"}, keys)
+	keys, cursor = suite.page("bucket-name", &common.ListOpts{Start: "a2", End: "b3", Limit: 2})
+	suite.Equal([]string{"a2", "a3"}, keys)
+	keys, _ = suite.page("bucket-name", &common.ListOpts{Start: "a2", End: "b3", Cursor: cursor})
+	suite.Equal([]string{"b1", "b2"}, keys)
+	keys, _ = suite.page("bucket-name", &common.ListOpts{Start: "a2", End: "b3", Reverse: true})
+	suite.Equal([]string{"b2", "b1", "a3", "a2"}, keys)
+	suite.NoError(suite.Store.DeleteBucket("bucket-name"))
+}
+
+func (suite *Suite) TestKeysOnlyAndCount() {
+	suite.NoError(suite.Store.CreateBucket("bucket-name"))
+	for _, key := range []string{"a1", "a2", "b1"} {
+		suite.NoError(suite.Store.Put("bucket-name", key, []byte(key)))
+	}
+	iter, err := suite.Store.Iterate("bucket-name", &common.ListOpts{Prefix: "a", KeysOnly: true})
+	suite.NoError(err)
+	keys := []string{}
+	for iter.Next() {
+		keys = append(keys, iter.Doc().Key)
+		suite.Empty(iter.Doc().Value)
+	}
+	suite.NoError(iter.Err())
+	suite.NoError(iter.Close())
+	suite.Equal([]string{"a1", "a2"}, keys)
+	n, err := suite.Store.Count("bucket-name", nil)
+	suite.NoError(err)
+	suite.Equal(3, n)
+	n, err = suite.Store.Count("bucket-name", &common.ListOpts{Prefix: "a"})
+	suite.NoError(err)
+	suite.Equal(2, n)
+	n, err = suite.Store.Count("bucket-name", &common.ListOpts{Start: "a2", End: "c", Limit: 1})
+	suite.NoError(err)
+	suite.Equal(1, n)
+	_, err = suite.Store.Count("unknown", nil)
+	suite.Error(err)
+	suite.NoError(suite.Store.DeleteBucket("bucket-name"))
+}
+
+// nextEvent waits for the next event of a watch
+func (suite *Suite) nextEvent(events <-chan *common.Event) *common.Event {
+	select {
+	case event, ok := <-events:
+		suite.True(ok, "watch closed")
+		if ok {
+			return event
+		}
+	case <-time.After(2 * time.Second):
+		suite.Fail("no event received")
+	}
+	return &common.Event{}
+}
+
+func (suite *Suite) TestWatch() {
+	store, ok := suite.Store.(storage.Watcher)
+	if !ok {
+		suite.T().Skip("storage does not support watching")
+	}
+	suite.NoError(suite.Store.CreateBucket("bucket-name"))
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := store.Watch(ctx, "bucket-name", "a")
+	if common.IsError(err, common.Unsupported) {
+		cancel()
+		suite.T().Skip("storage does not support watching")
+	}
+	if !suite.NoError(err) {
+		cancel()
+		return
+	}
+	suite.NoError(suite.Store.Put("bucket-name", "b1", []byte("ignored")))
+	suite.NoError(suite.Store.Put("bucket-name", "a1", []byte("foo")))
+	suite.NoError(suite.Store.Delete("bucket-name", "a1"))
+	event := suite.nextEvent(events)
+	suite.Equal(common.PutEvent, event.Type)
+	suite.Equal("bucket-name", event.Bucket)
+	suite.Equal("a1", event.Key)
+	suite.Equal("foo", string(event.Value))
+	event = suite.nextEvent(events)
+	suite.Equal(common.DeleteEvent, event.Type)
+	suite.Equal("a1", event.Key)
+	cancel()
+	for range events {
+	}
+	suite.NoError(suite.Store.DeleteBucket("bucket-name"))
+}
+
+func (suite *Suite) TestStream() {
+	suite.NoError(suite.Store.CreateBucket("bucket-name"))
+	// large enough to be split into several chunks by engines storing them chunked
+	large := make([]byte, 5<<19)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	suite.NoError(storage.PutReader(suite.Store, "bucket-name", "large", bytes.NewReader(large)))
+	r, err := storage.GetReader(suite.Store, "bucket-name", "large")
+	if suite.NoError(err) {
+		val, err := ioutil.ReadAll(r)
+		suite.NoError(err)
+		suite.NoError(r.Close())
+		suite.True(bytes.Equal(large, val))
+	}
+	val, err := suite.Store.Get("bucket-name", "large")
+	suite.NoError(err)
+	suite.True(bytes.Equal(large, val))
+	ch, err := suite.Store.List("bucket-name", nil)
+	suite.NoError(err)
+	for doc := range ch {
+		suite.Equal("large", doc.Key)
+		suite.True(bytes.Equal(large, doc.Value))
+	}
+	suite.NoError(suite.Store.Put("bucket-name", "large", []byte("small")))
+	r, err = storage.GetReader(suite.Store, "bucket-name", "large")
+	if suite.NoError(err) {
+		val, err = ioutil.ReadAll(r)
+		suite.NoError(err)
+		suite.NoError(r.Close())
+		suite.Equal("small", string(val))
+	}
+	suite.NoError(storage.PutReader(suite.Store, "bucket-name", "large", bytes.NewReader(large)))
+	suite.NoError(suite.Store.Delete("bucket-name", "large"))
+	_, err = storage.GetReader(suite.Store, "bucket-name", "large")
+	suite.Error(err)
+	suite.Error(storage.PutReader(suite.Store, "unknown", "large", bytes.NewReader(large)))
+	suite.NoError(suite.Store.DeleteBucket("bucket-name"))
+}
+
+func (suite *Suite) TestMetadata() {
+	store, ok := suite.Store.(storage.MetaStorage)
+	if !ok {
+		suite.T().Skip("storage does not keep metadata")
+	}
+	suite.NoError(suite.Store.CreateBucket("bucket-name"))
+	err := store.PutWithMeta("bucket-name", "doc", []byte("hello"), &common.Metadata{
+		ContentType: "text/plain",
+		Attributes:  map[string]string{"author": "alice"},
+	})
+	if common.IsError(err, common.Unsupported) {
+		suite.T().Skip("storage does not keep metadata")
+	}
+	suite.NoError(err)
+	first, err := store.Stat("bucket-name", "doc")
+	suite.NoError(err)
+	suite.Equal("text/plain", first.ContentType)
+	suite.Equal(map[string]string{"author": "alice"}, first.Attributes)
+	suite.Equal(int64(5), first.Size)
+	suite.False(first.Created.IsZero())
+	suite.False(first.Modified.IsZero())
+	time.Sleep(10 * time.Millisecond)
+	suite.NoError(suite.Store.Put("bucket-name", "doc", []byte("hello world")))
+	meta, err := store.Stat("bucket-name", "doc")
+	suite.NoError(err)
+	suite.Empty(meta.ContentType)
+	suite.Empty(meta.Attributes)
+	suite.Equal(int64(11), meta.Size)
+	suite.True(first.Created.Equal(meta.Created))
+	suite.True(meta.Modified.After(first.Modified))
+	for _, opts := range []*common.ListOpts{{WithMeta: true}, {WithMeta: true, KeysOnly: true}} {
+		ch, err := suite.Store.List("bucket-name", opts)
+		suite.NoError(err)
+		for doc := range ch {
+			suite.Equal("doc", doc.Key)
+			if suite.NotNil(doc.Meta) {
+				suite.Equal(int64(11), doc.Meta.Size)
+			}
+		}
+	}
+	suite.NoError(suite.Store.Delete("bucket-name", "doc"))
+	_, err = store.Stat("bucket-name", "doc")
+	suite.Error(err)
+	_, err = store.Stat("unknown", "doc")
+	suite.Error(err)
+	suite.NoError(suite.Store.DeleteBucket("bucket-name"))
+}
+
+func (suite *Suite) TestVersioning() {
+	store, ok := suite.Store.(storage.VersionedStorage)
+	if !ok {
+		suite.T().Skip("storage does not keep versions")
+	}
+	suite.Error(store.EnableVersioning("unknown"))
+	suite.NoError(suite.Store.CreateBucket("versioned-bucket"))
+	suite.NoError(suite.Store.Put("versioned-bucket", "doc", []byte("v1")))
+	err := store.EnableVersioning("versioned-bucket")
+	if common.IsError(err, common.Unsupported) {
+		suite.T().Skip("storage does not keep versions")
+	}
+	suite.NoError(err)
+	suite.NoError(store.EnableVersioning("versioned-bucket"))
+	suite.NoError(suite.Store.Put("versioned-bucket", "doc", []byte("v2")))
+	batch := storage.NewBatch(suite.Store)
+	batch.Put("versioned-bucket", "doc", []byte("v3"))
+	batch.Put("versioned-bucket", "other", []byte("a"))
+	suite.NoError(batch.Commit())
+	suite.NoError(suite.Store.Delete("versioned-bucket", "doc"))
+	suite.NoError(suite.Store.Delete("versioned-bucket", "missing"))
+	_, err = suite.Store.Get("versioned-bucket", "doc")
+	suite.Error(err)
+	versions, err := store.ListVersions("versioned-bucket", "doc")
+	suite.NoError(err)
+	if suite.Len(versions, 4) {
+		for i, v := range versions {
+			suite.Equal(uint64(i+1), v.Version)
+			suite.False(v.Modified.IsZero())
+		}
+		suite.Equal(int64(2), versions[2].Size)
+		suite.False(versions[2].Deleted)
+		suite.True(versions[3].Deleted)
+	}
+	for i, expected := range []string{"v1", "v2", "v3"} {
+		val, err := store.GetVersion("versioned-bucket", "doc", uint64(i+1))
+		suite.NoError(err)
+		suite.Equal(expected, string(val))
+	}
+	_, err = store.GetVersion("versioned-bucket", "doc", 4)
+	suite.Error(err)
+	_, err = store.GetVersion("versioned-bucket", "doc", 5)
+	suite.Error(err)
+	suite.NoError(suite.Store.Put("versioned-bucket", "doc", []byte("v5")))
+	versions, err = store.ListVersions("versioned-bucket", "doc")
+	suite.NoError(err)
+	suite.Len(versions, 5)
+	versions, err = store.ListVersions("versioned-bucket", "missing")
+	suite.NoError(err)
+	suite.Empty(versions)
+	if cas, ok := suite.Store.(storage.ConditionalStorage); ok {
+		done, err := cas.CompareAndSwap("versioned-bucket", "other", []byte("a"), []byte("b"))
+		if !common.IsError(err, common.Unsupported) {
+			suite.NoError(err)
+			suite.True(done)
+			val, err := store.GetVersion("versioned-bucket", "other", 2)
+			suite.NoError(err)
+			suite.Equal("b", string(val))
+		}
+	}
+	ch, err := suite.Store.List("versioned-bucket", common.KeysOnly(nil))
+	suite.NoError(err)
+	keys := []string{}
+	for doc := range ch {
+		keys = append(keys, doc.Key)
+	}
+	suite.Equal([]string{"doc", "other"}, keys)
+	buckets, err := suite.Store.ListBuckets()
+	suite.NoError(err)
+	suite.Equal(1, len(filter(buckets, "versioned-bucket")))
+	suite.NoError(suite.Store.DeleteBucket("versioned-bucket"))
+	suite.NoError(suite.Store.CreateBucket("versioned-bucket"))
+	suite.NoError(suite.Store.Put("versioned-bucket", "doc", []byte("fresh")))
+	versions, err = store.ListVersions("versioned-bucket", "doc")
+	suite.NoError(err)
+	suite.Empty(versions)
+	suite.NoError(suite.Store.DeleteBucket("versioned-bucket"))
+}
+
+// filter returns the names starting with prefix
+func filter(names []string, prefix string) []string {
+	res := []string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+func (suite *Suite) TestSnapshot() {
+	store, ok := suite.Store.(storage.Snapshotter)
+	if !ok {
+		suite.T().Skip("storage does not support snapshots")
+	}
+	suite.NoError(suite.Store.CreateBucket("snapshot-bucket"))
+	suite.NoError(suite.Store.Put("snapshot-bucket", "a", []byte("1")))
+	suite.NoError(suite.Store.Put("snapshot-bucket", "b", []byte("2")))
+	snap, err := store.Snapshot()
+	if common.IsError(err, common.Unsupported) {
+		suite.T().Skip("storage does not support snapshots")
+	}
+	suite.NoError(err)
+	suite.NoError(suite.Store.Put("snapshot-bucket", "a", []byte("changed")))
+	suite.NoError(suite.Store.Delete("snapshot-bucket", "b"))
+	suite.NoError(suite.Store.Put("snapshot-bucket", "c", []byte("3")))
+	suite.NoError(suite.Store.CreateBucket("snapshot-later"))
+	val, err := snap.Get("snapshot-bucket", "a")
+	suite.NoError(err)
+	suite.Equal("1", string(val))
+	val, err = snap.Get("snapshot-bucket", "b")
+	suite.NoError(err)
+	suite.Equal("2", string(val))
+	_, err = snap.Get("snapshot-bucket", "c")
+	suite.Error(err)
+	iter, err := snap.Iterate("snapshot-bucket", nil)
+	suite.NoError(err)
+	docs := []string{}
+	for iter.Next() {
+		docs = append(docs, iter.Doc().Key+"="+string(iter.Doc().Value))
+	}
+	suite.NoError(iter.Err())
+	suite.NoError(iter.Close())
+	suite.Equal([]string{"a=1", "b=2"}, docs)
+	n, err := snap.Count("snapshot-bucket", nil)
+	suite.NoError(err)
+	suite.Equal(2, n)
+	buckets, err := snap.ListBuckets()
+	suite.NoError(err)
+	suite.Contains(buckets, "snapshot-bucket")
+	suite.NotContains(buckets, "snapshot-later")
+	suite.True(common.IsError(snap.Put("snapshot-bucket", "d", []byte("4")), common.ReadOnly))
+	suite.True(common.IsError(snap.DeleteBucket("snapshot-bucket"), common.ReadOnly))
+	suite.NoError(snap.Close())
+	val, err = suite.Store.Get("snapshot-bucket", "a")
+	suite.NoError(err)
+	suite.Equal("changed", string(val))
+	suite.NoError(suite.Store.DeleteBucket("snapshot-bucket"))
+	suite.NoError(suite.Store.DeleteBucket("snapshot-later"))
+}